@@ -45,6 +45,22 @@ func Puts(b []byte, v string) []byte {
 	return b[vlen:]
 }
 
+// Putb32 is like Putb, but uses a 32-bit length prefix.
+func Putb32(b []byte, v []byte) []byte {
+	vlen := uint32(len(v))
+	b = Put32(b, vlen)
+	copy(b, v)
+	return b[vlen:]
+}
+
+// Puts32 is like Puts, but uses a 32-bit length prefix.
+func Puts32(b []byte, v string) []byte {
+	vlen := uint32(len(v))
+	b = Put32(b, vlen)
+	copy(b, v)
+	return b[vlen:]
+}
+
 func Get8(b []byte) (uint8, []byte) {
 	return b[0], b[1:]
 }
@@ -88,3 +104,19 @@ func Gets(b []byte) (string, []byte) {
 	vlen, b = Get16(b)
 	return string(b[:vlen]), b[vlen:]
 }
+
+// Getb32 is like Getb, but for values written with Putb32.
+func Getb32(b []byte) ([]byte, []byte) {
+	var vlen uint32
+	vlen, b = Get32(b)
+	s := make([]byte, vlen)
+	copy(s, b[:vlen])
+	return s, b[vlen:]
+}
+
+// Gets32 is like Gets, but for values written with Puts32.
+func Gets32(b []byte) (string, []byte) {
+	var vlen uint32
+	vlen, b = Get32(b)
+	return string(b[:vlen]), b[vlen:]
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 
 	"github.com/rogpeppe/rjson"
@@ -9,6 +13,44 @@ import (
 type config struct {
 	BlobServer string `json:"blob_server"`
 	Debug      bool   `json:"debug"`
+
+	// The name of the store, among the ones defined in the stores property,
+	// where blobs are actually stored. If empty, a disk-based store in
+	// $HOME/lib/dino/data is used.
+	Backend string `json:"backend"`
+
+	// Stores defines any number of storage.Store implementations, by name.
+	// The configuration is handled by github.com/nicolagi/dino/storage.Builder,
+	// like in the metadataserver configuration.
+	Stores map[string]interface{} `json:"stores"`
+
+	// If set, reject uploads of values that don't hash to their keys, as
+	// computed by storage.BlobStoreWrapper. Only suitable for blobservers
+	// that store nothing but blobs.
+	Verify bool `json:"verify"`
+
+	// Serve HTTPS with this key pair, if set.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// If set, require clients to present a certificate issued by one of the
+	// CAs in this PEM file. Requires HTTPS.
+	ClientCAFile string `json:"client_ca_file"`
+
+	// If not empty, requests must carry one of these tokens, as bearer
+	// tokens. Requires HTTPS.
+	Tokens []struct {
+		// Identifies the token in the logs.
+		Name string `json:"name"`
+
+		// The hex-encoded SHA-256 hash of the token, e.g., as output by
+		// printf %s "$token" | sha256sum.
+		SHA256 string `json:"sha256"`
+
+		// Either "read-only" or "read-write".
+		Access string `json:"access"`
+	} `json:"tokens"`
+	tokens []token
 }
 
 func loadConfig(pathname string) (*config, error) {
@@ -16,7 +58,38 @@ func loadConfig(pathname string) (*config, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer func() { _ = f.Close() }()
+	return decodeConfig(f)
+}
+
+func decodeConfig(r io.Reader) (*config, error) {
 	var c *config
-	err = rjson.NewDecoder(f).Decode(&c)
-	return c, err
+	if err := rjson.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("must specify both cert file and key file or neither")
+	}
+	if c.CertFile == "" && (c.ClientCAFile != "" || len(c.Tokens) != 0) {
+		return nil, errors.New("must use HTTPS if client certificates or tokens are required")
+	}
+	for _, t := range c.Tokens {
+		var parsed token
+		parsed.name = t.Name
+		b, err := hex.DecodeString(t.SHA256)
+		if err != nil || len(b) != len(parsed.hash) {
+			return nil, fmt.Errorf("token %q: invalid SHA-256 hash", t.Name)
+		}
+		copy(parsed.hash[:], b)
+		switch t.Access {
+		case "read-only":
+			parsed.access = readOnly
+		case "read-write":
+			parsed.access = readWrite
+		default:
+			return nil, fmt.Errorf("token %q: invalid access %q, want read-only or read-write", t.Name, t.Access)
+		}
+		c.tokens = append(c.tokens, parsed)
+	}
+	return c, nil
 }
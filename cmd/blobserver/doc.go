@@ -1,17 +1,40 @@
 // Package blobserver implements an HTTP server that can be used together with
-// its client, storage.RemoteStore. It is backed by a disk-based implementation
-// of storage.Store, but it should be extended to use any implementation.
+// its client, storage.RemoteStore. It is backed by any implementation of
+// storage.Store, as configured by the backend and stores properties of its
+// configuration (see storage.Builder), and by default by a disk-based one.
 //
-// Valid requests are GETs and PUTs to paths of the form "/b33f" or "/f00d",
-// that is, slash followed by a hexadecimal string, encoding the key to GET or
-// PUT. Requests for other paths or with other HTTP verbs will return 400.
+// Valid requests are GETs, HEADs and PUTs to paths of the form "/b33f" or
+// "/f00d", that is, slash followed by a hexadecimal string, encoding the key to
+// GET, HEAD or PUT, and POSTs to "/missing". Requests for other paths or with
+// other HTTP verbs will return 400.
 //
 // If a key is not found, GETs return 404 with no body, which the client should
 // propagate as storage.ErrNotFound. Any other error on the GET path returns 500
 // and the textual error message in the response body. The happy scenario is
 // that of a 200 response status code, and the value as the response body.
+// Values are streamed, with a Content-Length header, from backends that
+// implement storage.StreamStore. A Range header with a single range with a
+// start, e.g., "bytes=100-199" or "bytes=100-", gets a 206 response with that
+// part of the value only, or 416 if the range starts past the end of the value.
+// Other ranges are ignored.
 //
-// As for PUTs, the body is of course the value to be stored. The response is
+// HEADs are like GETs without the body, so clients can tell whether the value
+// exists, and its size, without transferring it. They are served cheaply from
+// backends that implement storage.Statter.
+//
+// POSTs to "/missing" carry up to storage.MissingBatchSize keys in the body,
+// hex-encoded and one per line. The response has the keys among those that
+// are not in the store, in the same format. Clients use this to skip uploading
+// values the server has already.
+//
+// As for PUTs, the body is of course the value to be stored, streamed to
+// backends that implement storage.StreamStore. The response is
 // either 200 status code and empty body, or 500 status code and the error
-// message in the body.
+// message in the body. If the server is configured to verify values, PUTs of
+// values that don't hash to their keys get 422, and are not stored.
+//
+// The server can be configured to serve HTTPS, and to require client
+// certificates and/or bearer tokens, each either read-only or read-write.
+// Requests with a missing or unknown token get 401, and PUTs with a read-only
+// token get 403.
 package main // import "github.com/nicolagi/dino/cmd/blobserver"
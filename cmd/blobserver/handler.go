@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nicolagi/dino/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+type access int
+
+const (
+	readOnly access = iota + 1
+	readWrite
+)
+
+// token is a bearer token clients can authenticate with.
+type token struct {
+	// Only used for logging.
+	name string
+
+	// The SHA-256 hash of the token. Unlike passwords, tokens are random and
+	// long, so a fast hash is good enough, and we can afford to hash the
+	// token in every request.
+	hash [sha256.Size]byte
+
+	access access
+}
+
+// handler serves GETs, HEADs and PUTs of blobs, and POSTs of keys to
+// /missing, to find which ones are not in the store. If there are tokens,
+// requests must carry one of them, with enough access.
+type handler struct {
+	store  storage.Store
+	tokens []token
+
+	// If set, reject PUTs of values that don't hash to their keys.
+	verify bool
+}
+
+// authenticate returns the token the request carries, if it's a known one.
+func (h *handler) authenticate(r *http.Request) (t token, ok bool) {
+	value := r.Header.Get("Authorization")
+	if !strings.HasPrefix(value, "Bearer ") {
+		return t, false
+	}
+	hash := sha256.Sum256([]byte(strings.TrimPrefix(value, "Bearer ")))
+	for _, t := range h.tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+			return t, true
+		}
+	}
+	return t, false
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{
+		"op":     r.Method,
+		"remote": r.RemoteAddr,
+	})
+	status, body := func() (int, []byte) {
+		var granted access = readWrite
+		if len(h.tokens) != 0 {
+			t, ok := h.authenticate(r)
+			if !ok {
+				logger.Warn("Unauthorized")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="dino"`)
+				return http.StatusUnauthorized, []byte("missing or unknown token")
+			}
+			logger = logger.WithField("token", t.name)
+			granted = t.access
+		}
+		if r.URL.Path == "/missing" {
+			if r.Method != http.MethodPost {
+				logger.Warn("Bad request")
+				return http.StatusBadRequest, []byte(fmt.Sprintf("%q: invalid method, expecting POST", r.Method))
+			}
+			return h.missing(w, r, logger)
+		}
+		hkey := r.URL.Path[1:]
+		key, err := hex.DecodeString(hkey)
+		if err != nil {
+			return http.StatusBadRequest, []byte(fmt.Sprintf("%q: not a valid path, expecting hex key only", r.URL.Path))
+		}
+		logger = logger.WithField("key", hkey)
+		switch r.Method {
+		case http.MethodGet:
+			return h.get(w, r, key, logger)
+		case http.MethodHead:
+			size, err := storage.Stat(r.Context(), h.store, key)
+			if errors.Is(err, storage.ErrNotFound) {
+				logger.WithField("err", err).Debug("Not found")
+				return http.StatusNotFound, nil
+			}
+			if err != nil {
+				logger.WithField("err", err).Error()
+				return http.StatusInternalServerError, nil
+			}
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			logger.Debug("Success")
+			return http.StatusOK, nil
+		case http.MethodPut:
+			if granted != readWrite {
+				logger.Warn("Forbidden")
+				return http.StatusForbidden, []byte("read-only token")
+			}
+			body, size := io.Reader(r.Body), r.ContentLength
+			if h.verify {
+				// With an unknown size, the body is read to the end, where
+				// the verifying reader checks the content.
+				body, size = storage.NewVerifyingReader(key, body), -1
+			}
+			if err := storage.PutStream(r.Context(), h.store, key, body, size); err != nil {
+				if errors.Is(err, storage.ErrCorrupted) {
+					logger.WithField("err", err).Warn("Rejected")
+					return http.StatusUnprocessableEntity, []byte(fmt.Sprintf("%q: rejected", hkey))
+				}
+				logger.WithField("err", err).Error()
+				return http.StatusInternalServerError, []byte(fmt.Sprintf("%q: %v", hkey, err))
+			}
+			logger.Debug("Success")
+			return http.StatusOK, nil
+		default:
+			logger.Warn("Bad request")
+			return http.StatusBadRequest, []byte(fmt.Sprintf("%q: invalid method, expecting GET, HEAD or PUT", r.Method))
+		}
+	}()
+	if status == 0 {
+		// Already responded.
+		return
+	}
+	w.WriteHeader(status)
+	if body != nil {
+		if _, err := w.Write(body); err != nil {
+			logger.WithField("err", err).Error("Failed writing response")
+		}
+	}
+}
+
+// get streams the value, or the part of it in the Range header, if any. It
+// returns a zero status if it responded already, or the status and body to
+// respond with.
+func (h *handler) get(w http.ResponseWriter, r *http.Request, key []byte, logger *log.Entry) (int, []byte) {
+	offset, length, ranged := parseRange(r.Header.Get("Range"))
+	rc, size, err := storage.GetRange(r.Context(), h.store, key, offset, length)
+	if errors.Is(err, storage.ErrNotFound) {
+		logger.WithField("err", err).Debug("Not found")
+		return http.StatusNotFound, nil
+	}
+	if err != nil {
+		logger.WithField("err", err).Error()
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("%x: %v", key, err))
+	}
+	defer func() { _ = rc.Close() }()
+	w.Header().Set("Accept-Ranges", "bytes")
+	status, n := http.StatusOK, size
+	if ranged {
+		if offset >= size {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return http.StatusRequestedRangeNotSatisfiable, nil
+		}
+		n = size - offset
+		if length >= 0 && length < n {
+			n = length
+		}
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size))
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	w.WriteHeader(status)
+	if _, err := io.CopyN(w, rc, n); err != nil {
+		logger.WithField("err", err).Error("Failed writing response")
+		return 0, nil
+	}
+	logger.Debug("Success")
+	return 0, nil
+}
+
+// maxMissingBodySize bounds the body of /missing requests, so that clients
+// can't make the handler read and parse any number of keys before it finds
+// out there are too many: it leaves room for a batch of keys of up to 256
+// bytes, hex-encoded, one per line.
+const maxMissingBodySize = storage.MissingBatchSize * (2*256 + 1)
+
+// missing responds with the keys in the request body, one per line and
+// hex-encoded, that are not in the store, in the same format.
+func (h *handler) missing(w http.ResponseWriter, r *http.Request, logger *log.Entry) (int, []byte) {
+	keys, err := storage.ParseKeys(http.MaxBytesReader(w, r.Body, maxMissingBodySize))
+	if err != nil {
+		logger.WithField("err", err).Warn("Bad request")
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+	if len(keys) > storage.MissingBatchSize {
+		logger.WithField("count", len(keys)).Warn("Bad request")
+		return http.StatusBadRequest, []byte(fmt.Sprintf("%d keys: too many, expecting at most %d", len(keys), storage.MissingBatchSize))
+	}
+	missing, err := storage.Missing(r.Context(), h.store, keys)
+	if err != nil {
+		logger.WithField("err", err).Error()
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	var body bytes.Buffer
+	for _, key := range missing {
+		_, _ = fmt.Fprintf(&body, "%x\n", key)
+	}
+	logger.WithFields(log.Fields{
+		"count":   len(keys),
+		"missing": len(missing),
+	}).Debug("Success")
+	return http.StatusOK, body.Bytes()
+}
+
+// parseRange parses the value of a Range header, returning the offset and
+// length to read, and whether it's a range the handler supports: a single
+// range, with a start (bytes=start-end or bytes=start-). The header is ignored
+// otherwise, and the whole value is served, as HTTP allows.
+func parseRange(value string) (offset int64, length int64, ok bool) {
+	if !strings.HasPrefix(value, "bytes=") || strings.Contains(value, ",") {
+		return 0, -1, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, "bytes="), "-", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return 0, -1, false
+	}
+	offset, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || offset < 0 {
+		return 0, -1, false
+	}
+	if parts[1] == "" {
+		return offset, -1, true
+	}
+	last, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || last < offset {
+		return 0, -1, false
+	}
+	return offset, last - offset + 1, true
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	do := func(h http.Handler, method string, path string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader("value"))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	t.Run("without tokens, anyone can get and put", func(t *testing.T) {
+		h := &handler{store: storage.NewInMemoryStore()}
+		assert.Equal(t, http.StatusNotFound, do(h, http.MethodGet, "/b33f", "").Code)
+		assert.Equal(t, http.StatusOK, do(h, http.MethodPut, "/b33f", "").Code)
+		w := do(h, http.MethodGet, "/b33f", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "value", w.Body.String())
+		assert.Equal(t, http.StatusBadRequest, do(h, http.MethodGet, "/not-hex", "").Code)
+	})
+	t.Run("with tokens, access depends on the token", func(t *testing.T) {
+		h := &handler{
+			store: storage.NewInMemoryStore(),
+			tokens: []token{
+				{name: "reader", hash: sha256.Sum256([]byte("r3ad")), access: readOnly},
+				{name: "writer", hash: sha256.Sum256([]byte("wr1te")), access: readWrite},
+			},
+		}
+		w := do(h, http.MethodGet, "/b33f", "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+		assert.Equal(t, http.StatusUnauthorized, do(h, http.MethodGet, "/b33f", "guess").Code)
+		assert.Equal(t, http.StatusForbidden, do(h, http.MethodPut, "/b33f", "r3ad").Code)
+		assert.Equal(t, http.StatusOK, do(h, http.MethodPut, "/b33f", "wr1te").Code)
+		assert.Equal(t, http.StatusOK, do(h, http.MethodGet, "/b33f", "r3ad").Code)
+		assert.Equal(t, http.StatusOK, do(h, http.MethodGet, "/b33f", "wr1te").Code)
+	})
+}
+
+func TestRanges(t *testing.T) {
+	h := &handler{store: storage.NewInMemoryStore()}
+	put := httptest.NewRequest(http.MethodPut, "/b33f", strings.NewReader("0123456789"))
+	put.ContentLength = -1
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, put)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	for _, tc := range []struct {
+		header       string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"", http.StatusOK, "0123456789", ""},
+		{"bytes=2-4", http.StatusPartialContent, "234", "bytes 2-4/10"},
+		{"bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"bytes=7-100", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"bytes=10-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		// Not supported, so the whole value is served.
+		{"bytes=-3", http.StatusOK, "0123456789", ""},
+		{"bytes=0-1,4-5", http.StatusOK, "0123456789", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/b33f", nil)
+		if tc.header != "" {
+			r.Header.Set("Range", tc.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, tc.status, w.Code, tc.header)
+		assert.Equal(t, tc.body, w.Body.String(), tc.header)
+		assert.Equal(t, tc.contentRange, w.Header().Get("Content-Range"), tc.header)
+		if tc.status != http.StatusRequestedRangeNotSatisfiable {
+			assert.Equal(t, fmt.Sprint(len(tc.body)), w.Header().Get("Content-Length"), tc.header)
+		}
+	}
+}
+
+func TestExistence(t *testing.T) {
+	h := &handler{store: storage.NewInMemoryStore()}
+	server := httptest.NewServer(h)
+	defer server.Close()
+	remote := storage.NewRemoteStore(strings.TrimPrefix(server.URL, "http://"))
+	ctx := context.Background()
+	require.Nil(t, remote.Put([]byte{0xb3, 0x3f}, []byte("value")))
+
+	t.Run("head", func(t *testing.T) {
+		size, err := remote.Stat(ctx, []byte{0xb3, 0x3f})
+		assert.Nil(t, err)
+		assert.EqualValues(t, 5, size)
+		_, err = remote.Stat(ctx, []byte{0xde, 0xad})
+		assert.True(t, errors.Is(err, storage.ErrNotFound), "got %v", err)
+	})
+	t.Run("missing keys", func(t *testing.T) {
+		var keys, want [][]byte
+		for i := 0; i < storage.MissingBatchSize+10; i++ {
+			key := []byte(fmt.Sprintf("key %d", i))
+			if i%2 == 0 {
+				require.Nil(t, remote.Put(key, nil))
+			} else {
+				want = append(want, key)
+			}
+			keys = append(keys, key)
+		}
+		missing, err := remote.Missing(ctx, keys)
+		require.Nil(t, err)
+		assert.Equal(t, want, missing)
+	})
+	t.Run("bad requests", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/missing", strings.NewReader("b33f\nnot-hex\n"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		r = httptest.NewRequest(http.MethodGet, "/missing", nil)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+	t.Run("too many keys are not read", func(t *testing.T) {
+		body := &countingReader{r: strings.NewReader(strings.Repeat("b33f\n", maxMissingBodySize))}
+		r := httptest.NewRequest(http.MethodPost, "/missing", body)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Less(t, body.n, int64(2*maxMissingBodySize))
+	})
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestVerify(t *testing.T) {
+	h := &handler{store: storage.NewInMemoryStore(), verify: true}
+	server := httptest.NewServer(h)
+	defer server.Close()
+	remote := storage.NewRemoteStore(strings.TrimPrefix(server.URL, "http://"))
+	blobs := storage.NewBlobStore(remote)
+
+	key, err := blobs.Put([]byte("value"))
+	require.Nil(t, err)
+	err = remote.Put(key, []byte("something else"))
+	assert.True(t, errors.Is(err, storage.ErrCorrupted), "got %v", err)
+	err = storage.PutStream(context.Background(), remote, []byte{0xb3, 0x3f}, strings.NewReader("value"), 5)
+	assert.True(t, errors.Is(err, storage.ErrCorrupted), "got %v", err)
+	value, err := blobs.Get(key)
+	require.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+}
+
+func TestConfig(t *testing.T) {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("r3ad")))
+	t.Run("tokens are decoded", func(t *testing.T) {
+		c, err := decodeConfig(strings.NewReader(fmt.Sprintf(`{
+			blob_server: ":3002"
+			cert_file: "cert.pem"
+			key_file: "key.pem"
+			tokens: [{name: "reader", sha256: %q, access: "read-only"}]
+		}`, hash)))
+		require.Nil(t, err)
+		assert.Equal(t, []token{{name: "reader", hash: sha256.Sum256([]byte("r3ad")), access: readOnly}}, c.tokens)
+	})
+	t.Run("tokens require HTTPS", func(t *testing.T) {
+		_, err := decodeConfig(strings.NewReader(fmt.Sprintf(`{
+			tokens: [{name: "reader", sha256: %q, access: "read-only"}]
+		}`, hash)))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "HTTPS")
+	})
+	t.Run("invalid tokens", func(t *testing.T) {
+		for _, tc := range []struct {
+			token string
+			want  string
+		}{
+			{fmt.Sprintf(`{name: "t", sha256: %q, access: "all"}`, hash), "invalid access"},
+			{`{name: "t", sha256: "abc", access: "read-only"}`, "invalid SHA-256"},
+		} {
+			_, err := decodeConfig(strings.NewReader(fmt.Sprintf(`{
+				cert_file: "cert.pem"
+				key_file: "key.pem"
+				tokens: [%s]
+			}`, tc.token)))
+			require.NotNil(t, err)
+			assert.Contains(t, err.Error(), tc.want)
+		}
+	})
+	t.Run("the backend is built from the stores", func(t *testing.T) {
+		c, err := decodeConfig(strings.NewReader(`{
+			backend: "cached"
+			stores: {
+				cached: {type: "paired", fast: "memory", slow: "more-memory"}
+				memory: {type: "in-memory"}
+				"more-memory": {type: "in-memory"}
+			}
+		}`))
+		require.Nil(t, err)
+		store, err := backend(c)
+		require.Nil(t, err)
+		_, ok := store.(storage.Paired)
+		assert.True(t, ok)
+	})
+	t.Run("unknown backend", func(t *testing.T) {
+		c, err := decodeConfig(strings.NewReader(`{backend: "nope"}`))
+		require.Nil(t, err)
+		_, err = backend(c)
+		assert.NotNil(t, err)
+	})
+}
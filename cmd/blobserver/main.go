@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/hex"
-	"errors"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -44,65 +44,52 @@ func main() {
 		defer agent.Close()
 	}
 
-	dir := os.ExpandEnv("$HOME/lib/dino")
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		log.Fatalf("Could not ensure directory %q exists: %v", dir, err)
+	store, err := backend(opts)
+	if err != nil {
+		log.Fatalf("Could not instantiate backend store: %v", err)
 	}
-	dir = os.ExpandEnv("$HOME/lib/dino/data")
-	store := storage.NewDiskStore(dir)
-	log.Infof("Will use a disk-based backend storing data at %s", dir)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		var logger *log.Entry
-		status, body := func() (int, []byte) {
-			hkey := r.URL.Path[1:]
-			key, err := hex.DecodeString(hkey)
+	srv := &http.Server{
+		Addr: opts.BlobServer,
+		Handler: &handler{
+			store:  store,
+			tokens: opts.tokens,
+			verify: opts.Verify,
+		},
+	}
+	if opts.CertFile == "" {
+		err = srv.ListenAndServe()
+	} else {
+		if opts.ClientCAFile != "" {
+			b, err := ioutil.ReadFile(os.ExpandEnv(opts.ClientCAFile))
 			if err != nil {
-				return http.StatusBadRequest, []byte(fmt.Sprintf("%q: not a valid path, expecting hex key only", r.URL.Path))
+				log.WithField("err", err).Fatal("Could not read client CAs")
 			}
-			logger = log.WithFields(log.Fields{
-				"op":  r.Method,
-				"key": hkey,
-			})
-			switch r.Method {
-			case http.MethodGet:
-				value, err := store.Get(key)
-				if errors.Is(err, storage.ErrNotFound) {
-					logger.WithField("err", err).Debug("Not found")
-					return http.StatusNotFound, nil
-				}
-				if err != nil {
-					logger.WithField("err", err).Error()
-					return http.StatusInternalServerError, []byte(fmt.Sprintf("%q: %v", hkey, err))
-				}
-				logger.Debug("Success")
-				return http.StatusOK, value
-			case http.MethodPut:
-				value, err := ioutil.ReadAll(r.Body)
-				if err != nil {
-					logger.WithField("err", err).Error()
-					return http.StatusInternalServerError, []byte(fmt.Sprintf("%q: %v", hkey, err))
-				}
-				if err := store.Put(key, value); err != nil {
-					logger.WithField("err", err).Error()
-					return http.StatusInternalServerError, []byte(fmt.Sprintf("%q: %v", hkey, err))
-				}
-				logger.Debug("Success")
-				return http.StatusOK, nil
-			default:
-				logger.Warn("Bad request")
-				return http.StatusBadRequest, []byte(fmt.Sprintf("%q: invalid method, expecting GET or PUT", r.Method))
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(b) {
+				log.WithField("path", opts.ClientCAFile).Fatal("No client CA certificates found")
 			}
-		}()
-		w.WriteHeader(status)
-		if body != nil {
-			if _, err := w.Write(body); err != nil {
-				logger.WithField("err", err).Error("Failed writing response")
+			srv.TLSConfig = &tls.Config{
+				ClientCAs:  pool,
+				ClientAuth: tls.RequireAndVerifyClientCert,
 			}
 		}
-	})
-
-	if err := http.ListenAndServe(opts.BlobServer, nil); err != nil {
+		err = srv.ListenAndServeTLS(os.ExpandEnv(opts.CertFile), os.ExpandEnv(opts.KeyFile))
+	}
+	if err != nil {
 		log.WithField("err", err).Fatal("Could not listen and serve")
 	}
 }
+
+func backend(opts *config) (storage.Store, error) {
+	if opts.Backend != "" {
+		log.WithField("backend", opts.Backend).Info("Will use the configured backend")
+		return storage.NewBuilder(opts.Stores).StoreByName(opts.Backend)
+	}
+	dir := os.ExpandEnv("$HOME/lib/dino/data")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not ensure directory %q exists: %w", dir, err)
+	}
+	log.Infof("Will use a disk-based backend storing data at %s", dir)
+	return storage.NewDiskStore(dir), nil
+}
@@ -15,15 +15,63 @@ type config struct {
 	LogPath    string `json:"log_path"`
 	DataPath   string `json:"data_path"`
 
+	// If non-empty, mount only this directory of the file system (e.g.,
+	// "projects/foo"), rather than its root. The directory is looked up at
+	// startup, and keeps being served if it's renamed or moved.
+	Subdir string `json:"subdir"`
+
 	Metadata struct {
 		Type string `json:"type"`
 
 		// Properties for "dino" type.
 		Address string `json:"address"`
 
-		// Authorize client connections with this key, if non-empty.
+		// Addresses of the replicas of a replicated metadata server, used
+		// in place of the address above.
+		Addresses []string `json:"addresses"`
+
+		// Metadata servers (or replicated metadata servers) each owning a
+		// part of the key space, used in place of the address(es) above.
+		// Names decide which keys each shard owns, so they must be the
+		// same for all file system instances. The shards can't change
+		// once the file system has been used with them.
+		Shards []struct {
+			Name      string   `json:"name"`
+			Address   string   `json:"address"`
+			Addresses []string `json:"addresses"`
+		} `json:"shards"`
+
+		// Volume of the metadata server(s) holding the file system; the
+		// default volume if empty. See the dinovolumes command.
+		Volume string `json:"volume"`
+
+		// Authorize client connections with this key, if non-empty. It can
+		// be the volume's own password, or the metadata server's, or the
+		// password of the user below.
 		AuthKey string `json:"auth_key"`
 
+		// If non-empty, log in as this user, getting the access the
+		// metadata server grants the user rather than full access.
+		User string `json:"user"`
+
+		// If set, trust only metadata servers with certificates issued by
+		// the CAs in this PEM file, rather than the system roots.
+		CAFile string `json:"ca_file"`
+
+		// If set, present this certificate to the metadata server, which
+		// may require it. If the server knows the user named by the
+		// certificate, there's no need for the user and auth key above.
+		CertFile string `json:"cert_file"`
+		KeyFile  string `json:"key_file"`
+
+		// If set, expect metadata server certificates for this name rather
+		// than for the host in the address.
+		ServerName string `json:"server_name"`
+
+		// If true, the metadata server will only notify which nodes changed,
+		// rather than send their new metadata, which is loaded on demand.
+		Invalidations bool `json:"invalidations"`
+
 		// Properties for "dynamodb" type.
 		Profile string `json:"profile"`
 		Region  string `json:"region"`
@@ -33,9 +81,33 @@ type config struct {
 	Blobs struct {
 		Type string `json:"type"`
 
+		// If true, check that blobs read hash to their keys, failing
+		// reads of corrupted blobs.
+		Verify bool `json:"verify"`
+
+		// The hash algorithm new content keys are computed with, among
+		// sha1 (readable by older clients), sha256 (the default) and
+		// blake2b-256. Content keys computed with any of them can be read.
+		HashAlgorithm string `json:"hash_algorithm"`
+
 		// Properties for "dino" type.
 		Address string `json:"address"`
 
+		// Talk HTTPS to the blobserver. Implied by the properties below.
+		HTTPS bool `json:"https"`
+
+		// If set, trust only blobservers with certificates issued by the
+		// CAs in this PEM file, rather than the system roots.
+		CAFile string `json:"ca_file"`
+
+		// If set, present this certificate to the blobserver.
+		CertFile string `json:"cert_file"`
+		KeyFile  string `json:"key_file"`
+
+		// If set, authenticate to the blobserver with this token.
+		// Requires HTTPS.
+		Token string `json:"token"`
+
 		// Properties for "s3" type.
 		Profile string `json:"profile"`
 		Region  string `json:"region"`
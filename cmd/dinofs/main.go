@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	golog "log"
 	"os"
+	"path"
 
 	"github.com/google/gops/agent"
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -18,6 +20,7 @@ import (
 func main() {
 	defaultConfigFile := os.ExpandEnv("$HOME/lib/dino/fs-default.config")
 	configFile := flag.String("c", defaultConfigFile, "location of configuration file, or an alias to expand to $HOME/lib/dino/fs-ALIAS.config")
+	migrateKeys := flag.Bool("migrate-keys", false, "rewrite content keys not computed with the configured hash algorithm, rather than mount")
 	flag.Parse()
 
 	log.SetFormatter(&log.TextFormatter{
@@ -59,7 +62,23 @@ func main() {
 		storage.NewDiskStore(os.ExpandEnv(config.DataPath)),
 		remote,
 	)
-	factory.blobs = storage.NewBlobStore(pairedStore)
+	var blobOpts []storage.BlobStoreOption
+	if config.Blobs.Verify {
+		blobOpts = append(blobOpts, storage.WithVerification())
+	}
+	if config.Blobs.HashAlgorithm != "" {
+		alg, err := storage.ParseHashAlgorithm(config.Blobs.HashAlgorithm)
+		if err != nil {
+			log.Fatalf("Invalid blobs configuration: %v", err)
+		}
+		blobOpts = append(blobOpts, storage.WithHashAlgorithm(alg))
+	}
+	factory.blobs = storage.NewBlobStore(pairedStore, blobOpts...)
+	if *migrateKeys {
+		// Write to the remote store directly, since the write-back of the
+		// paired store would be cut short when the process exits.
+		factory.blobs = storage.NewBlobStore(remote, blobOpts...)
+	}
 
 	g := newInodeNumbersGenerator()
 	go g.start()
@@ -73,10 +92,29 @@ func main() {
 	fsopts.FsName = config.Name
 	fsopts.Name = "dinofs"
 	var rootKey [nodeKeyLen]byte
-	root := factory.existingNode("root", rootKey)
+	rootName := "root"
+	if config.Subdir != "" {
+		rootKey, err = factory.resolve(context.Background(), config.Subdir)
+		if err != nil {
+			log.Fatalf("Could not find directory %q to mount: %v", config.Subdir, err)
+		}
+		rootName = path.Base(path.Clean("/" + config.Subdir))
+	}
+	if *migrateKeys {
+		migrated, err := factory.migrateContentKeys(context.Background(), rootKey)
+		if err != nil {
+			log.Fatalf("Could not migrate content keys (%d migrated): %v", migrated, err)
+		}
+		log.WithFields(log.Fields{
+			"count":     migrated,
+			"algorithm": factory.blobs.HashAlgorithm(),
+		}).Info("Migrated content keys")
+		return
+	}
+	root := factory.existingNode(rootName, rootKey)
 	factory.root = root
-	if err := root.loadMetadata(root.key); err != nil {
-		if errors.Is(err, storage.ErrNotFound) {
+	if err := root.loadMetadata(context.Background(), root.key); err != nil {
+		if errors.Is(err, storage.ErrNotFound) && config.Subdir == "" {
 			log.Infof("Serving an empty file system (no metadata found for root node)")
 			root.mode |= fuse.S_IFDIR
 			root.children = make(map[string]*dinoNode)
@@ -120,7 +158,20 @@ func redirectLogging(c *config) (cleanup func()) {
 func storeImpl(c *config) (storage.Store, error) {
 	switch c.Blobs.Type {
 	case "dino":
-		return storage.NewRemoteStore(c.Blobs.Address), nil
+		var opts []storage.RemoteStoreOption
+		if c.Blobs.HTTPS {
+			opts = append(opts, storage.WithHTTPS())
+		}
+		if c.Blobs.CAFile != "" {
+			opts = append(opts, storage.WithCAFile(os.ExpandEnv(c.Blobs.CAFile)))
+		}
+		if c.Blobs.CertFile != "" || c.Blobs.KeyFile != "" {
+			opts = append(opts, storage.WithClientKeyPair(os.ExpandEnv(c.Blobs.CertFile), os.ExpandEnv(c.Blobs.KeyFile)))
+		}
+		if c.Blobs.Token != "" {
+			opts = append(opts, storage.WithToken(c.Blobs.Token))
+		}
+		return storage.NewRemoteStore(c.Blobs.Address, opts...), nil
 	case "s3":
 		return storage.NewS3Store(
 			c.Blobs.Profile,
@@ -136,18 +187,61 @@ func storeImpl(c *config) (storage.Store, error) {
 func versionedStoreImpl(c *config, factory *dinoNodeFactory) (store storage.VersionedStore, close func()) {
 	switch c.Metadata.Type {
 	case "dino":
-		lowLevelOpts := []client.Option{
-			client.WithAddress(c.Metadata.Address),
+		clientOpts := func(address string, addresses []string) []client.Option {
+			opts := []client.Option{
+				client.WithAddress(address),
+			}
+			if len(addresses) != 0 {
+				opts = append(opts, client.WithAddresses(addresses...))
+			}
+			if c.Metadata.CAFile != "" {
+				opts = append(opts, client.WithCAFile(os.ExpandEnv(c.Metadata.CAFile)))
+			}
+			if c.Metadata.CertFile != "" || c.Metadata.KeyFile != "" {
+				opts = append(opts, client.WithKeyPair(os.ExpandEnv(c.Metadata.CertFile), os.ExpandEnv(c.Metadata.KeyFile)))
+			}
+			if c.Metadata.ServerName != "" {
+				opts = append(opts, client.WithServerName(c.Metadata.ServerName))
+			}
+			if c.Metadata.AuthKey == "" {
+				// Ignored by the client if any of the above is set.
+				opts = append(opts, client.WithFallbackToPlainTCP())
+			}
+			return opts
 		}
 		highLevelOpts := []storage.Option{
 			storage.WithChangeListener(factory.invalidateCache),
+			storage.WithResyncListener(factory.invalidateAll),
+			storage.WithConnectionStateListener(factory.connectionStateChanged),
+		}
+		if c.Metadata.Invalidations {
+			highLevelOpts = append(highLevelOpts, storage.WithInvalidations())
+		}
+		if c.Metadata.Volume != "" {
+			highLevelOpts = append(highLevelOpts, storage.WithVolume(c.Metadata.Volume))
 		}
 		if c.Metadata.AuthKey != "" {
 			highLevelOpts = append(highLevelOpts, storage.WithAuthKey(c.Metadata.AuthKey))
-		} else {
-			lowLevelOpts = append(lowLevelOpts, client.WithFallbackToPlainTCP())
 		}
-		s := storage.NewRemoteVersionedStore(client.New(lowLevelOpts...), highLevelOpts...)
+		if c.Metadata.User != "" {
+			highLevelOpts = append(highLevelOpts, storage.WithUser(c.Metadata.User))
+		}
+		if len(c.Metadata.Shards) != 0 {
+			clients := make(map[string]*client.Client)
+			for _, shard := range c.Metadata.Shards {
+				if _, ok := clients[shard.Name]; ok || shard.Name == "" {
+					log.WithField("name", shard.Name).Fatal("Shard names must be non-empty and unique")
+				}
+				clients[shard.Name] = client.New(clientOpts(shard.Address, shard.Addresses)...)
+			}
+			s := storage.NewShardedRemoteVersionedStore(clients, highLevelOpts...)
+			s.Start()
+			if err := s.CheckShards(context.Background()); err != nil {
+				log.WithField("err", err).Fatal("Refusing to use shards other than the ones holding the metadata")
+			}
+			return s, s.Stop
+		}
+		s := storage.NewRemoteVersionedStore(client.New(clientOpts(c.Metadata.Address, c.Metadata.Addresses)...), highLevelOpts...)
 		s.Start()
 		return s, s.Stop
 	case "dynamodb":
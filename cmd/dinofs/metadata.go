@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"math"
 	"syscall"
 	"time"
 
@@ -13,64 +16,119 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Serialized nodes start with this prefix if they use the wide format, with
+// 32-bit lengths and counts. Legacy nodes start with the user id, which can't
+// be -1. The wide format is only used if needed, so that nodes remain readable
+// by older clients as long as possible.
+var wideNodePrefix = []byte{0xff, 0xff, 0xff, 0xff, 1}
+
 func (node *dinoNode) serialize() []byte {
+	if node.needsWideFormat() {
+		return node.serializeWith(len(wideNodePrefix), 4, bits.Putb32, bits.Puts32)
+	}
+	return node.serializeWith(0, 2, bits.Putb, bits.Puts)
+}
+
+// needsWideFormat tells whether any length or count overflows 16 bits.
+func (node *dinoNode) needsWideFormat() bool {
+	if len(node.contentKey) > math.MaxUint16 || len(node.xattrs) > math.MaxUint16 {
+		return true
+	}
+	for attr, value := range node.xattrs {
+		if len(attr) > math.MaxUint16 || len(value) > math.MaxUint16 {
+			return true
+		}
+	}
+	for childName := range node.children {
+		if len(childName) > math.MaxUint16 {
+			return true
+		}
+	}
+	return false
+}
+
+func (node *dinoNode) serializeWith(
+	prefixLen int,
+	lenLen int,
+	putb func([]byte, []byte) []byte,
+	puts func([]byte, string) []byte,
+) []byte {
 	// Could use a pool of buffers, to be reused, instead of putting pressure on
 	// the GC.
-	size := 24 + len(node.contentKey)
+	size := prefixLen + 20 + 2*lenLen + len(node.contentKey)
 	for attr, value := range node.xattrs {
-		size += 4 + len(attr) + len(value)
+		size += 2*lenLen + len(attr) + len(value)
 	}
 	for childName := range node.children {
-		size += 4 + nodeKeyLen + len(childName)
+		size += 2*lenLen + nodeKeyLen + len(childName)
 	}
 	buf := make([]byte, size)
 	b := buf
+	if prefixLen > 0 {
+		b = b[copy(b, wideNodePrefix):]
+	}
 	b = bits.Put32(b, node.user)
 	b = bits.Put32(b, node.group)
 	b = bits.Put32(b, node.mode)
 	b = bits.Put64(b, uint64(node.time.UnixNano()))
-	b = bits.Putb(b, node.contentKey)
-	b = bits.Put16(b, uint16(len(node.xattrs)))
+	b = putb(b, node.contentKey)
+	if lenLen == 4 {
+		b = bits.Put32(b, uint32(len(node.xattrs)))
+	} else {
+		b = bits.Put16(b, uint16(len(node.xattrs)))
+	}
 	for attr, value := range node.xattrs {
-		b = bits.Puts(b, attr)
-		b = bits.Putb(b, value)
+		b = puts(b, attr)
+		b = putb(b, value)
 	}
 	for childName, childNode := range node.children {
-		b = bits.Puts(b, childName)
-		b = bits.Putb(b, childNode.key[:])
+		b = puts(b, childName)
+		b = putb(b, childNode.key[:])
 	}
 	return buf
 }
 
 func (node *dinoNode) unserialize(b []byte) {
+	getb, gets := bits.Getb, bits.Gets
+	wide := bytes.HasPrefix(b, wideNodePrefix)
+	if wide {
+		b = b[len(wideNodePrefix):]
+		getb, gets = bits.Getb32, bits.Gets32
+	}
 	node.user, b = bits.Get32(b)
 	node.group, b = bits.Get32(b)
 	node.mode, b = bits.Get32(b)
 	var unixnano uint64
 	unixnano, b = bits.Get64(b)
 	node.time = time.Unix(0, int64(unixnano))
-	node.contentKey, b = bits.Getb(b)
+	node.contentKey, b = getb(b)
 	if node.mode&fuse.S_IFDIR != 0 {
 		node.children = make(map[string]*dinoNode)
 	}
-	var nxattr uint16
-	nxattr, b = bits.Get16(b)
+	var nxattr uint32
+	if wide {
+		nxattr, b = bits.Get32(b)
+	} else {
+		var n uint16
+		n, b = bits.Get16(b)
+		nxattr = uint32(n)
+	}
 	if nxattr > 0 {
 		node.xattrs = make(map[string][]byte)
 	}
 	for ; nxattr > 0; nxattr-- {
 		var attr string
 		var value []byte
-		attr, b = bits.Gets(b)
-		value, b = bits.Getb(b)
+		attr, b = gets(b)
+		value, b = getb(b)
 		node.xattrs[attr] = value
 	}
 	if len(b) > 0 {
 		var childName string
 		var childKey []byte
 		for len(b) > 0 {
-			childName, b = bits.Gets(b)
-			childKey, b = bits.Getb(b)
+			childName, b = gets(b)
+			childKey, b = getb(b)
 			var key [nodeKeyLen]byte
 			copy(key[:], childKey)
 			node.children[childName] = node.factory.existingNode(childName, key)
@@ -78,9 +136,9 @@ func (node *dinoNode) unserialize(b []byte) {
 	}
 }
 
-func (node *dinoNode) saveMetadata() error {
+func (node *dinoNode) saveMetadata(ctx context.Context) error {
 	value := node.serialize()
-	err := node.factory.metadata.Put(node.version+1, node.key[:], value)
+	err := storage.VersionedPutContext(ctx, node.factory.metadata, node.version+1, node.key[:], value)
 	if err != nil {
 		return err
 	}
@@ -88,8 +146,26 @@ func (node *dinoNode) saveMetadata() error {
 	return nil
 }
 
-func (node *dinoNode) loadMetadata(key [nodeKeyLen]byte) error {
-	version, b, err := node.factory.metadata.Get(key[:])
+func (node *dinoNode) loadMetadata(ctx context.Context, key [nodeKeyLen]byte) error {
+	return node.loadMetadataWith(ctx, key, func(key []byte) (uint64, []byte, error) {
+		return storage.VersionedGetContext(ctx, node.factory.metadata, key)
+	})
+}
+
+// loadMetadataIfModified is like loadMetadata, but returns
+// storage.ErrNotModified if the stored metadata is still at the given version.
+func (node *dinoNode) loadMetadataIfModified(ctx context.Context, key [nodeKeyLen]byte, version uint64) error {
+	return node.loadMetadataWith(ctx, key, func(key []byte) (uint64, []byte, error) {
+		return storage.GetIfModifiedContext(ctx, node.factory.metadata, key, version)
+	})
+}
+
+func (node *dinoNode) loadMetadataWith(ctx context.Context, key [nodeKeyLen]byte, get func([]byte) (uint64, []byte, error)) error {
+	// Subscribe before reading, not to miss updates in between.
+	if err := node.factory.subscribe(ctx, key); err != nil {
+		return err
+	}
+	version, b, err := get(key[:])
 	if err != nil {
 		return err
 	}
@@ -99,16 +175,46 @@ func (node *dinoNode) loadMetadata(key [nodeKeyLen]byte) error {
 	return nil
 }
 
-func (node *dinoNode) sync() syscall.Errno {
+// loadMetadataMany is like calling loadMetadata for each of the given nodes, but
+// subscribes to and gets all their keys at once. Nodes whose metadata can't be
+// loaded are left alone, and the first such error is returned.
+func (factory *dinoNodeFactory) loadMetadataMany(ctx context.Context, nodes []*dinoNode) error {
+	keys := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		keys[i] = node.key[:]
+	}
+	// Subscribe before reading, not to miss updates in between.
+	if err := storage.SubscribeManyContext(ctx, factory.metadata, keys); err != nil {
+		return err
+	}
+	values, err := storage.GetManyContext(ctx, factory.metadata, keys)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		vv, ok := values[string(node.key[:])]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("%.10x: %w", node.key[:], storage.ErrNotFound)
+			}
+			continue
+		}
+		node.version = vv.Version
+		node.unserialize(vv.Value)
+	}
+	return err
+}
+
+func (node *dinoNode) sync(ctx context.Context) syscall.Errno {
 	if node.shouldSaveContent {
 		var err error
 		prev := node.contentKey
-		node.contentKey, err = node.factory.blobs.Put(node.content)
+		node.contentKey, err = node.factory.blobs.PutContext(ctx, node.content)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("Could not save content")
-			return syscall.EIO
+			return errnoFor(err)
 		}
 		node.shouldSaveContent = false
 		if !bytes.Equal(prev, node.contentKey) {
@@ -116,7 +222,7 @@ func (node *dinoNode) sync() syscall.Errno {
 		}
 	}
 	if node.shouldSaveMetadata {
-		err := node.saveMetadata()
+		err := node.saveMetadata(ctx)
 		if err != nil {
 			if errors.Is(err, storage.ErrStalePut) {
 				node.shouldReloadMetadata = true
@@ -124,7 +230,7 @@ func (node *dinoNode) sync() syscall.Errno {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("Could not save metadata")
-			return syscall.EIO
+			return errnoFor(err)
 		}
 		node.shouldSaveMetadata = false
 	}
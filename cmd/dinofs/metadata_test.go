@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"math/rand"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/nicolagi/dino/message"
 	"github.com/nicolagi/dino/storage"
 	"github.com/stretchr/testify/assert"
@@ -21,11 +26,11 @@ func TestNodeSerialization(t *testing.T) {
 	factory := &dinoNodeFactory{inogen: g, metadata: versioned}
 	for i := 0; i < 100; i++ {
 		before := randomNode(t, factory)
-		err := before.saveMetadata()
+		err := before.saveMetadata(context.Background())
 		require.Nil(t, err)
 		after, err := factory.allocNode()
 		require.Nil(t, err)
-		err = after.loadMetadata(before.key)
+		err = after.loadMetadata(context.Background(), before.key)
 		require.Nil(t, err)
 		assert.Equal(t, before.user, after.user)
 		assert.Equal(t, before.group, after.group)
@@ -37,6 +42,63 @@ func TestNodeSerialization(t *testing.T) {
 	}
 }
 
+func TestNodeSerializationWideFormat(t *testing.T) {
+	g := newInodeNumbersGenerator()
+	go g.start()
+	defer g.stop()
+	store := storage.NewInMemoryStore()
+	versioned := storage.NewVersionedWrapper(store)
+	factory := &dinoNodeFactory{inogen: g, metadata: versioned}
+	t.Run("small nodes use the legacy format", func(t *testing.T) {
+		node := randomNode(t, factory)
+		node.user = 1000
+		assert.False(t, bytes.HasPrefix(node.serialize(), wideNodePrefix))
+	})
+	t.Run("large extended attributes survive a round trip", func(t *testing.T) {
+		before := randomNode(t, factory)
+		before.xattrs["user.large"] = bytes.Repeat([]byte{42}, 100000)
+		assert.True(t, bytes.HasPrefix(before.serialize(), wideNodePrefix))
+		require.Nil(t, before.saveMetadata(context.Background()))
+		after, err := factory.allocNode()
+		require.Nil(t, err)
+		require.Nil(t, after.loadMetadata(context.Background(), before.key))
+		assert.Equal(t, before.user, after.user)
+		assert.Equal(t, before.mode, after.mode)
+		assert.EqualValues(t, before.contentKey, after.contentKey)
+		assert.Equal(t, before.xattrs, after.xattrs)
+	})
+}
+
+func TestLoadMetadataMany(t *testing.T) {
+	g := newInodeNumbersGenerator()
+	go g.start()
+	defer g.stop()
+	store := storage.NewInMemoryStore()
+	versioned := storage.NewVersionedWrapper(store)
+	factory := &dinoNodeFactory{inogen: g, metadata: versioned}
+	var saved, loaded []*dinoNode
+	for i := 0; i < 10; i++ {
+		node := randomNode(t, factory)
+		require.Nil(t, node.saveMetadata(context.Background()))
+		saved = append(saved, node)
+		loaded = append(loaded, factory.existingNode("", node.key))
+	}
+	missing, err := factory.allocNode()
+	require.Nil(t, err)
+	unsaved := factory.existingNode("", missing.key)
+
+	err = factory.loadMetadataMany(context.Background(), append(loaded, unsaved))
+	assert.True(t, errors.Is(err, storage.ErrNotFound))
+	assert.Equal(t, modeNotLoaded, unsaved.mode)
+	for i, after := range loaded {
+		before := saved[i]
+		assert.Equal(t, before.user, after.user)
+		assert.Equal(t, before.mode, after.mode)
+		assert.Equal(t, before.version, after.version)
+		assert.EqualValues(t, before.contentKey, after.contentKey)
+	}
+}
+
 func randomNode(t *testing.T, factory *dinoNodeFactory) *dinoNode {
 	node, err := factory.allocNode()
 	require.Nil(t, err)
@@ -55,3 +117,124 @@ func randomNode(t *testing.T, factory *dinoNodeFactory) *dinoNode {
 	}
 	return node
 }
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	versioned := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	factory := &dinoNodeFactory{metadata: versioned}
+	dir := func(name string, key [nodeKeyLen]byte, children ...*dinoNode) *dinoNode {
+		node := factory.existingNode(name, key)
+		node.mode = fuse.S_IFDIR | 0755
+		node.children = make(map[string]*dinoNode)
+		for _, child := range children {
+			node.children[child.name] = child
+		}
+		require.Nil(t, node.saveMetadata(ctx))
+		return node
+	}
+	newKey := func() (key [nodeKeyLen]byte) {
+		rand.Read(key[:])
+		return key
+	}
+	file := factory.existingNode("file", newKey())
+	file.mode = fuse.S_IFREG | 0644
+	require.Nil(t, file.saveMetadata(ctx))
+	foo := dir("foo", newKey())
+	projects := dir("projects", newKey(), foo)
+	var rootKey [nodeKeyLen]byte
+	root := dir("root", rootKey, projects, file)
+	factory.forget(root)
+
+	for _, pathname := range []string{"projects/foo", "/projects/foo/", "projects/../projects/./foo"} {
+		key, err := factory.resolve(ctx, pathname)
+		require.Nil(t, err)
+		assert.Equal(t, foo.key, key, pathname)
+	}
+	key, err := factory.resolve(ctx, "")
+	require.Nil(t, err)
+	assert.Equal(t, rootKey, key)
+	_, err = factory.resolve(ctx, "projects/bar")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = factory.resolve(ctx, "file/foo")
+	assert.NotNil(t, err)
+
+	// Resolving doesn't register the nodes along the way with the factory.
+	assert.Empty(t, factory.known)
+
+	// The key of a directory doesn't change when an ancestor is renamed.
+	delete(root.children, "projects")
+	root.children["archive"] = projects
+	require.Nil(t, root.saveMetadata(ctx))
+	key, err = factory.resolve(ctx, "archive/foo")
+	require.Nil(t, err)
+	assert.Equal(t, foo.key, key)
+}
+
+func TestMigrateContentKeys(t *testing.T) {
+	ctx := context.Background()
+	versioned := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewInMemoryStore()
+	factory := &dinoNodeFactory{metadata: versioned}
+	legacy := storage.NewBlobStore(blobs, storage.WithHashAlgorithm(storage.SHA1))
+	newKey := func() (key [nodeKeyLen]byte) {
+		rand.Read(key[:])
+		return key
+	}
+	file := func(name string, content string, store *storage.BlobStoreWrapper) *dinoNode {
+		node := factory.existingNode(name, newKey())
+		node.mode = fuse.S_IFREG | 0644
+		var err error
+		node.contentKey, err = store.Put([]byte(content))
+		require.Nil(t, err)
+		require.Nil(t, node.saveMetadata(ctx))
+		return node
+	}
+	old := file("old", "old content", legacy)
+	recent := file("recent", "recent content", storage.NewBlobStore(blobs))
+	corrupted := file("corrupted", "corrupted content", legacy)
+	require.Nil(t, blobs.Put(corrupted.contentKey, []byte("something else")))
+	empty := factory.existingNode("empty", newKey())
+	empty.mode = fuse.S_IFREG | 0644
+	require.Nil(t, empty.saveMetadata(ctx))
+	var rootKey [nodeKeyLen]byte
+	root := factory.existingNode("root", rootKey)
+	root.mode = fuse.S_IFDIR | 0755
+	root.children = map[string]*dinoNode{"old": old, "recent": recent, "corrupted": corrupted, "empty": empty}
+	require.Nil(t, root.saveMetadata(ctx))
+
+	factory.blobs = storage.NewBlobStore(blobs)
+	migrated, err := factory.migrateContentKeys(ctx, rootKey)
+	require.Nil(t, err)
+	assert.Equal(t, 1, migrated)
+
+	load := func(key [nodeKeyLen]byte) *dinoNode {
+		node := &dinoNode{factory: &dinoNodeFactory{metadata: versioned}}
+		require.Nil(t, node.loadMetadata(ctx, key))
+		return node
+	}
+	t.Run("legacy keys are rewritten", func(t *testing.T) {
+		node := load(old.key)
+		alg, err := storage.ParseContentKey(node.contentKey)
+		require.Nil(t, err)
+		assert.Equal(t, storage.DefaultHashAlgorithm, alg)
+		content, err := factory.blobs.Get(node.contentKey)
+		require.Nil(t, err)
+		assert.Equal(t, "old content", string(content))
+		assert.Equal(t, old.version+1, node.version)
+		// Still readable by clients holding the old metadata.
+		_, err = factory.blobs.Get(old.contentKey)
+		assert.Nil(t, err)
+	})
+	t.Run("other nodes are left alone", func(t *testing.T) {
+		for _, before := range []*dinoNode{recent, corrupted, empty, root} {
+			after := load(before.key)
+			assert.Equal(t, before.version, after.version, before.name)
+			assert.Equal(t, string(before.contentKey), string(after.contentKey), before.name)
+		}
+	})
+	t.Run("migrating again is a no-op", func(t *testing.T) {
+		migrated, err := factory.migrateContentKeys(ctx, rootKey)
+		require.Nil(t, err)
+		assert.Equal(t, 0, migrated)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nicolagi/dino/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrateContentKeys walks the tree rooted at the node with the given key and
+// rewrites the content keys that weren't computed with the blob store's hash
+// algorithm, e.g., legacy SHA-1 keys. The content is verified against the old
+// key and stored under the new one before the node metadata is updated, so
+// that clients reading either version of the metadata can get the content.
+// Nodes updated concurrently by other clients are reloaded and tried again;
+// nodes whose content can't be read, or is corrupted, are skipped.
+// Like resolve, it loads nodes outside of this factory, not to subscribe to
+// them. It returns how many nodes it updated.
+func (factory *dinoNodeFactory) migrateContentKeys(ctx context.Context, root [nodeKeyLen]byte) (migrated int, err error) {
+	scratch := &dinoNodeFactory{metadata: factory.metadata}
+	visited := make(map[[nodeKeyLen]byte]bool)
+	pending := [][nodeKeyLen]byte{root}
+	for len(pending) > 0 {
+		key := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if visited[key] {
+			continue
+		}
+		visited[key] = true
+		node, updated, err := factory.migrateNode(ctx, scratch, key)
+		if err != nil {
+			return migrated, err
+		}
+		if updated {
+			migrated++
+		}
+		for _, child := range node.children {
+			pending = append(pending, child.key)
+		}
+	}
+	return migrated, nil
+}
+
+// migrateNode rewrites the content key of a single node, if needed, and
+// returns the node as last loaded.
+func (factory *dinoNodeFactory) migrateNode(ctx context.Context, scratch *dinoNodeFactory, key [nodeKeyLen]byte) (node *dinoNode, updated bool, err error) {
+	logger := log.WithField("key", fmt.Sprintf("%.10x", key[:]))
+	for {
+		version, value, err := storage.VersionedGetContext(ctx, factory.metadata, key[:])
+		if err != nil {
+			return nil, false, fmt.Errorf("%.10x: %w", key[:], err)
+		}
+		node = &dinoNode{factory: scratch, key: key, version: version}
+		node.unserialize(value)
+		if len(node.contentKey) == 0 {
+			return node, false, nil
+		}
+		alg, err := storage.ParseContentKey(node.contentKey)
+		if err == nil && alg == factory.blobs.HashAlgorithm() {
+			return node, false, nil
+		}
+		content, err := factory.blobs.GetContext(ctx, node.contentKey)
+		if err == nil {
+			err = storage.VerifyBlob(node.contentKey, content)
+		}
+		if err != nil {
+			// Leave the node alone, rather than give up on the others.
+			logger.WithFields(log.Fields{
+				"err":     err,
+				"content": fmt.Sprintf("%.10x", node.contentKey),
+			}).Warn("Could not get content, skipping")
+			return node, false, nil
+		}
+		prev := node.contentKey
+		if node.contentKey, err = factory.blobs.PutContext(ctx, content); err != nil {
+			return nil, false, fmt.Errorf("%.10x: %w", key[:], err)
+		}
+		err = node.saveMetadata(ctx)
+		if errors.Is(err, storage.ErrStalePut) {
+			logger.Debug("Updated concurrently, trying again")
+			continue
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("%.10x: %w", key[:], err)
+		}
+		logger.WithFields(log.Fields{
+			"from": fmt.Sprintf("%.10x", prev),
+			"to":   fmt.Sprintf("%.10x", node.contentKey),
+		}).Info("Migrated content key")
+		return node, true, nil
+	}
+}
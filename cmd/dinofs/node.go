@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"strconv"
 	"sync"
 	"syscall"
@@ -12,12 +13,17 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/nicolagi/dino/storage"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	nodeKeyLen    int    = 20
 	modeNotLoaded uint32 = 0xffffffff
+
+	// Read-only extended attribute of the root node, telling the state of the
+	// connection to the metadata server.
+	connectionStateAttr = "user.dino.connection"
 )
 
 type dinoNode struct {
@@ -100,7 +106,7 @@ func (node *dinoNode) Setxattr(ctx context.Context, attr string, data []byte, fl
 	rbdata := node.xattrs[attr]
 	node.xattrs[attr] = append([]byte{}, data...)
 	node.shouldSaveMetadata = true
-	errno := node.sync()
+	errno := node.sync(ctx)
 	// Rollback.
 	if errno != 0 {
 		if rbdata != nil {
@@ -117,14 +123,16 @@ func (node *dinoNode) Setxattr(ctx context.Context, attr string, data []byte, fl
 // small, it should return ERANGE and the size of the attribute.
 // If not defined, Getxattr will return ENOATTR.
 func (node *dinoNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
-	node.mu.Lock()
-	defer node.mu.Unlock()
-	if node.xattrs == nil {
-		return 0, syscall.ENODATA
-	}
-	value, ok := node.xattrs[attr]
-	if !ok {
-		return 0, syscall.ENODATA
+	var value []byte
+	if state := node.factory.connectionState(); state != "" && attr == connectionStateAttr && node == node.factory.root {
+		value = []byte(state)
+	} else {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		var ok bool
+		if value, ok = node.xattrs[attr]; !ok {
+			return 0, syscall.ENODATA
+		}
 	}
 	if len(value) > len(dest) {
 		return uint32(len(value)), syscall.ERANGE
@@ -145,18 +153,21 @@ func (node *dinoNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 		return syscall.ENOENT
 	}
 	child.mu.Lock()
-	defer child.mu.Unlock()
-	if len(child.children) != 0 {
+	empty := len(child.children) == 0
+	child.mu.Unlock()
+	if !empty {
 		return syscall.ENOTEMPTY
 	}
 	delete(node.children, name)
 	node.shouldSaveMetadata = true
-	errno := node.sync()
+	errno := node.sync(ctx)
 	// Rollback.
 	if errno != 0 {
 		node.children[name] = child
+		return errno
 	}
-	return errno
+	node.factory.forget(child)
+	return 0
 }
 
 func (node *dinoNode) Unlink(ctx context.Context, name string) syscall.Errno {
@@ -165,29 +176,46 @@ func (node *dinoNode) Unlink(ctx context.Context, name string) syscall.Errno {
 	child := node.children[name]
 	delete(node.children, name)
 	node.shouldSaveMetadata = true
-	errno := node.sync()
+	errno := node.sync(ctx)
 	// Rollback.
 	if errno != 0 && child != nil {
 		node.children[name] = child
 	}
+	if errno == 0 && child != nil {
+		node.factory.forget(child)
+	}
 	return errno
 }
 
+// errnoFor returns the errno for an error from the storage layer: EINTR if the
+// operation was interrupted, EIO otherwise.
+func errnoFor(err error) syscall.Errno {
+	if errors.Is(err, context.Canceled) {
+		return syscall.EINTR
+	}
+	return syscall.EIO
+}
+
 // Call with lock held.
 func (node *dinoNode) fullPath() string {
 	return node.Path(node.factory.root.EmbeddedInode())
 }
 
 // Call with lock held.
-func (node *dinoNode) reloadIfNeeded() syscall.Errno {
+func (node *dinoNode) reloadIfNeeded(ctx context.Context) syscall.Errno {
 	if !node.shouldReloadMetadata {
 		return 0
 	}
 	logger := log.WithField("parent", node.name)
 	nn := &dinoNode{factory: node.factory}
-	if err := nn.loadMetadata(node.key); err != nil {
+	if err := nn.loadMetadataIfModified(ctx, node.key, node.version); err != nil {
+		if errors.Is(err, storage.ErrNotModified) {
+			logger.Debug("Not modified")
+			node.shouldReloadMetadata = false
+			return 0
+		}
 		logger.WithField("err", err).Error("Could not reload")
-		return syscall.EIO
+		return errnoFor(err)
 	}
 	node.shouldSaveMetadata = false
 	node.shouldReloadMetadata = false
@@ -217,6 +245,7 @@ func (node *dinoNode) reloadIfNeeded() syscall.Errno {
 				logger.Debug("Child kept same key - no op")
 			} else {
 				logger.Debug("Child changed key - updating that and marking for reload")
+				node.factory.unsubscribe(prev.key)
 				prev.key = child.key
 				prev.shouldReloadMetadata = true
 			}
@@ -230,8 +259,10 @@ func (node *dinoNode) reloadIfNeeded() syscall.Errno {
 	for name := range node.children {
 		if nn.children[name] == nil {
 			logger.Debug("Child has been removed, removing here too")
+			child := node.children[name]
 			node.RmChild(name)
 			delete(node.children, name)
+			node.factory.forget(child)
 		}
 	}
 
@@ -241,21 +272,16 @@ func (node *dinoNode) reloadIfNeeded() syscall.Errno {
 func (node *dinoNode) Opendir(ctx context.Context) syscall.Errno {
 	node.mu.Lock()
 	defer node.mu.Unlock()
-	if errno := node.reloadIfNeeded(); errno != 0 {
+	if errno := node.reloadIfNeeded(ctx); errno != 0 {
 		return errno
 	}
-	for _, childNode := range node.children {
-		if errno := node.ensureChildLoaded(ctx, childNode); errno != 0 {
-			return errno
-		}
-	}
-	return 0
+	return node.ensureChildrenLoaded(ctx)
 }
 
 func (node *dinoNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
-	if errno := node.reloadIfNeeded(); errno != 0 {
+	if errno := node.reloadIfNeeded(ctx); errno != 0 {
 		return nil, errno
 	}
 	child := node.children[name]
@@ -272,7 +298,7 @@ func (node *dinoNode) Lookup(ctx context.Context, name string, out *fuse.EntryOu
 	// In the below, if we don't report the size, any read to a mmap-ed file
 	// whose *dinoNode content hasn't been loaded would cause a SIGBUS.
 	// We wouldn't even get i/o calls to the *dinoNode.
-	if errno := child.ensureContentLoaded(); errno != 0 {
+	if errno := child.ensureContentLoaded(ctx); errno != 0 {
 		return nil, errno
 	}
 	out.Uid = child.user
@@ -290,13 +316,13 @@ func (node *dinoNode) ensureChildLoaded(ctx context.Context, childNode *dinoNode
 	if childNode.mode != modeNotLoaded {
 		return 0
 	}
-	if err := childNode.loadMetadata(childNode.key); err != nil {
+	if err := childNode.loadMetadata(ctx, childNode.key); err != nil {
 		log.WithFields(log.Fields{
 			"err":    err,
 			"child":  childNode.name,
 			"parent": node.fullPath(),
 		}).Error("could not load metadata")
-		return syscall.EIO
+		return errnoFor(err)
 	}
 	node.AddChild(childNode.name, node.NewInode(ctx, childNode, fs.StableAttr{
 		Mode: childNode.mode,
@@ -305,11 +331,42 @@ func (node *dinoNode) ensureChildLoaded(ctx context.Context, childNode *dinoNode
 	return 0
 }
 
+// Like ensureChildLoaded, but for all children at once. Call with lock held.
+func (node *dinoNode) ensureChildrenLoaded(ctx context.Context) syscall.Errno {
+	var unloaded []*dinoNode
+	for _, childNode := range node.children {
+		if childNode.mode == modeNotLoaded {
+			unloaded = append(unloaded, childNode)
+		}
+	}
+	if len(unloaded) == 0 {
+		return 0
+	}
+	err := node.factory.loadMetadataMany(ctx, unloaded)
+	for _, childNode := range unloaded {
+		if childNode.mode == modeNotLoaded {
+			continue
+		}
+		node.AddChild(childNode.name, node.NewInode(ctx, childNode, fs.StableAttr{
+			Mode: childNode.mode,
+			Ino:  node.factory.inogen.next(),
+		}), false)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"parent": node.fullPath(),
+		}).Error("could not load metadata of children")
+		return errnoFor(err)
+	}
+	return 0
+}
+
 func (node *dinoNode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
 	node.mu.Lock()
 	defer node.mu.Unlock()
 	prev := node.contentKey
-	errno := node.sync()
+	errno := node.sync(ctx)
 	if errno != 0 && !bytes.Equal(prev, node.contentKey) {
 		// Rollback.
 		node.contentKey = prev
@@ -330,10 +387,10 @@ func (node *dinoNode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32)
 func (node *dinoNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	node.mu.Lock()
 	defer node.mu.Unlock()
-	if errno := node.reloadIfNeeded(); errno != 0 {
+	if errno := node.reloadIfNeeded(ctx); errno != 0 {
 		return errno
 	}
-	if errno := node.ensureContentLoaded(); errno != 0 {
+	if errno := node.ensureContentLoaded(ctx); errno != 0 {
 		return errno
 	}
 	out.Uid = node.user
@@ -354,12 +411,12 @@ func (node *dinoNode) Create(ctx context.Context, name string, flags uint32, mod
 	}
 	defer child.mu.Unlock()
 	child.shouldSaveMetadata = true
-	if errno := child.sync(); errno != 0 {
+	if errno := child.sync(ctx); errno != 0 {
 		rollback()
 		return nil, nil, 0, errno
 	}
 	node.shouldSaveMetadata = true
-	if errno := node.sync(); errno != 0 {
+	if errno := node.sync(ctx); errno != 0 {
 		rollback()
 		return nil, nil, 0, errno
 	}
@@ -377,11 +434,11 @@ func (node *dinoNode) Mkdir(ctx context.Context, name string, mode uint32, out *
 	child.children = make(map[string]*dinoNode)
 	child.shouldSaveMetadata = true
 	node.shouldSaveMetadata = true
-	if errno := child.sync(); errno != 0 {
+	if errno := child.sync(ctx); errno != 0 {
 		rollback()
 		return nil, errno
 	}
-	if errno := node.sync(); errno != 0 {
+	if errno := node.sync(ctx); errno != 0 {
 		rollback()
 		return nil, errno
 	}
@@ -400,11 +457,11 @@ func (node *dinoNode) Symlink(ctx context.Context, target, name string, out *fus
 	child.content = []byte(target)
 	child.shouldSaveMetadata = true
 	node.shouldSaveMetadata = true
-	if errno := child.sync(); errno != 0 {
+	if errno := child.sync(ctx); errno != 0 {
 		rollback()
 		return nil, errno
 	}
-	if errno := node.sync(); errno != 0 {
+	if errno := node.sync(ctx); errno != 0 {
 		rollback()
 		return nil, errno
 	}
@@ -440,13 +497,13 @@ func (node *dinoNode) createLockedChild(ctx context.Context, name string, mode u
 func (node *dinoNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
-	if errno := node.reloadIfNeeded(); errno != 0 {
+	if errno := node.reloadIfNeeded(ctx); errno != 0 {
 		return nil, 0, errno
 	}
-	return nil, 0, node.ensureContentLoaded()
+	return nil, 0, node.ensureContentLoaded(ctx)
 }
 
-func (node *dinoNode) ensureContentLoaded() syscall.Errno {
+func (node *dinoNode) ensureContentLoaded(ctx context.Context) syscall.Errno {
 	logger := log.WithFields(log.Fields{
 		"name": node.name,
 	})
@@ -462,10 +519,10 @@ func (node *dinoNode) ensureContentLoaded() syscall.Errno {
 	if len(node.content) != 0 {
 		return 0
 	}
-	value, err := node.factory.blobs.Get(node.contentKey)
+	value, err := node.factory.blobs.GetContext(ctx, node.contentKey)
 	if err != nil {
 		logger.WithField("err", err).Error("Could not load content")
-		return syscall.EIO
+		return errnoFor(err)
 	}
 	logger.WithField("size", len(value)).Debug("Content loaded")
 	node.content = value
@@ -503,21 +560,25 @@ func (node *dinoNode) Rename(ctx context.Context, name string, newParent fs.Inod
 		newParentNode.mu.Lock()
 		defer newParentNode.mu.Unlock()
 	}
+	replaced := newParentNode.children[newName]
 	newParentNode.children[newName] = child
 	delete(node.children, name)
 
 	child.shouldSaveMetadata = true
 	newParentNode.shouldSaveMetadata = true
 	node.shouldSaveMetadata = true
-	if errno := child.sync(); errno != 0 {
+	if errno := child.sync(ctx); errno != 0 {
 		return errno
 	}
-	if errno := newParentNode.sync(); errno != 0 {
+	if errno := newParentNode.sync(ctx); errno != 0 {
 		return errno
 	}
-	if errno := node.sync(); errno != 0 {
+	if errno := node.sync(ctx); errno != 0 {
 		return errno
 	}
+	if replaced != nil && replaced != child {
+		node.factory.forget(replaced)
+	}
 	return 0
 }
 
@@ -577,7 +638,7 @@ func (node *dinoNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.Set
 		node.shouldSaveContent = true
 	}
 	node.shouldSaveMetadata = true
-	errno := node.sync()
+	errno := node.sync(ctx)
 	if errno != 0 {
 		// Rollback.
 		if rbtime != nil {
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
+	"os"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/nicolagi/dino/message"
 	"github.com/nicolagi/dino/storage"
 	log "github.com/sirupsen/logrus"
@@ -19,6 +24,10 @@ type dinoNodeFactory struct {
 
 	mu    sync.Mutex
 	known map[[nodeKeyLen]byte]*dinoNode
+
+	// State of the connection to the metadata server, empty if the metadata
+	// store doesn't report any.
+	connection string
 }
 
 func (factory *dinoNodeFactory) allocNode() (*dinoNode, error) {
@@ -36,6 +45,37 @@ func (factory *dinoNodeFactory) allocNode() (*dinoNode, error) {
 	return &node, nil
 }
 
+// resolve walks the given slash-separated path from the root of the volume, and
+// returns the key of the directory it leads to. Only the key matters from then
+// on, so that directory can keep being served as the root of the mount even if
+// other clients rename or move its ancestors. The directories along the way are
+// loaded outside of this factory, not to subscribe to them.
+func (factory *dinoNodeFactory) resolve(ctx context.Context, pathname string) (key [nodeKeyLen]byte, err error) {
+	scratch := &dinoNodeFactory{metadata: factory.metadata}
+	walked := "/"
+	for _, name := range strings.Split(path.Clean("/"+pathname), "/") {
+		if name == "" {
+			continue
+		}
+		_, value, err := storage.VersionedGetContext(ctx, factory.metadata, key[:])
+		if err != nil {
+			return key, fmt.Errorf("%q: %w", walked, err)
+		}
+		dir := &dinoNode{factory: scratch}
+		dir.unserialize(value)
+		if dir.mode&fuse.S_IFDIR == 0 {
+			return key, fmt.Errorf("%q: not a directory", walked)
+		}
+		walked = path.Join(walked, name)
+		child := dir.children[name]
+		if child == nil {
+			return key, fmt.Errorf("%q: %w", walked, os.ErrNotExist)
+		}
+		key = child.key
+	}
+	return key, nil
+}
+
 func (factory *dinoNodeFactory) existingNode(name string, key [nodeKeyLen]byte) *dinoNode {
 	var node dinoNode
 	node.factory = factory
@@ -73,6 +113,58 @@ func (factory *dinoNodeFactory) getKnown(key [nodeKeyLen]byte) *dinoNode {
 	return factory.known[key]
 }
 
+// subscribe asks the metadata store, if it needs to be told, to keep us posted
+// about updates to the node with the given key.
+func (factory *dinoNodeFactory) subscribe(ctx context.Context, key [nodeKeyLen]byte) error {
+	if s, ok := factory.metadata.(storage.ContextSubscriber); ok {
+		return s.SubscribeContext(ctx, key[:])
+	}
+	if s, ok := factory.metadata.(storage.Subscriber); ok {
+		return s.Subscribe(key[:])
+	}
+	return nil
+}
+
+func (factory *dinoNodeFactory) unsubscribe(key [nodeKeyLen]byte) {
+	s, ok := factory.metadata.(storage.Subscriber)
+	if !ok {
+		return
+	}
+	if err := s.Unsubscribe(key[:]); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"key": fmt.Sprintf("%.10x", key[:]),
+		}).Warn("Could not unsubscribe")
+	}
+}
+
+// forget is called for a node that has been removed from the tree, together
+// with its descendants. Call with the lock of the node's parent held.
+func (factory *dinoNodeFactory) forget(node *dinoNode) {
+	node.mu.Lock()
+	children := make([]*dinoNode, 0, len(node.children))
+	for _, child := range node.children {
+		children = append(children, child)
+	}
+	loaded := node.mode != modeNotLoaded
+	node.mu.Unlock()
+	for _, child := range children {
+		factory.forget(child)
+	}
+	factory.mu.Lock()
+	if factory.known[node.key] == node {
+		delete(factory.known, node.key)
+	}
+	factory.mu.Unlock()
+	if loaded {
+		factory.unsubscribe(node.key)
+	}
+	log.WithFields(log.Fields{
+		"key":  fmt.Sprintf("%.10x", node.key[:]),
+		"name": node.name,
+	}).Debug("Forgot node")
+}
+
 func (factory *dinoNodeFactory) invalidateCache(mutation message.Message) {
 	logger := log.WithFields(log.Fields{
 		"op":       "import",
@@ -102,3 +194,44 @@ func (factory *dinoNodeFactory) invalidateCache(mutation message.Message) {
 	logger.Debug("Marking for update")
 	node.shouldReloadMetadata = true
 }
+
+// connectionStateChanged is called when the connection to the metadata server
+// is made or lost.
+func (factory *dinoNodeFactory) connectionStateChanged(state storage.ConnectionState, err error) {
+	factory.mu.Lock()
+	factory.connection = state.String()
+	factory.mu.Unlock()
+	if state == storage.StateConnected {
+		log.Info("Connected to metadata server")
+	} else {
+		log.WithField("err", err).Warn("Lost connection to metadata server")
+	}
+}
+
+// connectionState returns the state of the connection to the metadata server,
+// if known.
+func (factory *dinoNodeFactory) connectionState() string {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	return factory.connection
+}
+
+// invalidateAll marks all loaded nodes for reload. It's called when the
+// metadata store could not catch up on the updates it missed, so any node might
+// be stale.
+func (factory *dinoNodeFactory) invalidateAll() {
+	factory.mu.Lock()
+	nodes := make([]*dinoNode, 0, len(factory.known))
+	for _, node := range factory.known {
+		nodes = append(nodes, node)
+	}
+	factory.mu.Unlock()
+	for _, node := range nodes {
+		node.mu.Lock()
+		if node.mode != modeNotLoaded {
+			node.shouldReloadMetadata = true
+		}
+		node.mu.Unlock()
+	}
+	log.WithField("count", len(nodes)).Info("Marked all nodes for update")
+}
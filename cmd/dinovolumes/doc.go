@@ -0,0 +1,17 @@
+// Command dinovolumes creates, lists and deletes the volumes of a metadata
+// server. Each volume is a file system of its own, with its own root node, key
+// space, broadcasts and, optionally, password. Volumes are kept in a file, the
+// one named by the volumes_file property of the metadataserver configuration,
+// which the metadataserver reads again on SIGHUP. Replicas and shards must be
+// given the same file, so that they agree on the volume ids.
+//
+// Usage:
+//
+//	dinovolumes [-file pathname] list
+//	dinovolumes [-file pathname] create [-auth-hash hash] name
+//	dinovolumes [-file pathname] delete name
+//
+// Deleting a volume disconnects its clients once the metadataserver reads the
+// file again, but its keys are left in the backend store. A new volume with the
+// same name starts out empty.
+package main // import "github.com/nicolagi/dino/cmd/dinovolumes"
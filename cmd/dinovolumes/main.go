@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nicolagi/dino/metadata/volume"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage:
+	dinovolumes [-file pathname] list
+	dinovolumes [-file pathname] create [-auth-hash hash] name
+	dinovolumes [-file pathname] delete name
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	file := flag.String("file", os.ExpandEnv("$HOME/lib/dino/volumes.json"), "location of the volumes file")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	registry, err := volume.LoadFile(*file)
+	if err != nil {
+		log.Fatalf("Loading volumes from %q: %v", *file, err)
+	}
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "list":
+		err = list(registry, args)
+	case "create":
+		err = create(registry, args)
+	case "delete":
+		err = remove(registry, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err == nil && flag.Arg(0) != "list" {
+		err = registry.SaveFile(*file)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func list(registry volume.Registry, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("list takes no arguments")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tPASSWORD")
+	for _, v := range registry.List() {
+		fmt.Fprintf(w, "%s\t%s\t%t\n", v.Name, v.ID, v.AuthHash != "")
+	}
+	return w.Flush()
+}
+
+func create(registry volume.Registry, args []string) error {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	authHash := flags.String("auth-hash", "", "bcrypt hash of the volume password")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("create takes exactly one volume name")
+	}
+	if *authHash != "" {
+		if _, err := bcrypt.Cost([]byte(*authHash)); err != nil {
+			return fmt.Errorf("invalid auth hash: %w", err)
+		}
+	}
+	v, err := registry.Create(flags.Arg(0), *authHash)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created volume %q with id %s\n", v.Name, v.ID)
+	return nil
+}
+
+func remove(registry volume.Registry, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("delete takes exactly one volume name")
+	}
+	return registry.Delete(args[0])
+}
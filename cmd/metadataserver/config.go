@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"golang.org/x/crypto/bcrypt"
@@ -13,13 +14,53 @@ import (
 
 var errIncompleteKeyPair = errors.New("must specify both cert file and key file or neither")
 
+// replicationOptions configure this server as a replica, one of a group of
+// servers agreeing on the order of puts, of which the leader serves clients.
+type replicationOptions struct {
+	// The id of this replica, one of the keys of Peers.
+	ID string
+
+	// Where to listen for the other replicas.
+	ListenAddress string `toml:"listen_address"`
+
+	// Bolt database holding the replicated log.
+	LogFile string `toml:"log_file"`
+
+	// The certificate this replica presents to the other replicas, and the
+	// CAs their certificates must be issued by. Any replica with such a
+	// certificate can write anything, so the CAs should only issue them to
+	// replicas. Required unless InsecureTransport is set.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	CAFile   string `toml:"ca_file"`
+
+	// Whether replicas may talk to each other in the clear, in which case
+	// anyone who can reach ListenAddress can write anything. Only for
+	// networks no one else can reach.
+	InsecureTransport bool `toml:"insecure_transport"`
+
+	// All replicas, including this one, by id.
+	Peers map[string]peerOptions
+}
+
+type peerOptions struct {
+	// Where the replica listens for the other replicas.
+	RaftAddress string `toml:"raft_address"`
+
+	// Where the replica listens for clients. Clients connecting to other
+	// replicas are pointed here while this replica is the leader.
+	ClientAddress string `toml:"client_address"`
+}
+
 type options struct {
 	Debug         bool
 	ListenAddress string `toml:"listen_address"`
 
 	// The backend property defines the backend  where the data handled by
 	// the server is actually stored. This can be any key-value store,
-	// defined in the Stores property.
+	// defined in the Stores property. Set versioning = "native" in the store
+	// definition to check versions in the store itself (boltdb and dynamodb
+	// stores only), rather than serializing all requests.
 	Backend string
 
 	// The two properties below are for TLS. Specify both or none (in case
@@ -27,10 +68,41 @@ type options struct {
 	CertFile string `toml:"cert_file"`
 	KeyFile  string `toml:"key_file"`
 
+	// If set, require clients to present a certificate issued by one of the
+	// CAs in this PEM file. Clients whose certificate common name is a user
+	// in the credentials file are logged in as that user. Requires TLS.
+	ClientCAFile string `toml:"client_ca_file"`
+
 	// If non-empty, the server will require a successful exchange of auth
 	// messages before any put/get messages.
 	AuthHash string `toml:"auth_hash"`
 
+	// If non-empty, clients can also log in as the users in this file, with
+	// the access it grants them (see credentialsFile). Requires TLS. The
+	// file is read again on SIGHUP, so that users can be added or revoked
+	// without restarting.
+	CredentialsFile string `toml:"credentials_file"`
+
+	// If non-empty, clients can choose among the volumes in this file,
+	// managed with the dinovolumes command, besides the default volume. The
+	// file is read again on SIGHUP. Replicas and shards must be given the
+	// same file.
+	VolumesFile string `toml:"volumes_file"`
+
+	// How many of the most recent accepted puts to retain, so that clients
+	// that reconnect can catch up on the updates they missed. If zero, a
+	// default is used.
+	ChangeLogSize int `toml:"change_log_size"`
+
+	// How long to wait for anything from a client that promised to ping,
+	// before closing its connection, e.g., "90s". If empty, a default is
+	// used. Zero disables closing idle connections.
+	IdleTimeout string `toml:"idle_timeout"`
+	idleTimeout time.Duration
+
+	// If the id is set, this server is a replica.
+	Replication replicationOptions
+
 	// Stores defines any number of storage.Store implementations that are
 	// referenced by name in the rest of the configuration. The configuration is
 	// handled by github.com/nicolagi/dino/storage.Builder. Also see the init
@@ -75,5 +147,33 @@ func loadOptions(r io.Reader) (*options, error) {
 			return nil, fmt.Errorf("invalid auth hash: %w", err)
 		}
 	}
+	if opts.CredentialsFile != "" && opts.CertFile == "" {
+		return nil, errors.New("must use TLS if credentials are used")
+	}
+	if opts.ClientCAFile != "" && opts.CertFile == "" {
+		return nil, errors.New("must use TLS if client certificates are required")
+	}
+	if opts.IdleTimeout != "" {
+		if opts.idleTimeout, err = time.ParseDuration(opts.IdleTimeout); err != nil {
+			return nil, fmt.Errorf("invalid idle timeout: %w", err)
+		}
+	}
+	if r := opts.Replication; r.ID != "" {
+		if _, ok := r.Peers[r.ID]; !ok {
+			return nil, fmt.Errorf("invalid replication: replica %q is not among the peers", r.ID)
+		}
+		if r.LogFile == "" {
+			return nil, errors.New("invalid replication: missing log file")
+		}
+		if r.ListenAddress == "" {
+			return nil, errors.New("invalid replication: missing listen address")
+		}
+		if (r.CertFile != "" && r.KeyFile == "") || (r.CertFile == "" && r.KeyFile != "") {
+			return nil, fmt.Errorf("invalid replication: %w", errIncompleteKeyPair)
+		}
+		if (r.CertFile == "" || r.CAFile == "") && !r.InsecureTransport {
+			return nil, errors.New("invalid replication: must specify cert file, key file and CA file, or allow insecure transport")
+		}
+	}
 	return &opts, nil
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/nicolagi/dino/storage"
 	"github.com/stretchr/testify/assert"
@@ -17,6 +19,8 @@ listen_address = ":6660"
 cert_file = "some cert file"
 key_file = "some key file"
 backend = "backend"
+change_log_size = 100
+idle_timeout = "2m"
 
 [stores]
 
@@ -40,6 +44,8 @@ type = "in-memory"
 		assert.Equal(t, "some cert file", opts.CertFile)
 		assert.Equal(t, "some key file", opts.KeyFile)
 		assert.Equal(t, "backend", opts.Backend)
+		assert.Equal(t, 100, opts.ChangeLogSize)
+		assert.Equal(t, 2*time.Minute, opts.idleTimeout)
 	})
 	t.Run("can create store", func(t *testing.T) {
 		store, err := storage.NewBuilder(opts.Stores).StoreByName(opts.Backend)
@@ -48,6 +54,77 @@ type = "in-memory"
 		_, ok := store.(storage.Paired)
 		assert.True(t, ok)
 	})
+	t.Run("invalid idle timeout", func(t *testing.T) {
+		_, err := loadOptions(strings.NewReader(`idle_timeout = "forever"`))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "invalid idle timeout")
+	})
+	t.Run("replication", func(t *testing.T) {
+		opts, err := loadOptions(strings.NewReader(`[replication]
+id = "a"
+listen_address = ":6661"
+log_file = "$HOME/lib/dino/raft.db"
+cert_file = "$HOME/lib/dino/replica.pem"
+key_file = "$HOME/lib/dino/replica.key"
+ca_file = "$HOME/lib/dino/replicas-ca.pem"
+
+[replication.peers.a]
+raft_address = "a:6661"
+client_address = "a:6660"
+
+[replication.peers.b]
+raft_address = "b:6661"
+client_address = "b:6660"
+`))
+		require.Nil(t, err)
+		assert.Equal(t, "a", opts.Replication.ID)
+		assert.Equal(t, ":6661", opts.Replication.ListenAddress)
+		assert.Equal(t, peerOptions{RaftAddress: "b:6661", ClientAddress: "b:6660"}, opts.Replication.Peers["b"])
+	})
+	t.Run("replication requires a listen address", func(t *testing.T) {
+		_, err := loadOptions(strings.NewReader(`[replication]
+id = "a"
+log_file = "raft.db"
+insecure_transport = true
+
+[replication.peers.a]
+raft_address = "a:6661"
+client_address = "a:6660"
+`))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "missing listen address")
+	})
+	t.Run("replication requires TLS unless insecure transport is allowed", func(t *testing.T) {
+		config := `[replication]
+id = "a"
+listen_address = ":6661"
+log_file = "raft.db"
+%s
+[replication.peers.a]
+raft_address = "a:6661"
+client_address = "a:6660"
+`
+		_, err := loadOptions(strings.NewReader(fmt.Sprintf(config, "")))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "allow insecure transport")
+		_, err = loadOptions(strings.NewReader(fmt.Sprintf(config, `cert_file = "replica.pem"`)))
+		require.NotNil(t, err)
+		assert.True(t, errors.Is(err, errIncompleteKeyPair), "got %v", err)
+		_, err = loadOptions(strings.NewReader(fmt.Sprintf(config, "insecure_transport = true")))
+		assert.Nil(t, err)
+	})
+	t.Run("replica not among peers", func(t *testing.T) {
+		_, err := loadOptions(strings.NewReader(`[replication]
+id = "c"
+log_file = "raft.db"
+
+[replication.peers.a]
+raft_address = "a:6661"
+client_address = "a:6660"
+`))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "invalid replication")
+	})
 	t.Run("invalid auth key", func(t *testing.T) {
 		err := quick.Check(func(s string) bool {
 			if s == "" {
@@ -66,4 +143,9 @@ type = "in-memory"
 			t.Fatal(err)
 		}
 	})
+	t.Run("client certificates require TLS", func(t *testing.T) {
+		_, err := loadOptions(strings.NewReader(`client_ca_file = "ca.pem"`))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "TLS")
+	})
 }
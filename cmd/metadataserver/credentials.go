@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nicolagi/dino/metadata/server"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentialsFile is the format of the credentials file, e.g.:
+//
+//	[users.alice]
+//	auth_hash = "$2a$10$..."
+//
+//	[[users.alice.grants]]
+//	volume = "home"
+//	access = "read-write"
+//
+//	[[users.alice.grants]]
+//	volume = "*"
+//	prefix = "shared/"
+//	access = "read-only"
+//
+// An empty volume means the default volume, and "*" means all volumes. An
+// empty prefix means all keys of the volume.
+type credentialsFile struct {
+	Users map[string]struct {
+		AuthHash string `toml:"auth_hash"`
+		Grants   []struct {
+			Volume string
+			Prefix string
+			Access string
+		}
+	}
+}
+
+var accessNames = map[string]server.Access{
+	"read-only":  server.ReadOnly,
+	"read-write": server.ReadWrite,
+}
+
+func loadCredentialsFromFile(pathname string) ([]server.User, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return loadCredentials(f)
+}
+
+// loadCredentials decodes the credentials file, sorting users by name.
+func loadCredentials(r io.Reader) ([]server.User, error) {
+	var file credentialsFile
+	decoderMetadata, err := toml.DecodeReader(r, &file)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := decoderMetadata.Undecoded(); len(undecoded) != 0 {
+		return nil, fmt.Errorf("%d undecoded keys: %v", len(undecoded), undecoded)
+	}
+	var users []server.User
+	for name, u := range file.Users {
+		if _, err := bcrypt.Cost([]byte(u.AuthHash)); err != nil {
+			return nil, fmt.Errorf("user %q: invalid auth hash: %w", name, err)
+		}
+		user := server.User{
+			Name:     name,
+			AuthHash: u.AuthHash,
+		}
+		for _, g := range u.Grants {
+			access, ok := accessNames[g.Access]
+			if !ok {
+				return nil, fmt.Errorf("user %q: invalid access %q, want read-only or read-write", name, g.Access)
+			}
+			user.Grants = append(user.Grants, server.Grant{
+				Volume: g.Volume,
+				Prefix: g.Prefix,
+				Access: access,
+			})
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users, nil
+}
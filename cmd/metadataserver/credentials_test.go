@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/dino/metadata/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCredentials(t *testing.T) {
+	b, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.Nil(t, err)
+	hash := string(b)
+	t.Run("users and grants are decoded", func(t *testing.T) {
+		users, err := loadCredentials(strings.NewReader(fmt.Sprintf(`
+[users.bob]
+auth_hash = %[1]q
+
+[users.alice]
+auth_hash = %[1]q
+
+[[users.alice.grants]]
+volume = "home"
+access = "read-write"
+
+[[users.alice.grants]]
+volume = "*"
+prefix = "shared/"
+access = "read-only"
+`, hash)))
+		require.Nil(t, err)
+		assert.Equal(t, []server.User{
+			{
+				Name:     "alice",
+				AuthHash: hash,
+				Grants: []server.Grant{
+					{Volume: "home", Access: server.ReadWrite},
+					{Volume: "*", Prefix: "shared/", Access: server.ReadOnly},
+				},
+			},
+			{
+				Name:     "bob",
+				AuthHash: hash,
+			},
+		}, users)
+	})
+	t.Run("invalid access", func(t *testing.T) {
+		_, err := loadCredentials(strings.NewReader(fmt.Sprintf(`
+[users.alice]
+auth_hash = %q
+
+[[users.alice.grants]]
+access = "write-only"
+`, hash)))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "invalid access")
+	})
+	t.Run("invalid auth hash", func(t *testing.T) {
+		_, err := loadCredentials(strings.NewReader(`
+[users.alice]
+auth_hash = "nope"
+`))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "invalid auth hash")
+	})
+	t.Run("undecoded keys", func(t *testing.T) {
+		_, err := loadCredentials(strings.NewReader(fmt.Sprintf(`
+[users.alice]
+auth_hash = %q
+role = "admin"
+`, hash)))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "undecoded keys")
+	})
+	t.Run("credentials require TLS", func(t *testing.T) {
+		_, err := loadOptions(strings.NewReader(`credentials_file = "users.toml"`))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "TLS")
+	})
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
+	"github.com/boltdb/bolt"
 	"github.com/google/gops/agent"
+	"github.com/nicolagi/dino/metadata/raft"
 	"github.com/nicolagi/dino/metadata/server"
 	"github.com/nicolagi/dino/storage"
 	log "github.com/sirupsen/logrus"
@@ -35,13 +39,11 @@ func main() {
 		defer agent.Close()
 	}
 
-	store, err := storage.NewBuilder(opts.Stores).StoreByName(opts.Backend)
+	metadataStore, err := storage.NewBuilder(opts.Stores).VersionedStoreByName(opts.Backend)
 	if err != nil {
 		log.Fatalf("Could not instantiate backend store: %v", err)
 	}
 
-	metadataStore := storage.NewVersionedWrapper(store)
-
 	srvOpts := []server.Option{
 		server.WithAddress(opts.ListenAddress),
 		server.WithVersionedStore(metadataStore),
@@ -53,9 +55,43 @@ func main() {
 			os.ExpandEnv(opts.KeyFile),
 		))
 	}
+	if opts.ClientCAFile != "" {
+		srvOpts = append(srvOpts, server.WithClientCAs(os.ExpandEnv(opts.ClientCAFile)))
+	}
 	if opts.AuthHash != "" {
 		srvOpts = append(srvOpts, server.WithAuthHash(opts.AuthHash))
 	}
+	var credentials *server.Credentials
+	if opts.CredentialsFile != "" {
+		users, err := loadCredentialsFromFile(os.ExpandEnv(opts.CredentialsFile))
+		if err != nil {
+			log.Fatalf("Loading credentials from %q: %v", opts.CredentialsFile, err)
+		}
+		credentials = server.NewCredentials(users...)
+		srvOpts = append(srvOpts, server.WithCredentials(credentials))
+	}
+	var volumes *server.Volumes
+	if opts.VolumesFile != "" {
+		registry, err := loadVolumes(os.ExpandEnv(opts.VolumesFile), opts.CertFile != "")
+		if err != nil {
+			log.Fatalf("Loading volumes from %q: %v", opts.VolumesFile, err)
+		}
+		volumes = server.NewVolumes(registry)
+		srvOpts = append(srvOpts, server.WithVolumes(volumes))
+	}
+	if opts.ChangeLogSize != 0 {
+		srvOpts = append(srvOpts, server.WithChangeLogSize(opts.ChangeLogSize))
+	}
+	if opts.IdleTimeout != "" {
+		srvOpts = append(srvOpts, server.WithIdleTimeout(opts.idleTimeout))
+	}
+	if opts.Replication.ID != "" {
+		node, clientAddresses, err := newReplica(opts.Replication)
+		if err != nil {
+			log.Fatalf("Could not set up replication: %v", err)
+		}
+		srvOpts = append(srvOpts, server.WithReplication(node, clientAddresses))
+	}
 	srv := server.New(srvOpts...)
 	addr, err := srv.Listen()
 	if err != nil {
@@ -77,7 +113,101 @@ func main() {
 		}
 	}()
 
+	if credentials != nil || volumes != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if credentials != nil {
+					reloadCredentials(os.ExpandEnv(opts.CredentialsFile), credentials)
+				}
+				if volumes != nil {
+					reloadVolumes(os.ExpandEnv(opts.VolumesFile), opts.CertFile != "", volumes)
+				}
+			}
+		}()
+	}
+
 	if err := srv.Serve(); err != nil {
 		log.Error(err)
 	}
 }
+
+// reloadCredentials reads the credentials file again. If the file can't be
+// loaded, the current credentials are kept.
+func reloadCredentials(pathname string, credentials *server.Credentials) {
+	users, err := loadCredentialsFromFile(pathname)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"file": pathname,
+		}).Error("Could not reload credentials, keeping the current ones")
+		return
+	}
+	credentials.Set(users...)
+	log.WithFields(log.Fields{
+		"file":  pathname,
+		"users": len(users),
+	}).Info("Reloaded credentials")
+}
+
+// reloadVolumes reads the volumes file again, disconnecting the clients of
+// volumes that are gone. If the file can't be loaded, the current volumes are
+// kept.
+func reloadVolumes(pathname string, tls bool, volumes *server.Volumes) {
+	registry, err := loadVolumes(pathname, tls)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"file": pathname,
+		}).Error("Could not reload volumes, keeping the current ones")
+		return
+	}
+	volumes.Set(registry)
+	log.WithFields(log.Fields{
+		"file":    pathname,
+		"volumes": len(registry),
+	}).Info("Reloaded volumes")
+}
+
+// newReplica opens the replicated log and listens for the other replicas. It
+// returns the node, and the client addresses of all replicas by node id.
+func newReplica(opts replicationOptions) (*raft.Node, map[string]string, error) {
+	file := os.ExpandEnv(opts.LogFile)
+	db, err := bolt.Open(file, 0600, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open database %q: %w", file, err)
+	}
+	raftLog, err := raft.NewBoltLog(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	peers := make(map[string]string)
+	clientAddresses := make(map[string]string)
+	for id, peer := range opts.Peers {
+		peers[id] = peer.RaftAddress
+		clientAddresses[id] = peer.ClientAddress
+	}
+	raftOpts := []raft.Option{
+		raft.WithID(opts.ID),
+		raft.WithAddress(opts.ListenAddress),
+		raft.WithPeers(peers),
+		raft.WithLog(raftLog),
+	}
+	if opts.CertFile != "" {
+		raftOpts = append(raftOpts, raft.WithKeyPair(os.ExpandEnv(opts.CertFile), os.ExpandEnv(opts.KeyFile)))
+	}
+	if opts.CAFile != "" {
+		raftOpts = append(raftOpts, raft.WithCAFile(os.ExpandEnv(opts.CAFile)))
+	}
+	if opts.InsecureTransport {
+		raftOpts = append(raftOpts, raft.WithInsecureTransport())
+	}
+	node := raft.New(raftOpts...)
+	addr, err := node.Listen()
+	if err != nil {
+		return nil, nil, err
+	}
+	log.WithFields(log.Fields{"addr": addr, "id": opts.ID}).Info("Listening for replicas")
+	return node, clientAddresses, nil
+}
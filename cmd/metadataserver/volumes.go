@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nicolagi/dino/metadata/volume"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loadVolumes reads the volumes file, as written by the dinovolumes command. A
+// missing file means there are no volumes besides the default one. Volume
+// passwords are only allowed with TLS.
+func loadVolumes(pathname string, tls bool) (volume.Registry, error) {
+	r, err := volume.LoadFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range r {
+		if v.AuthHash == "" {
+			continue
+		}
+		if !tls {
+			return nil, fmt.Errorf("volume %q: must use TLS if volumes have passwords", name)
+		}
+		if _, err := bcrypt.Cost([]byte(v.AuthHash)); err != nil {
+			return nil, fmt.Errorf("volume %q: invalid auth hash: %w", name, err)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/dino/metadata/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dino-volumes-")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	pathname := filepath.Join(dir, "volumes.json")
+	b, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.Nil(t, err)
+	save := func(t *testing.T, authHash string) volume.Registry {
+		r := make(volume.Registry)
+		_, err := r.Create("open", "")
+		require.Nil(t, err)
+		_, err = r.Create("home", authHash)
+		require.Nil(t, err)
+		require.Nil(t, r.SaveFile(pathname))
+		return r
+	}
+
+	t.Run("no file means no volumes", func(t *testing.T) {
+		r, err := loadVolumes(pathname, false)
+		require.Nil(t, err)
+		assert.Empty(t, r)
+	})
+	t.Run("volumes with passwords require TLS", func(t *testing.T) {
+		want := save(t, string(b))
+		r, err := loadVolumes(pathname, true)
+		require.Nil(t, err)
+		assert.Equal(t, want, r)
+		_, err = loadVolumes(pathname, false)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "must use TLS")
+	})
+	t.Run("invalid auth hash", func(t *testing.T) {
+		save(t, "not a hash")
+		_, err := loadVolumes(pathname, true)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "invalid auth hash")
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"sync"
 
 	"github.com/nicolagi/dino/bits"
@@ -16,16 +17,62 @@ var (
 
 	// ErrBadMessage could be returned by Encoder.Encode, which would never happen
 	// if messages are constructed via the provided helper message, e.g.,
-	// NewGetMessage.
+	// NewGetMessage. It is also returned by Decoder.Decode for get many and
+	// entries messages with malformed packed keys or entries.
 	ErrBadMessage = errors.New("bad message")
+
+	// ErrTooLarge is returned by Encoder.Encode if a key or value doesn't fit
+	// the length prefixes of the current framing, or is larger than
+	// MaxFieldSize, and by Decoder.Decode if a frame announces one that is.
+	ErrTooLarge = errors.New("too large")
 )
 
+// MaxFieldSize is the size of the largest key or value, in bytes, that can be
+// framed. Only wide framing gets there. Decoders check lengths against it
+// before making room for what follows, so that a peer can't make them
+// allocate gigabytes with a single length prefix.
+const MaxFieldSize = 16 << 20
+
 // Encoder is responsible for encoding any message to any writer (e.g., a
 // network connection, a file, a byte buffer...).
 type Encoder struct {
 	sync.Mutex
 	buf []byte
 	off int
+
+	// Whether keys and values are prefixed with 32-bit lengths instead of
+	// 16-bit ones. See CapabilityWideFraming.
+	wide bool
+
+	// Whether error messages carry error codes. See CapabilityErrorCodes.
+	codes bool
+
+	// Whether put messages carry sequence numbers. See CapabilitySequences.
+	sequences bool
+}
+
+// SetErrorCodes makes the encoder include error codes in error messages, or
+// not (the default).
+func (e *Encoder) SetErrorCodes(codes bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.codes = codes
+}
+
+// SetSequences makes the encoder include sequence numbers in put messages, or
+// not (the default).
+func (e *Encoder) SetSequences(sequences bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.sequences = sequences
+}
+
+// SetWide switches the encoder to wide framing (32-bit length prefixes) or
+// back to narrow framing (16-bit length prefixes, the default).
+func (e *Encoder) SetWide(wide bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.wide = wide
 }
 
 // Encode serializes the given message to the given writer, typically a network
@@ -35,22 +82,66 @@ type Encoder struct {
 func (e *Encoder) Encode(w io.Writer, m Message) error {
 	e.Lock()
 	defer e.Unlock()
+	if err := e.check(m); err != nil {
+		return err
+	}
+	p := e.prefixLen()
 	e.off = 0
 	e.makeroom(3)
 	e.put8(uint8(m.kind))
 	e.put16(m.tag)
 	switch m.kind {
-	case KindGet:
-		e.makeroom(e.off + 2 + len(m.key))
+	case KindGet, KindSubscribe, KindUnsubscribe:
+		e.makeroom(e.off + p + len(m.key))
 		e.puts(m.key)
 	case KindPut:
-		e.makeroom(e.off + 12 + len(m.key) + len(m.value))
+		e.makeroom(e.off + 2*p + 16 + len(m.key) + len(m.value))
 		e.puts(m.key)
 		e.puts(m.value)
 		e.put64(m.version)
-	case KindAuth, KindError:
-		e.makeroom(e.off + 2 + len(m.value))
+		if e.sequences {
+			e.put64(m.sequence)
+		}
+	case KindChanges:
+		e.makeroom(e.off + 8)
+		e.put64(m.sequence)
+	case KindPing, KindPong:
+		e.makeroom(e.off + 8)
+		e.put64(m.version)
+	case KindOption, KindLogin:
+		e.makeroom(e.off + 2*p + len(m.key) + len(m.value))
+		e.puts(m.key)
 		e.puts(m.value)
+	case KindGetIfModified:
+		e.makeroom(e.off + p + 8 + len(m.key))
+		e.puts(m.key)
+		e.put64(m.version)
+	case KindInvalidate, KindNotModified:
+		e.makeroom(e.off + p + 16 + len(m.key))
+		e.puts(m.key)
+		e.put64(m.version)
+		e.put64(m.sequence)
+	case KindAuth:
+		e.makeroom(e.off + p + len(m.value))
+		e.puts(m.value)
+	case KindError:
+		e.makeroom(e.off + p + 2 + len(m.value))
+		e.puts(m.value)
+		if e.codes {
+			e.put16(uint16(m.code))
+		}
+	case KindGetMany, KindSubscribeMany:
+		e.makeroom(e.off + p + len(m.value))
+		e.puts(m.value)
+	case KindEntries:
+		e.makeroom(e.off + p + 8 + len(m.value))
+		e.puts(m.value)
+		e.put64(m.sequence)
+	case KindHello:
+		e.makeroom(e.off + 2*p + 8 + len(m.key) + len(m.value))
+		e.puts(m.key)
+		e.puts(m.value)
+		e.put64(m.version)
 	default:
 		return ErrBadMessage
 	}
@@ -64,6 +155,28 @@ func (e *Encoder) Encode(w io.Writer, m Message) error {
 	return nil
 }
 
+// check returns ErrTooLarge if the message key or value can't be framed.
+func (e *Encoder) check(m Message) error {
+	max := int64(math.MaxUint16)
+	if e.wide {
+		max = MaxFieldSize
+	}
+	if int64(len(m.key)) > max {
+		return fmt.Errorf("key of %d bytes: %w", len(m.key), ErrTooLarge)
+	}
+	if int64(len(m.value)) > max {
+		return fmt.Errorf("value of %d bytes: %w", len(m.value), ErrTooLarge)
+	}
+	return nil
+}
+
+func (e *Encoder) prefixLen() int {
+	if e.wide {
+		return 4
+	}
+	return 2
+}
+
 func (e *Encoder) makeroom(required int) {
 	if len(e.buf) >= required {
 		return
@@ -89,8 +202,13 @@ func (e *Encoder) put64(v uint64) {
 }
 
 func (e *Encoder) puts(v string) {
-	bits.Puts(e.buf[e.off:], v)
-	e.off += 2 + len(v)
+	if e.wide {
+		bits.Puts32(e.buf[e.off:], v)
+		e.off += 4 + len(v)
+	} else {
+		bits.Puts(e.buf[e.off:], v)
+		e.off += 2 + len(v)
+	}
 }
 
 // Decoder is responsible for deserializing message from any reader (bytes to
@@ -103,6 +221,40 @@ type Decoder struct {
 	// For each Decode call, contains the first read error or underflow error.
 	// Reset to nil at the beginning of each Decode call.
 	err error
+
+	// Whether keys and values are prefixed with 32-bit lengths instead of
+	// 16-bit ones. See CapabilityWideFraming.
+	wide bool
+
+	// Whether error messages carry error codes. See CapabilityErrorCodes.
+	codes bool
+
+	// Whether put messages carry sequence numbers. See CapabilitySequences.
+	sequences bool
+}
+
+// SetErrorCodes makes the decoder expect error codes in error messages, or not
+// (the default).
+func (d *Decoder) SetErrorCodes(codes bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.codes = codes
+}
+
+// SetSequences makes the decoder expect sequence numbers in put messages, or
+// not (the default).
+func (d *Decoder) SetSequences(sequences bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.sequences = sequences
+}
+
+// SetWide switches the decoder to wide framing (32-bit length prefixes) or
+// back to narrow framing (16-bit length prefixes, the default).
+func (d *Decoder) SetWide(wide bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.wide = wide
 }
 
 // Decode deserializes bytes from the given reader into the given message. It
@@ -113,30 +265,134 @@ func (d *Decoder) Decode(r io.Reader, m *Message) error {
 	d.Lock()
 	defer d.Unlock()
 	d.err = nil
-	d.read(r, 5)
+	// Read the kind, the tag and the first length prefix (or the first bytes
+	// of the sequence number for KindChanges) in one go.
+	p := d.prefixLen()
+	d.read(r, 3+p)
 	m.kind = Kind(d.get8())
 	m.tag = d.get16()
 	switch m.kind {
-	case KindGet:
-		n := d.get16()
+	case KindGet, KindSubscribe, KindUnsubscribe:
+		n := d.getlen()
 		d.read(r, n)
 		m.key = d.gets(n)
 	case KindPut:
-		n := d.get16()
-		d.read(r, n+2)
+		n := d.getlen()
+		d.read(r, n+p)
 		m.key = d.gets(n)
-		n = d.get16()
-		d.read(r, n+8)
+		n = d.getlen()
+		if d.sequences {
+			d.read(r, n+16)
+			m.value = d.gets(n)
+			m.version = d.get64()
+			m.sequence = d.get64()
+		} else {
+			d.read(r, n+8)
+			m.value = d.gets(n)
+			m.version = d.get64()
+		}
+	case KindChanges, KindPing, KindPong:
+		// The header read above already contains the least significant bytes
+		// of the sequence number (or payload).
+		var n uint64
+		if d.wide {
+			low := uint64(d.get32())
+			d.read(r, 4)
+			n = low | uint64(d.get32())<<32
+		} else {
+			low := uint64(d.get16())
+			d.read(r, 6)
+			n = low | uint64(d.get16())<<16 | uint64(d.get32())<<32
+		}
+		if m.kind == KindChanges {
+			m.sequence = n
+		} else {
+			m.version = n
+		}
+	case KindOption, KindLogin:
+		n := d.getlen()
+		d.read(r, n+p)
+		m.key = d.gets(n)
+		n = d.getlen()
+		d.read(r, n)
 		m.value = d.gets(n)
+	case KindGetIfModified:
+		n := d.getlen()
+		d.read(r, n+8)
+		m.key = d.gets(n)
 		m.version = d.get64()
-	case KindAuth, KindError:
-		n := d.get16()
+	case KindInvalidate, KindNotModified:
+		n := d.getlen()
+		d.read(r, n+16)
+		m.key = d.gets(n)
+		m.version = d.get64()
+		m.sequence = d.get64()
+	case KindAuth:
+		n := d.getlen()
 		d.read(r, n)
 		m.value = d.gets(n)
+	case KindError:
+		n := d.getlen()
+		if d.codes {
+			d.read(r, n+2)
+			m.value = d.gets(n)
+			m.code = ErrorCode(d.get16())
+		} else {
+			d.read(r, n)
+			m.value = d.gets(n)
+		}
+	case KindGetMany, KindSubscribeMany:
+		n := d.getlen()
+		d.read(r, n)
+		m.value = d.gets(n)
+		if _, ok := unpackKeys(m.value); !ok && d.err == nil {
+			d.err = ErrBadMessage
+		}
+	case KindEntries:
+		n := d.getlen()
+		d.read(r, n+8)
+		m.value = d.gets(n)
+		m.sequence = d.get64()
+		if _, ok := unpackEntries(m.value); !ok && d.err == nil {
+			d.err = ErrBadMessage
+		}
+	case KindHello:
+		n := d.getlen()
+		d.read(r, n+p)
+		m.key = d.gets(n)
+		n = d.getlen()
+		d.read(r, n+8)
+		m.value = d.gets(n)
+		m.version = d.get64()
 	}
 	return d.err
 }
 
+func (d *Decoder) prefixLen() int {
+	if d.wide {
+		return 4
+	}
+	return 2
+}
+
+// getlen reads a length prefix. Lengths over MaxFieldSize fail decoding with
+// ErrTooLarge, and are taken as zero, so that nothing is allocated for them.
+func (d *Decoder) getlen() int {
+	var n int
+	if d.wide {
+		n = int(d.get32())
+	} else {
+		n = int(d.get16())
+	}
+	if n > MaxFieldSize {
+		if d.err == nil {
+			d.err = fmt.Errorf("field of %d bytes: %w", n, ErrTooLarge)
+		}
+		return 0
+	}
+	return n
+}
+
 func (d *Decoder) get8() uint8 {
 	v, _ := bits.Get8(d.buf[d.off:])
 	d.off++
@@ -149,21 +405,27 @@ func (d *Decoder) get16() uint16 {
 	return v
 }
 
+func (d *Decoder) get32() uint32 {
+	v, _ := bits.Get32(d.buf[d.off:])
+	d.off += 4
+	return v
+}
+
 func (d *Decoder) get64() uint64 {
 	v, _ := bits.Get64(d.buf[d.off:])
 	d.off += 8
 	return v
 }
 
-func (d *Decoder) gets(n uint16) string {
-	b := d.buf[d.off : d.off+int(n)]
-	d.off += int(n)
+func (d *Decoder) gets(n int) string {
+	b := d.buf[d.off : d.off+n]
+	d.off += n
 	return string(b)
 }
 
-func (d *Decoder) read(r io.Reader, n uint16) {
-	if uint16(len(d.buf)-d.off) < n {
-		larger := make([]byte, uint16(d.off)+n)
+func (d *Decoder) read(r io.Reader, n int) {
+	if len(d.buf)-d.off < n {
+		larger := make([]byte, d.off+n)
 		copy(larger, d.buf)
 		d.buf = larger
 	}
@@ -177,7 +439,7 @@ func (d *Decoder) read(r io.Reader, n uint16) {
 
 	var m int
 	m, d.err = io.ReadFull(r, d.buf[:n])
-	if d.err == nil && uint16(m) != n {
+	if d.err == nil && m != n {
 		d.err = fmt.Errorf("read %d of %d bytes: %w", m, n, ErrUnderflow)
 	}
 }
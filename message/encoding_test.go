@@ -2,6 +2,8 @@ package message_test
 
 import (
 	"bytes"
+	"errors"
+	"strings"
 	"testing"
 	"testing/quick"
 
@@ -22,6 +24,8 @@ func TestMessageWhatYouEncodeIsWhatYouDecode(t *testing.T) {
 			var out message.Message
 			encoder := new(message.Encoder)
 			decoder := new(message.Decoder)
+			encoder.SetSequences(true)
+			decoder.SetSequences(true)
 			assert.Nil(t, encoder.Encode(&buf, in))
 			assert.Nil(t, decoder.Decode(&buf, &out))
 			return out
@@ -34,6 +38,8 @@ func TestMessageWhatYouEncodeIsWhatYouDecode(t *testing.T) {
 		var buf bytes.Buffer
 		encoder := new(message.Encoder)
 		decoder := new(message.Decoder)
+		encoder.SetSequences(true)
+		decoder.SetSequences(true)
 		identity := func(m message.Message) message.Message {
 			return m
 		}
@@ -47,6 +53,172 @@ func TestMessageWhatYouEncodeIsWhatYouDecode(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+	t.Run("pack and unpack messages with wide framing", func(t *testing.T) {
+		var buf bytes.Buffer
+		encoder := new(message.Encoder)
+		decoder := new(message.Decoder)
+		encoder.SetWide(true)
+		decoder.SetWide(true)
+		encoder.SetSequences(true)
+		decoder.SetSequences(true)
+		identity := func(m message.Message) message.Message {
+			return m
+		}
+		packunpack := func(in message.Message) message.Message {
+			var out message.Message
+			assert.Nil(t, encoder.Encode(&buf, in))
+			assert.Nil(t, decoder.Decode(&buf, &out))
+			return out
+		}
+		if err := quick.CheckEqual(packunpack, identity, config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("large values need wide framing", func(t *testing.T) {
+		var buf bytes.Buffer
+		var out message.Message
+		in := message.NewPutMessage(42, "large", strings.Repeat("x", 70000), 1)
+		encoder := new(message.Encoder)
+		decoder := new(message.Decoder)
+		err := encoder.Encode(&buf, in)
+		assert.True(t, errors.Is(err, message.ErrTooLarge))
+		assert.Equal(t, 0, buf.Len())
+		encoder.SetWide(true)
+		decoder.SetWide(true)
+		assert.Nil(t, encoder.Encode(&buf, in))
+		assert.Nil(t, decoder.Decode(&buf, &out))
+		assert.Equal(t, in, out)
+	})
+	t.Run("fields over the maximum size are refused", func(t *testing.T) {
+		var buf bytes.Buffer
+		encoder := new(message.Encoder)
+		encoder.SetWide(true)
+		err := encoder.Encode(&buf, message.NewPutMessage(42, "large", strings.Repeat("x", message.MaxFieldSize+1), 1))
+		assert.True(t, errors.Is(err, message.ErrTooLarge), "got %v", err)
+		// A get claiming a 4 GiB key, without sending it: the decoder must
+		// fail straight away, not wait for the key or make room for it.
+		frame := []byte{byte(message.KindGet), 42, 0, 0xff, 0xff, 0xff, 0xff}
+		decoder := new(message.Decoder)
+		decoder.SetWide(true)
+		var out message.Message
+		err = decoder.Decode(bytes.NewReader(frame), &out)
+		assert.True(t, errors.Is(err, message.ErrTooLarge), "got %v", err)
+		assert.Equal(t, message.KindGet, out.Kind())
+		assert.EqualValues(t, 42, out.Tag())
+	})
+	t.Run("error codes are only sent if in use", func(t *testing.T) {
+		var buf bytes.Buffer
+		var out message.Message
+		in := message.NewCodedErrorMessage(42, message.CodeNotFound, "not found")
+		encoder := new(message.Encoder)
+		decoder := new(message.Decoder)
+		assert.Nil(t, encoder.Encode(&buf, in))
+		assert.Nil(t, decoder.Decode(&buf, &out))
+		assert.Equal(t, message.NewErrorMessage(42, "not found"), out)
+		encoder.SetErrorCodes(true)
+		decoder.SetErrorCodes(true)
+		assert.Nil(t, encoder.Encode(&buf, in))
+		assert.Nil(t, decoder.Decode(&buf, &out))
+		assert.Equal(t, in, out)
+	})
+	t.Run("sequence numbers are only sent if in use", func(t *testing.T) {
+		var buf bytes.Buffer
+		var out message.Message
+		in := message.NewPutMessage(42, "name", "mark", 666).WithSequence(7)
+		encoder := new(message.Encoder)
+		decoder := new(message.Decoder)
+		assert.Nil(t, encoder.Encode(&buf, in))
+		assert.Nil(t, decoder.Decode(&buf, &out))
+		assert.Equal(t, message.NewPutMessage(42, "name", "mark", 666), out)
+		encoder.SetSequences(true)
+		decoder.SetSequences(true)
+		assert.Nil(t, encoder.Encode(&buf, in))
+		assert.Nil(t, decoder.Decode(&buf, &out))
+		assert.Equal(t, in, out)
+	})
+	t.Run("frames are unchanged unless capabilities are in use", func(t *testing.T) {
+		// Frames as encoded before the hello message existed, which older
+		// peers still send and expect.
+		frames := []struct {
+			m     message.Message
+			frame []byte
+			want  message.Message
+		}{
+			{
+				message.NewGetMessage(0x0102, "name"),
+				[]byte{0, 2, 1, 4, 0, 'n', 'a', 'm', 'e'},
+				message.NewGetMessage(0x0102, "name"),
+			},
+			{
+				message.NewPutMessage(0x0304, "name", "mark", 0x0a0b).WithSequence(7),
+				[]byte{1, 4, 3, 4, 0, 'n', 'a', 'm', 'e', 4, 0, 'm', 'a', 'r', 'k', 0x0b, 0x0a, 0, 0, 0, 0, 0, 0},
+				message.NewPutMessage(0x0304, "name", "mark", 0x0a0b),
+			},
+			{
+				message.NewCodedErrorMessage(0x0506, message.CodeStalePut, "stale"),
+				[]byte{2, 6, 5, 5, 0, 's', 't', 'a', 'l', 'e'},
+				message.NewErrorMessage(0x0506, "stale"),
+			},
+			{
+				message.NewAuthMessage(0x0708, "pw"),
+				[]byte{3, 8, 7, 2, 0, 'p', 'w'},
+				message.NewAuthMessage(0x0708, "pw"),
+			},
+		}
+		var stream []byte
+		encoder := new(message.Encoder)
+		for _, f := range frames {
+			var buf bytes.Buffer
+			assert.Nil(t, encoder.Encode(&buf, f.m))
+			assert.Equal(t, f.frame, buf.Bytes(), "encoding %v", f.m)
+			stream = append(stream, f.frame...)
+		}
+		// Decoding back to back catches frames of the wrong length.
+		buf := bytes.NewBuffer(stream)
+		decoder := new(message.Decoder)
+		for _, f := range frames {
+			var out message.Message
+			assert.Nil(t, decoder.Decode(buf, &out))
+			assert.Equal(t, f.want, out)
+		}
+		assert.Equal(t, 0, buf.Len())
+	})
+	t.Run("wide framing only widens length prefixes", func(t *testing.T) {
+		var buf bytes.Buffer
+		var out message.Message
+		encoder := new(message.Encoder)
+		decoder := new(message.Decoder)
+		encoder.SetWide(true)
+		decoder.SetWide(true)
+		in := message.NewPutMessage(0x0304, "k", "v", 0x0a0b).WithSequence(7)
+		assert.Nil(t, encoder.Encode(&buf, in))
+		assert.Equal(t, []byte{1, 4, 3, 1, 0, 0, 0, 'k', 1, 0, 0, 0, 'v', 0x0b, 0x0a, 0, 0, 0, 0, 0, 0}, buf.Bytes())
+		assert.Nil(t, decoder.Decode(&buf, &out))
+		assert.Equal(t, message.NewPutMessage(0x0304, "k", "v", 0x0a0b), out)
+	})
+	t.Run("leader hints survive without error codes", func(t *testing.T) {
+		var buf bytes.Buffer
+		var out message.Message
+		assert.Nil(t, new(message.Encoder).Encode(&buf, message.NewNotLeaderMessage(42, "localhost:6660")))
+		assert.Nil(t, new(message.Decoder).Decode(&buf, &out))
+		leader, ok := out.NotLeader()
+		assert.True(t, ok)
+		assert.Equal(t, "localhost:6660", leader)
+		leader, ok = message.NewNotLeaderMessage(43, "").NotLeader()
+		assert.True(t, ok)
+		assert.Equal(t, "", leader)
+		_, ok = message.NewErrorMessage(44, "not found").NotLeader()
+		assert.False(t, ok)
+	})
+	t.Run("malformed packed keys", func(t *testing.T) {
+		var buf bytes.Buffer
+		var out message.Message
+		// Kind, tag, 16-bit length, then a 32-bit key length exceeding the
+		// rest of the value.
+		buf.Write([]byte{byte(message.KindGetMany), 1, 0, 5, 0, 9, 0, 0, 0, 'x'})
+		err := new(message.Decoder).Decode(&buf, &out)
+		assert.True(t, errors.Is(err, message.ErrBadMessage))
+	})
 	t.Run("conversion to string", func(t *testing.T) {
 		assert.Equal(t,
 			"kind=GET tag=42 key=name",
@@ -56,6 +228,50 @@ func TestMessageWhatYouEncodeIsWhatYouDecode(t *testing.T) {
 			"kind=PUT tag=43 key=name value=mark version=666",
 			message.NewPutMessage(43, "name", "mark", 666).String(),
 		)
+		assert.Equal(t,
+			"kind=PUT tag=43 key=name value=mark version=666 sequence=7",
+			message.NewPutMessage(43, "name", "mark", 666).WithSequence(7).String(),
+		)
+		assert.Equal(t,
+			"kind=CHANGES tag=47 sequence=8",
+			message.NewChangesMessage(47, 8).String(),
+		)
+		assert.Equal(t,
+			"kind=SUBSCRIBE tag=48 key=name",
+			message.NewSubscribeMessage(48, "name").String(),
+		)
+		assert.Equal(t,
+			"kind=INVALIDATE tag=0 key=name version=666 sequence=7",
+			message.NewPutMessage(43, "name", "mark", 666).WithSequence(7).ForInvalidation().String(),
+		)
+		assert.Equal(t,
+			"kind=ERROR tag=52 code=NOTFOUND value=not found",
+			message.NewCodedErrorMessage(52, message.CodeNotFound, "not found").String(),
+		)
+		assert.Equal(t,
+			"kind=GETMANY tag=53 keys=2",
+			message.NewGetManyMessage(53, []string{"name", "genre"}).String(),
+		)
+		assert.Equal(t,
+			"kind=SUBSCRIBEMANY tag=55 keys=3",
+			message.NewSubscribeManyMessage(55, []string{"name", "genre", "year"}).String(),
+		)
+		assert.Equal(t,
+			"kind=ENTRIES tag=54 entries=1 sequence=9",
+			message.NewEntriesMessage(54, []message.Entry{{Key: "name", Value: "mark", Version: 1}}).WithSequence(9).String(),
+		)
+		assert.Equal(t,
+			`kind=HELLO tag=51 protocol=1 peer=tony capabilities="wide-framing"`,
+			message.NewHelloMessage(51, 1, "tony", []string{"wide-framing"}).String(),
+		)
+		assert.Equal(t,
+			"kind=GETIFMODIFIED tag=49 key=name version=665",
+			message.NewGetIfModifiedMessage(49, "name", 665).String(),
+		)
+		assert.Equal(t,
+			"kind=OPTION tag=50 key=broadcast value=invalida...",
+			message.NewOptionMessage(50, message.OptionBroadcast, message.BroadcastInvalidations).String(),
+		)
 		assert.Equal(t,
 			"kind=ERROR tag=44 value=neutrino...",
 			message.NewErrorMessage(44, "neutrinos hit the memory bank").String(),
@@ -0,0 +1,86 @@
+package message
+
+import "github.com/nicolagi/dino/bits"
+
+// Entry is a key-value pair with its version, as carried by entries messages.
+type Entry struct {
+	Key     string
+	Value   string
+	Version uint64
+}
+
+// The keys of get many messages and the entries of entries messages are packed
+// in the message value, with 32-bit length prefixes regardless of the framing.
+
+func packKeys(keys []string) string {
+	size := 0
+	for _, key := range keys {
+		size += 4 + len(key)
+	}
+	buf := make([]byte, size)
+	b := buf
+	for _, key := range keys {
+		b = bits.Puts32(b, key)
+	}
+	return string(buf)
+}
+
+func packEntries(entries []Entry) string {
+	size := 0
+	for _, e := range entries {
+		size += 16 + len(e.Key) + len(e.Value)
+	}
+	buf := make([]byte, size)
+	b := buf
+	for _, e := range entries {
+		b = bits.Puts32(b, e.Key)
+		b = bits.Puts32(b, e.Value)
+		b = bits.Put64(b, e.Version)
+	}
+	return string(buf)
+}
+
+// unpackKeys returns false if the packed keys are malformed.
+func unpackKeys(packed string) (keys []string, ok bool) {
+	b := []byte(packed)
+	for len(b) > 0 {
+		var key string
+		if key, b, ok = unpackString(b); !ok {
+			return nil, false
+		}
+		keys = append(keys, key)
+	}
+	return keys, true
+}
+
+// unpackEntries returns false if the packed entries are malformed.
+func unpackEntries(packed string) (entries []Entry, ok bool) {
+	b := []byte(packed)
+	for len(b) > 0 {
+		var e Entry
+		if e.Key, b, ok = unpackString(b); !ok {
+			return nil, false
+		}
+		if e.Value, b, ok = unpackString(b); !ok {
+			return nil, false
+		}
+		if len(b) < 8 {
+			return nil, false
+		}
+		e.Version, b = bits.Get64(b)
+		entries = append(entries, e)
+	}
+	return entries, true
+}
+
+func unpackString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	n, rest := bits.Get32(b)
+	if uint64(len(rest)) < uint64(n) {
+		return "", nil, false
+	}
+	s, rest := bits.Gets32(b)
+	return s, rest, true
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"strings"
 	"unicode"
 )
 
@@ -42,9 +43,243 @@ const (
 	// not match, the server response will be of KindError.
 	KindAuth
 
+	// KindChanges is sent from client to server with the sequence number of
+	// the last accepted put the client knows about, typically after
+	// reconnecting. The server replays all accepted puts with a higher sequence
+	// number as broadcast messages, then responds with a message of this kind
+	// carrying its current sequence number. If the server's change log no
+	// longer goes back far enough, it responds with an error message instead,
+	// and the client should consider its cached values stale.
+	KindChanges
+
+	// KindSubscribe is sent from client to server to ask for broadcasts of
+	// accepted puts for the given key. The server responds with the same
+	// message. Clients that never subscribe receive broadcasts for all keys,
+	// while clients that subscribe receive broadcasts only for the keys they
+	// are subscribed to.
+	KindSubscribe
+
+	// KindUnsubscribe is sent from client to server to stop receiving
+	// broadcasts for the given key. The server responds with the same message.
+	KindUnsubscribe
+
+	// KindOption is sent from client to server to set an option for the
+	// connection, with the option name as the key and the option value as the
+	// value. The server responds with the same message, or with an error
+	// message if the option or its value are unknown. See OptionBroadcast.
+	KindOption
+
+	// KindInvalidate is broadcast by the server, in place of a put message,
+	// to the connections that asked for invalidations only. It carries the key
+	// and the version of the accepted put, but not the value.
+	KindInvalidate
+
+	// KindGetIfModified is sent from client to server like a get message, but
+	// also carries the version of the value the client already has. If that's
+	// still the latest version, the server responds with a not modified
+	// message, otherwise as it would respond to a get message.
+	KindGetIfModified
+
+	// KindNotModified is only sent from the server to the client, in response
+	// to a get if modified message, carrying the key and version from the
+	// request.
+	KindNotModified
+
+	// KindHello is the first message sent by the client on a new connection,
+	// even before the auth message. It carries the highest protocol version
+	// the client speaks as the version, the client id (e.g., its hostname) as
+	// the key, and the capabilities the client supports as the value. The
+	// server responds with a hello message carrying the protocol version to
+	// use, its own id, and the capabilities both sides support; these take
+	// effect right after the response. If the server can't speak any
+	// protocol version the client speaks, it responds with an error message
+	// and closes the connection. Protocol version zero is what was spoken
+	// before this message existed: no capabilities are in use, so messages are
+	// framed as they were back then (e.g., put messages carry no sequence
+	// numbers). Servers speak it to clients that never send a hello message.
+	// Clients speak it, on a new connection, to servers that respond to the
+	// hello message as servers predating it do, with an error message saying
+	// they don't know the kind, and then only send get, put and auth
+	// messages.
+	KindHello
+
+	// KindGetMany is sent from client to server like a get message, but for
+	// many keys at once, packed in the value. The server responds with an
+	// entries message, or with an error message. Only send it to servers
+	// supporting CapabilityGetMany.
+	KindGetMany
+
+	// KindEntries is only sent from the server to the client, in response to
+	// a get many message. It carries the keys, values and versions of the
+	// requested keys that the server knows about, packed in the value, and the
+	// latest change log sequence number at the time of the read.
+	KindEntries
+
+	// KindPing is sent from client to server to check the connection is
+	// still alive, carrying an arbitrary payload (e.g., the time it was sent).
+	// The server responds with a pong message carrying the same payload.
+	// Pings are answered even before the auth message. Only send them to
+	// servers supporting CapabilityPing.
+	KindPing
+
+	// KindPong is only sent from the server to the client, in response to a
+	// ping message.
+	KindPong
+
+	// KindLogin is like KindAuth, but also carries a user name as the key, so
+	// that the server can grant the client the access it grants that user
+	// rather than full access. The server responds with an auth message, or
+	// with an error message. Only send it to servers supporting
+	// CapabilityUsers.
+	KindLogin
+
+	// KindSubscribeMany is like KindSubscribe, but for many keys at once,
+	// packed in the value like in a get many message. The server responds
+	// with the same message. Only send it to servers supporting
+	// CapabilitySubscribeMany.
+	KindSubscribeMany
+
 	kindCount
 )
 
+const (
+	// OptionBroadcast is the name of the option that controls what the server
+	// broadcasts to a connection upon accepted puts: BroadcastPuts (the
+	// default) or BroadcastInvalidations.
+	OptionBroadcast = "broadcast"
+
+	// BroadcastPuts means put messages, carrying values, are broadcast.
+	BroadcastPuts = "puts"
+
+	// BroadcastInvalidations means invalidate messages, carrying only keys
+	// and versions, are broadcast.
+	BroadcastInvalidations = "invalidations"
+
+	// OptionVolume is the name of the option that picks the volume, i.e., the
+	// key space, the connection works on. Unlike other options, it must be
+	// set before the auth message, since each volume has its own password,
+	// and before any other request. If never set, the connection works on
+	// the default volume. Servers accept unknown volumes like volumes with a
+	// password, and only tell clients the volume doesn't exist, with a
+	// CodeNotFound error, in response to an auth or login message that
+	// would otherwise have succeeded.
+	OptionVolume = "volume"
+)
+
+const (
+	// ProtocolVersion is the highest protocol version this package speaks.
+	// Version 1 introduced the hello message.
+	ProtocolVersion = 1
+
+	// MinProtocolVersion is the lowest protocol version this package speaks
+	// in a hello message. (Clients not sending any hello message at all are
+	// still served, see KindHello.)
+	MinProtocolVersion = 1
+
+	// CapabilityWideFraming means keys and values are prefixed with 32-bit
+	// lengths instead of 16-bit ones, lifting the 64 KiB limit. Nothing else
+	// about the framing changes: e.g., put messages only carry sequence
+	// numbers with CapabilitySequences.
+	CapabilityWideFraming = "wide-framing"
+
+	// CapabilityErrorCodes means error messages carry an ErrorCode besides
+	// the textual description of the error.
+	CapabilityErrorCodes = "error-codes"
+
+	// CapabilityGetMany means the server understands get many messages.
+	CapabilityGetMany = "get-many"
+
+	// CapabilityPing means the server answers ping messages, and the client
+	// sends them often enough that the server can close the connection if it
+	// receives nothing for a while.
+	CapabilityPing = "ping"
+
+	// CapabilityUsers means the server understands login messages.
+	CapabilityUsers = "users"
+
+	// CapabilitySequences means put messages carry, after the version, the
+	// change log sequence number assigned to the put. Without it, put
+	// messages are framed as before the change log existed.
+	CapabilitySequences = "sequences"
+
+	// CapabilitySubscribeMany means the server understands subscribe many
+	// messages.
+	CapabilitySubscribeMany = "subscribe-many"
+)
+
+// ErrorCode tells what kind of error an error message is about, so that clients
+// need not interpret the textual description of the error.
+type ErrorCode uint16
+
+const (
+	// CodeUnknown is used for errors not falling in any other category, and
+	// is what error messages carry if error codes aren't in use.
+	CodeUnknown ErrorCode = iota
+
+	// CodeStalePut means the version in a put message is not the one
+	// following the latest version known to the server.
+	CodeStalePut
+
+	// CodeNotFound means the key in a get message is not known.
+	CodeNotFound
+
+	// CodeUnauthorized means the message was refused because of a missing or
+	// failed authorization.
+	CodeUnauthorized
+
+	// CodeBadRequest means the server can't make sense of the message, e.g.,
+	// a message of a kind that should only be sent from server to client.
+	CodeBadRequest
+
+	// CodeTooLarge means the response doesn't fit the framing in use.
+	CodeTooLarge
+
+	// CodeBusy means the server can't serve the request right now, and the
+	// client might retry later.
+	CodeBusy
+
+	// CodeChangeLogTruncated means the server's change log no longer goes
+	// back to the sequence number in a changes message.
+	CodeChangeLogTruncated
+
+	// CodeNotLeader means the server is a replica that isn't currently the
+	// leader of its group, and the client should turn to the leader. See
+	// NewNotLeaderMessage.
+	CodeNotLeader
+
+	// CodeForbidden means the client is authorized, but the user it logged in
+	// as may not access the key, or not for writing.
+	CodeForbidden
+)
+
+// String implements fmt.Stringer.
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeUnknown:
+		return "UNKNOWN"
+	case CodeStalePut:
+		return "STALEPUT"
+	case CodeNotFound:
+		return "NOTFOUND"
+	case CodeUnauthorized:
+		return "UNAUTHORIZED"
+	case CodeBadRequest:
+		return "BADREQUEST"
+	case CodeTooLarge:
+		return "TOOLARGE"
+	case CodeBusy:
+		return "BUSY"
+	case CodeChangeLogTruncated:
+		return "CHANGELOGTRUNCATED"
+	case CodeNotLeader:
+		return "NOTLEADER"
+	case CodeForbidden:
+		return "FORBIDDEN"
+	default:
+		return fmt.Sprintf("CODE%d", uint16(c))
+	}
+}
+
 // String implements fmt.Stringer.
 func (k Kind) String() string {
 	switch k {
@@ -56,6 +291,34 @@ func (k Kind) String() string {
 		return "ERROR"
 	case KindAuth:
 		return "AUTH"
+	case KindChanges:
+		return "CHANGES"
+	case KindSubscribe:
+		return "SUBSCRIBE"
+	case KindUnsubscribe:
+		return "UNSUBSCRIBE"
+	case KindOption:
+		return "OPTION"
+	case KindInvalidate:
+		return "INVALIDATE"
+	case KindGetIfModified:
+		return "GETIFMODIFIED"
+	case KindNotModified:
+		return "NOTMODIFIED"
+	case KindHello:
+		return "HELLO"
+	case KindGetMany:
+		return "GETMANY"
+	case KindEntries:
+		return "ENTRIES"
+	case KindPing:
+		return "PING"
+	case KindPong:
+		return "PONG"
+	case KindLogin:
+		return "LOGIN"
+	case KindSubscribeMany:
+		return "SUBSCRIBEMANY"
 	default:
 		return "UNKNOWN"
 	}
@@ -71,15 +334,35 @@ type Message struct {
 	// reserved for broadcast messages (those that are not responses to requests).
 	tag uint16
 
-	// The key to get or put. Meaningful for get and put messages only.
+	// The key to get, put, subscribe to or unsubscribe from. Meaningful for
+	// messages of those kinds only. Doubles as the option name in option
+	// messages, as the peer id in hello messages, and as the user name in
+	// login messages.
 	key string
 
 	// The value for a put message; doubles as a textual description of the error
-	// for error messages, and as the password in auth messages.
+	// for error messages, as the password in auth and login messages, as the option
+	// value in option messages, as the space-separated capabilities in hello
+	// messages, and as the packed keys or entries in get many, subscribe many
+	// and entries messages.
 	value string
 
-	// Version of the value. Meaningful only for put messages.
+	// Version of the value. Meaningful only for put, invalidate, get if
+	// modified and not modified messages. Doubles as the protocol version in
+	// hello messages, and as the payload in ping and pong messages.
 	version uint64
+
+	// Position of an accepted put in the server's change log. Put messages
+	// from the server carry the sequence number assigned to the put (for
+	// responses to puts and broadcasts) or the latest sequence number at the
+	// time of the read (for responses to gets). Changes messages carry the
+	// sequence number to replay from (requests) or the latest sequence number
+	// (responses). Zero means unknown.
+	sequence uint64
+
+	// What kind of error an error message is about. Meaningful only for error
+	// messages.
+	code ErrorCode
 }
 
 func repr(any string) string {
@@ -103,15 +386,40 @@ func repr(any string) string {
 // runes (not necessarily 10 bytes).
 func (m Message) String() string {
 	switch m.kind {
-	case KindGet:
+	case KindGet, KindSubscribe, KindUnsubscribe:
 		return fmt.Sprintf("kind=%v tag=%d key=%s", m.kind, m.tag, repr(m.key))
 	case KindError:
+		if m.code != CodeUnknown {
+			return fmt.Sprintf("kind=%v tag=%d code=%v value=%s", m.kind, m.tag, m.code, repr(m.value))
+		}
 		return fmt.Sprintf("kind=%v tag=%d value=%s", m.kind, m.tag, repr(m.value))
 	case KindAuth:
 		return fmt.Sprintf("kind=%v tag=%d value=%t", m.kind, m.tag, m.value != "")
+	case KindLogin:
+		return fmt.Sprintf("kind=%v tag=%d user=%s value=%t", m.kind, m.tag, repr(m.key), m.value != "")
+	case KindChanges:
+		return fmt.Sprintf("kind=%v tag=%d sequence=%d", m.kind, m.tag, m.sequence)
+	case KindOption:
+		return fmt.Sprintf("kind=%v tag=%d key=%s value=%s", m.kind, m.tag, repr(m.key), repr(m.value))
+	case KindGetIfModified:
+		return fmt.Sprintf("kind=%v tag=%d key=%s version=%d", m.kind, m.tag, repr(m.key), m.version)
+	case KindInvalidate, KindNotModified:
+		return fmt.Sprintf("kind=%v tag=%d key=%s version=%d sequence=%d", m.kind, m.tag, repr(m.key), m.version, m.sequence)
+	case KindHello:
+		return fmt.Sprintf("kind=%v tag=%d protocol=%d peer=%s capabilities=%q", m.kind, m.tag, m.version, repr(m.key), m.value)
+	case KindGetMany, KindSubscribeMany:
+		return fmt.Sprintf("kind=%v tag=%d keys=%d", m.kind, m.tag, len(m.Keys()))
+	case KindEntries:
+		return fmt.Sprintf("kind=%v tag=%d entries=%d sequence=%d", m.kind, m.tag, len(m.Entries()), m.sequence)
+	case KindPing, KindPong:
+		return fmt.Sprintf("kind=%v tag=%d payload=%d", m.kind, m.tag, m.version)
 	default:
 		// KindPut and unknown messages use all fields.
-		return fmt.Sprintf("kind=%v tag=%d key=%s value=%s version=%d", m.kind, m.tag, repr(m.key), repr(m.value), m.version)
+		s := fmt.Sprintf("kind=%v tag=%d key=%s value=%s version=%d", m.kind, m.tag, repr(m.key), repr(m.value), m.version)
+		if m.sequence != 0 {
+			s += fmt.Sprintf(" sequence=%d", m.sequence)
+		}
+		return s
 	}
 }
 
@@ -127,11 +435,13 @@ func (m Message) Tag() uint16 {
 	return m.tag
 }
 
-// Key returns a key-value pair's key from the message. Call only for
-// KindGet and KindPut, else it'll panic.
+// Key returns a key-value pair's key from the message, or the option name for
+// KindOption. Call only for KindGet, KindPut, KindSubscribe, KindUnsubscribe,
+// KindOption, KindInvalidate, KindGetIfModified and KindNotModified, else it'll
+// panic.
 func (m Message) Key() string {
 	switch m.kind {
-	case KindGet, KindPut:
+	case KindGet, KindPut, KindSubscribe, KindUnsubscribe, KindOption, KindInvalidate, KindGetIfModified, KindNotModified:
 		return m.key
 	default:
 		panic(m.accessorPanic("Key"))
@@ -139,27 +449,150 @@ func (m Message) Key() string {
 }
 
 // Value returns a key-value pair's value from the message. Call only for
-// KindAuth, KindError and KindPut, else it'll panic.
+// KindAuth, KindLogin, KindError, KindPut and KindOption, else it'll panic.
 func (m Message) Value() string {
 	switch m.kind {
-	case KindAuth, KindError, KindPut:
+	case KindAuth, KindLogin, KindError, KindPut, KindOption:
 		return m.value
 	default:
 		panic(m.accessorPanic("Value"))
 	}
 }
 
-// Version returns the version of a key-value pair. Call only for KindPut
-// messages, or it'll panic.
+// User returns the user name in a login message. Call only for KindLogin,
+// else it'll panic.
+func (m Message) User() string {
+	if m.kind != KindLogin {
+		panic(m.accessorPanic("User"))
+	}
+	return m.key
+}
+
+// Version returns the version of a key-value pair. Call only for KindPut,
+// KindInvalidate, KindGetIfModified and KindNotModified messages, or it'll
+// panic. (See ProtocolVersion for hello messages.)
 func (m Message) Version() uint64 {
 	switch m.kind {
-	case KindPut:
+	case KindPut, KindInvalidate, KindGetIfModified, KindNotModified:
 		return m.version
 	default:
 		panic(m.accessorPanic("Version"))
 	}
 }
 
+// Sequence returns the change log sequence number carried by the message. Call
+// only for KindPut, KindChanges, KindInvalidate, KindNotModified and
+// KindEntries messages, or it'll panic.
+func (m Message) Sequence() uint64 {
+	switch m.kind {
+	case KindPut, KindChanges, KindInvalidate, KindNotModified, KindEntries:
+		return m.sequence
+	default:
+		panic(m.accessorPanic("Sequence"))
+	}
+}
+
+// WithTag returns a copy of the message with the given tag. Used by clients
+// that assign tags to requests as they are sent.
+func (m Message) WithTag(tag uint16) Message {
+	m.tag = tag
+	return m
+}
+
+// WithKey returns a copy of the message with the given key. Used by the server
+// to map keys between a volume and the underlying key space. Call only for the
+// message kinds Key can be called for, or it'll panic.
+func (m Message) WithKey(key string) Message {
+	switch m.kind {
+	case KindGet, KindPut, KindSubscribe, KindUnsubscribe, KindOption, KindInvalidate, KindGetIfModified, KindNotModified:
+		m.key = key
+		return m
+	default:
+		panic(m.accessorPanic("WithKey"))
+	}
+}
+
+// WithSequence returns a copy of the message carrying the given sequence
+// number. Used by the server to stamp put messages with their position in the
+// change log. Call only for KindPut, KindChanges, KindInvalidate,
+// KindNotModified and KindEntries messages, or it'll panic.
+func (m Message) WithSequence(sequence uint64) Message {
+	switch m.kind {
+	case KindPut, KindChanges, KindInvalidate, KindNotModified, KindEntries:
+		m.sequence = sequence
+		return m
+	default:
+		panic(m.accessorPanic("WithSequence"))
+	}
+}
+
+// ErrorCode returns the error code of an error message. Call only for KindError
+// messages, or it'll panic.
+func (m Message) ErrorCode() ErrorCode {
+	if m.kind != KindError {
+		panic(m.accessorPanic("ErrorCode"))
+	}
+	return m.code
+}
+
+// Keys returns the keys of a get many or subscribe many message. Call only for
+// KindGetMany and KindSubscribeMany messages, or it'll panic.
+func (m Message) Keys() []string {
+	if m.kind != KindGetMany && m.kind != KindSubscribeMany {
+		panic(m.accessorPanic("Keys"))
+	}
+	keys, _ := unpackKeys(m.value)
+	return keys
+}
+
+// Entries returns the entries of an entries message. Call only for KindEntries
+// messages, or it'll panic.
+func (m Message) Entries() []Entry {
+	if m.kind != KindEntries {
+		panic(m.accessorPanic("Entries"))
+	}
+	entries, _ := unpackEntries(m.value)
+	return entries
+}
+
+// ProtocolVersion returns the protocol version of a hello message. Call only for
+// KindHello messages, or it'll panic.
+func (m Message) ProtocolVersion() uint64 {
+	if m.kind != KindHello {
+		panic(m.accessorPanic("ProtocolVersion"))
+	}
+	return m.version
+}
+
+// Peer returns the id of the sender of a hello message. Call only for KindHello
+// messages, or it'll panic.
+func (m Message) Peer() string {
+	if m.kind != KindHello {
+		panic(m.accessorPanic("Peer"))
+	}
+	return m.key
+}
+
+// Capabilities returns the capabilities in a hello message. Call only for
+// KindHello messages, or it'll panic.
+func (m Message) Capabilities() []string {
+	if m.kind != KindHello {
+		panic(m.accessorPanic("Capabilities"))
+	}
+	return strings.Fields(m.value)
+}
+
+// Payload returns the payload of a ping or pong message. Call only for KindPing
+// and KindPong messages, or it'll panic.
+func (m Message) Payload() uint64 {
+	switch m.kind {
+	case KindPing, KindPong:
+		return m.version
+	default:
+		panic(m.accessorPanic("Payload"))
+	}
+}
+
 func (m Message) accessorPanic(accessorName string) string {
 	return fmt.Sprintf("cannot call .%s for message of kind %v", accessorName, m.kind)
 }
@@ -193,6 +626,52 @@ func NewErrorMessage(tag uint16, message string) Message {
 	}
 }
 
+// NewCodedErrorMessage constructs a message of KindError kind carrying an error
+// code.
+func NewCodedErrorMessage(tag uint16, code ErrorCode, message string) Message {
+	return Message{
+		kind:  KindError,
+		tag:   tag,
+		value: message,
+		code:  code,
+	}
+}
+
+// The textual description of not leader errors, which the leader hint
+// follows, if any.
+const notLeader = "not leader"
+const notLeaderHint = notLeader + ", try "
+
+// NewNotLeaderMessage constructs an error message refusing a request, or a
+// hello message, sent to a replica that isn't the leader. The address of the
+// leader, if known, is carried as a hint in the textual description, so that
+// it is available also before error codes are agreed upon.
+func NewNotLeaderMessage(tag uint16, leader string) Message {
+	value := notLeader
+	if leader != "" {
+		value = notLeaderHint + leader
+	}
+	return NewCodedErrorMessage(tag, CodeNotLeader, value)
+}
+
+// NotLeader tells whether the message is an error message constructed by
+// NewNotLeaderMessage, and returns the leader address it carries, if any.
+func (m Message) NotLeader() (leader string, ok bool) {
+	if m.kind != KindError {
+		return "", false
+	}
+	if m.code != CodeNotLeader && m.code != CodeUnknown {
+		return "", false
+	}
+	if m.value == notLeader {
+		return "", true
+	}
+	if strings.HasPrefix(m.value, notLeaderHint) {
+		return strings.TrimPrefix(m.value, notLeaderHint), true
+	}
+	return "", false
+}
+
 func NewAuthMessage(tag uint16, password string) Message {
 	return Message{
 		kind:  KindAuth,
@@ -201,6 +680,129 @@ func NewAuthMessage(tag uint16, password string) Message {
 	}
 }
 
+// NewLoginMessage constructs a message of KindLogin kind.
+func NewLoginMessage(tag uint16, user string, password string) Message {
+	return Message{
+		kind:  KindLogin,
+		tag:   tag,
+		key:   user,
+		value: password,
+	}
+}
+
+// NewChangesMessage constructs a message of KindChanges kind.
+func NewChangesMessage(tag uint16, sequence uint64) Message {
+	return Message{
+		kind:     KindChanges,
+		tag:      tag,
+		sequence: sequence,
+	}
+}
+
+// NewSubscribeMessage constructs a message of KindSubscribe kind.
+func NewSubscribeMessage(tag uint16, key string) Message {
+	return Message{
+		kind: KindSubscribe,
+		tag:  tag,
+		key:  key,
+	}
+}
+
+// NewUnsubscribeMessage constructs a message of KindUnsubscribe kind.
+func NewUnsubscribeMessage(tag uint16, key string) Message {
+	return Message{
+		kind: KindUnsubscribe,
+		tag:  tag,
+		key:  key,
+	}
+}
+
+// NewOptionMessage constructs a message of KindOption kind.
+func NewOptionMessage(tag uint16, name string, value string) Message {
+	return Message{
+		kind:  KindOption,
+		tag:   tag,
+		key:   name,
+		value: value,
+	}
+}
+
+// NewGetIfModifiedMessage constructs a message of KindGetIfModified kind.
+func NewGetIfModifiedMessage(tag uint16, key string, version uint64) Message {
+	return Message{
+		kind:    KindGetIfModified,
+		tag:     tag,
+		key:     key,
+		version: version,
+	}
+}
+
+// NewNotModifiedMessage constructs a message of KindNotModified kind.
+func NewNotModifiedMessage(tag uint16, key string, version uint64) Message {
+	return Message{
+		kind:    KindNotModified,
+		tag:     tag,
+		key:     key,
+		version: version,
+	}
+}
+
+// NewHelloMessage constructs a message of KindHello kind.
+func NewHelloMessage(tag uint16, protocolVersion uint64, peer string, capabilities []string) Message {
+	return Message{
+		kind:    KindHello,
+		tag:     tag,
+		key:     peer,
+		value:   strings.Join(capabilities, " "),
+		version: protocolVersion,
+	}
+}
+
+// NewGetManyMessage constructs a message of KindGetMany kind.
+func NewGetManyMessage(tag uint16, keys []string) Message {
+	return Message{
+		kind:  KindGetMany,
+		tag:   tag,
+		value: packKeys(keys),
+	}
+}
+
+// NewSubscribeManyMessage constructs a message of KindSubscribeMany kind.
+func NewSubscribeManyMessage(tag uint16, keys []string) Message {
+	return Message{
+		kind:  KindSubscribeMany,
+		tag:   tag,
+		value: packKeys(keys),
+	}
+}
+
+// NewEntriesMessage constructs a message of KindEntries kind.
+func NewEntriesMessage(tag uint16, entries []Entry) Message {
+	return Message{
+		kind:  KindEntries,
+		tag:   tag,
+		value: packEntries(entries),
+	}
+}
+
+// NewPingMessage constructs a message of KindPing kind.
+func NewPingMessage(tag uint16, payload uint64) Message {
+	return Message{
+		kind:    KindPing,
+		tag:     tag,
+		version: payload,
+	}
+}
+
+// NewPongMessage constructs a message of KindPong kind.
+func NewPongMessage(tag uint16, payload uint64) Message {
+	return Message{
+		kind:    KindPong,
+		tag:     tag,
+		version: payload,
+	}
+}
+
 // ForBroadcast returns a copy of the message that's suitable to be broadcasted to
 // many connections.
 func (m Message) ForBroadcast() Message {
@@ -211,6 +813,20 @@ func (m Message) ForBroadcast() Message {
 	return m
 }
 
+// ForInvalidation returns an invalidate message for a put message, suitable to
+// be broadcasted to the connections that asked for invalidations only.
+func (m Message) ForInvalidation() Message {
+	if m.kind != KindPut {
+		panic(fmt.Sprintf("attempting to invalidate with a message of kind: %v", m.kind))
+	}
+	return Message{
+		kind:     KindInvalidate,
+		key:      m.key,
+		version:  m.version,
+		sequence: m.sequence,
+	}
+}
+
 // RandomTag is a test helper.
 func RandomTag() uint16 {
 	return uint16(rand.Int() % 65536)
@@ -241,7 +857,7 @@ func (Message) Generate(rand *rand.Rand, size int) reflect.Value {
 	m.kind = Kind(rand.Uint32()) % kindCount
 	m.tag = uint16(rand.Uint32() % 65536)
 	switch m.kind {
-	case KindGet:
+	case KindGet, KindSubscribe, KindUnsubscribe:
 		rand.Read(b)
 		m.key = string(b)
 	case KindPut:
@@ -250,9 +866,52 @@ func (Message) Generate(rand *rand.Rand, size int) reflect.Value {
 		rand.Read(b)
 		m.value = string(b)
 		m.version = rand.Uint64()
+		m.sequence = rand.Uint64()
+	case KindChanges:
+		m.sequence = rand.Uint64()
+	case KindOption, KindLogin:
+		rand.Read(b)
+		m.key = string(b)
+		rand.Read(b)
+		m.value = string(b)
+	case KindGetIfModified:
+		rand.Read(b)
+		m.key = string(b)
+		m.version = rand.Uint64()
+	case KindInvalidate, KindNotModified:
+		rand.Read(b)
+		m.key = string(b)
+		m.version = rand.Uint64()
+		m.sequence = rand.Uint64()
 	case KindAuth, KindError:
 		rand.Read(b)
 		m.value = string(b)
+	case KindHello:
+		rand.Read(b)
+		m.key = string(b)
+		rand.Read(b)
+		m.value = string(b)
+		m.version = rand.Uint64()
+	case KindGetMany, KindSubscribeMany:
+		keys := make([]string, rand.Intn(4))
+		for i := range keys {
+			rand.Read(b)
+			keys[i] = string(b)
+		}
+		m.value = packKeys(keys)
+	case KindEntries:
+		entries := make([]Entry, rand.Intn(4))
+		for i := range entries {
+			rand.Read(b)
+			entries[i].Key = string(b)
+			rand.Read(b)
+			entries[i].Value = string(b)
+			entries[i].Version = rand.Uint64()
+		}
+		m.value = packEntries(entries)
+		m.sequence = rand.Uint64()
+	case KindPing, KindPong:
+		m.version = rand.Uint64()
 	default:
 		panic("programmer error")
 	}
@@ -2,8 +2,12 @@ package client
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -13,28 +17,119 @@ import (
 
 var (
 	ErrTimeout = errors.New("timeout")
+
+	// ErrIncompatible is returned if the server responds to the handshake
+	// with a protocol version this package doesn't speak, or refuses it.
+	ErrIncompatible = errors.New("incompatible server")
+
+	// errLegacy is returned by the handshake if the server doesn't
+	// understand hello messages.
+	errLegacy = errors.New("server does not understand hello messages")
+
+	// legacyRefusals are the errors servers predating the handshake respond
+	// to hello messages with: they don't know the kind, or, when requiring
+	// authorization, any kind but auth. Any other error is a refusal from a
+	// server that does understand the handshake.
+	legacyRefusals = []string{"unknown message kind", "go away, bad message type"}
+
+	// ErrNotLeader is returned if the server refuses the handshake because
+	// it's a replica that isn't the leader, and no other server could be
+	// connected to.
+	ErrNotLeader = errors.New("not leader")
 )
 
+// Capabilities offered to the server in the handshake.
+var capabilities = []string{
+	message.CapabilityWideFraming,
+	message.CapabilityErrorCodes,
+	message.CapabilityGetMany,
+	message.CapabilityPing,
+	message.CapabilityUsers,
+	message.CapabilitySequences,
+	message.CapabilitySubscribeMany,
+}
+
 type options struct {
+	// Sent to the server in the handshake, defaults to the hostname.
+	id string
+
 	address string
 
+	// If not empty, the addresses of the replicas of a replicated server,
+	// used in place of the address above. The client connects to whichever
+	// is the leader.
+	addresses []string
+
 	fallbackToPlainTCP bool
+
+	// If set, verify the server certificate against the CA certificates in
+	// this PEM file, rather than against the system roots.
+	caFile string
+
+	// If set, present this certificate to servers requiring client
+	// certificates.
+	certFile string
+	keyFile  string
+
+	// If set, verify the server certificate is for this name, rather than
+	// for the host in the address.
+	serverName string
 }
 
 type Option func(*options)
 
+func WithID(value string) Option {
+	return func(o *options) {
+		o.id = value
+	}
+}
+
 func WithAddress(value string) Option {
 	return func(o *options) {
 		o.address = value
 	}
 }
 
+func WithAddresses(values ...string) Option {
+	return func(o *options) {
+		o.addresses = values
+	}
+}
+
+// WithFallbackToPlainTCP makes the client connect in plain TCP if it can't
+// connect using TLS. It is ignored if any of the TLS options below is given,
+// and the client never falls back if the server certificate fails
+// verification.
 func WithFallbackToPlainTCP() Option {
 	return func(o *options) {
 		o.fallbackToPlainTCP = true
 	}
 }
 
+// WithCAFile makes the client trust the server certificates issued by the CA
+// certificates in the given PEM file, and only those.
+func WithCAFile(value string) Option {
+	return func(o *options) {
+		o.caFile = value
+	}
+}
+
+// WithKeyPair makes the client present the given certificate to the server.
+func WithKeyPair(certFile, keyFile string) Option {
+	return func(o *options) {
+		o.certFile = certFile
+		o.keyFile = keyFile
+	}
+}
+
+// WithServerName makes the client expect server certificates for the given
+// name, e.g., when connecting by IP address.
+func WithServerName(value string) Option {
+	return func(o *options) {
+		o.serverName = value
+	}
+}
+
 // Client is a low-level metadata server client that can send and receive
 // message.Message's. It can be used to build higher level clients, e.g., a
 // storage.VersionedStore implementation.
@@ -49,10 +144,27 @@ type Client struct {
 
 	mu   sync.Mutex
 	conn net.Conn
+
+	// Messages received during the handshake on a new connection, to be
+	// returned by Receive before reading from the connection.
+	pending []message.Message
+
+	// Protocol version and capabilities agreed upon in the handshake on the
+	// current connection. Servers that don't understand the handshake speak
+	// protocol version zero, with no capabilities.
+	protocolVersion uint64
+	capabilities    []string
+
+	// Incremented on every new connection.
+	generation uint64
+
+	// The address last connected to, tried first on reconnection.
+	connected string
 }
 
 func New(opts ...Option) *Client {
 	var c Client
+	c.opts.id, _ = os.Hostname()
 	c.opts.address = "127.0.0.1:6660"
 	c.encoder = new(message.Encoder)
 	c.decoder = new(message.Decoder)
@@ -79,7 +191,9 @@ func (c *Client) closeBoth(cached net.Conn) {
 			logger.WithField("err", err).Warn("Could not close cached connection")
 		}
 	}
-	if c.conn != nil {
+	// An error on a connection that was already replaced says nothing about
+	// the current one.
+	if c.conn != nil && (cached == nil || cached == c.conn) {
 		logger := log.WithFields(log.Fields{
 			"local":  c.conn.LocalAddr(),
 			"remote": c.conn.RemoteAddr(),
@@ -89,6 +203,7 @@ func (c *Client) closeBoth(cached net.Conn) {
 			logger.WithField("err", err).Warn("Could not close current connection")
 		}
 		c.conn = nil
+		c.pending = nil
 	}
 }
 
@@ -105,10 +220,24 @@ func (c *Client) Send(m message.Message) error {
 // Receive receives a message from the server.
 func (c *Client) Receive(m *message.Message) error {
 	return c.doWithConn(func(conn net.Conn) error {
+		if c.popPending(m) {
+			return nil
+		}
 		return c.decoder.Decode(conn, m)
 	})
 }
 
+func (c *Client) popPending(m *message.Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return false
+	}
+	*m = c.pending[0]
+	c.pending = c.pending[1:]
+	return true
+}
+
 func (c *Client) doWithConn(consumer func(net.Conn) error) error {
 	conn, err := c.getCachedConn()
 	if err != nil {
@@ -128,14 +257,263 @@ func (c *Client) getCachedConn() (conn net.Conn, err error) {
 	if c.conn != nil {
 		return c.conn, nil
 	}
-	conn, err = tls.Dial("tcp", c.opts.address, nil)
-	if err != nil && c.opts.fallbackToPlainTCP {
-		log.WithField("err", err).Warn("Could not dial using TLS, trying plain TCP")
-		conn, err = net.Dial("tcp", c.opts.address)
+	// Try the address last connected to first, and follow the hints of
+	// replicas that aren't the leader, trying each address at most once.
+	addresses := c.opts.addresses
+	if len(addresses) == 0 {
+		addresses = []string{c.opts.address}
+	}
+	if c.connected != "" {
+		addresses = append([]string{c.connected}, addresses...)
+	}
+	tried := make(map[string]bool)
+	for len(addresses) > 0 {
+		address := addresses[0]
+		addresses = addresses[1:]
+		if tried[address] {
+			continue
+		}
+		tried[address] = true
+		conn, err = c.connect(address)
+		if err == nil {
+			c.conn = conn
+			c.connected = address
+			c.generation++
+			return conn, nil
+		}
+		var nle *notLeaderError
+		if errors.As(err, &nle) && nle.leader != "" {
+			addresses = append([]string{nle.leader}, addresses...)
+		}
+		log.WithFields(log.Fields{
+			"address": address,
+			"err":     err,
+		}).Debug("Could not connect")
+	}
+	return nil, err
+}
+
+// tlsConfig returns the TLS configuration for a new connection. Files are read
+// anew each time, so that renewed certificates are picked up on reconnection.
+func (c *Client) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: c.opts.serverName,
+	}
+	if c.opts.caFile != "" {
+		b, err := ioutil.ReadFile(c.opts.caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no CA certificates found", c.opts.caFile)
+		}
+	}
+	if c.opts.certFile != "" || c.opts.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.opts.certFile, c.opts.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// mayFallBack tells whether the client may connect in plain TCP after failing
+// to connect using TLS with the given error.
+func (c *Client) mayFallBack(err error) bool {
+	if !c.opts.fallbackToPlainTCP {
+		return false
+	}
+	if c.opts.caFile != "" || c.opts.certFile != "" || c.opts.serverName != "" {
+		return false
+	}
+	// The server does speak TLS, but can't be trusted.
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return !errors.As(err, &unknownAuthority) && !errors.As(err, &hostname) && !errors.As(err, &invalid)
+}
+
+// connect dials the given address and shakes hands. If the server doesn't
+// understand the handshake, it dials again and speaks protocol version zero,
+// since the server may have misread what followed the hello message.
+func (c *Client) connect(address string) (conn net.Conn, err error) {
+	conn, err = c.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	err = c.handshake(conn)
+	if err == nil {
+		return conn, nil
 	}
+	if err := conn.Close(); err != nil {
+		log.WithField("err", err).Warn("Could not close connection after failed handshake")
+	}
+	if !errors.Is(err, errLegacy) {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"address": address,
+		"err":     err,
+	}).Info("Speaking protocol version zero")
+	return c.dial(address)
+}
+
+// dial connects to the given address, using TLS unless falling back to plain
+// TCP is allowed and necessary.
+func (c *Client) dial(address string) (conn net.Conn, err error) {
+	config, err := c.tlsConfig()
 	if err != nil {
 		return nil, err
 	}
-	c.conn = conn
-	return conn, nil
+	conn, err = tls.Dial("tcp", address, config)
+	if err != nil && c.mayFallBack(err) {
+		log.WithField("err", err).Warn("Could not dial using TLS, trying plain TCP")
+		conn, err = net.Dial("tcp", address)
+	}
+	return conn, err
+}
+
+// notLeaderError is returned by the handshake with a replica that isn't the
+// leader, with the address of the leader, if the replica knows it.
+type notLeaderError struct {
+	leader string
+}
+
+func (e *notLeaderError) Error() string {
+	if e.leader == "" {
+		return ErrNotLeader.Error()
+	}
+	return fmt.Sprintf("%v, leader is %s", ErrNotLeader, e.leader)
+}
+
+func (e *notLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+// Connect connects to the server, unless already connected. Send and Receive
+// connect when needed anyway, this is for callers that want to know whether the
+// server can be reached before sending anything.
+func (c *Client) Connect() error {
+	conn, err := c.getCachedConn()
+	if err != nil {
+		c.closeBoth(conn)
+	}
+	return err
+}
+
+// Generation returns a number that's incremented every time a new connection
+// is made. Callers can compare generations to know whether any state they
+// associated with the connection, e.g., authorization, was lost with it. It is
+// zero before the first connection.
+func (c *Client) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// ProtocolVersion returns the protocol version agreed upon in the handshake on
+// the current connection, connecting if necessary. It is zero for servers that
+// don't understand the handshake, which only understand get, put and auth
+// messages.
+func (c *Client) ProtocolVersion() (uint64, error) {
+	conn, err := c.getCachedConn()
+	if err != nil {
+		c.closeBoth(conn)
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.protocolVersion, nil
+}
+
+// Capable tells whether the given capability was agreed upon in the handshake
+// on the current connection, connecting if necessary.
+func (c *Client) Capable(capability string) (bool, error) {
+	conn, err := c.getCachedConn()
+	if err != nil {
+		c.closeBoth(conn)
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.capabilities {
+		if s == capability {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// handshake exchanges hello messages on a new connection, before it's used for
+// anything else, and applies the agreed upon capabilities. Broadcasts received
+// in the meantime are kept for Receive. It returns errLegacy if the server
+// responds like servers predating the handshake do, not knowing the message
+// kind, or doesn't respond in time; the connection is then unusable. Other
+// refusals are reported as ErrIncompatible.
+func (c *Client) handshake(conn net.Conn) error {
+	// Any tag will do, as nothing else is in flight on a new connection.
+	const tag = 1
+	c.encoder.SetWide(false)
+	c.decoder.SetWide(false)
+	c.encoder.SetErrorCodes(false)
+	c.decoder.SetErrorCodes(false)
+	c.encoder.SetSequences(false)
+	c.decoder.SetSequences(false)
+	c.pending = nil
+	c.protocolVersion = 0
+	c.capabilities = nil
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	hello := message.NewHelloMessage(tag, message.ProtocolVersion, c.opts.id, capabilities)
+	if err := c.encoder.Encode(conn, hello); err != nil {
+		return err
+	}
+	var m message.Message
+	for {
+		if err := c.decoder.Decode(conn, &m); err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				return fmt.Errorf("%w: %v", errLegacy, err)
+			}
+			return err
+		}
+		if m.Tag() == tag && (m.Kind() == message.KindHello || m.Kind() == message.KindError) {
+			break
+		}
+		c.pending = append(c.pending, m)
+	}
+	if leader, ok := m.NotLeader(); ok {
+		return &notLeaderError{leader: leader}
+	}
+	if m.Kind() == message.KindError {
+		for _, refusal := range legacyRefusals {
+			if m.Value() == refusal {
+				return fmt.Errorf("%w: %s", errLegacy, m.Value())
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrIncompatible, m.Value())
+	}
+	if v := m.ProtocolVersion(); v < message.MinProtocolVersion || v > message.ProtocolVersion {
+		return fmt.Errorf("%w: server %q picked protocol version %d, client speaks versions %d to %d",
+			ErrIncompatible, m.Peer(), v, message.MinProtocolVersion, message.ProtocolVersion)
+	}
+	c.protocolVersion = m.ProtocolVersion()
+	c.capabilities = m.Capabilities()
+	for _, s := range c.capabilities {
+		switch s {
+		case message.CapabilityWideFraming:
+			c.encoder.SetWide(true)
+			c.decoder.SetWide(true)
+		case message.CapabilityErrorCodes:
+			c.encoder.SetErrorCodes(true)
+			c.decoder.SetErrorCodes(true)
+		case message.CapabilitySequences:
+			c.encoder.SetSequences(true)
+			c.decoder.SetSequences(true)
+		}
+	}
+	return conn.SetDeadline(time.Time{})
 }
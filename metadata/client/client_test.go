@@ -1,7 +1,11 @@
 package client_test
 
 import (
+	"errors"
+	"io"
 	"math/rand"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -41,6 +45,131 @@ func TestClient(t *testing.T) {
 		m := gtor.Generate(r, 12).Interface().(message.Message)
 		err := clnt.Send(m)
 		require.Nil(t, err)
+		capable, err := clnt.Capable(message.CapabilityWideFraming)
+		require.Nil(t, err)
+		assert.True(t, capable)
 		clnt.Close()
 	})
+	t.Run("refuses server speaking an unknown protocol version", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.Nil(t, err)
+		defer func() {
+			_ = ln.Close()
+		}()
+		go func() {
+			// Accept the failed TLS attempt too.
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				var encoder message.Encoder
+				var decoder message.Decoder
+				var hello message.Message
+				if decoder.Decode(conn, &hello) == nil && hello.Kind() == message.KindHello {
+					_ = encoder.Encode(conn, message.NewHelloMessage(hello.Tag(), message.ProtocolVersion+1, "future", nil))
+				}
+				_ = conn.Close()
+			}
+		}()
+		clnt := client.New(client.WithAddress(ln.Addr().String()), client.WithFallbackToPlainTCP())
+		err = clnt.Send(message.NewGetMessage(1, "name"))
+		assert.True(t, errors.Is(err, client.ErrIncompatible))
+		assert.Contains(t, err.Error(), `server "future" picked protocol version`)
+	})
+	t.Run("reports refusals of the handshake", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.Nil(t, err)
+		defer func() {
+			_ = ln.Close()
+		}()
+		var hellos, gets int32
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				var encoder message.Encoder
+				var decoder message.Decoder
+				var m message.Message
+				if decoder.Decode(conn, &m) == nil {
+					if m.Kind() == message.KindHello {
+						atomic.AddInt32(&hellos, 1)
+						_ = encoder.Encode(conn, message.NewErrorMessage(m.Tag(), "incompatible protocol version 1, server speaks versions 2 to 3"))
+					} else if m.Kind() == message.KindGet {
+						atomic.AddInt32(&gets, 1)
+					}
+				}
+				_ = conn.Close()
+			}
+		}()
+		clnt := client.New(client.WithAddress(ln.Addr().String()), client.WithFallbackToPlainTCP())
+		err = clnt.Send(message.NewGetMessage(1, "name"))
+		assert.True(t, errors.Is(err, client.ErrIncompatible), "got %v", err)
+		assert.Contains(t, err.Error(), "server speaks versions 2 to 3")
+		// No retrying with protocol version zero.
+		assert.EqualValues(t, 1, atomic.LoadInt32(&hellos))
+		assert.Zero(t, atomic.LoadInt32(&gets))
+	})
+	t.Run("speaks protocol version zero to servers predating the handshake", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.Nil(t, err)
+		defer func() {
+			_ = ln.Close()
+		}()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go serveLegacy(conn)
+			}
+		}()
+		clnt := client.New(client.WithAddress(ln.Addr().String()), client.WithFallbackToPlainTCP())
+		defer clnt.Close()
+		require.Nil(t, clnt.Send(message.NewGetMessage(1, "name")))
+		var m message.Message
+		require.Nil(t, clnt.Receive(&m))
+		assert.Equal(t, message.NewPutMessage(1, "name", "tony", 1), m)
+		version, err := clnt.ProtocolVersion()
+		require.Nil(t, err)
+		assert.EqualValues(t, 0, version)
+		capable, err := clnt.Capable(message.CapabilityWideFraming)
+		require.Nil(t, err)
+		assert.False(t, capable)
+	})
+}
+
+// serveLegacy serves a connection like servers predating the handshake did:
+// reading the kind, tag and first length prefix of a message, and responding
+// to kinds other than get with an error message, then reading on from wherever
+// the unknown message left off.
+func serveLegacy(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	var encoder message.Encoder
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		kind := message.Kind(header[0])
+		tag := uint16(header[1]) | uint16(header[2])<<8
+		var response message.Message
+		if kind == message.KindGet {
+			key := make([]byte, int(header[3])|int(header[4])<<8)
+			if _, err := io.ReadFull(conn, key); err != nil {
+				return
+			}
+			response = message.NewPutMessage(tag, string(key), "tony", 1)
+		} else {
+			response = message.NewErrorMessage(tag, "unknown message kind")
+		}
+		if err := encoder.Encode(conn, response); err != nil {
+			return
+		}
+	}
 }
@@ -0,0 +1,163 @@
+package raft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// Entry is an entry of the replicated log. Entries with nil data are appended
+// by new leaders to commit the entries of previous terms, and are not passed
+// to the apply function.
+type Entry struct {
+	Term uint64
+	Data []byte
+}
+
+// Log persists the state a node needs to recover after a restart without
+// breaking the promises it made to other nodes: the current term, whom it
+// voted for in that term, and the log entries.
+type Log interface {
+	// Load returns all of the persisted state.
+	Load() (term uint64, votedFor string, entries []Entry, err error)
+
+	// SetState persists the current term and vote.
+	SetState(term uint64, votedFor string) error
+
+	// Append discards the entries from the given (1-based) index on, and
+	// appends the given entries in their place.
+	Append(from uint64, entries []Entry) error
+}
+
+// MemoryLog is a Log that doesn't survive restarts, only suitable for tests.
+// Safety is only guaranteed if nodes using it are never restarted.
+type MemoryLog struct {
+	mu       sync.Mutex
+	term     uint64
+	votedFor string
+	entries  []Entry
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{}
+}
+
+func (l *MemoryLog) Load() (uint64, string, []Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]Entry, len(l.entries))
+	copy(entries, l.entries)
+	return l.term, l.votedFor, entries, nil
+}
+
+func (l *MemoryLog) SetState(term uint64, votedFor string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.term = term
+	l.votedFor = votedFor
+	return nil
+}
+
+func (l *MemoryLog) Append(from uint64, entries []Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if from == 0 || from > uint64(len(l.entries))+1 {
+		return fmt.Errorf("append from %d to a log of %d entries: %w", from, len(l.entries), ErrGap)
+	}
+	l.entries = append(l.entries[:from-1], entries...)
+	return nil
+}
+
+var (
+	stateBucket   = []byte("raft-state")
+	entriesBucket = []byte("raft-entries")
+	termKey       = []byte("term")
+	votedForKey   = []byte("voted-for")
+)
+
+// BoltLog is a Log backed by a Bolt database.
+type BoltLog bolt.DB
+
+func NewBoltLog(db *bolt.DB) (*BoltLog, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{stateBucket, entriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("could not ensure bucket %q exists: %w", name, err)
+			}
+		}
+		return nil
+	})
+	return (*BoltLog)(db), err
+}
+
+func (l *BoltLog) Load() (term uint64, votedFor string, entries []Entry, err error) {
+	err = (*bolt.DB)(l).View(func(tx *bolt.Tx) error {
+		state := tx.Bucket(stateBucket)
+		if b := state.Get(termKey); b != nil {
+			term = binary.BigEndian.Uint64(b)
+		}
+		votedFor = string(state.Get(votedForKey))
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			if index := binary.BigEndian.Uint64(k); index != uint64(len(entries))+1 {
+				return fmt.Errorf("entry %d after %d entries: %w", index, len(entries), ErrGap)
+			}
+			data := make([]byte, len(v)-8)
+			copy(data, v[8:])
+			entries = append(entries, Entry{Term: binary.BigEndian.Uint64(v), Data: data})
+			return nil
+		})
+	})
+	return term, votedFor, entries, err
+}
+
+func (l *BoltLog) SetState(term uint64, votedFor string) error {
+	return (*bolt.DB)(l).Update(func(tx *bolt.Tx) error {
+		state := tx.Bucket(stateBucket)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, term)
+		if err := state.Put(termKey, b); err != nil {
+			return err
+		}
+		return state.Put(votedForKey, []byte(votedFor))
+	})
+}
+
+func (l *BoltLog) Append(from uint64, entries []Entry) error {
+	return (*bolt.DB)(l).Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		if from == 0 {
+			return fmt.Errorf("append from 0: %w", ErrGap)
+		}
+		if from > 1 && bucket.Get(indexKey(from-1)) == nil {
+			return fmt.Errorf("append from %d: %w", from, ErrGap)
+		}
+		// Deleting while iterating would skip keys.
+		var discarded [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.Seek(indexKey(from)); k != nil; k, _ = c.Next() {
+			discarded = append(discarded, k)
+		}
+		for _, k := range discarded {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		for i, e := range entries {
+			v := make([]byte, 8+len(e.Data))
+			binary.BigEndian.PutUint64(v, e.Term)
+			copy(v[8:], e.Data)
+			if err := bucket.Put(indexKey(from+uint64(i)), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func indexKey(index uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, index)
+	return k
+}
@@ -0,0 +1,929 @@
+package raft
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotLeader is returned by Propose and ConfirmLeadership on nodes
+	// that aren't the leader. Use Leader to find out which node to turn to.
+	ErrNotLeader = errors.New("not leader")
+
+	// ErrLeadershipLost is returned by Propose if the node stopped being the
+	// leader before the proposed entry was applied. The entry might still be
+	// committed by the next leader. It's returned by ConfirmLeadership if the
+	// node stopped being the leader before a majority confirmed it was.
+	ErrLeadershipLost = errors.New("leadership lost")
+
+	// ErrStopped is returned by Propose and ConfirmLeadership once the node
+	// is stopped.
+	ErrStopped = errors.New("stopped")
+
+	// ErrEmptyEntry is returned by Propose for empty data, which is reserved
+	// for the entries new leaders append.
+	ErrEmptyEntry = errors.New("empty entry")
+
+	// ErrGap is returned by Log implementations asked to leave a gap in the
+	// log, or finding one.
+	ErrGap = errors.New("gap in log")
+
+	// ErrInsecureTransport is returned by Listen unless the node is given
+	// a key pair and the CAs to verify its peers with, or is explicitly
+	// allowed to talk to its peers in the clear.
+	ErrInsecureTransport = errors.New("must use TLS between nodes unless insecure transport is allowed")
+)
+
+// ApplyFunc is called with the data of each committed entry, in log order, on
+// every node. The result is returned by Propose on the node that proposed the
+// entry. Applying the same entries in the same order must lead to the same
+// state and results on every node.
+type ApplyFunc func(index uint64, data []byte) interface{}
+
+type Option func(*options)
+
+type options struct {
+	id      string
+	address string
+
+	// Addresses of all nodes of the group, by id. It may or may not include
+	// this node.
+	peers map[string]string
+
+	log Log
+
+	// Followers start an election if they don't hear from a leader for
+	// somewhere between one and two election timeouts. Leaders step down if
+	// they don't hear from a majority for an election timeout.
+	electionTimeout time.Duration
+
+	// How often leaders contact followers when there's nothing new.
+	heartbeatInterval time.Duration
+
+	// The certificate this node presents to its peers, and the CAs their
+	// certificates must be issued by, for mutual TLS.
+	certFile string
+	keyFile  string
+	caFile   string
+
+	// Whether to talk to peers in the clear if the above aren't set.
+	insecure bool
+}
+
+func WithID(value string) Option {
+	return func(o *options) {
+		o.id = value
+	}
+}
+
+func WithAddress(value string) Option {
+	return func(o *options) {
+		o.address = value
+	}
+}
+
+func WithPeers(value map[string]string) Option {
+	return func(o *options) {
+		o.peers = value
+	}
+}
+
+func WithLog(value Log) Option {
+	return func(o *options) {
+		o.log = value
+	}
+}
+
+func WithElectionTimeout(value time.Duration) Option {
+	return func(o *options) {
+		o.electionTimeout = value
+	}
+}
+
+func WithHeartbeatInterval(value time.Duration) Option {
+	return func(o *options) {
+		o.heartbeatInterval = value
+	}
+}
+
+// WithKeyPair makes the node present the given certificate to its peers, both
+// when listening and when calling them. Use with WithCAFile.
+func WithKeyPair(certFile, keyFile string) Option {
+	return func(o *options) {
+		o.certFile = certFile
+		o.keyFile = keyFile
+	}
+}
+
+// WithCAFile makes the node only talk to peers whose certificates are issued
+// by the CAs in the given PEM file, which should only issue certificates to
+// nodes of the group: any node with one can append to the log. Use with
+// WithKeyPair.
+func WithCAFile(value string) Option {
+	return func(o *options) {
+		o.caFile = value
+	}
+}
+
+// WithInsecureTransport lets the node talk to its peers over plain TCP if no
+// key pair and CAs are given. Anyone who can reach the node can then append to
+// the log, so it's only fit for tests, or for networks no one else can reach.
+func WithInsecureTransport() Option {
+	return func(o *options) {
+		o.insecure = true
+	}
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// How many entries to send at most in a single call.
+const maxBatch = 256
+
+type result struct {
+	value interface{}
+	err   error
+}
+
+type waiter struct {
+	term uint64
+	c    chan result
+}
+
+// Node is a member of a group of nodes agreeing on the order of entries in a
+// log, using the Raft consensus algorithm. As long as a majority of the nodes
+// can talk to each other, one of them is the leader, which accepts proposed
+// entries and replicates them.
+//
+// The log is never compacted: it's all kept in memory, and loaded in full on
+// restart, so it grows with every put for as long as the group runs.
+type Node struct {
+	opts options
+
+	ln      net.Listener
+	tls     *tls.Config
+	peers   []*peer
+	apply   ApplyFunc
+	changed func()
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+
+	mu       sync.Mutex
+	role     role
+	term     uint64
+	votedFor string
+	leader   string
+	entries  []Entry
+
+	commitIndex uint64
+	lastApplied uint64
+	applying    *sync.Cond
+
+	// Signaled when entries are applied, peers answer the leader, or the
+	// node steps down, for ConfirmLeadership.
+	progress *sync.Cond
+
+	// Leader state, reset on every election won. The first index of the
+	// term is that of the empty entry appended on becoming the leader: once
+	// that's applied, all entries committed in previous terms are too.
+	// The last contact with a peer is when the leader sent the last call
+	// the peer answered in this term, so the peer recognized this node as
+	// the leader at some point after then.
+	firstIndexOfTerm uint64
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	lastContact      map[string]time.Time
+	triggers         map[string]chan struct{}
+	waiters          map[uint64]waiter
+
+	electionDeadline time.Time
+
+	stopped bool
+	stopc   chan struct{}
+	doing   sync.WaitGroup
+}
+
+func New(opts ...Option) *Node {
+	n := &Node{
+		conns: make(map[net.Conn]struct{}),
+		stopc: make(chan struct{}),
+	}
+	n.opts.address = ":6661"
+	n.opts.electionTimeout = time.Second
+	n.opts.heartbeatInterval = 100 * time.Millisecond
+	for _, o := range opts {
+		o(&n.opts)
+	}
+	if n.opts.log == nil {
+		n.opts.log = NewMemoryLog()
+	}
+	n.applying = sync.NewCond(&n.mu)
+	n.progress = sync.NewCond(&n.mu)
+	return n
+}
+
+// ID returns the id of this node.
+func (n *Node) ID() string {
+	return n.opts.id
+}
+
+// Listen listens for calls from other nodes, returning the address. It uses
+// mutual TLS, unless explicitly allowed not to (see ErrInsecureTransport).
+func (n *Node) Listen() (addr string, err error) {
+	if n.opts.certFile != "" || n.opts.caFile != "" || !n.opts.insecure {
+		if n.tls, err = n.tlsConfig(); err != nil {
+			return "", err
+		}
+		n.ln, err = tls.Listen("tcp", n.opts.address, n.tls)
+	} else {
+		n.ln, err = net.Listen("tcp", n.opts.address)
+	}
+	if err != nil {
+		return "", err
+	}
+	return n.ln.Addr().String(), nil
+}
+
+// tlsConfig returns the configuration for both ends of connections between
+// nodes, each requiring the other's certificate.
+func (n *Node) tlsConfig() (*tls.Config, error) {
+	if n.opts.certFile == "" && n.opts.caFile == "" {
+		return nil, ErrInsecureTransport
+	}
+	if n.opts.certFile == "" || n.opts.caFile == "" {
+		return nil, errors.New("must specify both a key pair and CA file for TLS between nodes")
+	}
+	cert, err := tls.LoadX509KeyPair(n.opts.certFile, n.opts.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(n.opts.caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no CA certificates found", n.opts.caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// Start loads the persisted state and starts taking part in elections and
+// replication, applying committed entries with the given function. The changed
+// function, if not nil, is called (in a separate goroutine) whenever the node
+// learns of a different leader, or that there's no leader.
+func (n *Node) Start(apply ApplyFunc, changed func()) error {
+	term, votedFor, entries, err := n.opts.log.Load()
+	if err != nil {
+		return err
+	}
+	n.apply = apply
+	n.changed = changed
+	n.term = term
+	n.votedFor = votedFor
+	n.entries = entries
+	for id, address := range n.opts.peers {
+		if id != n.opts.id {
+			n.peers = append(n.peers, &peer{id: id, address: address, tls: n.tls})
+		}
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &Service{node: n}); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.resetElectionDeadline()
+	n.mu.Unlock()
+	n.doing.Add(3)
+	go n.serve(server)
+	go n.tickLoop()
+	go n.applyLoop()
+	return nil
+}
+
+// Stop stops the node, and waits for its goroutines to exit.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	n.stopped = true
+	n.failWaiters(ErrStopped)
+	n.applying.Broadcast()
+	n.progress.Broadcast()
+	n.mu.Unlock()
+	close(n.stopc)
+	if err := n.ln.Close(); err != nil {
+		log.WithField("err", err).Warn("Could not close listener")
+	}
+	n.connsMu.Lock()
+	for conn := range n.conns {
+		_ = conn.Close()
+	}
+	n.connsMu.Unlock()
+	for _, p := range n.peers {
+		p.mu.Lock()
+		client := p.client
+		p.mu.Unlock()
+		if client != nil {
+			p.disconnect(client)
+		}
+	}
+	n.doing.Wait()
+}
+
+// Leader returns the id of the node believed to be the leader, if any.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// IsLeader tells whether this node is the leader, and has applied all entries
+// committed by previous leaders. A leader that was deposed doesn't know until
+// it hears from the new one, so use ConfirmLeadership before reads that must
+// be up to date.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader && n.lastApplied >= n.firstIndexOfTerm
+}
+
+// Propose appends an entry with the given data to the log, if this node is the
+// leader, and waits for it to be committed and applied. It returns what the
+// apply function returned for it.
+func (n *Node) Propose(ctx context.Context, data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, ErrEmptyEntry
+	}
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if n.role != leader {
+		n.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	if err := n.appendLocal(Entry{Term: n.term, Data: data}); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	index := n.lastIndex()
+	c := make(chan result, 1)
+	n.waiters[index] = waiter{term: n.term, c: c}
+	n.triggerReplication()
+	n.advanceCommit()
+	n.mu.Unlock()
+	select {
+	case r := <-c:
+		return r.value, r.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// ConfirmLeadership waits until reads from the state this node applied are
+// as up to date as if they were committed to the log, which a deposed leader
+// that hasn't found out yet can't guarantee. That's once a majority of the
+// group confirmed, after the call, that this node is still the leader, and
+// the entries committed when the call was made are applied.
+func (n *Node) ConfirmLeadership(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return ErrStopped
+	}
+	if n.role != leader || n.lastApplied < n.firstIndexOfTerm {
+		return ErrNotLeader
+	}
+	term, index, start := n.term, n.commitIndex, time.Now()
+	n.triggerReplication()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.mu.Lock()
+			n.progress.Broadcast()
+			n.mu.Unlock()
+		case <-done:
+		}
+	}()
+	for {
+		switch {
+		case n.stopped:
+			return ErrStopped
+		case n.role != leader || n.term != term:
+			return ErrLeadershipLost
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case n.contactedSince(start) && n.lastApplied >= index:
+			return nil
+		}
+		n.progress.Wait()
+	}
+}
+
+func (n *Node) serve(server *rpc.Server) {
+	defer n.doing.Done()
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			select {
+			case <-n.stopc:
+				return
+			default:
+			}
+			log.WithField("err", err).Warn("Could not accept")
+			continue
+		}
+		n.connsMu.Lock()
+		n.conns[conn] = struct{}{}
+		n.connsMu.Unlock()
+		go func() {
+			server.ServeConn(conn)
+			n.connsMu.Lock()
+			delete(n.conns, conn)
+			n.connsMu.Unlock()
+		}()
+	}
+}
+
+func (n *Node) tickLoop() {
+	defer n.doing.Done()
+	ticker := time.NewTicker(n.opts.electionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopc:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.role == leader && !n.hasQuorum():
+			log.WithFields(log.Fields{
+				"id":   n.opts.id,
+				"term": n.term,
+			}).Warn("Lost contact with the majority, stepping down")
+			n.becomeFollower(n.term)
+			n.resetElectionDeadline()
+		case n.role != leader && time.Now().After(n.electionDeadline):
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) applyLoop() {
+	defer n.doing.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.stopped && n.lastApplied >= n.commitIndex {
+			n.applying.Wait()
+		}
+		if n.stopped {
+			return
+		}
+		first := n.lastApplied + 1
+		batch := make([]Entry, n.commitIndex-n.lastApplied)
+		copy(batch, n.entries[first-1:n.commitIndex])
+		n.mu.Unlock()
+		for i, e := range batch {
+			var value interface{}
+			if len(e.Data) != 0 {
+				value = n.apply(first+uint64(i), e.Data)
+			}
+			n.mu.Lock()
+			n.lastApplied = first + uint64(i)
+			n.progress.Broadcast()
+			if w, ok := n.waiters[n.lastApplied]; ok {
+				delete(n.waiters, n.lastApplied)
+				if w.term == e.Term {
+					w.c <- result{value: value}
+				} else {
+					w.c <- result{err: ErrLeadershipLost}
+				}
+			}
+			n.mu.Unlock()
+		}
+		n.mu.Lock()
+	}
+}
+
+// The methods below must be called with the mutex held.
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.entries))
+}
+
+func (n *Node) termAt(index uint64) uint64 {
+	if index == 0 || index > n.lastIndex() {
+		return 0
+	}
+	return n.entries[index-1].Term
+}
+
+func (n *Node) majority() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.opts.electionTimeout + time.Duration(rand.Int63n(int64(n.opts.electionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// setState persists the term and vote before adopting them, so that the node
+// never acts on promises it could forget in a restart.
+func (n *Node) setState(term uint64, votedFor string) error {
+	if err := n.opts.log.SetState(term, votedFor); err != nil {
+		return err
+	}
+	n.term = term
+	n.votedFor = votedFor
+	return nil
+}
+
+func (n *Node) appendLocal(entries ...Entry) error {
+	if err := n.opts.log.Append(n.lastIndex()+1, entries); err != nil {
+		return err
+	}
+	n.entries = append(n.entries, entries...)
+	return nil
+}
+
+func (n *Node) setLeader(id string) {
+	if n.leader == id {
+		return
+	}
+	n.leader = id
+	log.WithFields(log.Fields{
+		"id":     n.opts.id,
+		"term":   n.term,
+		"leader": id,
+	}).Info("Leader changed")
+	if n.changed != nil {
+		go n.changed()
+	}
+}
+
+// becomeFollower steps down, adopting the given term if it's newer. It steps
+// down even if the new term can't be persisted, but then keeps the old term,
+// and returns the error so that callers don't act on the new one.
+func (n *Node) becomeFollower(term uint64) error {
+	var err error
+	if term > n.term {
+		if err = n.setState(term, ""); err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"term": term,
+			}).Error("Could not persist state")
+		}
+	}
+	if n.role == leader {
+		n.failWaiters(ErrLeadershipLost)
+		n.triggers = nil
+		n.setLeader("")
+		n.progress.Broadcast()
+	}
+	n.role = follower
+	return err
+}
+
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.c <- result{err: err}
+		delete(n.waiters, index)
+	}
+}
+
+func (n *Node) hasQuorum() bool {
+	return n.contactedSince(time.Now().Add(-n.opts.electionTimeout))
+}
+
+// contactedSince tells whether a majority, counting this node, recognized
+// this node as the leader after the given time.
+func (n *Node) contactedSince(t time.Time) bool {
+	count := 1
+	for _, p := range n.peers {
+		if n.lastContact[p.id].After(t) {
+			count++
+		}
+	}
+	return count >= n.majority()
+}
+
+// triggerReplication makes the leader contact all peers straight away.
+func (n *Node) triggerReplication() {
+	for _, trigger := range n.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *Node) startElection() {
+	n.resetElectionDeadline()
+	if err := n.setState(n.term+1, n.opts.id); err != nil {
+		// Voting for itself without remembering it could mean voting
+		// for another candidate in the same term after a restart.
+		log.WithFields(log.Fields{
+			"err":  err,
+			"term": n.term + 1,
+		}).Error("Could not persist vote, not starting an election")
+		return
+	}
+	n.role = candidate
+	n.setLeader("")
+	args := RequestVoteArgs{
+		Term:         n.term,
+		Candidate:    n.opts.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.termAt(n.lastIndex()),
+	}
+	votes := 1
+	if votes >= n.majority() {
+		n.becomeLeader()
+		return
+	}
+	for _, p := range n.peers {
+		p := p
+		n.doing.Add(1)
+		go func() {
+			defer n.doing.Done()
+			var reply RequestVoteReply
+			if err := p.call("RequestVote", &args, &reply, n.opts.electionTimeout); err != nil {
+				log.WithFields(log.Fields{
+					"err":  err,
+					"peer": p.id,
+				}).Debug("Could not request vote")
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			if n.role != candidate || n.term != args.Term || !reply.Granted {
+				return
+			}
+			votes++
+			if votes >= n.majority() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.setLeader(n.opts.id)
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.lastContact = make(map[string]time.Time)
+	n.triggers = make(map[string]chan struct{})
+	n.waiters = make(map[uint64]waiter)
+	if err := n.appendLocal(Entry{Term: n.term}); err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"term": n.term,
+		}).Error("Could not append entry on becoming leader")
+		n.becomeFollower(n.term)
+		return
+	}
+	n.firstIndexOfTerm = n.lastIndex()
+	log.WithFields(log.Fields{
+		"id":   n.opts.id,
+		"term": n.term,
+	}).Info("Became leader")
+	now := time.Now()
+	for _, p := range n.peers {
+		n.nextIndex[p.id] = n.lastIndex()
+		n.lastContact[p.id] = now
+		trigger := make(chan struct{}, 1)
+		trigger <- struct{}{}
+		n.triggers[p.id] = trigger
+		n.doing.Add(1)
+		go n.replicate(p, n.term, trigger)
+	}
+	n.advanceCommit()
+}
+
+// advanceCommit commits the entries of the current term stored on a majority.
+// (Entries of previous terms are committed along with them.)
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		count := 1
+		for _, p := range n.peers {
+			if n.matchIndex[p.id] >= index {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commitIndex = index
+			n.applying.Broadcast()
+			return
+		}
+	}
+}
+
+// The methods below must be called without holding the mutex.
+
+// replicate sends entries, or heartbeats, to a peer for as long as this node
+// is the leader in the given term.
+func (n *Node) replicate(p *peer, term uint64, trigger chan struct{}) {
+	defer n.doing.Done()
+	ticker := time.NewTicker(n.opts.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopc:
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+		for {
+			leading, more := n.sendEntries(p, term)
+			if !leading {
+				return
+			}
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+func (n *Node) sendEntries(p *peer, term uint64) (leading bool, more bool) {
+	n.mu.Lock()
+	if n.stopped || n.role != leader || n.term != term {
+		n.mu.Unlock()
+		return false, false
+	}
+	next := n.nextIndex[p.id]
+	end := n.lastIndex()
+	if end-next+1 > maxBatch {
+		end = next + maxBatch - 1
+	}
+	entries := make([]Entry, end-next+1)
+	copy(entries, n.entries[next-1:end])
+	args := AppendEntriesArgs{
+		Term:         term,
+		Leader:       n.opts.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	sent := time.Now()
+	var reply AppendEntriesReply
+	if err := p.call("AppendEntries", &args, &reply, n.opts.electionTimeout); err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"peer": p.id,
+		}).Debug("Could not append entries")
+		return true, false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term)
+		return false, false
+	}
+	if n.role != leader || n.term != term {
+		return false, false
+	}
+	if sent.After(n.lastContact[p.id]) {
+		n.lastContact[p.id] = sent
+		n.progress.Broadcast()
+	}
+	if reply.Success {
+		if match := args.PrevLogIndex + uint64(len(entries)); match > n.matchIndex[p.id] {
+			n.matchIndex[p.id] = match
+		}
+		n.nextIndex[p.id] = n.matchIndex[p.id] + 1
+		n.advanceCommit()
+	} else {
+		next := reply.ConflictIndex
+		if next == 0 || next >= args.PrevLogIndex+1 {
+			next = args.PrevLogIndex
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[p.id] = next
+	}
+	return true, n.nextIndex[p.id] <= n.lastIndex()
+}
+
+func (n *Node) requestVote(args *RequestVoteArgs) RequestVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if args.Term > n.term {
+		if err := n.becomeFollower(args.Term); err != nil {
+			return RequestVoteReply{Term: n.term}
+		}
+		n.setLeader("")
+	}
+	reply := RequestVoteReply{Term: n.term}
+	if args.Term < n.term || (n.votedFor != "" && n.votedFor != args.Candidate) {
+		return reply
+	}
+	// Only vote for candidates whose log is at least as up to date.
+	lastTerm := n.termAt(n.lastIndex())
+	if args.LastLogTerm < lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex < n.lastIndex()) {
+		return reply
+	}
+	if err := n.setState(n.term, args.Candidate); err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"term":      n.term,
+			"candidate": args.Candidate,
+		}).Error("Could not persist vote, refusing it")
+		return reply
+	}
+	n.resetElectionDeadline()
+	reply.Granted = true
+	return reply
+}
+
+func (n *Node) appendEntries(args *AppendEntriesArgs) AppendEntriesReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if args.Term < n.term {
+		return AppendEntriesReply{Term: n.term}
+	}
+	if err := n.becomeFollower(args.Term); err != nil {
+		return AppendEntriesReply{Term: n.term}
+	}
+	n.setLeader(args.Leader)
+	n.resetElectionDeadline()
+	reply := AppendEntriesReply{Term: n.term}
+	if args.PrevLogIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return reply
+	}
+	if conflictTerm := n.termAt(args.PrevLogIndex); conflictTerm != args.PrevLogTerm {
+		index := args.PrevLogIndex
+		for index > 1 && n.termAt(index-1) == conflictTerm {
+			index--
+		}
+		reply.ConflictIndex = index
+		return reply
+	}
+	for i, e := range args.Entries {
+		index := args.PrevLogIndex + 1 + uint64(i)
+		if index <= n.lastIndex() && n.termAt(index) == e.Term {
+			continue
+		}
+		if err := n.opts.log.Append(index, args.Entries[i:]); err != nil {
+			log.WithFields(log.Fields{
+				"err":   err,
+				"index": index,
+			}).Error("Could not append entries")
+			reply.ConflictIndex = index
+			return reply
+		}
+		n.entries = append(n.entries[:index-1], args.Entries[i:]...)
+		break
+	}
+	commit := args.LeaderCommit
+	if lastNew := args.PrevLogIndex + uint64(len(args.Entries)); lastNew < commit {
+		commit = lastNew
+	}
+	if commit > n.commitIndex {
+		n.commitIndex = commit
+		n.applying.Broadcast()
+	}
+	reply.Success = true
+	return reply
+}
@@ -0,0 +1,277 @@
+package raft_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/nicolagi/dino/metadata/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode(t *testing.T) {
+	t.Run("single node elects itself", func(t *testing.T) {
+		g := newGroup(t, 1)
+		defer g.stop()
+		leader := g.waitForLeader(t)
+		result, err := leader.Propose(context.Background(), []byte("hello"))
+		require.Nil(t, err)
+		assert.Equal(t, "applied hello at 2", result)
+	})
+	t.Run("entries are applied in the same order everywhere", func(t *testing.T) {
+		g := newGroup(t, 3)
+		defer g.stop()
+		leader := g.waitForLeader(t)
+		for i := 0; i < 10; i++ {
+			_, err := leader.Propose(context.Background(), []byte(fmt.Sprint(i)))
+			require.Nil(t, err)
+		}
+		g.waitForApplied(t, 10)
+		for id := range g.nodes {
+			assert.Equal(t, g.applied[g.ids[0]], g.applied[id])
+		}
+	})
+	t.Run("followers refuse proposals", func(t *testing.T) {
+		g := newGroup(t, 3)
+		defer g.stop()
+		leader := g.waitForLeader(t)
+		for _, n := range g.nodes {
+			if n == leader {
+				continue
+			}
+			_, err := n.Propose(context.Background(), []byte("hello"))
+			assert.True(t, errors.Is(err, raft.ErrNotLeader))
+			assert.Equal(t, leader.ID(), n.Leader())
+		}
+	})
+	t.Run("a new leader takes over when the leader stops", func(t *testing.T) {
+		g := newGroup(t, 3)
+		defer g.stop()
+		first := g.waitForLeader(t)
+		_, err := first.Propose(context.Background(), []byte("before"))
+		require.Nil(t, err)
+		g.stopNode(first)
+		second := g.waitForLeader(t)
+		require.NotEqual(t, first.ID(), second.ID())
+		_, err = second.Propose(context.Background(), []byte("after"))
+		require.Nil(t, err)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		assert.Equal(t, []string{"before", "after"}, g.applied[second.ID()])
+	})
+	t.Run("an isolated leader steps down", func(t *testing.T) {
+		g := newGroup(t, 3)
+		defer g.stop()
+		leader := g.waitForLeader(t)
+		for _, n := range g.nodes {
+			if n != leader {
+				g.stopNode(n)
+			}
+		}
+		assert.Eventually(t, func() bool {
+			return !leader.IsLeader()
+		}, 5*time.Second, 10*time.Millisecond)
+		_, err := leader.Propose(context.Background(), []byte("hello"))
+		assert.True(t, errors.Is(err, raft.ErrNotLeader))
+	})
+	t.Run("only a leader in touch with the majority confirms its leadership", func(t *testing.T) {
+		g := newGroup(t, 3)
+		defer g.stop()
+		leader := g.waitForLeader(t)
+		assert.Nil(t, leader.ConfirmLeadership(context.Background()))
+		for _, n := range g.nodes {
+			if n != leader {
+				assert.True(t, errors.Is(n.ConfirmLeadership(context.Background()), raft.ErrNotLeader))
+				g.stopNode(n)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := leader.ConfirmLeadership(ctx)
+		assert.True(t, errors.Is(err, raft.ErrLeadershipLost), "got %v", err)
+	})
+	t.Run("a node that can't persist its vote doesn't elect itself", func(t *testing.T) {
+		g := newGroupWithLogs(t, 1, func(string) raft.Log {
+			return failingLog{raft.NewMemoryLog()}
+		})
+		defer g.stop()
+		assert.Never(t, g.hasLeader, time.Second, 10*time.Millisecond)
+	})
+	t.Run("nodes that can't persist their votes don't vote", func(t *testing.T) {
+		// Only the first node could become the leader, with a vote from
+		// either of the others.
+		g := newGroupWithLogs(t, 3, func(id string) raft.Log {
+			if id == "node0" {
+				return raft.NewMemoryLog()
+			}
+			return failingLog{raft.NewMemoryLog()}
+		})
+		defer g.stop()
+		assert.Never(t, g.hasLeader, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestBoltLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-dino-raft-")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	db, err := bolt.Open(f.Name(), 0600, nil)
+	require.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	l, err := raft.NewBoltLog(db)
+	require.Nil(t, err)
+
+	require.Nil(t, l.SetState(3, "b"))
+	require.Nil(t, l.Append(1, []raft.Entry{{Term: 1}, {Term: 2, Data: []byte("x")}, {Term: 2, Data: []byte("y")}}))
+	require.Nil(t, l.Append(3, []raft.Entry{{Term: 3, Data: []byte("z")}}))
+	assert.True(t, errors.Is(l.Append(5, nil), raft.ErrGap))
+
+	term, votedFor, entries, err := l.Load()
+	require.Nil(t, err)
+	assert.EqualValues(t, 3, term)
+	assert.Equal(t, "b", votedFor)
+	assert.Equal(t, []raft.Entry{{Term: 1, Data: []byte{}}, {Term: 2, Data: []byte("x")}, {Term: 3, Data: []byte("z")}}, entries)
+}
+
+// failingLog fails to persist the term and vote, as a full disk would.
+type failingLog struct {
+	raft.Log
+}
+
+func (failingLog) SetState(uint64, string) error {
+	return errors.New("no space left on device")
+}
+
+type group struct {
+	ids       []string
+	addresses map[string]string
+	nodes     map[string]*raft.Node
+
+	mu      sync.Mutex
+	applied map[string][]string
+	stopped map[string]bool
+}
+
+func newGroup(t *testing.T, size int) *group {
+	return newGroupWithOptions(t, size, func(string) []raft.Option {
+		return []raft.Option{raft.WithInsecureTransport()}
+	})
+}
+
+func newGroupWithLogs(t *testing.T, size int, logFor func(id string) raft.Log) *group {
+	return newGroupWithOptions(t, size, func(id string) []raft.Option {
+		return []raft.Option{raft.WithInsecureTransport(), raft.WithLog(logFor(id))}
+	})
+}
+
+// newGroupWithOptions starts a group of nodes, each with the options returned
+// for its id on top of those common to all.
+func newGroupWithOptions(t *testing.T, size int, optsFor func(id string) []raft.Option) *group {
+	g := &group{
+		nodes:   make(map[string]*raft.Node),
+		applied: make(map[string][]string),
+		stopped: make(map[string]bool),
+	}
+	// Reserve the ports first, as all nodes need to know all addresses.
+	peers := make(map[string]string)
+	for i := 0; i < size; i++ {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.Nil(t, err)
+		id := fmt.Sprintf("node%d", i)
+		g.ids = append(g.ids, id)
+		peers[id] = ln.Addr().String()
+		require.Nil(t, ln.Close())
+	}
+	g.addresses = peers
+	for _, id := range g.ids {
+		id := id
+		n := raft.New(append([]raft.Option{
+			raft.WithID(id),
+			raft.WithAddress(peers[id]),
+			raft.WithPeers(peers),
+			raft.WithElectionTimeout(200 * time.Millisecond),
+			raft.WithHeartbeatInterval(20 * time.Millisecond),
+		}, optsFor(id)...)...)
+		_, err := n.Listen()
+		require.Nil(t, err)
+		require.Nil(t, n.Start(func(index uint64, data []byte) interface{} {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.applied[id] = append(g.applied[id], string(data))
+			return fmt.Sprintf("applied %s at %d", data, index)
+		}, nil))
+		g.nodes[id] = n
+	}
+	return g
+}
+
+func (g *group) waitForLeader(t *testing.T) (leader *raft.Node) {
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for id, n := range g.nodes {
+			if !g.stopped[id] && n.IsLeader() {
+				leader = n
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func (g *group) hasLeader() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for id, n := range g.nodes {
+		if !g.stopped[id] && n.Leader() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *group) waitForApplied(t *testing.T, count int) {
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for _, id := range g.ids {
+			if len(g.applied[id]) < count {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func (g *group) stopNode(n *raft.Node) {
+	g.mu.Lock()
+	g.stopped[n.ID()] = true
+	g.mu.Unlock()
+	n.Stop()
+}
+
+func (g *group) stop() {
+	for _, n := range g.nodes {
+		g.mu.Lock()
+		stopped := g.stopped[n.ID()]
+		g.stopped[n.ID()] = true
+		g.mu.Unlock()
+		if !stopped {
+			n.Stop()
+		}
+	}
+}
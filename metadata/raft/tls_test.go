@@ -0,0 +1,133 @@
+package raft_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/metadata/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportSecurity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dino-raft-tls-")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	ca := newCA(t, dir, "ca")
+	ca.issue(t, dir, "node")
+	newCA(t, dir, "other").issue(t, dir, "impostor")
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	t.Run("refuses to talk in the clear unless allowed", func(t *testing.T) {
+		_, err := raft.New(raft.WithAddress("localhost:0")).Listen()
+		assert.True(t, errors.Is(err, raft.ErrInsecureTransport), "got %v", err)
+		_, err = raft.New(raft.WithAddress("localhost:0"), raft.WithCAFile(file("ca.pem"))).Listen()
+		assert.NotNil(t, err)
+	})
+	t.Run("nodes with trusted certificates replicate", func(t *testing.T) {
+		g := newGroupWithOptions(t, 3, func(string) []raft.Option {
+			return []raft.Option{
+				raft.WithKeyPair(file("node.pem"), file("node.key")),
+				raft.WithCAFile(file("ca.pem")),
+			}
+		})
+		defer g.stop()
+		leader := g.waitForLeader(t)
+		_, err := leader.Propose(context.Background(), []byte("hello"))
+		require.Nil(t, err)
+		g.waitForApplied(t, 1)
+
+		// Neither plain TCP nor an untrusted certificate gets a call
+		// through, e.g., to depose the leader.
+		address := g.addresses[leader.ID()]
+		args := &raft.AppendEntriesArgs{Term: 1 << 40, Leader: "impostor"}
+		var reply raft.AppendEntriesReply
+		conn, err := net.Dial("tcp", address)
+		require.Nil(t, err)
+		client := rpc.NewClient(conn)
+		assert.NotNil(t, client.Call("Raft.AppendEntries", args, &reply))
+		_ = client.Close()
+		cert, err := tls.LoadX509KeyPair(file("impostor.pem"), file("impostor.key"))
+		require.Nil(t, err)
+		conn, err = tls.Dial("tcp", address, &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+		})
+		if err == nil {
+			client = rpc.NewClient(conn)
+			assert.NotNil(t, client.Call("Raft.AppendEntries", args, &reply))
+			_ = client.Close()
+		}
+		assert.True(t, leader.IsLeader())
+	})
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCA writes a self-signed CA certificate to name.pem in dir.
+func newCA(t *testing.T, dir string, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue writes a certificate for 127.0.0.1, valid for both ends of
+// connections between nodes, to name.pem in dir, and its key to name.key.
+func (ca *testCA) issue(t *testing.T, dir string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.Nil(t, err)
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	b, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	writePEM(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", b)
+}
+
+func writePEM(t *testing.T, pathname string, blockType string, der []byte) {
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.Nil(t, ioutil.WriteFile(pathname, b, 0600))
+}
@@ -0,0 +1,128 @@
+package raft
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errRPCTimeout = errors.New("rpc timeout")
+
+// RequestVoteArgs and the other exported types below are only exported for
+// the sake of net/rpc.
+type RequestVoteArgs struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+
+	// On failure, the index the leader should retry from, which lets the
+	// leader skip a whole term of conflicting entries at once.
+	ConflictIndex uint64
+}
+
+// Service handles the calls from other nodes.
+type Service struct {
+	node *Node
+}
+
+func (s *Service) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	*reply = s.node.requestVote(args)
+	return nil
+}
+
+func (s *Service) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	*reply = s.node.appendEntries(args)
+	return nil
+}
+
+// peer makes calls to another node, connecting when needed, over TLS if
+// configured.
+type peer struct {
+	id      string
+	address string
+	tls     *tls.Config
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+func (p *peer) call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	client, err := p.connect(timeout)
+	if err != nil {
+		return err
+	}
+	call := client.Go("Raft."+method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-timer.C:
+		err = errRPCTimeout
+	}
+	if err != nil {
+		p.disconnect(client)
+	}
+	return err
+}
+
+func (p *peer) connect(timeout time.Duration) (*rpc.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		return p.client, nil
+	}
+	var conn net.Conn
+	var err error
+	if p.tls != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", p.address, p.tls)
+	} else {
+		conn, err = net.DialTimeout("tcp", p.address, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.client = rpc.NewClient(conn)
+	return p.client, nil
+}
+
+// disconnect drops the given client, unless it was already replaced.
+func (p *peer) disconnect(client *rpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != client {
+		return
+	}
+	if err := client.Close(); err != nil && !errors.Is(err, rpc.ErrShutdown) {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"peer": p.id,
+		}).Debug("Could not close connection to peer")
+	}
+	p.client = nil
+}
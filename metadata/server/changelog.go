@@ -0,0 +1,99 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/storage"
+)
+
+// changeLog keeps the most recently accepted puts, each stamped with a sequence
+// number, so that clients that missed some broadcasts (e.g., because they were
+// disconnected) can catch up. The zero value is a change log that retains
+// nothing.
+type changeLog struct {
+	mu   sync.Mutex
+	size int
+
+	// Sequence number of the last recorded put.
+	last uint64
+
+	// Sequence number of the last put that is no longer retained, or the
+	// initial sequence number if nothing was discarded yet. Changes since any
+	// sequence number before this one can't be replayed.
+	trimmed uint64
+
+	entries []message.Message
+}
+
+func (cl *changeLog) init(size int) {
+	// Start from the current time, so that sequence numbers keep increasing
+	// across server restarts, and a client can't mistake a number assigned by a
+	// previous incarnation of the server for one assigned by this one.
+	cl.initAt(size, uint64(time.Now().UnixNano()))
+}
+
+// initAt is like init, but starts from the given sequence number. Replicas
+// start from zero, and use log indices as sequence numbers (see recordAt), so
+// that they are the same on all replicas.
+func (cl *changeLog) initAt(size int, sequence uint64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.size = size
+	cl.last = sequence
+	cl.trimmed = cl.last
+	cl.entries = nil
+}
+
+// record assigns the next sequence number to the given put message, and
+// returns a copy of the message stamped with it.
+func (cl *changeLog) record(m message.Message) message.Message {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.recordLocked(m, cl.last+1)
+}
+
+// recordAt is like record, but with the given sequence number, which must be
+// greater than any recorded before.
+func (cl *changeLog) recordAt(m message.Message, sequence uint64) message.Message {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.recordLocked(m, sequence)
+}
+
+func (cl *changeLog) recordLocked(m message.Message, sequence uint64) message.Message {
+	cl.last = sequence
+	m = m.WithSequence(cl.last)
+	cl.entries = append(cl.entries, m.ForBroadcast())
+	if excess := len(cl.entries) - cl.size; excess > 0 {
+		cl.trimmed = cl.entries[excess-1].Sequence()
+		cl.entries = cl.entries[excess:]
+	}
+	return m
+}
+
+// latest returns the sequence number of the last recorded put.
+func (cl *changeLog) latest() uint64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.last
+}
+
+// since returns the recorded puts with a sequence number greater than the
+// given one, ready to be broadcast, and the sequence number of the last
+// recorded put.
+func (cl *changeLog) since(sequence uint64) (changes []message.Message, last uint64, err error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if sequence < cl.trimmed || sequence > cl.last {
+		return nil, 0, storage.ErrChangeLogTruncated
+	}
+	i := sort.Search(len(cl.entries), func(i int) bool {
+		return cl.entries[i].Sequence() > sequence
+	})
+	changes = make([]message.Message, len(cl.entries)-i)
+	copy(changes, cl.entries[i:])
+	return changes, cl.last, nil
+}
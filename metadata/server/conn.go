@@ -1,13 +1,17 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/volume"
 	"github.com/nicolagi/dino/storage"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type serverConn struct {
@@ -18,7 +22,52 @@ type serverConn struct {
 	encoder *message.Encoder
 	decoder *message.Decoder
 
+	// Frames to be written to the connection by the writer goroutine, and a
+	// channel closed when that goroutine exits.
+	queue   chan []byte
+	written chan struct{}
+
+	// Whether wide framing is in use, whether put messages carry sequence
+	// numbers, and whether the client was found too slow to keep up with
+	// broadcasts. Guarded by the server's fan-out mutex.
+	wide      bool
+	sequences bool
+	slow      bool
+
+	// The volume the connection works on, guarded by the server's fan-out
+	// mutex, since broadcasts look at it. It's only set by the goroutine
+	// handling input, so that goroutine needs no lock to read it. If the
+	// volume chosen doesn't exist, the connection can't be authorized.
+	volume        volume.Volume
+	unknownVolume bool
+
+	// Whether the connection is authorized, and whether any request was
+	// served besides handshakes, pings, and choosing the volume.
 	authorized bool
+	served     bool
+
+	// The user the connection logged in as, if any, and the hash of the
+	// user's password at the time, to tell if the user was revoked since.
+	// Guarded by the server's fan-out mutex like the volume.
+	user     string
+	userHash string
+
+	// Keys the client wants broadcasts for. If nil, the client hasn't
+	// subscribed to anything yet and gets broadcasts for all keys.
+	mu            sync.Mutex
+	subscriptions map[string]struct{}
+
+	// Whether the client wants invalidate messages broadcast in place of put
+	// messages.
+	invalidations bool
+
+	// Set by the handshake (see message.KindHello), which is only allowed as
+	// the first message. Clients that skip it speak protocol version zero,
+	// with no capabilities, hence the framing predating the handshake.
+	started         bool
+	peer            string
+	protocolVersion uint64
+	capabilities    []string
 }
 
 func (s *Server) wrapConn(conn net.Conn) *serverConn {
@@ -34,8 +83,29 @@ func (s *Server) wrapConn(conn net.Conn) *serverConn {
 // To be run in a separate goroutine, which will exit when the connection is
 // closed or reset.
 func (sc *serverConn) handleInput() {
+	sc.startWriter()
+	if err := sc.identify(); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"id":     sc.id,
+			"remote": sc.conn.RemoteAddr(),
+		}).Warn("Could not identify client")
+		sc.close()
+		sc.server.removeConn(sc)
+		sc.stopWriter()
+		return
+	}
+	// Whether the client was refused service, with a response to be written
+	// before closing the connection.
+	refused := false
 	for {
 		var input message.Message
+		if err := sc.setIdleDeadline(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"id":  sc.id,
+			}).Warn("Could not set read deadline")
+		}
 		if err := sc.decoder.Decode(sc.conn, &input); err != nil {
 			logger := log.WithFields(log.Fields{
 				"err":    err,
@@ -43,6 +113,13 @@ func (sc *serverConn) handleInput() {
 				"remote": sc.conn.RemoteAddr(),
 				"local":  sc.conn.LocalAddr(),
 			})
+			// The client stopped pinging, it's probably gone.
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				logger.Info("Evicting idle client")
+				sc.close()
+				break
+			}
 			// The following happens when the connection is closed on the client side.
 			if err == io.EOF {
 				logger.Info("Client detached")
@@ -54,42 +131,318 @@ func (sc *serverConn) handleInput() {
 					break
 				}
 			}
+			// The client announced a key or value that's too large,
+			// and the rest of its input can't be made sense of.
+			if errors.Is(err, message.ErrTooLarge) {
+				logger.Warn("Frame too large, disconnecting client")
+				if err := sc.respond(input, message.NewCodedErrorMessage(input.Tag(), message.CodeTooLarge, err.Error())); err != nil {
+					log.Warn(err)
+				}
+				refused = true
+				break
+			}
 			logger.Warn("Unknown error decoding")
 			break
 		}
+		// The accepted put to broadcast, if any, with its key in the
+		// versioned store.
+		var accepted message.Message
 		var output message.Message
-		if sc.server.opts.authHash != "" && !sc.authorized {
+		if input.Kind() == message.KindHello {
+			output = sc.hello(input)
+		} else if input.Kind() == message.KindPing {
+			output = message.NewPongMessage(input.Tag(), input.Payload())
+		} else if !sc.server.leading() {
+			output = message.NewNotLeaderMessage(input.Tag(), sc.server.leaderAddress())
+		} else if input.Kind() == message.KindOption && input.Key() == message.OptionVolume {
+			output = sc.selectVolume(input)
+		} else if sc.mustAuthorize() {
 			switch {
+			case input.Kind() == message.KindLogin:
+				if sc.login(input.User(), input.Value()) {
+					log.WithFields(log.Fields{
+						"id":     sc.id,
+						"remote": sc.conn.RemoteAddr(),
+						"user":   input.User(),
+						"volume": sc.volume.Name,
+					}).Info("Client logged in")
+					output = message.NewAuthMessage(input.Tag(), "")
+				} else {
+					output = message.NewCodedErrorMessage(input.Tag(), message.CodeUnauthorized, "go away, bad user or password")
+				}
 			case input.Kind() != message.KindAuth:
-				output = message.NewErrorMessage(input.Tag(), "go away, bad message type")
-			case bcrypt.CompareHashAndPassword([]byte(sc.server.opts.authHash), []byte(input.Value())) == nil:
-				sc.authorized = true
+				output = message.NewCodedErrorMessage(input.Tag(), message.CodeUnauthorized, "go away, bad message type")
+			case sc.authorize(input.Value()):
 				output = message.NewAuthMessage(input.Tag(), "")
 			default:
-				output = message.NewErrorMessage(input.Tag(), "go away, bad password")
+				output = message.NewCodedErrorMessage(input.Tag(), message.CodeUnauthorized, "go away, bad password")
+			}
+			if sc.unknownVolume && output.Kind() == message.KindAuth {
+				output = sc.unknownVolumeError(input)
 			}
+		} else if refusal, ok := sc.permit(input); !ok {
+			output = refusal
 		} else {
-			output = storage.ApplyMessage(sc.server.opts.store, input)
+			sc.served = true
+			switch input.Kind() {
+			case message.KindChanges:
+				output = sc.replayChanges(input)
+			case message.KindSubscribe:
+				sc.subscribe(input.Key())
+				output = input
+			case message.KindSubscribeMany:
+				for _, key := range input.Keys() {
+					sc.subscribe(key)
+				}
+				output = input
+			case message.KindUnsubscribe:
+				sc.unsubscribe(input.Key())
+				output = input
+			case message.KindOption:
+				output = sc.setOption(input)
+			default:
+				var ok bool
+				if output, ok = sc.toStore(input); ok {
+					output = sc.server.apply(output)
+				}
+				if input.Kind() == message.KindPut && output.Kind() == message.KindPut {
+					accepted = output
+				}
+				output = sc.fromStore(output)
+			}
 		}
 		if log.IsLevelEnabled(log.DebugLevel) {
 			log.WithFields(log.Fields{
+				"id":     sc.id,
+				"user":   sc.user,
 				"input":  input,
 				"output": output,
 			}).Debug("Handled message")
 		}
-		if err := sc.encoder.Encode(sc.conn, output); err != nil {
+		if err := sc.respond(input, output); err != nil {
 			log.Warn(err)
 		}
-		if input.Kind() == message.KindPut && output.Kind() == message.KindPut {
-			// All these goroutines will serialize on the fan-out mutex. It might be
-			// better to use a buffered channel to write to here instead of piling up
-			// goroutines.
-			go sc.server.broadcast(sc.id, output)
+		sc.started = true
+		if input.Kind() == message.KindHello && output.Kind() != message.KindHello {
+			log.WithFields(log.Fields{
+				"id":     sc.id,
+				"remote": sc.conn.RemoteAddr(),
+				"input":  input,
+				"output": output,
+			}).Warn("Refused client")
+			refused = true
+			break
+		}
+		if accepted.Kind() == message.KindPut {
+			sc.server.broadcast(sc.id, accepted)
 		}
 	}
 	// Since we're no longer handling input, deregister this connection from
-	// notification.
+	// notification. Only then nothing else can be queued.
 	sc.server.removeConn(sc)
+	sc.stopWriter()
+	if refused {
+		// Only now that the response is written.
+		sc.close()
+	}
+}
+
+// replayChanges sends the client the accepted puts it missed since the
+// sequence number in the request, as broadcast messages, and returns the
+// response to the request. The replayed puts are queued at once, as a single
+// frame, with the fan-out mutex held, so that concurrent broadcasts can't be
+// interleaved with them. Like broadcasts, they are never waited for: if the
+// queue is full, the client is disconnected.
+func (sc *serverConn) replayChanges(input message.Message) message.Message {
+	sc.server.mu.Lock()
+	defer sc.server.mu.Unlock()
+	changes, last, err := sc.server.changes.since(input.Sequence())
+	if err != nil {
+		return storage.NewErrorMessage(input.Tag(), err)
+	}
+	var frame []byte
+	for _, m := range changes {
+		key, ok := sc.volume.LocalKey(m.Key())
+		if !ok || !sc.subscribed(key) || sc.access(key) == NoAccess {
+			continue
+		}
+		m = m.WithKey(key)
+		m = sc.forBroadcast(m, m.ForInvalidation())
+		b, err := sc.encode(m)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"id":      sc.id,
+				"message": m,
+			}).Warn("Could not replay")
+			return storage.NewErrorMessage(input.Tag(), err)
+		}
+		frame = append(frame, b...)
+	}
+	if len(frame) > 0 && !sc.offerLocked(frame) {
+		return message.NewCodedErrorMessage(input.Tag(), message.CodeBusy, "too slow to keep up")
+	}
+	return message.NewChangesMessage(input.Tag(), last)
+}
+
+func (sc *serverConn) subscribe(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.subscriptions == nil {
+		sc.subscriptions = make(map[string]struct{})
+	}
+	sc.subscriptions[key] = struct{}{}
+}
+
+func (sc *serverConn) unsubscribe(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.subscriptions == nil {
+		// Unsubscribing from a key also means opting out of getting
+		// broadcasts for all keys.
+		sc.subscriptions = make(map[string]struct{})
+	}
+	delete(sc.subscriptions, key)
+}
+
+// subscribed tells whether broadcasts for the given key should be sent to this
+// connection.
+func (sc *serverConn) subscribed(key string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.subscriptions == nil {
+		return true
+	}
+	_, ok := sc.subscriptions[key]
+	return ok
+}
+
+// hello handles the handshake, picking the protocol version and capabilities
+// to use on this connection, or refusing the client.
+func (sc *serverConn) hello(input message.Message) message.Message {
+	if sc.started {
+		return message.NewCodedErrorMessage(input.Tag(), message.CodeBadRequest, "hello must be the first message")
+	}
+	if !sc.server.leading() {
+		return message.NewNotLeaderMessage(input.Tag(), sc.server.leaderAddress())
+	}
+	version := input.ProtocolVersion()
+	if version < message.MinProtocolVersion {
+		return message.NewErrorMessage(input.Tag(), fmt.Sprintf(
+			"incompatible protocol version %d, server speaks versions %d to %d",
+			version, message.MinProtocolVersion, message.ProtocolVersion))
+	}
+	if version > message.ProtocolVersion {
+		version = message.ProtocolVersion
+	}
+	var capabilities []string
+	for _, c := range input.Capabilities() {
+		for _, supported := range sc.server.capabilities {
+			if c == supported {
+				capabilities = append(capabilities, c)
+				break
+			}
+		}
+	}
+	sc.peer = input.Peer()
+	sc.protocolVersion = version
+	sc.capabilities = capabilities
+	return message.NewHelloMessage(input.Tag(), version, sc.server.opts.id, capabilities)
+}
+
+// setIdleDeadline makes reads time out if the client, having promised to ping,
+// doesn't send anything for too long.
+func (sc *serverConn) setIdleDeadline() error {
+	timeout := sc.server.opts.idleTimeout
+	if timeout <= 0 || !sc.capable(message.CapabilityPing) {
+		return nil
+	}
+	return sc.conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+func (sc *serverConn) capable(capability string) bool {
+	for _, c := range sc.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// respond queues the output for the given input. If the output can't be framed
+// (e.g., a large value requested by a client not capable of wide framing), an
+// error message is queued instead. The capabilities agreed upon in a handshake
+// take effect right after the response, so the fan-out mutex is held while
+// responding and switching framing, not to let any broadcast in between; since
+// that mutex must not wait for the client, the response to the handshake is
+// queued like a broadcast.
+func (sc *serverConn) respond(input message.Message, output message.Message) error {
+	if output.Kind() != message.KindHello {
+		frame, err := sc.encode(output)
+		if errors.Is(err, message.ErrTooLarge) {
+			frame, err = sc.encode(storage.NewErrorMessage(output.Tag(), err))
+		}
+		if err != nil {
+			return err
+		}
+		sc.send(frame)
+		return nil
+	}
+	sc.server.mu.Lock()
+	defer sc.server.mu.Unlock()
+	frame, err := sc.encode(output)
+	if err != nil {
+		return err
+	}
+	if !sc.offerLocked(frame) {
+		return errors.New("could not respond to handshake")
+	}
+	wide := sc.capable(message.CapabilityWideFraming)
+	sc.wide = wide
+	sc.encoder.SetWide(wide)
+	sc.decoder.SetWide(wide)
+	codes := sc.capable(message.CapabilityErrorCodes)
+	sc.encoder.SetErrorCodes(codes)
+	sc.decoder.SetErrorCodes(codes)
+	sequences := sc.capable(message.CapabilitySequences)
+	sc.sequences = sequences
+	sc.encoder.SetSequences(sequences)
+	sc.decoder.SetSequences(sequences)
+	return nil
+}
+
+func (sc *serverConn) setOption(input message.Message) message.Message {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	switch name, value := input.Key(), input.Value(); name {
+	case message.OptionBroadcast:
+		switch value {
+		case message.BroadcastPuts:
+			sc.invalidations = false
+		case message.BroadcastInvalidations:
+			sc.invalidations = true
+		default:
+			return message.NewCodedErrorMessage(input.Tag(), message.CodeBadRequest, fmt.Sprintf("%q: invalid value for option %q", value, name))
+		}
+	default:
+		return message.NewCodedErrorMessage(input.Tag(), message.CodeBadRequest, fmt.Sprintf("%q: unknown option", name))
+	}
+	return input
+}
+
+// forBroadcast picks what to broadcast to this connection for an accepted put:
+// the put itself or the corresponding invalidation.
+func (sc *serverConn) forBroadcast(put message.Message, invalidation message.Message) message.Message {
+	if sc.wantsInvalidations() {
+		return invalidation
+	}
+	return put
+}
+
+func (sc *serverConn) wantsInvalidations() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.invalidations
 }
 
 func (sc *serverConn) close() {
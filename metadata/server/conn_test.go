@@ -5,13 +5,16 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strings"
 	"testing"
 	"testing/quick"
 	"time"
 
 	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/volume"
 	"github.com/nicolagi/dino/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // fakeConn implements net.Conn.
@@ -138,6 +141,204 @@ func TestServerConn(t *testing.T) {
 			assert.Equal(t, message.NewErrorMessage(2, "messages of kind AUTH cannot be applied"), responses[1])
 		})
 	})
+	t.Run("rejects unknown options", func(t *testing.T) {
+		conn := fakeConn{}
+		sc := serverConn{
+			conn:    &conn,
+			encoder: &message.Encoder{},
+			decoder: &message.Decoder{},
+			server:  &Server{},
+		}
+
+		conn.sendMessage(t, message.NewOptionMessage(1, message.OptionBroadcast, message.BroadcastInvalidations))
+		conn.sendMessage(t, message.NewOptionMessage(2, message.OptionBroadcast, "smoke signals"))
+		conn.sendMessage(t, message.NewOptionMessage(3, "verbosity", "high"))
+		conn.freeze()
+
+		sc.handleInput()
+		assert.True(t, sc.invalidations)
+
+		responses := conn.receiveMessages(t)
+		assert.Len(t, responses, 3)
+		assert.Equal(t, message.NewOptionMessage(1, message.OptionBroadcast, message.BroadcastInvalidations), responses[0])
+		assert.Equal(t, message.KindError, responses[1].Kind())
+		assert.Equal(t, message.KindError, responses[2].Kind())
+	})
+	t.Run("replays changes", func(t *testing.T) {
+		conn := fakeConn{}
+		srv := &Server{
+			opts: options{
+				store: storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+			},
+		}
+		srv.changes.init(2)
+		sc := serverConn{
+			conn:    &conn,
+			encoder: &message.Encoder{},
+			decoder: &message.Decoder{},
+			server:  srv,
+		}
+		// As if negotiated in a handshake.
+		sc.encoder.SetSequences(true)
+		sc.decoder.SetSequences(true)
+		conn.encoder.SetSequences(true)
+		conn.decoder.SetSequences(true)
+		base := srv.changes.latest()
+
+		conn.sendMessage(t, message.NewPutMessage(1, "name", "tony", 1))
+		conn.sendMessage(t, message.NewPutMessage(2, "name", "tony", 2))
+		conn.sendMessage(t, message.NewPutMessage(3, "name", "tony", 3))
+		conn.sendMessage(t, message.NewChangesMessage(4, base+1))
+		conn.sendMessage(t, message.NewChangesMessage(5, base+3))
+		conn.sendMessage(t, message.NewChangesMessage(6, base))
+		conn.freeze()
+
+		sc.handleInput()
+
+		responses := conn.receiveMessages(t)
+		assert.Len(t, responses, 8)
+		// Only the last two puts are retained and replayed as broadcasts.
+		assert.Equal(t, message.NewPutMessage(0, "name", "tony", 2).WithSequence(base+2), responses[3])
+		assert.Equal(t, message.NewPutMessage(0, "name", "tony", 3).WithSequence(base+3), responses[4])
+		assert.Equal(t, message.NewChangesMessage(4, base+3), responses[5])
+		assert.Equal(t, message.NewChangesMessage(5, base+3), responses[6])
+		assert.Equal(t, message.NewErrorMessage(6, storage.ErrChangeLogTruncated.Error()), responses[7])
+	})
+	t.Run("disconnects rather than wait to replay changes", func(t *testing.T) {
+		conn := fakeConn{}
+		srv := &Server{
+			opts: options{
+				store: storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+			},
+		}
+		srv.changes.init(2)
+		base := srv.changes.latest()
+		srv.changes.record(message.NewPutMessage(1, "name", "tony", 1))
+		sc := &serverConn{
+			conn:    &conn,
+			encoder: &message.Encoder{},
+			decoder: &message.Decoder{},
+			server:  srv,
+			// Full, with no writer draining it.
+			queue: make(chan []byte, 1),
+		}
+		sc.queue <- nil
+		srv.conns = []*serverConn{sc}
+
+		done := make(chan message.Message)
+		go func() {
+			done <- sc.replayChanges(message.NewChangesMessage(1, base))
+		}()
+		select {
+		case response := <-done:
+			assert.Equal(t, message.NewCodedErrorMessage(1, message.CodeBusy, "too slow to keep up"), response)
+		case <-time.After(5 * time.Second):
+			t.Fatal("replay waited for the client")
+		}
+		assert.True(t, sc.slow)
+	})
+	t.Run("refuses to replay changes too large for the framing", func(t *testing.T) {
+		srv := &Server{
+			opts: options{
+				store: storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+			},
+		}
+		srv.changes.init(2)
+		base := srv.changes.latest()
+		srv.changes.record(message.NewPutMessage(1, "name", strings.Repeat("x", 70000), 1))
+		sc := &serverConn{
+			conn:    &fakeConn{},
+			encoder: &message.Encoder{},
+			decoder: &message.Decoder{},
+			server:  srv,
+			queue:   make(chan []byte, 1),
+		}
+		response := sc.replayChanges(message.NewChangesMessage(1, base))
+		assert.Equal(t, message.KindError, response.Kind())
+		assert.Equal(t, message.CodeTooLarge, response.ErrorCode())
+	})
+	t.Run("handshake", func(t *testing.T) {
+		newServerConn := func(conn *fakeConn) *serverConn {
+			return &serverConn{
+				conn:    conn,
+				encoder: &message.Encoder{},
+				decoder: &message.Decoder{},
+				server: &Server{
+					opts: options{
+						id:    "server",
+						store: storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+					},
+					capabilities: []string{message.CapabilityWideFraming},
+				},
+			}
+		}
+		t.Run("agrees on version and capabilities", func(t *testing.T) {
+			conn := fakeConn{}
+			sc := newServerConn(&conn)
+			conn.sendMessage(t, message.NewHelloMessage(1, message.ProtocolVersion+1, "client", []string{"teleportation", message.CapabilityWideFraming}))
+			conn.encoder.SetWide(true)
+			conn.sendMessage(t, message.NewPutMessage(2, "name", "mark", 1))
+			conn.freeze()
+			sc.handleInput()
+			assert.Equal(t, "client", sc.peer)
+
+			// The response to the hello message is still narrow.
+			outputReader := bytes.NewReader(conn.writer.Bytes())
+			var response message.Message
+			require.Nil(t, conn.decoder.Decode(outputReader, &response))
+			assert.Equal(t, message.NewHelloMessage(1, message.ProtocolVersion, "server", []string{message.CapabilityWideFraming}), response)
+			conn.decoder.SetWide(true)
+			require.Nil(t, conn.decoder.Decode(outputReader, &response))
+			assert.Equal(t, message.NewPutMessage(2, "name", "mark", 1), response.WithSequence(0))
+		})
+		t.Run("refuses old protocol versions", func(t *testing.T) {
+			conn := fakeConn{}
+			sc := newServerConn(&conn)
+			conn.sendMessage(t, message.NewHelloMessage(1, message.MinProtocolVersion-1, "client", nil))
+			conn.sendMessage(t, message.NewGetMessage(2, "name"))
+			conn.freeze()
+			sc.handleInput()
+			responses := conn.receiveMessages(t)
+			// No response to the get message, as the connection is closed.
+			require.Len(t, responses, 1)
+			assert.Equal(t, message.KindError, responses[0].Kind())
+			assert.Contains(t, responses[0].Value(), "incompatible protocol version")
+		})
+		t.Run("drops clients announcing fields too large", func(t *testing.T) {
+			conn := fakeConn{}
+			sc := newServerConn(&conn)
+			sc.server.capabilities = append(sc.server.capabilities, message.CapabilityErrorCodes)
+			conn.sendMessage(t, message.NewHelloMessage(1, message.ProtocolVersion, "client", sc.server.capabilities))
+			// A get claiming a 4 GiB key, followed by a get that's never answered.
+			_, _ = conn.enqueuer.Write([]byte{byte(message.KindGet), 2, 0, 0xff, 0xff, 0xff, 0xff})
+			conn.encoder.SetWide(true)
+			conn.sendMessage(t, message.NewGetMessage(3, "name"))
+			conn.freeze()
+			sc.handleInput()
+			outputReader := bytes.NewReader(conn.writer.Bytes())
+			var response message.Message
+			require.Nil(t, conn.decoder.Decode(outputReader, &response))
+			require.Equal(t, message.KindHello, response.Kind())
+			conn.decoder.SetWide(true)
+			conn.decoder.SetErrorCodes(true)
+			require.Nil(t, conn.decoder.Decode(outputReader, &response))
+			assert.Equal(t, message.KindError, response.Kind())
+			assert.EqualValues(t, 2, response.Tag())
+			assert.Equal(t, message.CodeTooLarge, response.ErrorCode())
+			assert.Zero(t, outputReader.Len())
+		})
+		t.Run("must be the first message", func(t *testing.T) {
+			conn := fakeConn{}
+			sc := newServerConn(&conn)
+			conn.sendMessage(t, message.NewGetMessage(1, "name"))
+			conn.sendMessage(t, message.NewHelloMessage(2, message.ProtocolVersion, "client", nil))
+			conn.freeze()
+			sc.handleInput()
+			responses := conn.receiveMessages(t)
+			require.Len(t, responses, 2)
+			assert.Equal(t, message.NewErrorMessage(2, "hello must be the first message"), responses[1])
+		})
+	})
 	t.Run("when authorization is required", func(t *testing.T) {
 		t.Run("error responses for non-auth message or auth message with non-matching password", func(t *testing.T) {
 			err := quick.Check(func(request message.Message) bool {
@@ -156,6 +357,14 @@ func TestServerConn(t *testing.T) {
 				conn.freeze()
 				sc.handleInput()
 				responses := conn.receiveMessages(t)
+				// The handshake comes before authorization.
+				if request.Kind() == message.KindHello && request.ProtocolVersion() >= message.MinProtocolVersion {
+					return responses[0].Kind() == message.KindHello
+				}
+				// So do pings.
+				if request.Kind() == message.KindPing {
+					return responses[0] == message.NewPongMessage(request.Tag(), request.Payload())
+				}
 				return responses[0].Kind() == message.KindError
 			}, nil)
 			if err != nil {
@@ -191,4 +400,166 @@ func TestServerConn(t *testing.T) {
 			assert.Equal(t, message.NewPutMessage(2, "name", "tony", 1), responses[1])
 		})
 	})
+	t.Run("when the volume has its own password", func(t *testing.T) {
+		// A possible hash for "foobar".
+		const hash = "$2a$10$xdMaS2UL7abbg2sgnjhR3.aOXpKlg4R3z2XRQoA9MRRTF0I5NrDNy"
+		newConn := func(t *testing.T, tls bool, authHash string) (*fakeConn, *serverConn) {
+			registry := make(volume.Registry)
+			_, err := registry.Create("home", hash)
+			require.Nil(t, err)
+			conn := &fakeConn{}
+			return conn, &serverConn{
+				conn:    conn,
+				encoder: &message.Encoder{},
+				decoder: &message.Decoder{},
+				server: &Server{
+					opts: options{
+						store:    storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+						tls:      tls,
+						authHash: authHash,
+						volumes:  NewVolumes(registry),
+					},
+				},
+			}
+		}
+		t.Run("requires it after choosing the volume", func(t *testing.T) {
+			conn, sc := newConn(t, true, "")
+			conn.sendMessage(t, message.NewOptionMessage(1, message.OptionVolume, "home"))
+			conn.sendMessage(t, message.NewPutMessage(2, "name", "tony", 1))
+			conn.sendMessage(t, message.NewAuthMessage(3, "foobar"))
+			conn.sendMessage(t, message.NewPutMessage(4, "name", "tony", 1))
+			conn.sendMessage(t, message.NewOptionMessage(5, message.OptionVolume, "home"))
+			conn.freeze()
+			sc.handleInput()
+
+			responses := conn.receiveMessages(t)
+			require.Len(t, responses, 5)
+			assert.Equal(t, message.NewOptionMessage(1, message.OptionVolume, "home"), responses[0])
+			assert.Equal(t, message.NewErrorMessage(2, "go away, bad message type"), responses[1])
+			assert.Equal(t, message.NewAuthMessage(3, ""), responses[2])
+			// Keys are the volume's own.
+			assert.Equal(t, message.NewPutMessage(4, "name", "tony", 1), responses[3])
+			assert.Equal(t, message.NewErrorMessage(5, "volume must be chosen before any other request"), responses[4])
+			_, _, err := sc.server.opts.store.Get([]byte("name"))
+			assert.True(t, errors.Is(err, storage.ErrNotFound))
+		})
+		t.Run("refuses it without TLS", func(t *testing.T) {
+			conn, sc := newConn(t, false, "")
+			conn.sendMessage(t, message.NewOptionMessage(1, message.OptionVolume, "home"))
+			conn.sendMessage(t, message.NewAuthMessage(2, "foobar"))
+			conn.freeze()
+			sc.handleInput()
+
+			responses := conn.receiveMessages(t)
+			require.Len(t, responses, 2)
+			assert.Equal(t, message.NewOptionMessage(1, message.OptionVolume, "home"), responses[0])
+			assert.Equal(t, message.NewErrorMessage(2, "go away, bad password"), responses[1])
+			assert.False(t, sc.authorized)
+		})
+		t.Run("unknown volumes look the same to unauthorized clients", func(t *testing.T) {
+			responses := make(map[string][]message.Message)
+			for _, name := range []string{"home", "work"} {
+				conn, sc := newConn(t, true, "")
+				conn.sendMessage(t, message.NewOptionMessage(1, message.OptionVolume, name))
+				conn.sendMessage(t, message.NewGetMessage(2, "name"))
+				conn.sendMessage(t, message.NewAuthMessage(3, "wrong"))
+				conn.freeze()
+				sc.handleInput()
+				responses[name] = conn.receiveMessages(t)
+				require.Len(t, responses[name], 3)
+				assert.Equal(t, message.NewOptionMessage(1, message.OptionVolume, name), responses[name][0])
+			}
+			assert.Equal(t, responses["home"][1:], responses["work"][1:])
+		})
+		t.Run("unknown volumes are reported to authorized clients only", func(t *testing.T) {
+			conn, sc := newConn(t, true, hash)
+			conn.sendMessage(t, message.NewOptionMessage(1, message.OptionVolume, "work"))
+			conn.sendMessage(t, message.NewAuthMessage(2, "foobar"))
+			conn.sendMessage(t, message.NewGetMessage(3, "name"))
+			conn.freeze()
+			sc.handleInput()
+
+			responses := conn.receiveMessages(t)
+			require.Len(t, responses, 3)
+			assert.Equal(t, message.NewErrorMessage(2, `"work": no such volume`), responses[1])
+			assert.Equal(t, message.NewErrorMessage(3, "go away, bad message type"), responses[2])
+			assert.False(t, sc.authorized)
+		})
+	})
+	t.Run("when users log in", func(t *testing.T) {
+		// A possible hash for "foobar".
+		const hash = "$2a$10$xdMaS2UL7abbg2sgnjhR3.aOXpKlg4R3z2XRQoA9MRRTF0I5NrDNy"
+		newConn := func() (*fakeConn, *serverConn) {
+			conn := &fakeConn{}
+			return conn, &serverConn{
+				conn:    conn,
+				encoder: &message.Encoder{},
+				decoder: &message.Decoder{},
+				server: &Server{
+					opts: options{
+						store: storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+						tls:   true,
+						credentials: NewCredentials(User{
+							Name:     "alice",
+							AuthHash: hash,
+							Grants: []Grant{
+								{Access: ReadOnly},
+								{Prefix: "home/", Access: ReadWrite},
+							},
+						}),
+					},
+				},
+			}
+		}
+		t.Run("grants the user's access", func(t *testing.T) {
+			conn, sc := newConn()
+			conn.sendMessage(t, message.NewLoginMessage(1, "alice", "barfoo"))
+			conn.sendMessage(t, message.NewLoginMessage(2, "bob", "foobar"))
+			conn.sendMessage(t, message.NewLoginMessage(3, "alice", "foobar"))
+			conn.sendMessage(t, message.NewPutMessage(4, "home/name", "tony", 1))
+			conn.sendMessage(t, message.NewPutMessage(5, "etc/name", "tony", 1))
+			conn.sendMessage(t, message.NewGetMessage(6, "home/name"))
+			conn.sendMessage(t, message.NewGetManyMessage(7, []string{"home/name", "etc/name"}))
+			conn.freeze()
+			sc.handleInput()
+
+			responses := conn.receiveMessages(t)
+			require.Len(t, responses, 7)
+			assert.Equal(t, message.NewErrorMessage(1, "go away, bad user or password"), responses[0])
+			assert.Equal(t, message.NewErrorMessage(2, "go away, bad user or password"), responses[1])
+			assert.Equal(t, message.NewAuthMessage(3, ""), responses[2])
+			assert.Equal(t, message.NewPutMessage(4, "home/name", "tony", 1), responses[3])
+			assert.Equal(t, message.NewErrorMessage(5, "6574632f6e616d65: forbidden"), responses[4])
+			assert.Equal(t, message.NewPutMessage(6, "home/name", "tony", 1), responses[5])
+			assert.Equal(t, message.KindEntries, responses[6].Kind())
+		})
+		t.Run("revoked users must authorize again", func(t *testing.T) {
+			conn, sc := newConn()
+			// As if logged in before the password changed.
+			sc.authorized = true
+			sc.user = "alice"
+			sc.userHash = "an old hash"
+			conn.sendMessage(t, message.NewGetMessage(1, "home/name"))
+			conn.sendMessage(t, message.NewGetMessage(2, "home/name"))
+			conn.freeze()
+			sc.handleInput()
+
+			responses := conn.receiveMessages(t)
+			require.Len(t, responses, 2)
+			assert.Equal(t, message.NewErrorMessage(1, "go away, credentials revoked"), responses[0])
+			assert.Equal(t, message.NewErrorMessage(2, "go away, bad message type"), responses[1])
+		})
+		t.Run("access is the widest among matching grants", func(t *testing.T) {
+			u := User{Grants: []Grant{
+				{Volume: AllVolumes, Prefix: "shared/", Access: ReadOnly},
+				{Volume: "home", Access: ReadWrite},
+				{Prefix: "etc/", Access: ReadOnly},
+			}}
+			assert.Equal(t, ReadWrite, u.Access("home", "shared/x"))
+			assert.Equal(t, ReadOnly, u.Access("work", "shared/x"))
+			assert.Equal(t, NoAccess, u.Access("work", "x"))
+			assert.Equal(t, ReadOnly, u.Access("", "etc/x"))
+			assert.Equal(t, NoAccess, u.Access("", "x"))
+		})
+	})
 }
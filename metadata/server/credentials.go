@@ -0,0 +1,243 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Access is what a user may do with a key.
+type Access int
+
+const (
+	NoAccess Access = iota
+	ReadOnly
+	ReadWrite
+)
+
+// String implements fmt.Stringer.
+func (a Access) String() string {
+	switch a {
+	case NoAccess:
+		return "none"
+	case ReadOnly:
+		return "read-only"
+	case ReadWrite:
+		return "read-write"
+	default:
+		return fmt.Sprintf("Access(%d)", int(a))
+	}
+}
+
+// AllVolumes can be used as the volume of a grant that applies to all volumes.
+const AllVolumes = "*"
+
+// Grant gives a user access to some keys.
+type Grant struct {
+	// The name of the volume the keys belong to, empty for the default
+	// volume, or AllVolumes.
+	Volume string
+
+	// The grant applies to the keys of the volume starting with this prefix,
+	// i.e., to all keys if empty.
+	Prefix string
+
+	Access Access
+}
+
+// User is someone clients can log in as (see message.KindLogin).
+type User struct {
+	Name string
+
+	// The bcrypt hash of the user's password.
+	AuthHash string
+
+	Grants []Grant
+}
+
+// Access returns the widest access the user's grants give to the key of the
+// volume.
+func (u User) Access(volume string, key string) Access {
+	access := NoAccess
+	for _, g := range u.Grants {
+		if g.Volume != AllVolumes && g.Volume != volume {
+			continue
+		}
+		if strings.HasPrefix(key, g.Prefix) && g.Access > access {
+			access = g.Access
+		}
+	}
+	return access
+}
+
+// Credentials are the users clients can log in as. They can be replaced while
+// the server runs, e.g., to revoke a user's access: connections logged in as a
+// user that's gone, or whose password changed, are refused further requests.
+type Credentials struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func NewCredentials(users ...User) *Credentials {
+	c := new(Credentials)
+	c.Set(users...)
+	return c
+}
+
+// Set replaces all users.
+func (c *Credentials) Set(users ...User) {
+	m := make(map[string]User, len(users))
+	for _, u := range users {
+		m[u.Name] = u
+	}
+	c.mu.Lock()
+	c.users = m
+	c.mu.Unlock()
+}
+
+func (c *Credentials) lookup(name string) (User, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	u, ok := c.users[name]
+	return u, ok
+}
+
+// WithCredentials lets clients log in as the given users, with the access
+// their grants give them. Like WithAuthHash, it requires TLS, and requires
+// clients to authorize before other requests.
+func WithCredentials(value *Credentials) Option {
+	return func(o *options) {
+		o.credentials = value
+	}
+}
+
+// login tells whether the password is the user's, and if so, authorizes the
+// connection as the user, unless the volume is unknown.
+func (sc *serverConn) login(name string, password string) bool {
+	if sc.server.opts.credentials == nil {
+		return false
+	}
+	u, ok := sc.server.opts.credentials.lookup(name)
+	if !ok || bcrypt.CompareHashAndPassword([]byte(u.AuthHash), []byte(password)) != nil {
+		return false
+	}
+	if sc.unknownVolume {
+		return true
+	}
+	// Broadcasts look at the user.
+	sc.server.mu.Lock()
+	sc.user = u.Name
+	sc.userHash = u.AuthHash
+	sc.authorized = true
+	sc.server.mu.Unlock()
+	return true
+}
+
+// identify completes the TLS handshake, if client certificates are required,
+// and logs the connection in as the user named by the certificate's common
+// name, if there's such a user.
+func (sc *serverConn) identify() error {
+	tc, ok := sc.conn.(*tls.Conn)
+	if !ok || sc.server.opts.clientCAFile == "" {
+		return nil
+	}
+	// Don't let clients hold the connection without even shaking hands.
+	if timeout := sc.server.opts.idleTimeout; timeout > 0 {
+		if err := tc.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		defer func() { _ = tc.SetDeadline(time.Time{}) }()
+	}
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 || sc.server.opts.credentials == nil {
+		return nil
+	}
+	name := certs[0].Subject.CommonName
+	u, ok := sc.server.opts.credentials.lookup(name)
+	if !ok {
+		return nil
+	}
+	sc.server.mu.Lock()
+	sc.user = u.Name
+	sc.userHash = u.AuthHash
+	sc.authorized = true
+	sc.server.mu.Unlock()
+	log.WithFields(log.Fields{
+		"id":     sc.id,
+		"remote": sc.conn.RemoteAddr(),
+		"user":   sc.user,
+	}).Info("Client logged in by certificate")
+	return nil
+}
+
+// loggedIn returns the user the connection logged in as, if any, and whether
+// that user is still valid. Connections authorized by password, or not
+// required to authorize at all, are not logged in as any user.
+func (sc *serverConn) loggedIn() (u User, valid bool) {
+	if sc.user == "" {
+		return u, false
+	}
+	u, ok := sc.server.opts.credentials.lookup(sc.user)
+	return u, ok && u.AuthHash == sc.userHash
+}
+
+// access returns what the connection may do with a key of its volume.
+func (sc *serverConn) access(key string) Access {
+	if sc.user == "" {
+		return ReadWrite
+	}
+	u, valid := sc.loggedIn()
+	if !valid {
+		return NoAccess
+	}
+	return u.Access(sc.volume.Name, key)
+}
+
+// permit checks the request against the access of the user the connection
+// logged in as. If the request is refused, it returns an error message to
+// respond with, and false. If the user was revoked, the connection must
+// authorize again.
+func (sc *serverConn) permit(input message.Message) (message.Message, bool) {
+	if sc.user == "" {
+		return input, true
+	}
+	if _, valid := sc.loggedIn(); !valid {
+		log.WithFields(log.Fields{
+			"id":     sc.id,
+			"remote": sc.conn.RemoteAddr(),
+			"user":   sc.user,
+		}).Info("Credentials revoked")
+		sc.server.mu.Lock()
+		sc.user = ""
+		sc.userHash = ""
+		sc.authorized = false
+		sc.server.mu.Unlock()
+		return message.NewCodedErrorMessage(input.Tag(), message.CodeUnauthorized, "go away, credentials revoked"), false
+	}
+	need := ReadOnly
+	var keys []string
+	switch input.Kind() {
+	case message.KindGet, message.KindGetIfModified:
+		keys = []string{input.Key()}
+	case message.KindGetMany:
+		keys = input.Keys()
+	case message.KindPut:
+		keys = []string{input.Key()}
+		need = ReadWrite
+	}
+	for _, key := range keys {
+		if sc.access(key) < need {
+			return message.NewCodedErrorMessage(input.Tag(), message.CodeForbidden, fmt.Sprintf("%x: forbidden", key)), false
+		}
+	}
+	return input, true
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/raft"
+	"github.com/nicolagi/dino/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// leading tells whether this server should serve clients: either it's not a
+// replica, or it's the leader.
+func (s *Server) leading() bool {
+	return s.opts.node == nil || s.opts.node.IsLeader()
+}
+
+// confirmLeading tells whether this server can serve a read from its store:
+// either it's not a replica, or the group confirmed it's still the leader and
+// it has applied all committed puts. If not, it also returns what to reply.
+func (s *Server) confirmLeading(input message.Message) (refusal message.Message, ok bool) {
+	if s.opts.node == nil {
+		return refusal, true
+	}
+	err := s.opts.node.ConfirmLeadership(context.Background())
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		return message.NewNotLeaderMessage(input.Tag(), s.leaderAddress()), false
+	}
+	if err != nil {
+		return storage.NewErrorMessage(input.Tag(), err), false
+	}
+	return refusal, true
+}
+
+// leaderAddress returns the address clients should use to connect to the
+// leader, if known.
+func (s *Server) leaderAddress() string {
+	if s.opts.node == nil {
+		return ""
+	}
+	return s.opts.clientAddresses[s.opts.node.Leader()]
+}
+
+// leaderChanged closes all client connections if this server stopped being
+// the leader, so that clients go find the new one.
+func (s *Server) leaderChanged() {
+	if s.leading() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		log.WithFields(log.Fields{
+			"id":     conn.id,
+			"remote": conn.conn.RemoteAddr(),
+			"leader": s.leaderAddress(),
+		}).Info("No longer the leader, disconnecting client")
+		conn.close()
+	}
+}
+
+// propose appends a put to the replicated log, and returns the result of
+// applying it, once committed.
+func (s *Server) propose(input message.Message) message.Message {
+	var buf bytes.Buffer
+	encoder := new(message.Encoder)
+	encoder.SetWide(true)
+	encoder.SetSequences(true)
+	if err := encoder.Encode(&buf, input); err != nil {
+		return storage.NewErrorMessage(input.Tag(), err)
+	}
+	result, err := s.opts.node.Propose(context.Background(), buf.Bytes())
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		return message.NewNotLeaderMessage(input.Tag(), s.leaderAddress())
+	}
+	if err != nil {
+		return storage.NewErrorMessage(input.Tag(), err)
+	}
+	return result.(message.Message)
+}
+
+// applyCommitted applies a put committed to the replicated log to the
+// versioned store, on every replica, recording it in the change log with the
+// log index as its sequence number. Entries may be applied again after a
+// restart, so a put that finds its own version and value already in the store
+// counts as accepted: that way the latest put for each key makes it to the
+// change log again.
+func (s *Server) applyCommitted(index uint64, data []byte) interface{} {
+	var input message.Message
+	decoder := new(message.Decoder)
+	decoder.SetWide(true)
+	decoder.SetSequences(true)
+	if err := decoder.Decode(bytes.NewReader(data), &input); err != nil {
+		log.WithFields(log.Fields{
+			"err":   err,
+			"index": index,
+		}).Error("Could not decode committed entry")
+		return storage.NewErrorMessage(0, err)
+	}
+	output := storage.ApplyMessage(s.opts.store, input)
+	if output.Kind() == message.KindError && output.ErrorCode() == message.CodeStalePut && s.alreadyApplied(input) {
+		output = input
+	}
+	if output.Kind() == message.KindPut {
+		output = s.changes.recordAt(output, index)
+	}
+	return output
+}
+
+func (s *Server) alreadyApplied(put message.Message) bool {
+	version, value, err := s.opts.store.Get([]byte(put.Key()))
+	return err == nil && version == put.Version() && string(value) == put.Value()
+}
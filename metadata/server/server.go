@@ -2,20 +2,35 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/raft"
 	"github.com/nicolagi/dino/storage"
 	log "github.com/sirupsen/logrus"
 )
 
-var ErrPasswordWithoutTLS = errors.New("must use TLS if authorization is required")
+var (
+	ErrPasswordWithoutTLS = errors.New("must use TLS if authorization is required")
+
+	// ErrClientCAsWithoutTLS is returned by Listen if client certificates
+	// are required but TLS is not in use.
+	ErrClientCAsWithoutTLS = errors.New("must use TLS if client certificates are required")
+)
 
 type Option func(*options)
 
 type options struct {
+	// Sent to clients in the handshake, defaults to the hostname.
+	id string
+
 	address string
 	store   storage.VersionedStore
 
@@ -23,10 +38,53 @@ type options struct {
 	certFile string
 	keyFile  string
 
+	// If set, clients must present a certificate issued by one of the CA
+	// certificates in this PEM file.
+	clientCAFile string
+
 	// If non-empty, the server will require a successful auth message exchange
 	// before any other message on a client connection. Only TLS connections can
 	// be used in this case.
 	authHash string
+
+	// If not nil, clients can also authorize by logging in as one of these
+	// users, getting the access the user is granted. Only TLS connections
+	// can be used in this case.
+	credentials *Credentials
+
+	// Volumes clients can choose, besides the default one.
+	volumes *Volumes
+
+	// How many of the most recently accepted puts to retain, so that clients
+	// can catch up on the broadcasts they missed.
+	changeLogSize int
+
+	// Room in each connection's queue of outgoing frames. Clients whose
+	// queue overflows are disconnected. They'll catch up on the missed
+	// broadcasts when they reconnect.
+	queueSize int
+
+	// How long writing a frame to a client may take before the client is
+	// considered gone. Zero means no limit.
+	writeTimeout time.Duration
+
+	// Connections from clients that ping (see message.CapabilityPing) are
+	// closed if nothing is received from them for this long. Zero means
+	// never.
+	idleTimeout time.Duration
+
+	// If not nil, this server is a replica, ordering puts through the node's
+	// log, and only serving clients while the node is the leader. Addresses
+	// clients should use to connect to each replica, by node id, to point
+	// them to the leader.
+	node            *raft.Node
+	clientAddresses map[string]string
+}
+
+func WithID(value string) Option {
+	return func(o *options) {
+		o.id = value
+	}
 }
 
 func WithAddress(value string) Option {
@@ -49,53 +107,154 @@ func WithKeyPair(certFile, keyFile string) Option {
 	}
 }
 
+// WithClientCAs requires clients to present a certificate issued by one of the
+// CA certificates in the given PEM file. If credentials are in use (see
+// WithCredentials), a client whose certificate common name is the name of a
+// user is logged in as that user, with no need for a password.
+func WithClientCAs(caFile string) Option {
+	return func(o *options) {
+		o.clientCAFile = caFile
+	}
+}
+
 func WithAuthHash(value string) Option {
 	return func(o *options) {
 		o.authHash = value
 	}
 }
 
+func WithChangeLogSize(value int) Option {
+	return func(o *options) {
+		o.changeLogSize = value
+	}
+}
+
+func WithQueueSize(value int) Option {
+	return func(o *options) {
+		o.queueSize = value
+	}
+}
+
+func WithWriteTimeout(value time.Duration) Option {
+	return func(o *options) {
+		o.writeTimeout = value
+	}
+}
+
+// WithReplication makes the server a replica, one of a group whose nodes agree
+// on the order of puts. The node must be listening already, and will be
+// started by Listen and stopped by Shutdown. The given addresses, by node id,
+// are the ones clients should use to connect to each replica.
+func WithReplication(node *raft.Node, clientAddresses map[string]string) Option {
+	return func(o *options) {
+		o.node = node
+		o.clientAddresses = clientAddresses
+	}
+}
+
+func WithIdleTimeout(value time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = value
+	}
+}
+
 type Server struct {
-	opts    options
+	opts options
+
+	// Capabilities offered to clients in the handshake.
+	capabilities []string
+
 	ln      net.Listener
 	connIDs *message.MonotoneTags
+	changes changeLog
 	mu      sync.Mutex
 	conns   []*serverConn
 }
 
 func New(opts ...Option) *Server {
 	s := &Server{
+		capabilities: []string{
+			message.CapabilityWideFraming,
+			message.CapabilityErrorCodes,
+			message.CapabilityGetMany,
+			message.CapabilityPing,
+			message.CapabilityUsers,
+			message.CapabilitySequences,
+			message.CapabilitySubscribeMany,
+		},
 		connIDs: message.NewMonotoneTags(),
 	}
+	s.opts.id, _ = os.Hostname()
 	s.opts.address = ":6660"
+	s.opts.changeLogSize = 4096
+	s.opts.idleTimeout = 90 * time.Second
+	s.opts.queueSize = 1024
+	s.opts.writeTimeout = 30 * time.Second
 	for _, o := range opts {
 		o(&s.opts)
 	}
+	if s.opts.node != nil {
+		s.changes.initAt(s.opts.changeLogSize, 0)
+	} else {
+		s.changes.init(s.opts.changeLogSize)
+	}
+	if s.opts.volumes != nil {
+		s.opts.volumes.listen(s.volumesChanged)
+	}
 	return s
 }
 
 func (s *Server) Listen() (addr string, err error) {
 	if s.opts.tls {
-		var c tls.Certificate
-		c, err = tls.LoadX509KeyPair(s.opts.certFile, s.opts.keyFile)
+		var config *tls.Config
+		config, err = s.tlsConfig()
 		if err == nil {
-			s.ln, err = tls.Listen("tcp", s.opts.address, &tls.Config{
-				Certificates: []tls.Certificate{c},
-			})
+			s.ln, err = tls.Listen("tcp", s.opts.address, config)
 		}
 	} else {
-		if s.opts.authHash != "" {
+		if s.opts.authHash != "" || s.opts.credentials != nil || s.opts.volumes.protected() {
 			return "", ErrPasswordWithoutTLS
 		}
+		if s.opts.clientCAFile != "" {
+			return "", ErrClientCAsWithoutTLS
+		}
 		s.ln, err = net.Listen("tcp", s.opts.address)
 	}
 	if err != nil {
 		return
 	}
+	if s.opts.node != nil {
+		if err = s.opts.node.Start(s.applyCommitted, s.leaderChanged); err != nil {
+			_ = s.ln.Close()
+			return
+		}
+	}
 	addr = s.ln.Addr().String()
 	return
 }
 
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	c, err := tls.LoadX509KeyPair(s.opts.certFile, s.opts.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{c},
+	}
+	if s.opts.clientCAFile != "" {
+		b, err := ioutil.ReadFile(s.opts.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no CA certificates found", s.opts.clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
 // Serve listens and spawns a server goroutine for each incoming connection. The
 // function will return (some time after) shutdown is called.
 func (s *Server) Serve() error {
@@ -140,36 +299,75 @@ func (s *Server) removeConn(sc *serverConn) {
 	s.conns = newConns
 }
 
+// apply applies the message to the versioned store, stamping the resulting put
+// messages with change log sequence numbers.
+func (s *Server) apply(input message.Message) message.Message {
+	switch input.Kind() {
+	case message.KindGet, message.KindGetIfModified, message.KindGetMany:
+		if refusal, ok := s.confirmLeading(input); !ok {
+			return refusal
+		}
+		// Read the sequence number before the value, so that the client can't
+		// be led to believe it has seen a put that it hasn't.
+		sequence := s.changes.latest()
+		output := storage.ApplyMessage(s.opts.store, input)
+		if k := output.Kind(); k == message.KindPut || k == message.KindNotModified || k == message.KindEntries {
+			output = output.WithSequence(sequence)
+		}
+		return output
+	case message.KindPut:
+		if s.opts.node != nil {
+			return s.propose(input)
+		}
+		output := storage.ApplyMessage(s.opts.store, input)
+		if output.Kind() == message.KindPut {
+			output = s.changes.record(output)
+		}
+		return output
+	default:
+		return storage.ApplyMessage(s.opts.store, input)
+	}
+}
+
+// broadcast queues an accepted put (or the corresponding invalidation) for all
+// interested connections on the same volume but the one it came from, if they
+// may read the key. It never waits for slow clients: those whose queue is full
+// are disconnected.
 func (s *Server) broadcast(excluded uint16, m message.Message) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	broadcastMessage := m.ForBroadcast()
+	frames := newBroadcastFrames(m)
 	for _, conn := range s.conns {
-		if excluded == conn.id {
+		if excluded == conn.id || conn.slow {
+			continue
+		}
+		if conn.mustAuthorize() {
 			continue
 		}
-		if s.opts.authHash != "" && !conn.authorized {
+		key, ok := conn.volume.LocalKey(m.Key())
+		if !ok || !conn.subscribed(key) || conn.access(key) == NoAccess {
 			continue
 		}
 		logger := log.WithFields(log.Fields{
-			"message":   broadcastMessage,
+			"message":   frames.put,
 			"sender":    excluded,
 			"recipient": conn.id,
+			"user":      conn.user,
 			"local":     conn.conn.LocalAddr(),
 			"remote":    conn.conn.RemoteAddr(),
 		})
-		// Note: We're re-encoding for all conns, that's a waste.
-		// This calls for a refactoring.
-		err := conn.encoder.Encode(conn.conn, broadcastMessage)
+		frame, err := frames.frame(conn.volume, key, conn.wide, conn.sequences, conn.wantsInvalidations())
 		if err != nil {
 			// Never mind if a client didn't get the message. They are simply more likely
 			// to send stale puts as a consequence of the missed update. They would also
-			// see potentially stale content. Note: We should probably have a retry
-			// queue.
+			// see potentially stale content.
 			logger.WithField("err", err).Warn("Could not notify")
-		} else {
-			logger.Debug("Notified")
+			continue
+		}
+		if !conn.offerLocked(frame) {
+			continue
 		}
+		logger.Debug("Notified")
 	}
 }
 
@@ -180,6 +378,9 @@ func (s *Server) Shutdown() error {
 	// Stop accepting
 	err := s.ln.Close()
 	s.connIDs.Stop()
+	if s.opts.node != nil {
+		s.opts.node.Stop()
+	}
 	// Stop accepted
 	s.mu.Lock()
 	defer s.mu.Unlock()
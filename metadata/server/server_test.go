@@ -2,13 +2,22 @@ package server_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/nicolagi/dino/message"
 	"github.com/nicolagi/dino/metadata/client"
+	"github.com/nicolagi/dino/metadata/raft"
 	"github.com/nicolagi/dino/metadata/server"
+	"github.com/nicolagi/dino/metadata/volume"
 	"github.com/nicolagi/dino/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -30,6 +39,34 @@ func TestServer(t *testing.T) {
 		assert.Equal(t, message.KindError, response.Kind())
 		assert.Equal(t, "messages of kind ERROR cannot be applied", response.Value())
 	})
+	t.Run("refusals of the handshake are written before closing", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+		for i := 0; i < 10; i++ {
+			conn, err := net.Dial("tcp", address)
+			require.Nil(t, err)
+			var encoder message.Encoder
+			var decoder message.Decoder
+			require.Nil(t, encoder.Encode(conn, message.NewHelloMessage(1, message.MinProtocolVersion-1, "client", nil)))
+			var response message.Message
+			require.Nil(t, decoder.Decode(conn, &response))
+			assert.Equal(t, message.KindError, response.Kind())
+			assert.Contains(t, response.Value(), "incompatible protocol version")
+			assert.True(t, errors.Is(decoder.Decode(conn, &response), io.EOF))
+			_ = conn.Close()
+		}
+	})
+	t.Run("error messages carry codes", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+		c := newAttachedClient(address)
+		assert.Nil(t, c.Send(message.NewGetMessage(432, "missing")))
+		var response message.Message
+		require.Nil(t, c.Receive(&response))
+		assert.Equal(t, message.KindError, response.Kind())
+		assert.Equal(t, message.CodeNotFound, response.ErrorCode())
+		assert.True(t, errors.Is(storage.MessageError(response), storage.ErrNotFound))
+	})
 	t.Run("send auth message", func(t *testing.T) {
 		address, cleanup := newDisposableServer(t)
 		defer cleanup()
@@ -59,7 +96,8 @@ func TestServer(t *testing.T) {
 		// failing.
 		var res1 message.Message
 		require.Nil(t, c1.Receive(&res1))
-		assert.Equal(t, req1, res1)
+		assert.Equal(t, req1, res1.WithSequence(0))
+		assert.NotZero(t, res1.Sequence())
 	})
 	t.Run("one client puts, another client puts, conflict", func(t *testing.T) {
 		address, cleanup := newDisposableServer(t)
@@ -138,6 +176,445 @@ func TestServer(t *testing.T) {
 		verify(vs2)
 		verify(vs3)
 	})
+	t.Run("successful put fans out to subscribed clients only", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, ready2 := newRemoteVersionedStore(address)
+		vs3, ready3 := newRemoteVersionedStore(address)
+		require.Nil(t, vs2.Subscribe([]byte("foo")))
+		require.Nil(t, vs3.Subscribe([]byte("bar")))
+
+		require.Nil(t, vs1.Put(1, []byte("foo"), []byte("one")))
+		require.Nil(t, vs1.Put(1, []byte("bar"), []byte("two")))
+
+		m := <-ready2
+		assert.Equal(t, "foo", m.Key())
+		m = <-ready3
+		assert.Equal(t, "bar", m.Key())
+
+		// Unsubscribing drops the locally cached value.
+		_, _, err := vs2.Get([]byte("foo"))
+		require.Nil(t, err)
+		require.Nil(t, vs2.Unsubscribe([]byte("foo")))
+		require.Nil(t, vs1.Put(2, []byte("foo"), []byte("three")))
+		require.Nil(t, vs1.Put(2, []byte("bar"), []byte("four")))
+		<-ready3
+		version, value, err := vs2.Get([]byte("foo"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 2, version)
+		assert.Equal(t, []byte("three"), value)
+		select {
+		case m := <-ready2:
+			t.Errorf("got %v, want nothing", m)
+		default:
+		}
+	})
+	t.Run("subscribing to many keys at once", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, ready2 := newRemoteVersionedStore(address)
+		require.Nil(t, storage.SubscribeManyContext(context.Background(), vs2, [][]byte{[]byte("foo"), []byte("bar")}))
+
+		require.Nil(t, vs1.Put(1, []byte("baz"), []byte("zero")))
+		require.Nil(t, vs1.Put(1, []byte("foo"), []byte("one")))
+		require.Nil(t, vs1.Put(1, []byte("bar"), []byte("two")))
+
+		assert.Equal(t, "foo", (<-ready2).Key())
+		assert.Equal(t, "bar", (<-ready2).Key())
+	})
+	t.Run("invalidations and conditional gets", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, ready2 := newRemoteVersionedStore(address, storage.WithInvalidations())
+		require.Nil(t, vs2.Subscribe([]byte("foo")))
+
+		require.Nil(t, vs1.Put(1, []byte("foo"), []byte("one")))
+		m := <-ready2
+		assert.Equal(t, message.KindInvalidate, m.Kind())
+		assert.Equal(t, "foo", m.Key())
+		assert.EqualValues(t, 1, m.Version())
+
+		_, _, err := vs2.GetIfModified([]byte("foo"), 1)
+		assert.True(t, errors.Is(err, storage.ErrNotModified))
+		version, value, err := vs2.GetIfModified([]byte("foo"), 0)
+		require.Nil(t, err)
+		assert.EqualValues(t, 1, version)
+		assert.Equal(t, []byte("one"), value)
+	})
+	t.Run("get many", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, _ := newRemoteVersionedStore(address)
+		require.Nil(t, vs2.Subscribe([]byte("nothing")))
+		require.Nil(t, vs1.Put(1, []byte("name"), []byte("mark")))
+		require.Nil(t, vs1.Put(1, []byte("genre"), []byte("jazz")))
+		require.Nil(t, vs1.Put(2, []byte("genre"), []byte("blues")))
+		values, err := vs2.GetMany([][]byte{[]byte("name"), []byte("genre"), []byte("missing")})
+		require.Nil(t, err)
+		assert.Equal(t, map[string]storage.VersionedValue{
+			"name":  {Version: 1, Value: []byte("mark")},
+			"genre": {Version: 2, Value: []byte("blues")},
+		}, values)
+	})
+	t.Run("large values with wide framing", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, _ := newRemoteVersionedStore(address)
+		large := bytes.Repeat([]byte("dino"), 50000)
+		require.Nil(t, vs1.Put(1, []byte("large"), large))
+		version, value, err := vs2.Get([]byte("large"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 1, version)
+		assert.Equal(t, large, value)
+	})
+	t.Run("large values with narrow framing", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs, _ := newRemoteVersionedStore(address)
+		require.Nil(t, vs.Put(1, []byte("large"), bytes.Repeat([]byte("dino"), 50000)))
+
+		// A raw connection, skipping the handshake, hence using narrow framing.
+		conn, err := net.Dial("tcp", address)
+		require.Nil(t, err)
+		defer func() {
+			_ = conn.Close()
+		}()
+		var encoder message.Encoder
+		var decoder message.Decoder
+		require.Nil(t, encoder.Encode(conn, message.NewGetMessage(1, "large")))
+		var response message.Message
+		require.Nil(t, decoder.Decode(conn, &response))
+		assert.Equal(t, message.KindError, response.Kind())
+		assert.Contains(t, response.Value(), "too large")
+	})
+	t.Run("put framing only changes with negotiated capabilities", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		for i, tc := range []struct {
+			wide      bool
+			sequences bool
+		}{
+			{false, false},
+			{true, false},
+			{false, true},
+			{true, true},
+		} {
+			var capabilities []string
+			if tc.wide {
+				capabilities = append(capabilities, message.CapabilityWideFraming)
+			}
+			if tc.sequences {
+				capabilities = append(capabilities, message.CapabilitySequences)
+			}
+			conn, err := net.Dial("tcp", address)
+			require.Nil(t, err)
+			var encoder message.Encoder
+			var decoder message.Decoder
+			require.Nil(t, encoder.Encode(conn, message.NewHelloMessage(1, message.ProtocolVersion, "test", capabilities)))
+			var response message.Message
+			require.Nil(t, decoder.Decode(conn, &response))
+			require.Equal(t, len(capabilities), len(response.Capabilities()))
+			encoder.SetWide(tc.wide)
+			decoder.SetWide(tc.wide)
+			encoder.SetSequences(tc.sequences)
+			decoder.SetSequences(tc.sequences)
+			// A put followed by a get: a put framed differently than expected
+			// would garble the response to the get.
+			key := fmt.Sprintf("key%d", i)
+			require.Nil(t, encoder.Encode(conn, message.NewPutMessage(2, key, "value", 1)))
+			require.Nil(t, encoder.Encode(conn, message.NewGetMessage(3, key)))
+			require.Nil(t, decoder.Decode(conn, &response))
+			assert.Equal(t, message.KindPut, response.Kind())
+			assert.Equal(t, uint16(2), response.Tag())
+			assert.Equal(t, tc.sequences, response.Sequence() != 0)
+			require.Nil(t, decoder.Decode(conn, &response))
+			assert.Equal(t, message.KindPut, response.Kind())
+			assert.Equal(t, uint16(3), response.Tag())
+			assert.Equal(t, "value", response.Value())
+			_ = conn.Close()
+		}
+	})
+	t.Run("reconnecting client catches up on missed puts", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		remote2 := client.New(client.WithAddress(address), client.WithFallbackToPlainTCP())
+		recv2 := make(chan message.Message, 1)
+		vs2 := storage.NewRemoteVersionedStore(
+			remote2,
+			storage.WithRequestTimeout(5*time.Second),
+			storage.WithResponseBackoff(100*time.Millisecond),
+			storage.WithChangeListener(func(m message.Message) {
+				recv2 <- m
+			}),
+		)
+		vs2.Start()
+		defer vs2.Stop()
+
+		// The second client connects and learns the current sequence number.
+		_, _, err := vs2.Get([]byte("album"))
+		require.True(t, errors.Is(err, storage.ErrNotFound))
+		require.Nil(t, vs1.Put(1, []byte("album"), []byte("Kind of Blue")))
+		<-recv2
+
+		// The second client disconnects, and misses a put.
+		remote2.Close()
+		require.Nil(t, vs1.Put(2, []byte("album"), []byte("A Love Supreme")))
+
+		select {
+		case m := <-recv2:
+			assert.Equal(t, "album", m.Key())
+			assert.Equal(t, "A Love Supreme", m.Value())
+			assert.EqualValues(t, 2, m.Version())
+		case <-time.After(5 * time.Second):
+			t.Fatal("missed put was not replayed")
+		}
+	})
+	t.Run("reconnecting client renews its subscriptions", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		remote2 := client.New(client.WithAddress(address), client.WithFallbackToPlainTCP())
+		recv2 := make(chan message.Message, 3)
+		vs2 := storage.NewRemoteVersionedStore(
+			remote2,
+			storage.WithRequestTimeout(5*time.Second),
+			storage.WithResponseBackoff(100*time.Millisecond),
+			storage.WithChangeListener(func(m message.Message) {
+				recv2 <- m
+			}),
+		)
+		vs2.Start()
+		defer vs2.Stop()
+		require.Nil(t, vs2.Subscribe([]byte("foo")))
+		require.Nil(t, vs2.Subscribe([]byte("bar")))
+		require.Nil(t, vs1.Put(1, []byte("foo"), []byte("zero")))
+		<-recv2
+
+		// Subscriptions are renewed, with a single subscribe many message,
+		// before the client catches up.
+		remote2.Close()
+		require.Nil(t, vs1.Put(1, []byte("baz"), []byte("zero")))
+		require.Nil(t, vs1.Put(2, []byte("foo"), []byte("one")))
+		require.Nil(t, vs1.Put(1, []byte("bar"), []byte("two")))
+
+		got := make(map[string]string)
+		for len(got) < 2 {
+			select {
+			case m := <-recv2:
+				got[m.Key()] = m.Value()
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got %v, want broadcasts for foo and bar", got)
+			}
+		}
+		assert.Equal(t, map[string]string{"foo": "one", "bar": "two"}, got)
+	})
+	t.Run("idle clients that ping are evicted", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t, server.WithIdleTimeout(200*time.Millisecond))
+		defer cleanup()
+
+		handshake := func(capabilities []string) (net.Conn, *message.Decoder) {
+			conn, err := net.Dial("tcp", address)
+			require.Nil(t, err)
+			var encoder message.Encoder
+			decoder := new(message.Decoder)
+			require.Nil(t, encoder.Encode(conn, message.NewHelloMessage(1, message.ProtocolVersion, "test", capabilities)))
+			var response message.Message
+			require.Nil(t, decoder.Decode(conn, &response))
+			require.Equal(t, message.KindHello, response.Kind())
+			require.Equal(t, len(capabilities), len(response.Capabilities()))
+			require.Nil(t, encoder.Encode(conn, message.NewPingMessage(2, 42)))
+			var pong message.Message
+			require.Nil(t, decoder.Decode(conn, &pong))
+			assert.Equal(t, message.NewPongMessage(2, 42), pong)
+			return conn, decoder
+		}
+
+		pinging, decoder := handshake([]string{message.CapabilityPing})
+		defer func() {
+			_ = pinging.Close()
+		}()
+		require.Nil(t, pinging.SetReadDeadline(time.Now().Add(5*time.Second)))
+		var m message.Message
+		err := decoder.Decode(pinging, &m)
+		assert.True(t, errors.Is(err, io.EOF), "got %v", err)
+
+		// Clients that don't promise to ping are left alone.
+		quiet, decoder := handshake(nil)
+		defer func() {
+			_ = quiet.Close()
+		}()
+		require.Nil(t, quiet.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+		err = decoder.Decode(quiet, &m)
+		var nerr net.Error
+		assert.True(t, errors.As(err, &nerr) && nerr.Timeout(), "got %v", err)
+	})
+	t.Run("slow clients are disconnected, others keep receiving broadcasts", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t, server.WithQueueSize(4), server.WithWriteTimeout(time.Minute))
+		defer cleanup()
+
+		// A client that never reads what the server sends.
+		slow, err := net.Dial("tcp", address)
+		require.Nil(t, err)
+		defer func() {
+			_ = slow.Close()
+		}()
+		var encoder message.Encoder
+		require.Nil(t, encoder.Encode(slow, message.NewHelloMessage(1, message.ProtocolVersion, "test", nil)))
+
+		// A client that keeps up.
+		var notified int32
+		attentive, _ := newRemoteVersionedStore(address, storage.WithChangeListener(func(message.Message) {
+			atomic.AddInt32(&notified, 1)
+		}))
+		defer attentive.Stop()
+		_, _, _ = attentive.Get([]byte("warm-up"))
+
+		// Put enough data to fill the slow client's socket buffers, and then
+		// its queue.
+		putter := newAttachedClient(address)
+		value := strings.Repeat("x", 60000)
+		const puts = 400
+		for i := 0; i < puts; i++ {
+			require.Nil(t, putter.Send(message.NewPutMessage(uint16(i), fmt.Sprintf("key%d", i), value, 1)))
+			var response message.Message
+			require.Nil(t, putter.Receive(&response))
+			require.Equal(t, message.KindPut, response.Kind())
+		}
+
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&notified) == puts
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// The slow client finds its connection closed, after whatever was
+		// written before the queue overflowed.
+		require.Nil(t, slow.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, err := io.Copy(ioutil.Discard, slow)
+		assert.Nil(t, err)
+		assert.True(t, n < puts*60000, "got %d bytes", n)
+	})
+	t.Run("replicas fail over to a new leader", func(t *testing.T) {
+		replicas := newReplicas(t, 3)
+		defer replicas.shutdown()
+
+		replicas.waitForLeader(t)
+
+		// Clients find the leader, whichever address they're given first.
+		addresses := replicas.addresses()
+		vs1 := newReplicatedStore(addresses...)
+		defer vs1.Stop()
+		require.Nil(t, vs1.Put(1, []byte("album"), []byte("Kind of Blue")))
+		vs2 := newReplicatedStore(addresses[2], addresses[1], addresses[0])
+		defer vs2.Stop()
+		version, value, err := vs2.Get([]byte("album"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 1, version)
+		assert.Equal(t, []byte("Kind of Blue"), value)
+
+		replicas.shutdownLeader(t)
+		replicas.waitForLeader(t)
+
+		// The put goes through once the clients have found the new leader.
+		assert.Eventually(t, func() bool {
+			return vs1.Put(2, []byte("album"), []byte("Blue Train")) == nil
+		}, 10*time.Second, 50*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			version, value, err = vs2.Get([]byte("album"))
+			return err == nil && version == 2
+		}, 10*time.Second, 50*time.Millisecond)
+		assert.Equal(t, []byte("Blue Train"), value)
+
+		// Stale puts are still refused.
+		assert.Equal(t, storage.ErrStalePut, vs2.Put(2, []byte("album"), []byte("Giant Steps")))
+	})
+	t.Run("volumes are separate key spaces with their own broadcasts", func(t *testing.T) {
+		registry := make(volume.Registry)
+		home, err := registry.Create("home", "")
+		require.Nil(t, err)
+		_, err = registry.Create("work", "")
+		require.Nil(t, err)
+		address, cleanup := newDisposableServer(t, server.WithVolumes(server.NewVolumes(registry)))
+		defer cleanup()
+
+		admin, _ := newRemoteVersionedStore(address)
+
+		home1, _ := newRemoteVersionedStore(address, storage.WithVolume("home"))
+		home2, homeRecv := newRemoteVersionedStore(address, storage.WithVolume("home"))
+		work, _ := newRemoteVersionedStore(address, storage.WithVolume("work"))
+		// Connect before the puts below, not to miss broadcasts.
+		for _, vs := range []*storage.RemoteVersionedStore{home2, work} {
+			_, _, err := vs.Get([]byte("nothing"))
+			require.True(t, errors.Is(err, storage.ErrNotFound))
+		}
+
+		require.Nil(t, home1.Put(1, []byte("root"), []byte("home root")))
+		require.Nil(t, work.Put(1, []byte("root"), []byte("work root")))
+		require.Nil(t, admin.Put(1, []byte("root"), []byte("default root")))
+		require.Nil(t, home1.Put(1, []byte("last"), []byte("home last")))
+
+		// Broadcasts for the other volumes are not received.
+		m := <-homeRecv
+		assert.Equal(t, "root", m.Key())
+		assert.Equal(t, "home root", m.Value())
+		m = <-homeRecv
+		assert.Equal(t, "last", m.Key())
+
+		for vs, want := range map[*storage.RemoteVersionedStore]string{
+			home2: "home root",
+			work:  "work root",
+			admin: "default root",
+		} {
+			_, value, err := vs.Get([]byte("root"))
+			require.Nil(t, err)
+			assert.Equal(t, want, string(value))
+		}
+
+		// The default volume can't reach into other volumes.
+		_, _, err = admin.Get([]byte(home.Key("root")))
+		assert.NotNil(t, err)
+		assert.False(t, errors.Is(err, storage.ErrNotFound))
+	})
+	t.Run("deleting a volume disconnects its clients", func(t *testing.T) {
+		registry := make(volume.Registry)
+		_, err := registry.Create("home", "")
+		require.Nil(t, err)
+		volumes := server.NewVolumes(registry)
+		address, cleanup := newDisposableServer(t, server.WithVolumes(volumes))
+		defer cleanup()
+
+		states := make(chan storage.ConnectionState, 16)
+		home, _ := newRemoteVersionedStore(address,
+			storage.WithVolume("home"),
+			storage.WithConnectionStateListener(func(state storage.ConnectionState, err error) {
+				states <- state
+			}),
+		)
+		defer home.Stop()
+		require.Nil(t, home.Put(1, []byte("root"), []byte("home root")))
+		require.Equal(t, storage.StateConnected, <-states)
+
+		volumes.Set(nil)
+		require.Equal(t, storage.StateDisconnected, <-states)
+		// Without a password to prove otherwise, the client can't be told
+		// the volume doesn't exist.
+		_, _, err = home.Get([]byte("root"))
+		assert.True(t, errors.Is(err, storage.ErrUnauthorized), "got %v", err)
+		assert.False(t, errors.Is(err, storage.ErrNotFound))
+	})
 	t.Run("should not allow a password to be transmitted in cleartext", func(t *testing.T) {
 		s := server.New(server.WithAuthHash("anything"))
 		_, err := s.Listen()
@@ -145,13 +622,13 @@ func TestServer(t *testing.T) {
 	})
 }
 
-func newDisposableServer(t *testing.T) (address string, cleanup func()) {
+func newDisposableServer(t *testing.T, opts ...server.Option) (address string, cleanup func()) {
 	store := storage.NewInMemoryStore()
 	versionedStore := storage.NewVersionedWrapper(store)
-	metadataServer := server.New(
+	metadataServer := server.New(append([]server.Option{
 		server.WithAddress("localhost:0"),
 		server.WithVersionedStore(versionedStore),
-	)
+	}, opts...)...)
 	address, err := metadataServer.Listen()
 	require.Nil(t, err)
 	errc := make(chan error, 1)
@@ -164,18 +641,120 @@ func newDisposableServer(t *testing.T) (address string, cleanup func()) {
 	}
 }
 
+type replicas struct {
+	nodes   []*raft.Node
+	servers []*server.Server
+	clients []string
+	errcs   []chan error
+	down    []bool
+}
+
+// newReplicas starts a group of replicated servers on localhost.
+func newReplicas(t *testing.T, size int) *replicas {
+	r := &replicas{}
+	peers := make(map[string]string)
+	clientAddresses := make(map[string]string)
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("replica%d", i)
+		node := raft.New(
+			raft.WithID(id),
+			raft.WithAddress("localhost:0"),
+			raft.WithPeers(peers),
+			raft.WithElectionTimeout(200*time.Millisecond),
+			raft.WithHeartbeatInterval(20*time.Millisecond),
+			raft.WithInsecureTransport(),
+		)
+		address, err := node.Listen()
+		require.Nil(t, err)
+		peers[id] = address
+		srv := server.New(
+			server.WithID(id),
+			server.WithAddress("localhost:0"),
+			server.WithVersionedStore(storage.NewVersionedWrapper(storage.NewInMemoryStore())),
+			server.WithReplication(node, clientAddresses),
+		)
+		r.nodes = append(r.nodes, node)
+		r.servers = append(r.servers, srv)
+	}
+	// Peers and client addresses are only read once started.
+	for i, srv := range r.servers {
+		address, err := srv.Listen()
+		require.Nil(t, err)
+		clientAddresses[r.nodes[i].ID()] = address
+		r.clients = append(r.clients, address)
+		errc := make(chan error, 1)
+		go func(srv *server.Server) {
+			errc <- srv.Serve()
+		}(srv)
+		r.errcs = append(r.errcs, errc)
+		r.down = append(r.down, false)
+	}
+	return r
+}
+
+func (r *replicas) addresses() []string {
+	return r.clients
+}
+
+func (r *replicas) waitForLeader(t *testing.T) {
+	require.Eventually(t, func() bool {
+		for i, node := range r.nodes {
+			if !r.down[i] && node.IsLeader() {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func (r *replicas) shutdownLeader(t *testing.T) {
+	for i, node := range r.nodes {
+		if !r.down[i] && node.IsLeader() {
+			r.shutdownReplica(i)
+			return
+		}
+	}
+	t.Fatal("no leader")
+}
+
+func (r *replicas) shutdownReplica(i int) {
+	r.down[i] = true
+	_ = r.servers[i].Shutdown()
+	<-r.errcs[i]
+}
+
+func (r *replicas) shutdown() {
+	for i := range r.servers {
+		if !r.down[i] {
+			r.shutdownReplica(i)
+		}
+	}
+}
+
+func newReplicatedStore(addresses ...string) *storage.RemoteVersionedStore {
+	vs := storage.NewRemoteVersionedStore(
+		client.New(client.WithAddresses(addresses...), client.WithFallbackToPlainTCP()),
+		storage.WithRequestTimeout(5*time.Second),
+	)
+	vs.Start()
+	return vs
+}
+
 func newAttachedClient(address string) (c *client.Client) {
 	return client.New(client.WithAddress(address), client.WithFallbackToPlainTCP())
 }
 
-func newRemoteVersionedStore(address string) (*storage.RemoteVersionedStore, chan message.Message) {
+func newRemoteVersionedStore(address string, opts ...storage.Option) (*storage.RemoteVersionedStore, chan message.Message) {
 	recv := make(chan message.Message, 1)
-	vs := storage.NewRemoteVersionedStore(
-		client.New(client.WithAddress(address), client.WithFallbackToPlainTCP()),
-		storage.WithRequestTimeout(5*time.Second),
+	opts = append([]storage.Option{
+		storage.WithRequestTimeout(5 * time.Second),
 		storage.WithChangeListener(func(m message.Message) {
 			recv <- m
 		}),
+	}, opts...)
+	vs := storage.NewRemoteVersionedStore(
+		client.New(client.WithAddress(address), client.WithFallbackToPlainTCP()),
+		opts...,
 	)
 	vs.Start()
 	return vs, recv
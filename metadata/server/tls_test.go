@@ -0,0 +1,179 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/metadata/client"
+	"github.com/nicolagi/dino/metadata/server"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dino-tls-")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	ca := newCA(t, dir, "ca")
+	ca.issue(t, dir, "server", "localhost")
+	ca.issue(t, dir, "alice", "alice")
+	ca.issue(t, dir, "mallory", "mallory")
+	newCA(t, dir, "other").issue(t, dir, "impostor", "alice")
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	address, cleanup := newDisposableServer(t,
+		server.WithKeyPair(file("server.pem"), file("server.key")),
+		server.WithClientCAs(file("ca.pem")),
+		server.WithCredentials(server.NewCredentials(server.User{
+			Name: "alice",
+			// A possible hash for "foobar".
+			AuthHash: "$2a$10$xdMaS2UL7abbg2sgnjhR3.aOXpKlg4R3z2XRQoA9MRRTF0I5NrDNy",
+			Grants: []server.Grant{
+				{Access: server.ReadOnly},
+				{Prefix: "home/", Access: server.ReadWrite},
+			},
+		})),
+	)
+	defer cleanup()
+	newStoreWithOptions := func(opts []client.Option, storeOpts ...storage.Option) *storage.RemoteVersionedStore {
+		opts = append([]client.Option{
+			client.WithAddress(address),
+			client.WithCAFile(file("ca.pem")),
+			client.WithServerName("localhost"),
+		}, opts...)
+		storeOpts = append([]storage.Option{storage.WithRequestTimeout(5 * time.Second)}, storeOpts...)
+		vs := storage.NewRemoteVersionedStore(client.New(opts...), storeOpts...)
+		vs.Start()
+		return vs
+	}
+	newStore := func(opts ...client.Option) *storage.RemoteVersionedStore {
+		return newStoreWithOptions(opts)
+	}
+
+	t.Run("the certificate logs the client in as its user", func(t *testing.T) {
+		vs := newStore(client.WithKeyPair(file("alice.pem"), file("alice.key")))
+		defer vs.Stop()
+		assert.Nil(t, vs.Put(0, []byte("home/name"), []byte("tony")))
+		err := vs.Put(0, []byte("etc/name"), []byte("tony"))
+		assert.True(t, errors.Is(err, storage.ErrForbidden), "got %v", err)
+		_, value, err := vs.Get([]byte("home/name"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("tony"), value)
+	})
+	t.Run("certificates not naming a user must still authorize", func(t *testing.T) {
+		vs := newStore(client.WithKeyPair(file("mallory.pem"), file("mallory.key")))
+		defer vs.Stop()
+		_, _, err := vs.Get([]byte("home/name"))
+		assert.True(t, errors.Is(err, storage.ErrUnauthorized), "got %v", err)
+	})
+	t.Run("only users are told the volume doesn't exist", func(t *testing.T) {
+		opts := []client.Option{client.WithKeyPair(file("mallory.pem"), file("mallory.key"))}
+		for password, want := range map[string]error{
+			"foobar": storage.ErrNoVolume,
+			"wrong":  storage.ErrUnauthorized,
+		} {
+			vs := newStoreWithOptions(opts,
+				storage.WithVolume("nowhere"),
+				storage.WithUser("alice"),
+				storage.WithAuthKey(password),
+			)
+			_, _, err := vs.Get([]byte("home/name"))
+			vs.Stop()
+			assert.True(t, errors.Is(err, want), "got %v", err)
+		}
+	})
+	t.Run("clients without a trusted certificate are refused", func(t *testing.T) {
+		for _, opts := range [][]client.Option{
+			{client.WithAddress(address), client.WithCAFile(file("ca.pem"))},
+			{client.WithAddress(address), client.WithCAFile(file("ca.pem")), client.WithKeyPair(file("impostor.pem"), file("impostor.key"))},
+		} {
+			c := client.New(opts...)
+			assert.NotNil(t, c.Connect())
+			c.Close()
+		}
+	})
+	t.Run("servers without a trusted certificate are refused", func(t *testing.T) {
+		c := client.New(
+			client.WithAddress(address),
+			client.WithCAFile(file("other.pem")),
+			client.WithKeyPair(file("alice.pem"), file("alice.key")),
+		)
+		defer c.Close()
+		var uae x509.UnknownAuthorityError
+		assert.True(t, errors.As(c.Connect(), &uae))
+	})
+	t.Run("client certificates require TLS", func(t *testing.T) {
+		s := server.New(server.WithAddress("localhost:0"), server.WithClientCAs(file("ca.pem")))
+		_, err := s.Listen()
+		assert.True(t, errors.Is(err, server.ErrClientCAsWithoutTLS))
+	})
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCA writes a self-signed CA certificate to name.pem in dir.
+func newCA(t *testing.T, dir string, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue writes a certificate for the given common name, valid for both
+// servers and clients, to name.pem in dir, and its key to name.key.
+func (ca *testCA) issue(t *testing.T, dir string, name string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.Nil(t, err)
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	b, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	writePEM(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", b)
+}
+
+func writePEM(t *testing.T, pathname string, blockType string, der []byte) {
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.Nil(t, ioutil.WriteFile(pathname, b, 0600))
+}
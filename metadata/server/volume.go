@@ -0,0 +1,221 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/volume"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Volumes are the volumes clients can choose (see message.OptionVolume). They
+// can be replaced while the server runs: clients of volumes that are gone, or
+// were recreated since, are disconnected.
+type Volumes struct {
+	mu        sync.RWMutex
+	registry  volume.Registry
+	listeners []func(volume.Registry)
+}
+
+func NewVolumes(r volume.Registry) *Volumes {
+	v := new(Volumes)
+	v.Set(r)
+	return v
+}
+
+// Set replaces all volumes.
+func (v *Volumes) Set(r volume.Registry) {
+	m := make(volume.Registry, len(r))
+	for name, vol := range r {
+		m[name] = vol
+	}
+	v.mu.Lock()
+	v.registry = m
+	listeners := v.listeners
+	v.mu.Unlock()
+	for _, f := range listeners {
+		f(m)
+	}
+}
+
+// lookup returns the volume with the given name, if any. There are no volumes
+// besides the default one if v is nil.
+func (v *Volumes) lookup(name string) (volume.Volume, bool) {
+	if v == nil {
+		return volume.Volume{}, false
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	vol, ok := v.registry[name]
+	return vol, ok
+}
+
+// protected tells whether any volume has a password of its own.
+func (v *Volumes) protected() bool {
+	if v == nil {
+		return false
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, vol := range v.registry {
+		if vol.AuthHash != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// listen makes Set call f with the new volumes.
+func (v *Volumes) listen(f func(volume.Registry)) {
+	v.mu.Lock()
+	v.listeners = append(v.listeners, f)
+	v.mu.Unlock()
+}
+
+// WithVolumes lets clients choose among the given volumes, besides the default
+// one. Volumes with a password of their own require TLS.
+func WithVolumes(value *Volumes) Option {
+	return func(o *options) {
+		o.volumes = value
+	}
+}
+
+// selectVolume handles the volume option, which is only allowed before the
+// connection is authorized and before any other request. Unknown volumes are
+// accepted like volumes with a password of their own, so that clients can't
+// tell which volumes exist, but the connection can't be authorized: clients
+// that prove they could otherwise are told the volume doesn't exist.
+func (sc *serverConn) selectVolume(input message.Message) message.Message {
+	if sc.served || sc.authorized {
+		return message.NewCodedErrorMessage(input.Tag(), message.CodeBadRequest, "volume must be chosen before any other request")
+	}
+	v := volume.Volume{}
+	unknown := false
+	if name := input.Value(); name != "" {
+		var ok bool
+		if v, ok = sc.server.opts.volumes.lookup(name); !ok {
+			v = volume.Volume{Name: name}
+			unknown = true
+		}
+	}
+	// Broadcasts look at the volume.
+	sc.server.mu.Lock()
+	sc.volume = v
+	sc.unknownVolume = unknown
+	sc.server.mu.Unlock()
+	return input
+}
+
+// unknownVolumeError is the response to authorizing on an unknown volume.
+func (sc *serverConn) unknownVolumeError(input message.Message) message.Message {
+	return message.NewCodedErrorMessage(input.Tag(), message.CodeNotFound, fmt.Sprintf("%q: %v", sc.volume.Name, volume.ErrNotFound))
+}
+
+// authHashes returns the hashes of the passwords that authorize the connection:
+// the server's, and the volume's own, if any.
+func (sc *serverConn) authHashes() []string {
+	var hashes []string
+	for _, h := range []string{sc.volume.AuthHash, sc.server.opts.authHash} {
+		if h != "" {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+// mustAuthorize tells whether an auth message is due before other requests.
+func (sc *serverConn) mustAuthorize() bool {
+	return !sc.authorized && (sc.unknownVolume || len(sc.authHashes()) != 0 || sc.server.opts.credentials != nil)
+}
+
+// authorize tells whether the password is one of those authorizing the
+// connection, and if so, authorizes it, unless the volume is unknown. The
+// volume's own password is only accepted over TLS (see Listen for the
+// server's).
+func (sc *serverConn) authorize(password string) bool {
+	for _, h := range sc.authHashes() {
+		if h == sc.volume.AuthHash && !sc.server.opts.tls {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(h), []byte(password)) == nil {
+			sc.authorized = !sc.unknownVolume
+			return true
+		}
+	}
+	return false
+}
+
+// toStore maps the keys in a request from the connection's volume to the
+// versioned store. If the request refers to keys outside of the volume, it
+// returns an error message to respond with instead, and false.
+func (sc *serverConn) toStore(input message.Message) (message.Message, bool) {
+	mapKey := func(key string) (string, bool) {
+		mapped := sc.volume.Key(key)
+		_, ok := sc.volume.LocalKey(mapped)
+		return mapped, ok
+	}
+	refuse := func(key string) (message.Message, bool) {
+		return message.NewCodedErrorMessage(input.Tag(), message.CodeBadRequest, fmt.Sprintf("%x: reserved key", key)), false
+	}
+	switch input.Kind() {
+	case message.KindGet, message.KindPut, message.KindGetIfModified:
+		key, ok := mapKey(input.Key())
+		if !ok {
+			return refuse(input.Key())
+		}
+		return input.WithKey(key), true
+	case message.KindGetMany:
+		keys := input.Keys()
+		for i, key := range keys {
+			var ok bool
+			if keys[i], ok = mapKey(key); !ok {
+				return refuse(key)
+			}
+		}
+		return message.NewGetManyMessage(input.Tag(), keys), true
+	default:
+		return input, true
+	}
+}
+
+// fromStore maps the keys in a response from the versioned store to the
+// connection's volume.
+func (sc *serverConn) fromStore(output message.Message) message.Message {
+	switch output.Kind() {
+	case message.KindPut, message.KindNotModified, message.KindInvalidate:
+		if key, ok := sc.volume.LocalKey(output.Key()); ok {
+			return output.WithKey(key)
+		}
+		return output
+	case message.KindEntries:
+		entries := output.Entries()
+		for i, e := range entries {
+			if key, ok := sc.volume.LocalKey(e.Key); ok {
+				entries[i].Key = key
+			}
+		}
+		return message.NewEntriesMessage(output.Tag(), entries).WithSequence(output.Sequence())
+	default:
+		return output
+	}
+}
+
+// volumesChanged disconnects the clients of volumes that were deleted, given
+// the new volumes.
+func (s *Server) volumesChanged(registry volume.Registry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		if conn.volume.IsDefault() || registry[conn.volume.Name].ID == conn.volume.ID {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":     conn.id,
+			"remote": conn.conn.RemoteAddr(),
+			"volume": conn.volume.Name,
+		}).Info("Volume deleted, disconnecting client")
+		conn.close()
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// startWriter starts the goroutine writing the frames queued for the
+// connection, which is the only one writing to it. The queue is closed, and
+// the goroutine waited for, by stopWriter.
+func (sc *serverConn) startWriter() {
+	size := sc.server.opts.queueSize
+	if size <= 0 {
+		size = 1
+	}
+	sc.queue = make(chan []byte, size)
+	sc.written = make(chan struct{})
+	go sc.writeLoop()
+}
+
+func (sc *serverConn) stopWriter() {
+	close(sc.queue)
+	<-sc.written
+}
+
+// writeLoop writes the queued frames to the connection. After a failed write,
+// the connection is closed, so that the input loop stops too, and the frames
+// still queued are discarded, so that no one blocks queueing more.
+func (sc *serverConn) writeLoop() {
+	defer close(sc.written)
+	failed := false
+	for frame := range sc.queue {
+		if failed {
+			continue
+		}
+		if timeout := sc.server.opts.writeTimeout; timeout > 0 {
+			if err := sc.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+					"id":  sc.id,
+				}).Warn("Could not set write deadline")
+			}
+		}
+		if _, err := sc.conn.Write(frame); err != nil {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"id":     sc.id,
+				"remote": sc.conn.RemoteAddr(),
+			}).Warn("Could not write, closing connection")
+			failed = true
+			sc.close()
+		}
+	}
+}
+
+// send queues a frame, waiting for room in the queue if necessary. Used for
+// responses, which a client waits for anyway.
+func (sc *serverConn) send(frame []byte) {
+	sc.queue <- frame
+}
+
+// offer queues a frame if there's room in the queue, and tells whether there
+// was. Used for broadcasts, which must not wait for slow clients.
+func (sc *serverConn) offer(frame []byte) bool {
+	select {
+	case sc.queue <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// offerLocked is like offer, but disconnects the client if there's no room in
+// the queue, since it isn't keeping up. Call with the fan-out mutex held, which
+// must never wait for a slow client: every broadcast would wait too.
+func (sc *serverConn) offerLocked(frame []byte) bool {
+	if sc.offer(frame) {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"id":     sc.id,
+		"user":   sc.user,
+		"remote": sc.conn.RemoteAddr(),
+	}).Warn("Client too slow to keep up, disconnecting")
+	sc.slow = true
+	sc.close()
+	return false
+}
+
+// encode encodes a message using the framing agreed upon for the connection.
+func (sc *serverConn) encode(m message.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	err := sc.encoder.Encode(&buf, m)
+	return buf.Bytes(), err
+}
+
+// broadcastFrames encodes a broadcast once for each volume, framing and kind of
+// broadcast (puts or invalidations) in use, rather than once per connection.
+type broadcastFrames struct {
+	put    message.Message
+	frames map[broadcastVariant][]byte
+}
+
+type broadcastVariant struct {
+	volume        string
+	wide          bool
+	sequences     bool
+	invalidations bool
+}
+
+func newBroadcastFrames(put message.Message) *broadcastFrames {
+	return &broadcastFrames{
+		put:    put.ForBroadcast(),
+		frames: make(map[broadcastVariant][]byte),
+	}
+}
+
+// frame returns the frame for connections on the given volume, whose key for
+// the put is the given one.
+func (bf *broadcastFrames) frame(v volume.Volume, key string, wide bool, sequences bool, invalidations bool) ([]byte, error) {
+	variant := broadcastVariant{volume: v.ID, wide: wide, sequences: sequences, invalidations: invalidations}
+	if frame, ok := bf.frames[variant]; ok {
+		return frame, nil
+	}
+	m := bf.put.WithKey(key)
+	if invalidations {
+		m = m.ForInvalidation()
+	}
+	var encoder message.Encoder
+	encoder.SetWide(wide)
+	encoder.SetSequences(sequences)
+	var buf bytes.Buffer
+	if err := encoder.Encode(&buf, m); err != nil {
+		return nil, err
+	}
+	bf.frames[variant] = buf.Bytes()
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,5 @@
+// Package volume manages the registry of the volumes a metadata server holds,
+// each an independent key space (and so an independent file system) in the
+// same versioned store, and maps keys between volumes and that store. The
+// registry is kept in a file, outside of the store.
+package volume // import "github.com/nicolagi/dino/metadata/volume"
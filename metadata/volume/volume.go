@@ -0,0 +1,187 @@
+package volume
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrExists      = errors.New("volume exists")
+	ErrNotFound    = errors.New("no such volume")
+	ErrInvalidName = errors.New("invalid volume name")
+)
+
+// The keys of all volumes but the default one start with this prefix, followed
+// by the volume id and a NUL byte. The default volume can't use such keys.
+const keyPrefix = "\x00volume\x00"
+
+// Volume is a key space of its own within a versioned store. The zero value is
+// the default volume, whose keys are the keys of the versioned store itself.
+type Volume struct {
+	Name string `json:"name"`
+
+	// Random, so that a new volume doesn't see the keys of a deleted volume
+	// with the same name.
+	ID string `json:"id"`
+
+	// The bcrypt hash of the volume password, if any.
+	AuthHash string `json:"auth_hash,omitempty"`
+}
+
+// IsDefault tells whether the volume is the default volume.
+func (v Volume) IsDefault() bool {
+	return v.ID == ""
+}
+
+// Key maps a key of the volume to the key in the versioned store.
+func (v Volume) Key(key string) string {
+	if v.IsDefault() {
+		return key
+	}
+	return keyPrefix + v.ID + "\x00" + key
+}
+
+// LocalKey maps a key in the versioned store to the key of the volume. It
+// returns false if the key doesn't belong to the volume.
+func (v Volume) LocalKey(key string) (string, bool) {
+	if v.IsDefault() {
+		return key, !strings.HasPrefix(key, keyPrefix)
+	}
+	prefix := keyPrefix + v.ID + "\x00"
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	return key[len(prefix):], true
+}
+
+// ValidName tells whether a name can be used for a new volume: up to 64
+// letters, digits, dots, dashes and underscores.
+func ValidName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '.', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Registry holds all volumes but the default one, by name. It's kept in a file
+// of its own rather than in the versioned store, so that clients can't read or
+// change the password hashes, and so that the same volumes, with the same ids,
+// can be given to all replicas and shards.
+type Registry map[string]Volume
+
+// Decode decodes a registry, as encoded by Encode.
+func Decode(value []byte) (Registry, error) {
+	r := make(Registry)
+	if err := json.Unmarshal(value, &r); err != nil {
+		return nil, fmt.Errorf("could not decode volume registry: %w", err)
+	}
+	for name, v := range r {
+		if name != v.Name || !ValidName(name) || v.ID == "" {
+			return nil, fmt.Errorf("could not decode volume registry: %q: %w", name, ErrInvalidName)
+		}
+	}
+	return r, nil
+}
+
+// Encode encodes the registry, one volume per line.
+func (r Registry) Encode() ([]byte, error) {
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// LoadFile reads the registry from a file. A missing file is an empty registry.
+func LoadFile(pathname string) (Registry, error) {
+	b, err := ioutil.ReadFile(pathname)
+	if os.IsNotExist(err) {
+		return make(Registry), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Decode(b)
+}
+
+// SaveFile writes the registry to a file, replacing it as a whole, so that
+// servers reading it meanwhile see either the old or the new registry.
+func (r Registry) SaveFile(pathname string) error {
+	b, err := r.Encode()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(pathname), filepath.Base(pathname)+".")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), pathname)
+}
+
+// Create adds a volume with the given name and password hash (empty for no
+// password of its own) to the registry.
+func (r Registry) Create(name string, authHash string) (v Volume, err error) {
+	if !ValidName(name) {
+		return v, fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+	if _, ok := r[name]; ok {
+		return v, fmt.Errorf("%q: %w", name, ErrExists)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return v, err
+	}
+	v = Volume{
+		Name:     name,
+		ID:       hex.EncodeToString(id),
+		AuthHash: authHash,
+	}
+	r[name] = v
+	return v, nil
+}
+
+// Delete removes a volume from the registry. Its keys are left in the store,
+// but are no longer reachable.
+func (r Registry) Delete(name string) error {
+	if _, ok := r[name]; !ok {
+		return fmt.Errorf("%q: %w", name, ErrNotFound)
+	}
+	delete(r, name)
+	return nil
+}
+
+// List returns all volumes in the registry, sorted by name.
+func (r Registry) List() []Volume {
+	volumes := make([]Volume, 0, len(r))
+	for _, v := range r {
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Name < volumes[j].Name
+	})
+	return volumes
+}
@@ -0,0 +1,97 @@
+package volume_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/dino/metadata/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := make(volume.Registry)
+	assert.Empty(t, r.List())
+
+	home, err := r.Create("home", "")
+	require.Nil(t, err)
+	work, err := r.Create("work", "hash")
+	require.Nil(t, err)
+	assert.NotEqual(t, home.ID, work.ID)
+
+	_, err = r.Create("home", "")
+	assert.True(t, errors.Is(err, volume.ErrExists))
+	_, err = r.Create("no/slashes", "")
+	assert.True(t, errors.Is(err, volume.ErrInvalidName))
+	assert.Equal(t, []volume.Volume{home, work}, r.List())
+
+	require.Nil(t, r.Delete("home"))
+	assert.True(t, errors.Is(r.Delete("home"), volume.ErrNotFound))
+	recreated, err := r.Create("home", "")
+	require.Nil(t, err)
+	assert.NotEqual(t, home.ID, recreated.ID)
+	assert.Equal(t, []volume.Volume{recreated, work}, r.List())
+}
+
+func TestRegistryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dino-volumes-")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	pathname := filepath.Join(dir, "volumes.json")
+
+	t.Run("a missing file is an empty registry", func(t *testing.T) {
+		r, err := volume.LoadFile(pathname)
+		require.Nil(t, err)
+		assert.Empty(t, r)
+	})
+	t.Run("volumes are saved and loaded", func(t *testing.T) {
+		r := make(volume.Registry)
+		_, err := r.Create("home", "hash")
+		require.Nil(t, err)
+		require.Nil(t, r.SaveFile(pathname))
+		loaded, err := volume.LoadFile(pathname)
+		require.Nil(t, err)
+		assert.Equal(t, r, loaded)
+		names, err := filepath.Glob(filepath.Join(dir, "*"))
+		require.Nil(t, err)
+		assert.Equal(t, []string{pathname}, names)
+	})
+	t.Run("invalid volumes are refused", func(t *testing.T) {
+		for _, value := range []string{
+			`{"home": {"name": "work", "id": "1234"}}`,
+			`{"no/slashes": {"name": "no/slashes", "id": "1234"}}`,
+			`{"home": {"name": "home"}}`,
+		} {
+			_, err := volume.Decode([]byte(value))
+			assert.True(t, errors.Is(err, volume.ErrInvalidName), "%s: got %v", value, err)
+		}
+	})
+}
+
+func TestKeys(t *testing.T) {
+	var def volume.Volume
+	v := volume.Volume{Name: "home", ID: "1234"}
+	other := volume.Volume{Name: "work", ID: "5678"}
+
+	assert.Equal(t, "root", def.Key("root"))
+	key, ok := def.LocalKey("root")
+	assert.True(t, ok)
+	assert.Equal(t, "root", key)
+
+	mapped := v.Key("root")
+	assert.NotEqual(t, "root", mapped)
+	key, ok = v.LocalKey(mapped)
+	assert.True(t, ok)
+	assert.Equal(t, "root", key)
+
+	// Keys of a volume belong to no other volume.
+	_, ok = def.LocalKey(mapped)
+	assert.False(t, ok)
+	_, ok = other.LocalKey(mapped)
+	assert.False(t, ok)
+	_, ok = v.LocalKey("root")
+	assert.False(t, ok)
+}
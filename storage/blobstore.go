@@ -1,35 +1,158 @@
 package storage
 
 import (
-	"crypto/sha1"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
 )
 
+// ErrCorrupted indicates that a blob's content does not hash to its key.
+var ErrCorrupted = errors.New("content does not match key")
+
 type BlobStore interface {
 	Get(key []byte) (value []byte, err error)
 	Put(value []byte) (key []byte, err error)
 }
 
+// ContextBlobStore is like BlobStore, but its operations take a context.
+type ContextBlobStore interface {
+	GetContext(ctx context.Context, key []byte) (value []byte, err error)
+	PutContext(ctx context.Context, value []byte) (key []byte, err error)
+}
+
 // BlobStore wraps a Store to make sure content is never overwritten, by using
-// as key for a value the SHA1 hash of the value. Even if there are concurrent
-// writes for the same key, those would write the same contents (with very high
-// probability).
+// as key for a value a hash of the value (see ContentKey). Even if there are
+// concurrent writes for the same key, those would write the same contents (with
+// very high probability). Values can be read with keys computed with any
+// algorithm, including legacy SHA-1 keys.
 type BlobStoreWrapper struct {
 	delegate Store
+	opts     blobStoreOptions
+}
+
+type blobStoreOptions struct {
+	verify bool
+	alg    HashAlgorithm
+}
+
+type BlobStoreOption func(*blobStoreOptions)
+
+// WithHashAlgorithm makes the blob store compute the keys of the values it
+// puts with the given algorithm, rather than DefaultHashAlgorithm.
+func WithHashAlgorithm(alg HashAlgorithm) BlobStoreOption {
+	return func(o *blobStoreOptions) {
+		o.alg = alg
+	}
 }
 
-func NewBlobStore(delegate Store) *BlobStoreWrapper {
-	return &BlobStoreWrapper{
+// WithVerification makes the blob store check that the values it gets hash
+// to their keys, and return ErrCorrupted otherwise.
+func WithVerification() BlobStoreOption {
+	return func(o *blobStoreOptions) {
+		o.verify = true
+	}
+}
+
+func NewBlobStore(delegate Store, opts ...BlobStoreOption) *BlobStoreWrapper {
+	s := &BlobStoreWrapper{
 		delegate: delegate,
+		opts: blobStoreOptions{
+			alg: DefaultHashAlgorithm,
+		},
 	}
+	for _, o := range opts {
+		o(&s.opts)
+	}
+	return s
 }
 
 func (s *BlobStoreWrapper) Put(value []byte) (key []byte, err error) {
-	hash := sha1.Sum(value)
-	key = hash[:]
-	err = s.delegate.Put(key, value)
+	return s.PutContext(context.Background(), value)
+}
+
+// PutContext implements ContextBlobStore. Since the key is derived from the
+// value, the value isn't written if the delegate has the key already. If the
+// delegate can't tell, the value is written anyway. Paired stores are only
+// asked about their fast store: they find out which values their slow store
+// has in the background, in batches, rather than on every put.
+func (s *BlobStoreWrapper) PutContext(ctx context.Context, value []byte) (key []byte, err error) {
+	key = ContentKey(s.opts.alg, value)
+	checked := s.delegate
+	if p, ok := checked.(Paired); ok {
+		checked = p.fast
+	}
+	if has, _ := Has(ctx, checked, key); has {
+		return key, nil
+	}
+	err = PutContext(ctx, s.delegate, key, value)
 	return
 }
 
+// HashAlgorithm returns the algorithm the blob store computes keys with.
+func (s *BlobStoreWrapper) HashAlgorithm() HashAlgorithm {
+	return s.opts.alg
+}
+
 func (s *BlobStoreWrapper) Get(key []byte) (value []byte, err error) {
-	return s.delegate.Get(key)
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextBlobStore.
+func (s *BlobStoreWrapper) GetContext(ctx context.Context, key []byte) (value []byte, err error) {
+	value, err = GetContext(ctx, s.delegate, key)
+	if err == nil && s.opts.verify {
+		if err = VerifyBlob(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return value, err
+}
+
+// VerifyBlob returns ErrCorrupted if the value does not hash to the blob key,
+// or if the key is not a content key.
+func VerifyBlob(key, value []byte) error {
+	alg, err := ParseContentKey(key)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, ErrCorrupted)
+	}
+	if !bytes.Equal(ContentKey(alg, value), key) {
+		return fmt.Errorf("%x: %w", key, ErrCorrupted)
+	}
+	return nil
+}
+
+// NewVerifyingReader returns a reader that reads from r, and when r is
+// exhausted, returns ErrCorrupted rather than io.EOF if what it read does not
+// hash to the blob key. It's meant to be read to the end, e.g., by
+// PutStream with an unknown size, so that a corrupted value fails the put.
+// If the key is not a content key, reading fails straight away.
+func NewVerifyingReader(key []byte, r io.Reader) io.Reader {
+	alg, err := ParseContentKey(key)
+	if err != nil {
+		return &verifyingReader{err: fmt.Errorf("%v: %w", err, ErrCorrupted)}
+	}
+	return &verifyingReader{key: key, r: r, alg: alg, hash: alg.new()}
+}
+
+type verifyingReader struct {
+	key  []byte
+	r    io.Reader
+	alg  HashAlgorithm
+	hash hash.Hash
+	err  error
+}
+
+func (v *verifyingReader) Read(p []byte) (n int, err error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err = v.r.Read(p)
+	_, _ = v.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(contentKeyFor(v.alg, v.hash), v.key) {
+		err = fmt.Errorf("%x: %w", v.key, ErrCorrupted)
+	}
+	return n, err
 }
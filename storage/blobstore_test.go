@@ -1,11 +1,17 @@
 package storage_test
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/nicolagi/dino/message"
 	"github.com/nicolagi/dino/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBlobStore(t *testing.T) {
@@ -16,8 +22,8 @@ func TestBlobStore(t *testing.T) {
 		key2, err2 := store.Put(value)
 		assert.Nil(t, err1)
 		assert.Nil(t, err2)
-		assert.Len(t, key1, 20)
-		assert.Len(t, key2, 20)
+		assert.Len(t, key1, 33)
+		assert.Len(t, key2, 33)
 		assert.Equal(t, key1, key2)
 	})
 	t.Run("different values, different keys", func(t *testing.T) {
@@ -27,8 +33,8 @@ func TestBlobStore(t *testing.T) {
 		key2, err2 := store.Put(value2)
 		assert.Nil(t, err1)
 		assert.Nil(t, err2)
-		assert.Len(t, key1, 20)
-		assert.Len(t, key2, 20)
+		assert.Len(t, key1, 33)
+		assert.Len(t, key2, 33)
 		assert.NotEqual(t, key1, key2)
 	})
 	t.Run("what you put is what you get", func(t *testing.T) {
@@ -40,3 +46,76 @@ func TestBlobStore(t *testing.T) {
 		assert.Equal(t, before, after)
 	})
 }
+
+func TestContentKeys(t *testing.T) {
+	value := []byte("value")
+	t.Run("keys describe their algorithm", func(t *testing.T) {
+		for _, tc := range []struct {
+			alg  storage.HashAlgorithm
+			name string
+			size int
+		}{
+			{storage.SHA1, "sha1", 20},
+			{storage.SHA256, "sha256", 33},
+			{storage.BLAKE2b256, "blake2b-256", 33},
+		} {
+			store := storage.NewBlobStore(storage.NewInMemoryStore(), storage.WithHashAlgorithm(tc.alg))
+			key, err := store.Put(value)
+			require.Nil(t, err)
+			assert.Len(t, key, tc.size)
+			assert.Equal(t, storage.ContentKey(tc.alg, value), key)
+			alg, err := storage.ParseContentKey(key)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.alg, alg)
+			assert.Nil(t, storage.VerifyBlob(key, value))
+			alg, err = storage.ParseHashAlgorithm(tc.name)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.alg, alg)
+		}
+	})
+	t.Run("legacy keys stay readable", func(t *testing.T) {
+		delegate := storage.NewInMemoryStore()
+		legacy := sha1.Sum(value)
+		require.Nil(t, delegate.Put(legacy[:], value))
+		got, err := storage.NewBlobStore(delegate, storage.WithVerification()).Get(legacy[:])
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+	})
+	t.Run("invalid keys", func(t *testing.T) {
+		for _, key := range [][]byte{nil, {byte(storage.SHA256), 1, 2}, append([]byte{42}, make([]byte, 32)...)} {
+			_, err := storage.ParseContentKey(key)
+			assert.NotNil(t, err, "%x", key)
+			assert.True(t, errors.Is(storage.VerifyBlob(key, value), storage.ErrCorrupted), "%x", key)
+		}
+		_, err := storage.ParseHashAlgorithm("md5")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestBlobStoreVerification(t *testing.T) {
+	delegate := storage.NewInMemoryStore()
+	store := storage.NewBlobStore(delegate, storage.WithVerification())
+	value := message.RandomBytes()
+	key, err := store.Put(value)
+	require.Nil(t, err)
+	t.Run("intact values are returned", func(t *testing.T) {
+		got, err := store.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+	})
+	t.Run("corrupted values are rejected", func(t *testing.T) {
+		require.Nil(t, delegate.Put(key, []byte("something else")))
+		_, err := store.Get(key)
+		assert.True(t, errors.Is(err, storage.ErrCorrupted), "got %v", err)
+		got, err := storage.NewBlobStore(delegate).Get(key)
+		assert.Nil(t, err, "only checked in verify mode")
+		assert.Equal(t, "something else", string(got))
+	})
+	t.Run("verifying reader", func(t *testing.T) {
+		b, err := ioutil.ReadAll(storage.NewVerifyingReader(key, bytes.NewReader(value)))
+		assert.Nil(t, err)
+		assert.Equal(t, value, b)
+		_, err = ioutil.ReadAll(storage.NewVerifyingReader(key, strings.NewReader("something else")))
+		assert.True(t, errors.Is(err, storage.ErrCorrupted), "got %v", err)
+	})
+}
@@ -59,3 +59,70 @@ func (s *BoltStore) Get(key []byte) (value []byte, err error) {
 	})
 	return value, err
 }
+
+// BoltVersionedStore is a native VersionedStore implementation backed by a
+// Bolt database. Unlike a VersionedWrapper around a BoltStore, it checks the
+// version and writes in a single transaction, and doesn't serialize gets.
+// Values are stored in the same bucket and with the same encoding as the
+// wrapper would, so either can be used on the same database.
+type BoltVersionedStore bolt.DB
+
+func init() {
+	registerVersionedBuilder("boltdb", func(_ *Builder, store Store, _ map[string]interface{}) (VersionedStore, error) {
+		return NewBoltVersionedStore((*bolt.DB)(store.(*BoltStore)))
+	})
+}
+
+func NewBoltVersionedStore(db *bolt.DB) (*BoltVersionedStore, error) {
+	_, err := NewBoltStore(db)
+	return (*BoltVersionedStore)(db), err
+}
+
+// Put stores the given value at the given key, provided the passed version
+// is greater than the current one.
+func (s *BoltVersionedStore) Put(version uint64, key []byte, value []byte) error {
+	return (*bolt.DB)(s).Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		if curr := bucket.Get(key); curr != nil {
+			if currVersion, _ := decodeVersioned(curr); version <= currVersion {
+				return ErrStalePut
+			}
+		}
+		if err := bucket.Put(key, encodeVersioned(version, value)); err != nil {
+			return fmt.Errorf("could not put %.40q with %.40q: %w", key, value, err)
+		}
+		return nil
+	})
+}
+
+func (s *BoltVersionedStore) Get(key []byte) (version uint64, value []byte, err error) {
+	err = (*bolt.DB)(s).View(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket(bucketName).Get(key)
+		if encoded == nil {
+			return fmt.Errorf("%.40q: %w", key, ErrNotFound)
+		}
+		// Values are only valid for the life of the transaction.
+		version, value = decodeVersioned(encoded)
+		value = dup(value)
+		return nil
+	})
+	return version, value, err
+}
+
+// GetMany implements MultiGetter, reading all keys in one transaction.
+func (s *BoltVersionedStore) GetMany(keys [][]byte) (map[string]VersionedValue, error) {
+	values := make(map[string]VersionedValue, len(keys))
+	err := (*bolt.DB)(s).View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		for _, key := range keys {
+			encoded := bucket.Get(key)
+			if encoded == nil {
+				continue
+			}
+			version, value := decodeVersioned(encoded)
+			values[string(key)] = VersionedValue{Version: version, Value: dup(value)}
+		}
+		return nil
+	})
+	return values, err
+}
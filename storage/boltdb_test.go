@@ -31,3 +31,51 @@ file = %q
 	_, ok := store.(*storage.BoltStore)
 	assert.True(t, ok)
 }
+
+func TestBoltVersionedStore(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	var config map[string]interface{}
+	require.Nil(t, toml.Unmarshal([]byte(fmt.Sprintf(`[boltdb-store]
+type = "boltdb"
+file = %q
+versioning = "native"
+`, f.Name())), &config))
+	builder := storage.NewBuilder(config)
+	vs, err := builder.VersionedStoreByName("boltdb-store")
+	require.Nil(t, err)
+	native, ok := vs.(*storage.BoltVersionedStore)
+	require.True(t, ok)
+
+	t.Run("shares data with a wrapped bolt store", func(t *testing.T) {
+		store, err := builder.StoreByName("boltdb-store")
+		require.Nil(t, err)
+		wrapped := storage.NewVersionedWrapper(store)
+		require.Nil(t, wrapped.Put(3, []byte("artist"), []byte("Coltrane")))
+		version, value, err := native.Get([]byte("artist"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 3, version)
+		assert.Equal(t, []byte("Coltrane"), value)
+		assert.Equal(t, storage.ErrStalePut, native.Put(3, []byte("artist"), []byte("Davis")))
+		require.Nil(t, native.Put(4, []byte("artist"), []byte("Davis")))
+		version, value, err = wrapped.Get([]byte("artist"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 4, version)
+		assert.Equal(t, []byte("Davis"), value)
+	})
+	t.Run("get many", func(t *testing.T) {
+		require.Nil(t, native.Put(1, []byte("one"), []byte("uno")))
+		require.Nil(t, native.Put(2, []byte("two"), []byte("due")))
+		values, err := storage.GetMany(native, [][]byte{[]byte("one"), []byte("two"), []byte("three")})
+		require.Nil(t, err)
+		assert.Equal(t, map[string]storage.VersionedValue{
+			"one": {Version: 1, Value: []byte("uno")},
+			"two": {Version: 2, Value: []byte("due")},
+		}, values)
+	})
+}
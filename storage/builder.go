@@ -12,17 +12,95 @@ func registerBuilder(storeType string, storeBuilder builderFunc) {
 	builderByType[storeType] = storeBuilder
 }
 
+// A versionedBuilderFunc builds a native versioned store on top of the plain
+// store of the same type, which it can share resources with (e.g., a database
+// handle).
+type versionedBuilderFunc func(builder *Builder, store Store, config map[string]interface{}) (VersionedStore, error)
+
+var versionedBuilderByType = make(map[string]versionedBuilderFunc)
+
+func registerVersionedBuilder(storeType string, storeBuilder versionedBuilderFunc) {
+	versionedBuilderByType[storeType] = storeBuilder
+}
+
+const (
+	// The versioning property of a store configuration tells how
+	// VersionedStoreByName should build a versioned store: by wrapping the
+	// store with a VersionedWrapper (the default), or natively, checking
+	// versions and writing atomically in the backend, without serializing all
+	// calls. Only some store types support native versioning.
+	versioningWrapper = "wrapper"
+	versioningNative  = "native"
+)
+
 type Builder struct {
 	config map[string]interface{}
 	stores map[string]Store
 	errors map[string]error
+
+	versionedStores map[string]VersionedStore
+	versionedErrors map[string]error
 }
 
 func NewBuilder(config map[string]interface{}) *Builder {
 	return &Builder{
-		config: config,
-		stores: make(map[string]Store),
-		errors: make(map[string]error),
+		config:          config,
+		stores:          make(map[string]Store),
+		errors:          make(map[string]error),
+		versionedStores: make(map[string]VersionedStore),
+		versionedErrors: make(map[string]error),
+	}
+}
+
+// VersionedStoreByName builds a versioned store from the store configuration
+// with the given name, according to its versioning property. The underlying
+// store is the one StoreByName returns for the same name.
+func (b *Builder) VersionedStoreByName(name string) (VersionedStore, error) {
+	if err := b.versionedErrors[name]; err != nil {
+		return nil, err
+	}
+	if store := b.versionedStores[name]; store != nil {
+		return store, nil
+	}
+	store, err := b.versionedStoreByName(name)
+	if err != nil {
+		b.versionedErrors[name] = err
+	} else {
+		b.versionedStores[name] = store
+	}
+	return store, err
+}
+
+func (b *Builder) versionedStoreByName(name string) (VersionedStore, error) {
+	storeConfig, err := b.getMap(b.config, name)
+	if err != nil {
+		return nil, err
+	}
+	versioning := versioningWrapper
+	if storeConfig["versioning"] != nil {
+		if versioning, err = b.getString(storeConfig, "versioning"); err != nil {
+			return nil, err
+		}
+	}
+	store, err := b.StoreByName(name)
+	if err != nil {
+		return nil, err
+	}
+	switch versioning {
+	case versioningWrapper:
+		return NewVersionedWrapper(store), nil
+	case versioningNative:
+		storeType, err := b.getString(storeConfig, "type")
+		if err != nil {
+			return nil, err
+		}
+		storeBuilder := versionedBuilderByType[storeType]
+		if storeBuilder == nil {
+			return nil, fmt.Errorf("stores of type %q don't support native versioning", storeType)
+		}
+		return storeBuilder(b, store, storeConfig)
+	default:
+		return nil, fmt.Errorf("unknown versioning %q, want %q or %q", versioning, versioningWrapper, versioningNative)
 	}
 }
 
@@ -60,6 +60,36 @@ type = 666
 		assert.Nil(t, store)
 		assert.NotNil(t, err)
 	})
+	t.Run("versioned stores are wrapped by default", func(t *testing.T) {
+		var config map[string]interface{}
+		require.Nil(t, toml.Unmarshal([]byte(`[store]
+type = "in-memory"
+`), &config))
+		store, err := NewBuilder(config).VersionedStoreByName("store")
+		require.Nil(t, err)
+		_, ok := store.(*VersionedWrapper)
+		assert.True(t, ok)
+	})
+	t.Run("native versioning not supported", func(t *testing.T) {
+		var config map[string]interface{}
+		require.Nil(t, toml.Unmarshal([]byte(`[store]
+type = "in-memory"
+versioning = "native"
+`), &config))
+		store, err := NewBuilder(config).VersionedStoreByName("store")
+		assert.Nil(t, store)
+		assert.NotNil(t, err)
+	})
+	t.Run("unknown versioning", func(t *testing.T) {
+		var config map[string]interface{}
+		require.Nil(t, toml.Unmarshal([]byte(`[store]
+type = "in-memory"
+versioning = "optimistic"
+`), &config))
+		store, err := NewBuilder(config).VersionedStoreByName("store")
+		assert.Nil(t, store)
+		assert.NotNil(t, err)
+	})
 	t.Run("errors are cached", func(t *testing.T) {
 		registerBuilder("faulty", func(*Builder, map[string]interface{}) (Store, error) {
 			return nil, fmt.Errorf("error@%d", time.Now().UnixNano())
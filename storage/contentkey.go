@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashAlgorithm identifies the hash function a content key is computed with.
+// Content keys are the algorithm, as a single byte, followed by the digest of
+// the content. Legacy content keys, computed before keys described their
+// algorithm, are the bare 20-byte SHA-1 digest.
+type HashAlgorithm byte
+
+const (
+	// SHA1 content keys are written in the legacy format, so that they can
+	// be verified by older clients.
+	SHA1 HashAlgorithm = iota + 1
+	SHA256
+	BLAKE2b256
+
+	// DefaultHashAlgorithm is the algorithm blob stores compute new content
+	// keys with, unless told otherwise.
+	DefaultHashAlgorithm = SHA256
+)
+
+func (alg HashAlgorithm) String() string {
+	switch alg {
+	case SHA1:
+		return "sha1"
+	case SHA256:
+		return "sha256"
+	case BLAKE2b256:
+		return "blake2b-256"
+	default:
+		return fmt.Sprintf("HashAlgorithm(%d)", byte(alg))
+	}
+}
+
+// ParseHashAlgorithm returns the algorithm with the given name, as returned by
+// its String method.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	for _, alg := range []HashAlgorithm{SHA1, SHA256, BLAKE2b256} {
+		if name == alg.String() {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("%q: unknown hash algorithm, want sha1, sha256 or blake2b-256", name)
+}
+
+func (alg HashAlgorithm) new() hash.Hash {
+	switch alg {
+	case SHA1:
+		return sha1.New()
+	case SHA256:
+		return sha256.New()
+	case BLAKE2b256:
+		h, _ := blake2b.New256(nil) // Only fails for bad keys.
+		return h
+	default:
+		return nil
+	}
+}
+
+// ContentKey returns the key for the value, computed with the given algorithm.
+func ContentKey(alg HashAlgorithm, value []byte) []byte {
+	h := alg.new()
+	_, _ = h.Write(value)
+	return contentKeyFor(alg, h)
+}
+
+// contentKeyFor returns the content key for what was written to h.
+func contentKeyFor(alg HashAlgorithm, h hash.Hash) []byte {
+	if alg == SHA1 {
+		return h.Sum(nil)
+	}
+	return h.Sum([]byte{byte(alg)})
+}
+
+// ParseContentKey returns the algorithm the content key was computed with, or
+// an error if the key is not a content key.
+func ParseContentKey(key []byte) (HashAlgorithm, error) {
+	if len(key) == sha1.Size {
+		return SHA1, nil
+	}
+	if len(key) == 0 {
+		return 0, fmt.Errorf("empty content key")
+	}
+	alg := HashAlgorithm(key[0])
+	h := alg.new()
+	if h == nil || len(key) != 1+h.Size() {
+		return 0, fmt.Errorf("%.10x: not a content key", key)
+	}
+	return alg, nil
+}
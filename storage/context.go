@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// ContextStore is implemented by stores whose operations can be cancelled, or
+// be given a deadline, through a context. Use the PutContext and GetContext
+// functions to fall back to the plain methods for other stores.
+type ContextStore interface {
+	PutContext(ctx context.Context, key, value []byte) (err error)
+
+	// GetContext should return ErrNotFound if the key is not in the store.
+	GetContext(ctx context.Context, key []byte) (value []byte, err error)
+}
+
+// ContextVersionedStore is like ContextStore, for versioned stores. Use the
+// VersionedPutContext and VersionedGetContext functions to fall back to the
+// plain methods for other versioned stores.
+type ContextVersionedStore interface {
+	PutContext(ctx context.Context, version uint64, key []byte, value []byte) (err error)
+	GetContext(ctx context.Context, key []byte) (version uint64, value []byte, err error)
+}
+
+// ContextConditionalGetter is like ConditionalGetter, but takes a context.
+type ContextConditionalGetter interface {
+	GetIfModifiedContext(ctx context.Context, key []byte, version uint64) (newVersion uint64, value []byte, err error)
+}
+
+// ContextMultiGetter is like MultiGetter, but takes a context.
+type ContextMultiGetter interface {
+	GetManyContext(ctx context.Context, keys [][]byte) (map[string]VersionedValue, error)
+}
+
+// ContextSubscriber is like Subscriber, but takes a context.
+type ContextSubscriber interface {
+	SubscribeContext(ctx context.Context, key []byte) error
+	UnsubscribeContext(ctx context.Context, key []byte) error
+}
+
+// ContextMultiSubscriber is like MultiSubscriber, but takes a context.
+type ContextMultiSubscriber interface {
+	SubscribeManyContext(ctx context.Context, keys [][]byte) error
+}
+
+// PutContext calls the store's PutContext method if it is a ContextStore.
+// Otherwise, it calls Put, unless the context is already done. Stores that
+// don't take a context are expected to be local and fast, so that checking
+// once before starting is good enough.
+func PutContext(ctx context.Context, store Store, key, value []byte) error {
+	if cs, ok := store.(ContextStore); ok {
+		return cs.PutContext(ctx, key, value)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Put(key, value)
+}
+
+// GetContext is like PutContext, for gets.
+func GetContext(ctx context.Context, store Store, key []byte) ([]byte, error) {
+	if cs, ok := store.(ContextStore); ok {
+		return cs.GetContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.Get(key)
+}
+
+// VersionedPutContext is like PutContext, for versioned stores.
+func VersionedPutContext(ctx context.Context, store VersionedStore, version uint64, key []byte, value []byte) error {
+	if cs, ok := store.(ContextVersionedStore); ok {
+		return cs.PutContext(ctx, version, key, value)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Put(version, key, value)
+}
+
+// VersionedGetContext is like GetContext, for versioned stores.
+func VersionedGetContext(ctx context.Context, store VersionedStore, key []byte) (uint64, []byte, error) {
+	if cs, ok := store.(ContextVersionedStore); ok {
+		return cs.GetContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	return store.Get(key)
+}
+
+// GetIfModifiedContext is like GetIfModified, but takes a context.
+func GetIfModifiedContext(ctx context.Context, store VersionedStore, key []byte, version uint64) (newVersion uint64, value []byte, err error) {
+	if cg, ok := store.(ContextConditionalGetter); ok {
+		return cg.GetIfModifiedContext(ctx, key, version)
+	}
+	if _, ok := store.(ConditionalGetter); ok {
+		if err := ctx.Err(); err != nil {
+			return 0, nil, err
+		}
+		return GetIfModified(store, key, version)
+	}
+	newVersion, value, err = VersionedGetContext(ctx, store, key)
+	if err == nil && newVersion == version {
+		return 0, nil, ErrNotModified
+	}
+	return newVersion, value, err
+}
+
+// GetManyContext is like GetMany, but takes a context.
+func GetManyContext(ctx context.Context, store VersionedStore, keys [][]byte) (map[string]VersionedValue, error) {
+	if mg, ok := store.(ContextMultiGetter); ok {
+		return mg.GetManyContext(ctx, keys)
+	}
+	if _, ok := store.(MultiGetter); ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return GetMany(store, keys)
+	}
+	values := make(map[string]VersionedValue, len(keys))
+	for _, key := range keys {
+		version, value, err := VersionedGetContext(ctx, store, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[string(key)] = VersionedValue{Version: version, Value: value}
+	}
+	return values, nil
+}
+
+// SubscribeManyContext is like SubscribeMany, but takes a context.
+func SubscribeManyContext(ctx context.Context, store VersionedStore, keys [][]byte) error {
+	if ms, ok := store.(ContextMultiSubscriber); ok {
+		return ms.SubscribeManyContext(ctx, keys)
+	}
+	if _, ok := store.(MultiSubscriber); ok {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return SubscribeMany(store, keys)
+	}
+	if s, ok := store.(ContextSubscriber); ok {
+		for _, key := range keys {
+			if err := s.SubscribeContext(ctx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, ok := store.(Subscriber); ok {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return SubscribeMany(store, keys)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextFallbacks(t *testing.T) {
+	store := storage.NewInMemoryStore()
+	versioned := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	live := context.Background()
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("store", func(t *testing.T) {
+		require.Nil(t, storage.PutContext(live, store, []byte("k"), []byte("v")))
+		value, err := storage.GetContext(live, store, []byte("k"))
+		require.Nil(t, err)
+		assert.Equal(t, []byte("v"), value)
+		assert.Equal(t, context.Canceled, storage.PutContext(done, store, []byte("k"), []byte("w")))
+		_, err = storage.GetContext(done, store, []byte("k"))
+		assert.Equal(t, context.Canceled, err)
+	})
+	t.Run("versioned store", func(t *testing.T) {
+		require.Nil(t, storage.VersionedPutContext(live, versioned, 1, []byte("k"), []byte("v")))
+		version, value, err := storage.VersionedGetContext(live, versioned, []byte("k"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 1, version)
+		assert.Equal(t, []byte("v"), value)
+		_, _, err = storage.GetIfModifiedContext(live, versioned, []byte("k"), 1)
+		assert.Equal(t, storage.ErrNotModified, err)
+		values, err := storage.GetManyContext(live, versioned, [][]byte{[]byte("k"), []byte("missing")})
+		require.Nil(t, err)
+		assert.Equal(t, map[string]storage.VersionedValue{"k": {Version: 1, Value: []byte("v")}}, values)
+		assert.Equal(t, context.Canceled, storage.VersionedPutContext(done, versioned, 2, []byte("k"), []byte("w")))
+		_, _, err = storage.GetIfModifiedContext(done, versioned, []byte("k"), 0)
+		assert.Equal(t, context.Canceled, err)
+		_, err = storage.GetManyContext(done, versioned, [][]byte{[]byte("k")})
+		assert.Equal(t, context.Canceled, err)
+	})
+	t.Run("blob store", func(t *testing.T) {
+		blobs := storage.NewBlobStore(store)
+		key, err := blobs.PutContext(live, []byte("blob"))
+		require.Nil(t, err)
+		value, err := blobs.GetContext(live, key)
+		require.Nil(t, err)
+		assert.Equal(t, []byte("blob"), value)
+		_, err = blobs.GetContext(done, key)
+		assert.Equal(t, context.Canceled, err)
+	})
+}
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"context"
 	"crypto/sha512"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -54,6 +56,80 @@ func (s *DiskStore) Get(key []byte) (value []byte, err error) {
 	return
 }
 
+// PutStream implements StreamStore. The value is written to a temporary file
+// first, so that readers never see a partial value.
+func (s *DiskStore) PutStream(ctx context.Context, key []byte, r io.Reader, size int64) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	valpath := s.pathFor(key)
+	if err = os.MkdirAll(filepath.Dir(valpath), 0700); err != nil {
+		return fmt.Errorf("could not make dir for %q: %w", valpath, err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(valpath), ".put-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if size < 0 {
+		_, err = io.Copy(f, r)
+	} else {
+		_, err = io.CopyN(f, r, size)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %q: %w", valpath, err)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), valpath)
+}
+
+// GetRange implements StreamStore.
+func (s *DiskStore) GetRange(ctx context.Context, key []byte, offset int64, length int64) (rc io.ReadCloser, size int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(s.pathFor(key))
+	if os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("%x: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	size = info.Size()
+	start, end := clampRange(offset, length, size)
+	return readCloser{
+		Reader: io.NewSectionReader(f, start, end-start),
+		Closer: f,
+	}, size, nil
+}
+
+// Stat implements Statter.
+func (s *DiskStore) Stat(ctx context.Context, key []byte) (size int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(s.pathFor(key))
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("%x: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
 func (s *DiskStore) pathFor(key []byte) string {
 	// Prevent ENAMETOOLONG, while retaining low probability of clashes.
 	if len(key) > sha512.Size {
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
@@ -56,6 +58,11 @@ func NewDynamoDBStore(profile, region, table string) (*DynamoDBStore, error) {
 }
 
 func (s *DynamoDBStore) Put(key, value []byte) (err error) {
+	return s.PutContext(context.Background(), key, value)
+}
+
+// PutContext implements ContextStore.
+func (s *DynamoDBStore) PutContext(ctx context.Context, key, value []byte) (err error) {
 	var input dynamodb.PutItemInput
 	input.TableName = &s.table
 	input.Item = map[string]*dynamodb.AttributeValue{
@@ -64,18 +71,23 @@ func (s *DynamoDBStore) Put(key, value []byte) (err error) {
 	if len(value) != 0 {
 		input.Item["va"] = ddbBinary(value)
 	}
-	_, err = s.ddb.PutItem(&input)
+	_, err = s.ddb.PutItemWithContext(ctx, &input)
 	return err
 }
 
 func (s *DynamoDBStore) Get(key []byte) (value []byte, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextStore.
+func (s *DynamoDBStore) GetContext(ctx context.Context, key []byte) (value []byte, err error) {
 	var input dynamodb.GetItemInput
 	input.TableName = &s.table
 	input.Key = map[string]*dynamodb.AttributeValue{
 		"k": ddbBinary(key),
 	}
 	var output *dynamodb.GetItemOutput
-	if output, err = s.ddb.GetItem(&input); err != nil {
+	if output, err = s.ddb.GetItemWithContext(ctx, &input); err != nil {
 		if e, ok := err.(awserr.Error); ok {
 			if e.Code() == dynamodb.ErrCodeResourceNotFoundException {
 				return nil, fmt.Errorf("%v: %w", e, ErrNotFound)
@@ -92,6 +104,116 @@ func (s *DynamoDBStore) Get(key []byte) (value []byte, err error) {
 	return output.Item["va"].B, nil
 }
 
+// DynamoDBConditionalStore is a native VersionedStore implementation on top of
+// the table of a DynamoDBStore. It checks versions with conditional writes,
+// rather than reading and then writing under a mutex as a VersionedWrapper
+// does. Values are stored with the wrapper's encoding, so either can be used on
+// the same table, with the version also kept in its own attribute for the
+// condition expressions.
+type DynamoDBConditionalStore struct {
+	table string
+	ddb   *dynamodb.DynamoDB
+}
+
+func init() {
+	registerVersionedBuilder("dynamodb", func(_ *Builder, store Store, _ map[string]interface{}) (VersionedStore, error) {
+		return NewDynamoDBConditionalStore(store.(*DynamoDBStore)), nil
+	})
+}
+
+func NewDynamoDBConditionalStore(store *DynamoDBStore) *DynamoDBConditionalStore {
+	return &DynamoDBConditionalStore{
+		table: store.table,
+		ddb:   store.ddb,
+	}
+}
+
+func (s *DynamoDBConditionalStore) Put(version uint64, key []byte, value []byte) error {
+	return s.PutContext(context.Background(), version, key, value)
+}
+
+// PutContext implements ContextVersionedStore.
+func (s *DynamoDBConditionalStore) PutContext(ctx context.Context, version uint64, key []byte, value []byte) error {
+	err := s.put(ctx, version, key, value, "attribute_not_exists(k) or ve < :ve", nil)
+	if !errors.Is(err, ErrStalePut) {
+		return err
+	}
+	// Items written through a VersionedWrapper have no version attribute.
+	// For those, check the version in the value, and then make sure the
+	// item hasn't changed in the meantime.
+	item, err := s.getItem(ctx, key)
+	if err != nil {
+		return err
+	}
+	if item == nil || item["ve"] != nil || item["va"] == nil {
+		return ErrStalePut
+	}
+	if currVersion, _ := decodeVersioned(item["va"].B); version <= currVersion {
+		return ErrStalePut
+	}
+	return s.put(ctx, version, key, value, "va = :va", item["va"])
+}
+
+func (s *DynamoDBConditionalStore) put(ctx context.Context, version uint64, key []byte, value []byte, condition string, seen *dynamodb.AttributeValue) error {
+	ve := ddbNumber(version)
+	var input dynamodb.PutItemInput
+	input.TableName = &s.table
+	input.ConditionExpression = aws.String(condition)
+	input.ExpressionAttributeValues = make(map[string]*dynamodb.AttributeValue)
+	if seen != nil {
+		input.ExpressionAttributeValues[":va"] = seen
+	} else {
+		input.ExpressionAttributeValues[":ve"] = ve
+	}
+	input.Item = map[string]*dynamodb.AttributeValue{
+		"k":  ddbBinary(key),
+		"ve": ve,
+		"va": ddbBinary(encodeVersioned(version, value)),
+	}
+	_, err := s.ddb.PutItemWithContext(ctx, &input)
+	if e, ok := err.(awserr.Error); ok && e.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrStalePut
+	}
+	return err
+}
+
+func (s *DynamoDBConditionalStore) Get(key []byte) (version uint64, value []byte, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextVersionedStore. Reads are strongly consistent,
+// so that a client that gets a value can then put the next version.
+func (s *DynamoDBConditionalStore) GetContext(ctx context.Context, key []byte) (version uint64, value []byte, err error) {
+	item, err := s.getItem(ctx, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if item == nil || item["va"] == nil {
+		return 0, nil, fmt.Errorf("%.10x: %w", key, ErrNotFound)
+	}
+	version, value = decodeVersioned(item["va"].B)
+	return version, value, nil
+}
+
+func (s *DynamoDBConditionalStore) getItem(ctx context.Context, key []byte) (map[string]*dynamodb.AttributeValue, error) {
+	var input dynamodb.GetItemInput
+	input.TableName = &s.table
+	input.ConsistentRead = aws.Bool(true)
+	input.Key = map[string]*dynamodb.AttributeValue{
+		"k": ddbBinary(key),
+	}
+	output, err := s.ddb.GetItemWithContext(ctx, &input)
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok {
+			if e.Code() == dynamodb.ErrCodeResourceNotFoundException {
+				return nil, fmt.Errorf("%v: %w", e, ErrNotFound)
+			}
+		}
+		return nil, err
+	}
+	return output.Item, nil
+}
+
 type DynamoDBVersionedStore struct {
 	profile string
 	region  string
@@ -151,6 +273,11 @@ func (s *DynamoDBVersionedStore) configureLimiters() error {
 }
 
 func (s *DynamoDBVersionedStore) Put(version uint64, key []byte, value []byte) (err error) {
+	return s.PutContext(context.Background(), version, key, value)
+}
+
+// PutContext implements ContextVersionedStore.
+func (s *DynamoDBVersionedStore) PutContext(ctx context.Context, version uint64, key []byte, value []byte) (err error) {
 	k := ddbBinary(key)
 	va := ddbBinary(value)
 	ve := ddbNumber(version)
@@ -165,8 +292,10 @@ func (s *DynamoDBVersionedStore) Put(version uint64, key []byte, value []byte) (
 		"ve": ve,
 		"va": va,
 	}
-	time.Sleep(s.putLimiter.Reserve().Delay())
-	_, err = s.ddb.PutItem(&input)
+	if err := s.putLimiter.Wait(ctx); err != nil {
+		return err
+	}
+	_, err = s.ddb.PutItemWithContext(ctx, &input)
 	if err != nil {
 		if e, ok := err.(awserr.Error); ok {
 			if e.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
@@ -185,6 +314,11 @@ func (s *DynamoDBVersionedStore) Put(version uint64, key []byte, value []byte) (
 }
 
 func (s *DynamoDBVersionedStore) Get(key []byte) (version uint64, value []byte, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextVersionedStore.
+func (s *DynamoDBVersionedStore) GetContext(ctx context.Context, key []byte) (version uint64, value []byte, err error) {
 	version, value, err = s.local.Get(key)
 	if err == nil {
 		log.WithFields(log.Fields{
@@ -198,8 +332,10 @@ func (s *DynamoDBVersionedStore) Get(key []byte) (version uint64, value []byte,
 	input.Key = map[string]*dynamodb.AttributeValue{
 		"k": ddbBinary(key),
 	}
-	time.Sleep(s.getLimiter.Reserve().Delay())
-	output, err := s.ddb.GetItem(&input)
+	if err := s.getLimiter.Wait(ctx); err != nil {
+		return 0, nil, err
+	}
+	output, err := s.ddb.GetItemWithContext(ctx, &input)
 	if err != nil {
 		if e, ok := err.(awserr.Error); ok {
 			if e.Code() == dynamodb.ErrCodeResourceNotFoundException {
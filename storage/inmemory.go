@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"sync"
 )
@@ -43,3 +44,21 @@ func (s *InMemoryStore) Get(key []byte) (value []byte, err error) {
 	}
 	return value, nil
 }
+
+// Stat implements Statter.
+func (s *InMemoryStore) Stat(_ context.Context, key []byte) (size int64, err error) {
+	s.Lock()
+	value, ok := s.m[string(key)]
+	s.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("%.40q: %w", key, ErrNotFound)
+	}
+	return int64(len(value)), nil
+}
+
+// Delete removes the given key from the store, if present.
+func (s *InMemoryStore) Delete(key []byte) {
+	s.Lock()
+	delete(s.m, string(key))
+	s.Unlock()
+}
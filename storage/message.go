@@ -1,34 +1,160 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/nicolagi/dino/message"
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	// ErrUnauthorized indicates the server refused a request because of a
+	// missing or failed authorization.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrBadRequest indicates the server could not make sense of a request.
+	ErrBadRequest = errors.New("bad request")
+
+	// ErrTooLarge indicates a key or value is too large to be transferred.
+	ErrTooLarge = message.ErrTooLarge
+
+	// ErrBusy indicates the server could not serve a request right now, and
+	// the request might be retried later.
+	ErrBusy = errors.New("server busy")
+
+	// ErrForbidden indicates the user the client logged in as may not access
+	// a key, or not for writing.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Error codes and the corresponding sentinel errors.
+var codeErrors = []struct {
+	code message.ErrorCode
+	err  error
+}{
+	{message.CodeStalePut, ErrStalePut},
+	{message.CodeNotFound, ErrNotFound},
+	{message.CodeUnauthorized, ErrUnauthorized},
+	{message.CodeBadRequest, ErrBadRequest},
+	{message.CodeTooLarge, ErrTooLarge},
+	{message.CodeBusy, ErrBusy},
+	{message.CodeChangeLogTruncated, ErrChangeLogTruncated},
+	{message.CodeNotLeader, ErrNotLeader},
+	{message.CodeForbidden, ErrForbidden},
+}
+
+// NewErrorMessage constructs an error message for the given error, with the
+// error code corresponding to the sentinel error it wraps, if any.
+func NewErrorMessage(tag uint16, err error) message.Message {
+	for _, ce := range codeErrors {
+		if errors.Is(err, ce.err) {
+			return message.NewCodedErrorMessage(tag, ce.code, err.Error())
+		}
+	}
+	return message.NewErrorMessage(tag, err.Error())
+}
+
+// MessageError returns the error described by an error message, wrapping the
+// sentinel error corresponding to its error code, so that errors.Is can be used
+// on it. Error messages without an error code, e.g., from servers that predate
+// error codes, are recognized by their textual description as well as
+// possible.
+func MessageError(m message.Message) error {
+	code := m.ErrorCode()
+	v := m.Value()
+	if code == message.CodeUnknown {
+		switch {
+		case v == ErrStalePut.Error():
+			code = message.CodeStalePut
+		case strings.HasSuffix(v, ErrNotFound.Error()):
+			code = message.CodeNotFound
+		case strings.Contains(v, "go away"):
+			code = message.CodeUnauthorized
+		case v == ErrChangeLogTruncated.Error():
+			code = message.CodeChangeLogTruncated
+		case strings.HasPrefix(v, ErrNotLeader.Error()):
+			code = message.CodeNotLeader
+		}
+	}
+	for _, ce := range codeErrors {
+		if ce.code != code {
+			continue
+		}
+		if v == ce.err.Error() {
+			return ce.err
+		}
+		return &remoteError{description: v, sentinel: ce.err}
+	}
+	return errors.New(v)
+}
+
+// remoteError keeps the textual description of the error from the server, while
+// still wrapping the corresponding sentinel error.
+type remoteError struct {
+	description string
+	sentinel    error
+}
+
+func (e *remoteError) Error() string {
+	return e.description
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.sentinel
+}
+
 func ApplyMessage(store VersionedStore, in message.Message) (out message.Message) {
 	inTag := in.Tag()
 	switch kind := in.Kind(); kind {
 	case message.KindGet:
 		version, value, err := store.Get([]byte(in.Key()))
 		if err != nil {
-			return message.NewErrorMessage(inTag, err.Error())
+			return NewErrorMessage(inTag, err)
 		}
 		return message.NewPutMessage(inTag, in.Key(), string(value), version)
 	case message.KindPut:
 		err := store.Put(in.Version(), []byte(in.Key()), []byte(in.Value()))
 		if err != nil {
-			return message.NewErrorMessage(inTag, err.Error())
+			return NewErrorMessage(inTag, err)
 		}
 		log.WithFields(log.Fields{
 			"key":     fmt.Sprintf("%.10x", in.Key()),
 			"version": in.Version(),
 		}).Debug("Applied put message")
 		return in
-	case message.KindAuth, message.KindError:
-		return message.NewErrorMessage(inTag, fmt.Sprintf("messages of kind %s cannot be applied", kind))
+	case message.KindGetIfModified:
+		version, value, err := GetIfModified(store, []byte(in.Key()), in.Version())
+		if errors.Is(err, ErrNotModified) {
+			return message.NewNotModifiedMessage(inTag, in.Key(), in.Version())
+		}
+		if err != nil {
+			return NewErrorMessage(inTag, err)
+		}
+		return message.NewPutMessage(inTag, in.Key(), string(value), version)
+	case message.KindGetMany:
+		keys := in.Keys()
+		bkeys := make([][]byte, len(keys))
+		for i, key := range keys {
+			bkeys[i] = []byte(key)
+		}
+		values, err := GetMany(store, bkeys)
+		if err != nil {
+			return NewErrorMessage(inTag, err)
+		}
+		entries := make([]message.Entry, 0, len(values))
+		for _, key := range keys {
+			if vv, ok := values[key]; ok {
+				entries = append(entries, message.Entry{Key: key, Value: string(vv.Value), Version: vv.Version})
+			}
+		}
+		return message.NewEntriesMessage(inTag, entries)
+	case message.KindAuth, message.KindError, message.KindChanges, message.KindSubscribe, message.KindUnsubscribe,
+		message.KindOption, message.KindInvalidate, message.KindNotModified, message.KindHello,
+		message.KindEntries, message.KindPing, message.KindPong, message.KindLogin:
+		return message.NewCodedErrorMessage(inTag, message.CodeBadRequest, fmt.Sprintf("messages of kind %s cannot be applied", kind))
 	default:
-		return message.NewErrorMessage(inTag, "unknown message kind")
+		return message.NewCodedErrorMessage(inTag, message.CodeBadRequest, "unknown message kind")
 	}
 }
@@ -0,0 +1,45 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorMessages(t *testing.T) {
+	t.Run("sentinel errors survive a round trip", func(t *testing.T) {
+		for _, sentinel := range []error{
+			storage.ErrStalePut,
+			storage.ErrNotFound,
+			storage.ErrUnauthorized,
+			storage.ErrBadRequest,
+			storage.ErrTooLarge,
+			storage.ErrBusy,
+			storage.ErrChangeLogTruncated,
+			storage.ErrNotLeader,
+		} {
+			m := storage.NewErrorMessage(42, sentinel)
+			assert.NotEqual(t, message.CodeUnknown, m.ErrorCode())
+			assert.Equal(t, sentinel, storage.MessageError(m))
+
+			wrapped := fmt.Errorf("some context: %w", sentinel)
+			err := storage.MessageError(storage.NewErrorMessage(42, wrapped))
+			assert.True(t, errors.Is(err, sentinel))
+			assert.Equal(t, wrapped.Error(), err.Error())
+		}
+	})
+	t.Run("other errors have no code", func(t *testing.T) {
+		m := storage.NewErrorMessage(42, errors.New("disk on fire"))
+		assert.Equal(t, message.CodeUnknown, m.ErrorCode())
+		assert.EqualError(t, storage.MessageError(m), "disk on fire")
+	})
+	t.Run("errors without codes are recognized by description", func(t *testing.T) {
+		assert.Equal(t, storage.ErrStalePut, storage.MessageError(message.NewErrorMessage(42, "stale put")))
+		assert.True(t, errors.Is(storage.MessageError(message.NewErrorMessage(42, "key deadbeef: not found")), storage.ErrNotFound))
+		assert.True(t, errors.Is(storage.MessageError(message.NewErrorMessage(42, "go away, bad password")), storage.ErrUnauthorized))
+	})
+}
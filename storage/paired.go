@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -54,14 +55,19 @@ func NewPaired(fast, slow Store) Paired {
 }
 
 func (s Paired) Get(key []byte) (value []byte, err error) {
-	value, err = s.fast.Get(key)
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextStore.
+func (s Paired) GetContext(ctx context.Context, key []byte) (value []byte, err error) {
+	value, err = GetContext(ctx, s.fast, key)
 	if err == nil {
 		return
 	}
 	if !errors.Is(err, ErrNotFound) {
 		return
 	}
-	value, err = s.slow.Get(key)
+	value, err = GetContext(ctx, s.slow, key)
 	if err != nil {
 		return nil, err
 	}
@@ -77,7 +83,13 @@ func (s Paired) Get(key []byte) (value []byte, err error) {
 }
 
 func (s Paired) Put(key, value []byte) (err error) {
-	if err = s.fast.Put(key, value); err != nil {
+	return s.PutContext(context.Background(), key, value)
+}
+
+// PutContext implements ContextStore. Only the put to the fast store can be
+// cancelled, the background propagation to the slow store can't.
+func (s Paired) PutContext(ctx context.Context, key, value []byte) (err error) {
+	if err = PutContext(ctx, s.fast, key, value); err != nil {
 		return err
 	}
 	// This can get stuck if it fills up and the remote is not able to fulfill
@@ -87,11 +99,72 @@ func (s Paired) Put(key, value []byte) (err error) {
 	return nil
 }
 
+// Stat implements Statter. A key is in the paired store if it's in either
+// store.
+func (s Paired) Stat(ctx context.Context, key []byte) (size int64, err error) {
+	size, err = Stat(ctx, s.fast, key)
+	if errors.Is(err, ErrNotFound) {
+		return Stat(ctx, s.slow, key)
+	}
+	return size, err
+}
+
+// Missing implements MissingFinder. Only the keys missing from the fast store
+// are looked up in the slow store.
+func (s Paired) Missing(ctx context.Context, keys [][]byte) (missing [][]byte, err error) {
+	missing, err = Missing(ctx, s.fast, keys)
+	if err != nil || len(missing) == 0 {
+		return missing, err
+	}
+	return Missing(ctx, s.slow, missing)
+}
+
+// writebackBatchSize is the maximum number of pending writes for which the
+// slow store is asked at once whether it has the keys already.
+const writebackBatchSize = 100
+
 func (s Paired) writeback() {
 	for kv := range s.wbc {
-		key := kv[0]
-		value := kv[1]
-		s.writeback1(key, value)
+		batch := [][2][]byte{kv}
+	drain:
+		for len(batch) < writebackBatchSize {
+			select {
+			case kv := <-s.wbc:
+				batch = append(batch, kv)
+			default:
+				break drain
+			}
+		}
+		s.writebackMany(batch)
+	}
+}
+
+// writebackMany propagates the batch of writes to the slow store, skipping
+// the keys the slow store has already. If the slow store can't tell, all the
+// writes are propagated.
+func (s Paired) writebackMany(batch [][2][]byte) {
+	keys := make([][]byte, len(batch))
+	for i, kv := range batch {
+		keys[i] = kv[0]
+	}
+	missing, err := Missing(context.Background(), s.slow, keys)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":   err,
+			"count": len(keys),
+		}).Debug("Could not find keys missing from slow store, propagating all")
+		missing = keys
+	}
+	propagate := make(map[string]bool, len(missing))
+	for _, key := range missing {
+		propagate[string(key)] = true
+	}
+	for _, kv := range batch {
+		if propagate[string(kv[0])] {
+			s.writeback1(kv[0], kv[1])
+		} else {
+			log.WithField("key", fmt.Sprintf("%.10x", kv[0])).Debug("Already in slow store")
+		}
 	}
 }
 
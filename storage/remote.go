@@ -1,16 +1,86 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"sync"
 )
 
+// ErrInsecureToken is returned by remote stores configured with a token but
+// not with HTTPS, rather than send the token in the clear.
+var ErrInsecureToken = errors.New("token requires HTTPS")
+
 // RemoteStore implements Store. It requires to connect to a blobserver.
 type RemoteStore struct {
 	address string
+	opts    remoteStoreOptions
+
+	// Built on first use, since it might need to read files.
+	once      sync.Once
+	client    *http.Client
+	clientErr error
+}
+
+type remoteStoreOptions struct {
+	https bool
+
+	// If set, trust only blobservers with certificates issued by the CAs in
+	// this PEM file.
+	caFile string
+
+	// If set, present this certificate to the blobserver.
+	certFile string
+	keyFile  string
+
+	// If set, sent as a bearer token in all requests.
+	token string
+}
+
+type RemoteStoreOption func(*remoteStoreOptions)
+
+// WithHTTPS makes the store talk HTTPS rather than HTTP. It is implied by the
+// other TLS options.
+func WithHTTPS() RemoteStoreOption {
+	return func(o *remoteStoreOptions) {
+		o.https = true
+	}
+}
+
+// WithCAFile makes the store trust only blobservers with certificates issued by
+// the CA certificates in the given PEM file, rather than the system roots.
+func WithCAFile(value string) RemoteStoreOption {
+	return func(o *remoteStoreOptions) {
+		o.https = true
+		o.caFile = value
+	}
+}
+
+// WithClientKeyPair makes the store present the given certificate to
+// blobservers requiring one.
+func WithClientKeyPair(certFile, keyFile string) RemoteStoreOption {
+	return func(o *remoteStoreOptions) {
+		o.https = true
+		o.certFile = certFile
+		o.keyFile = keyFile
+	}
+}
+
+// WithToken makes the store authenticate with the given token. It requires
+// HTTPS: without it, the store fails all requests with ErrInsecureToken.
+func WithToken(value string) RemoteStoreOption {
+	return func(o *remoteStoreOptions) {
+		o.token = value
+	}
 }
 
 func init() {
@@ -19,21 +89,116 @@ func init() {
 		if err != nil {
 			return nil, err
 		}
-		return NewRemoteStore(address), nil
+		var opts []RemoteStoreOption
+		var s string
+		if config["https"] != nil {
+			https, ok := config["https"].(bool)
+			if !ok {
+				return nil, fmt.Errorf("%q: not a boolean", "https")
+			}
+			if https {
+				opts = append(opts, WithHTTPS())
+			}
+		}
+		if config["ca_file"] != nil {
+			if s, err = builder.getString(config, "ca_file"); err != nil {
+				return nil, err
+			}
+			opts = append(opts, WithCAFile(os.ExpandEnv(s)))
+		}
+		if config["cert_file"] != nil || config["key_file"] != nil {
+			certFile, err := builder.getString(config, "cert_file")
+			if err != nil {
+				return nil, err
+			}
+			keyFile, err := builder.getString(config, "key_file")
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, WithClientKeyPair(os.ExpandEnv(certFile), os.ExpandEnv(keyFile)))
+		}
+		if config["token"] != nil {
+			if s, err = builder.getString(config, "token"); err != nil {
+				return nil, err
+			}
+			opts = append(opts, WithToken(s))
+		}
+		return NewRemoteStore(address, opts...), nil
+	})
+}
+
+func NewRemoteStore(address string, opts ...RemoteStoreOption) *RemoteStore {
+	r := &RemoteStore{address: address}
+	for _, o := range opts {
+		o(&r.opts)
+	}
+	return r
+}
+
+// httpClient returns the client to send requests with, building it on first
+// use.
+func (r *RemoteStore) httpClient() (*http.Client, error) {
+	r.once.Do(func() {
+		if r.opts.token != "" && !r.opts.https {
+			r.clientErr = ErrInsecureToken
+			return
+		}
+		if !r.opts.https || (r.opts.caFile == "" && r.opts.certFile == "") {
+			r.client = http.DefaultClient
+			return
+		}
+		config := &tls.Config{}
+		if r.opts.caFile != "" {
+			b, err := ioutil.ReadFile(r.opts.caFile)
+			if err != nil {
+				r.clientErr = err
+				return
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(b) {
+				r.clientErr = fmt.Errorf("%s: no CA certificates found", r.opts.caFile)
+				return
+			}
+		}
+		if r.opts.certFile != "" {
+			cert, err := tls.LoadX509KeyPair(r.opts.certFile, r.opts.keyFile)
+			if err != nil {
+				r.clientErr = err
+				return
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		r.client = &http.Client{Transport: transport}
 	})
+	return r.client, r.clientErr
 }
 
-func NewRemoteStore(address string) *RemoteStore {
-	return &RemoteStore{address: address}
+// do sends the request, authenticated if a token is configured.
+func (r *RemoteStore) do(request *http.Request) (*http.Response, error) {
+	client, err := r.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if r.opts.token != "" {
+		request.Header.Set("Authorization", "Bearer "+r.opts.token)
+	}
+	return client.Do(request)
 }
 
 func (r *RemoteStore) Put(key, value []byte) (err error) {
+	return r.PutContext(context.Background(), key, value)
+}
+
+// PutContext implements ContextStore.
+func (r *RemoteStore) PutContext(ctx context.Context, key, value []byte) (err error) {
 	url := r.pathFor(key)
-	request, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(value))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(value))
 	if err != nil {
 		return err
 	}
-	response, err := http.DefaultClient.Do(request)
+	response, err := r.do(request)
 	if response != nil && response.Body != nil {
 		defer func() {
 			_ = response.Body.Close()
@@ -47,14 +212,23 @@ func (r *RemoteStore) Put(key, value []byte) (err error) {
 		return err
 	}
 	if response.StatusCode != http.StatusOK {
-		return errors.New(string(body))
+		return responseError(response.StatusCode, body)
 	}
 	return nil
 }
 
 func (r *RemoteStore) Get(key []byte) (value []byte, err error) {
+	return r.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextStore.
+func (r *RemoteStore) GetContext(ctx context.Context, key []byte) (value []byte, err error) {
 	url := r.pathFor(key)
-	response, err := http.Get(url)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := r.do(request)
 	if response != nil && response.Body != nil {
 		defer func() {
 			_ = response.Body.Close()
@@ -71,11 +245,218 @@ func (r *RemoteStore) Get(key []byte) (value []byte, err error) {
 		return nil, err
 	}
 	if response.StatusCode != http.StatusOK {
-		return nil, errors.New(string(body))
+		return nil, responseError(response.StatusCode, body)
 	}
 	return body, nil
 }
 
+// PutStream implements StreamStore.
+func (r *RemoteStore) PutStream(ctx context.Context, key []byte, body io.Reader, size int64) error {
+	if size >= 0 {
+		body = io.LimitReader(body, size)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, r.pathFor(key), body)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		request.ContentLength = size
+	} else if size == 0 {
+		request.Body = http.NoBody
+	}
+	response, err := r.do(request)
+	if response != nil && response.Body != nil {
+		defer func() {
+			_ = response.Body.Close()
+		}()
+	}
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		b, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		return responseError(response.StatusCode, b)
+	}
+	return nil
+}
+
+// GetRange implements StreamStore, with an HTTP range request. Blobservers
+// that ignore the range are also handled, by skipping the unwanted bytes.
+func (r *RemoteStore) GetRange(ctx context.Context, key []byte, offset int64, length int64) (rc io.ReadCloser, size int64, err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, r.pathFor(key), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	ranged := offset > 0 || length >= 0
+	if ranged {
+		request.Header.Set("Range", rangeHeader(offset, length))
+	}
+	response, err := r.do(request)
+	if err != nil {
+		if response != nil && response.Body != nil {
+			_ = response.Body.Close()
+		}
+		return nil, 0, err
+	}
+	empty := ioutil.NopCloser(bytes.NewReader(nil))
+	switch response.StatusCode {
+	case http.StatusOK:
+		size = response.ContentLength
+		if !ranged {
+			return response.Body, size, nil
+		}
+		// The range was ignored.
+		if _, err := io.CopyN(ioutil.Discard, response.Body, offset); err != nil && err != io.EOF {
+			_ = response.Body.Close()
+			return nil, 0, err
+		}
+		if length >= 0 {
+			return readCloser{Reader: io.LimitReader(response.Body, length), Closer: response.Body}, size, nil
+		}
+		return response.Body, size, nil
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		size, err = parseContentRangeSize(response.Header.Get("Content-Range"))
+		if err != nil || response.StatusCode == http.StatusRequestedRangeNotSatisfiable || length == 0 {
+			_ = response.Body.Close()
+			if err != nil {
+				return nil, 0, err
+			}
+			return empty, size, nil
+		}
+		return response.Body, size, nil
+	case http.StatusNotFound:
+		_ = response.Body.Close()
+		return nil, 0, fmt.Errorf("%x: %w", key, ErrNotFound)
+	default:
+		defer func() { _ = response.Body.Close() }()
+		b, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, responseError(response.StatusCode, b)
+	}
+}
+
+// Stat implements Statter, with a HEAD request.
+func (r *RemoteStore) Stat(ctx context.Context, key []byte) (size int64, err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, r.pathFor(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	response, err := r.do(request)
+	if response != nil && response.Body != nil {
+		defer func() {
+			_ = response.Body.Close()
+		}()
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, fmt.Errorf("%x: %w", key, ErrNotFound)
+	default:
+		// Responses to HEAD requests have no body to explain the error.
+		return 0, responseError(response.StatusCode, []byte(response.Status))
+	}
+}
+
+// MissingBatchSize is the maximum number of keys a blobserver checks in one
+// request. RemoteStore.Missing splits larger sets of keys into more requests.
+const MissingBatchSize = 1000
+
+// Missing implements MissingFinder. The keys are sent, hex-encoded and one per
+// line, in a POST to the blobserver's /missing endpoint, which responds with
+// the missing ones, in the same format.
+func (r *RemoteStore) Missing(ctx context.Context, keys [][]byte) (missing [][]byte, err error) {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > MissingBatchSize {
+			n = MissingBatchSize
+		}
+		batch, err := r.missing(ctx, keys[:n])
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, batch...)
+		keys = keys[n:]
+	}
+	return missing, nil
+}
+
+func (r *RemoteStore) missing(ctx context.Context, keys [][]byte) (missing [][]byte, err error) {
+	var body bytes.Buffer
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(&body, "%x\n", key)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, r.urlFor("/missing"), &body)
+	if err != nil {
+		return nil, err
+	}
+	response, err := r.do(request)
+	if response != nil && response.Body != nil {
+		defer func() {
+			_ = response.Body.Close()
+		}()
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, responseError(response.StatusCode, b)
+	}
+	return ParseKeys(bytes.NewReader(b))
+}
+
+// ParseKeys reads hex-encoded keys, one per line, ignoring empty lines.
+func ParseKeys(r io.Reader) (keys [][]byte, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		key := make([]byte, hex.DecodedLen(len(line)))
+		if _, err := hex.Decode(key, line); err != nil {
+			return nil, fmt.Errorf("%.40q: not a hex key: %w", line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// responseError returns the error described by a response with an unexpected
+// status code.
+func responseError(status int, body []byte) error {
+	switch status {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%s: %w", bytes.TrimSpace(body), ErrUnauthorized)
+	case http.StatusForbidden:
+		return fmt.Errorf("%s: %w", bytes.TrimSpace(body), ErrForbidden)
+	case http.StatusUnprocessableEntity:
+		return fmt.Errorf("%s: %w", bytes.TrimSpace(body), ErrCorrupted)
+	default:
+		return errors.New(string(body))
+	}
+}
+
 func (r *RemoteStore) pathFor(key []byte) string {
-	return fmt.Sprintf("http://%s/%x", r.address, key)
+	return r.urlFor(fmt.Sprintf("/%x", key))
+}
+
+func (r *RemoteStore) urlFor(path string) string {
+	scheme := "http"
+	if r.opts.https {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.address, path)
 }
@@ -1,7 +1,17 @@
 package storage_test
 
 import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/nicolagi/dino/storage"
@@ -21,3 +31,78 @@ address = "dino.example.org:7777"
 	_, ok := store.(*storage.RemoteStore)
 	assert.True(t, ok)
 }
+
+func TestRemoteStoreContext(t *testing.T) {
+	// Hangs until the end of the test.
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	store := storage.NewRemoteStore(strings.TrimPrefix(server.URL, "http://"))
+
+	t.Run("get", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := store.GetContext(ctx, []byte("key"))
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+	t.Run("put", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err := store.PutContext(ctx, []byte("key"), []byte("value"))
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+}
+
+func TestRemoteStoreTLSAndToken(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer s3cret":
+			_, _ = w.Write([]byte("value"))
+		case "Bearer r3ad":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	f, err := ioutil.TempFile("", "dino-ca-")
+	require.Nil(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+	require.Nil(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	require.Nil(t, f.Close())
+	address := strings.TrimPrefix(server.URL, "https://")
+
+	t.Run("trusts the given CAs and sends the token", func(t *testing.T) {
+		store := storage.NewRemoteStore(address, storage.WithCAFile(f.Name()), storage.WithToken("s3cret"))
+		value, err := store.Get([]byte("key"))
+		require.Nil(t, err)
+		assert.Equal(t, []byte("value"), value)
+	})
+	t.Run("refused tokens", func(t *testing.T) {
+		store := storage.NewRemoteStore(address, storage.WithCAFile(f.Name()), storage.WithToken("guess"))
+		_, err := store.Get([]byte("key"))
+		assert.True(t, errors.Is(err, storage.ErrUnauthorized), "got %v", err)
+		store = storage.NewRemoteStore(address, storage.WithCAFile(f.Name()), storage.WithToken("r3ad"))
+		err = store.Put([]byte("key"), []byte("value"))
+		assert.True(t, errors.Is(err, storage.ErrForbidden), "got %v", err)
+	})
+	t.Run("tokens are never sent in the clear", func(t *testing.T) {
+		var sent int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&sent, 1)
+		}))
+		defer server.Close()
+		store := storage.NewRemoteStore(strings.TrimPrefix(server.URL, "http://"), storage.WithToken("s3cret"))
+		_, err := store.Get([]byte("key"))
+		assert.True(t, errors.Is(err, storage.ErrInsecureToken), "got %v", err)
+		assert.Zero(t, atomic.LoadInt32(&sent))
+	})
+	t.Run("untrusted servers are refused", func(t *testing.T) {
+		store := storage.NewRemoteStore(address, storage.WithHTTPS(), storage.WithToken("s3cret"))
+		_, err := store.Get([]byte("key"))
+		assert.NotNil(t, err)
+	})
+}
@@ -1,9 +1,10 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -14,18 +15,45 @@ import (
 
 var (
 	ErrTimeout = errors.New("request timed out")
+
+	// ErrStopped is returned for requests made after, or still waiting for a
+	// response when, Stop is called.
+	ErrStopped = errors.New("store stopped")
+
+	// ErrTooManyCalls is returned if all tags are in use by requests still
+	// waiting for a response.
+	ErrTooManyCalls = errors.New("too many requests in flight")
+
+	// ErrDisconnected is returned for requests still waiting for a response
+	// when the connection is lost.
+	ErrDisconnected = errors.New("connection lost")
+
+	// ErrNoVolume is returned for all requests if the volume chosen with
+	// WithVolume doesn't exist (or no longer does). Servers only say so to
+	// clients that authorize with a password or user valid for the volume,
+	// had it existed; others are refused as unauthorized.
+	ErrNoVolume = errors.New("no such volume")
 )
 
 type options struct {
 	requestTimeout  time.Duration
 	responseBackoff time.Duration
+	maxBackoff      time.Duration
+	pingInterval    time.Duration
 	listener        ChangeListener
+	resyncListener  ResyncListener
+	stateListener   ConnectionStateListener
 	authKey         string
+	user            string
+	invalidations   bool
+	volume          string
 }
 
 var defaultOptions = options{
 	requestTimeout:  5 * time.Second,
-	responseBackoff: 5 * time.Second,
+	responseBackoff: 500 * time.Millisecond,
+	maxBackoff:      30 * time.Second,
+	pingInterval:    30 * time.Second,
 }
 
 type Option func(*options)
@@ -36,42 +64,127 @@ func WithRequestTimeout(value time.Duration) Option {
 	}
 }
 
+// WithResponseBackoff sets how long to wait before connecting again when the
+// connection is lost. The wait doubles on every failed attempt, up to the
+// maximum backoff, and is randomized not to have all clients reconnect at once.
 func WithResponseBackoff(value time.Duration) Option {
 	return func(o *options) {
 		o.responseBackoff = value
 	}
 }
 
+// WithMaxBackoff sets the longest wait between attempts to connect again.
+func WithMaxBackoff(value time.Duration) Option {
+	return func(o *options) {
+		o.maxBackoff = value
+	}
+}
+
+// WithPingInterval sets how often to ping the server, if it supports pings, to
+// detect dead connections. If a ping times out, the connection is dropped and
+// made again. Zero disables pings.
+func WithPingInterval(value time.Duration) Option {
+	return func(o *options) {
+		o.pingInterval = value
+	}
+}
+
+func WithConnectionStateListener(value ConnectionStateListener) Option {
+	return func(o *options) {
+		o.stateListener = value
+	}
+}
+
 func WithChangeListener(value ChangeListener) Option {
 	return func(o *options) {
 		o.listener = value
 	}
 }
 
+func WithResyncListener(value ResyncListener) Option {
+	return func(o *options) {
+		o.resyncListener = value
+	}
+}
+
+// WithInvalidations makes the server broadcast invalidations (keys and versions)
+// rather than values. Invalidated keys will be fetched again when requested.
+func WithInvalidations() Option {
+	return func(o *options) {
+		o.invalidations = true
+	}
+}
+
+// WithVolume makes the store work on the given volume of the metadata server,
+// rather than on the default one.
+func WithVolume(value string) Option {
+	return func(o *options) {
+		o.volume = value
+	}
+}
+
 func WithAuthKey(value string) Option {
 	return func(o *options) {
 		o.authKey = value
 	}
 }
 
+// WithUser makes the store log in as the given user, with the auth key as the
+// user's password, rather than authorize with the server's or the volume's
+// password.
+func WithUser(value string) Option {
+	return func(o *options) {
+		o.user = value
+	}
+}
+
 type ChangeListener func(message.Message)
 
+// ResyncListener is called when the store could not catch up on the updates it
+// missed while disconnected, meaning any value obtained from the store before
+// the call might be stale.
+type ResyncListener func()
+
+// ConnectionState is the state of the connection to the metadata server.
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnected
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnected:
+		return "connected"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(state))
+	}
+}
+
+// ConnectionStateListener is called when the connection to the server is made
+// or lost. In the latter case, the error tells why.
+type ConnectionStateListener func(state ConnectionState, err error)
+
+// remoteCall is a request waiting for a response. The done channel is closed
+// once either the response or the error are set.
 type remoteCall struct {
-	tag      uint16
-	request  message.Message
 	response message.Message
+	err      error
 	done     chan struct{}
-
-	prev *remoteCall
-	next *remoteCall
 }
 
 // RemoteVersionedStore is an implementation of VersionedStore, via a client to a remote
 // metadataserver process.
 type RemoteVersionedStore struct {
-	tags   *message.MonotoneTags
 	remote *client.Client
+
+	// Values received as broadcasts. The versioned store wraps the in-memory
+	// one, which is kept around so that keys can be dropped.
 	local  VersionedStore
+	cached *InMemoryStore
 
 	opts options
 
@@ -80,19 +193,46 @@ type RemoteVersionedStore struct {
 	// return when Shutdown is called.
 	doing sync.WaitGroup
 
-	mu        sync.Mutex
-	firstCall *remoteCall
-	lastCall  *remoteCall
-	stopped   bool
+	mu      sync.Mutex
+	stopped bool
+
+	// Closed on Stop, to interrupt waiting to reconnect.
+	stopc chan struct{}
+
+	state ConnectionState
+
+	// Requests waiting for a response, by tag, and the last tag assigned to
+	// a request.
+	calls   map[uint16]*remoteCall
+	lastTag uint16
+
+	// The highest change log sequence number seen in messages from the
+	// server. After reconnecting, the server is asked to replay the puts
+	// following this one.
+	lastSequence uint64
 
-	authorized bool
+	// Keys to receive broadcasts for. If nil, Subscribe was never called,
+	// and broadcasts for all keys are received.
+	subscriptions map[string]struct{}
+
+	// Held while authorizing and configuring a connection.
+	readying sync.Mutex
+
+	// The generations of the client connections that had the volume chosen,
+	// that were authorized, and that had the connection options set. See
+	// client.Client.Generation.
+	selectedOn   uint64
+	authorizedOn uint64
+	configuredOn uint64
 }
 
 func NewRemoteVersionedStore(remote *client.Client, options ...Option) *RemoteVersionedStore {
 	var rs RemoteVersionedStore
-	rs.tags = message.NewMonotoneTags()
 	rs.remote = remote
-	rs.local = NewVersionedWrapper(NewInMemoryStore())
+	rs.calls = make(map[uint16]*remoteCall)
+	rs.stopc = make(chan struct{})
+	rs.cached = NewInMemoryStore()
+	rs.local = NewVersionedWrapper(rs.cached)
 	rs.opts = defaultOptions
 	for _, o := range options {
 		o(&rs.opts)
@@ -100,122 +240,138 @@ func NewRemoteVersionedStore(remote *client.Client, options ...Option) *RemoteVe
 	return &rs
 }
 
-func (rs *RemoteVersionedStore) newCall(tag uint16, in message.Message) *remoteCall {
-	return &remoteCall{
-		request: in,
-		tag:     tag,
-		done:    make(chan struct{}),
-	}
-}
-
-func (rs *RemoteVersionedStore) linkCall(rc *remoteCall) {
-	if rs.lastCall != nil {
-		rs.lastCall.next = rc
-	} else {
-		rs.firstCall = rc
-	}
-	rs.lastCall = rc
-}
-
-func (rs *RemoteVersionedStore) unlinkCall(rc *remoteCall) {
-	switch {
-	case rc.next == nil && rc.prev == nil:
-		rs.firstCall = nil
-		rs.lastCall = nil
-	case rc.next == nil:
-		rs.lastCall = rc.prev
-		rc.prev.next = nil
-		rc.prev = nil
-	case rc.prev == nil:
-		rs.firstCall = rc.next
-		rc.next.prev = nil
-		rc.next = nil
-	default:
-		rc.prev.next = rc.next
-		rc.prev = nil
-		rc.next.prev = rc.prev
-		rc.next = nil
-	}
-}
-
 func (rs *RemoteVersionedStore) Start() {
 	go rs.receiveLoop()
+	if rs.opts.pingInterval > 0 {
+		rs.doing.Add(1)
+		go rs.pingLoop()
+	}
 }
 
 func (rs *RemoteVersionedStore) Stop() {
 	rs.mu.Lock()
+	if !rs.stopped {
+		close(rs.stopc)
+	}
 	rs.stopped = true
 	rs.mu.Unlock()
+	rs.failCalls(ErrStopped)
 
-	// The goroutines waiting for a response will timeout (and return
-	// ErrCancelledRendezvous). The receive loop will fail the receive because
-	// of the connection being closed, and will see the stopped flag is set, and
-	// exit.
+	// The receive loop will fail the receive because of the connection being
+	// closed, and will see the stopped flag is set, and exit.
 	rs.remote.Close()
 	rs.doing.Wait()
+}
+
+// registerCall assigns the call a tag that's not in use by any other call
+// waiting for a response. Call with mu held.
+func (rs *RemoteVersionedStore) registerCall(call *remoteCall) (uint16, error) {
+	if rs.stopped {
+		return 0, ErrStopped
+	}
+	// The zero tag is reserved for broadcasts.
+	if len(rs.calls) >= 1<<16-1 {
+		return 0, ErrTooManyCalls
+	}
+	for {
+		rs.lastTag++
+		if rs.lastTag == 0 {
+			continue
+		}
+		if _, ok := rs.calls[rs.lastTag]; !ok {
+			break
+		}
+	}
+	rs.calls[rs.lastTag] = call
+	return rs.lastTag, nil
+}
 
-	rs.tags.Stop()
+// failCalls fails all requests waiting for a response with the given error.
+func (rs *RemoteVersionedStore) failCalls(err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for tag, call := range rs.calls {
+		delete(rs.calls, tag)
+		call.err = err
+		close(call.done)
+	}
+}
+
+func (rs *RemoteVersionedStore) unregisterCall(tag uint16) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.calls, tag)
 }
 
 func (rs *RemoteVersionedStore) pairResponse(tag uint16, response message.Message) {
 	rs.mu.Lock()
-	call := rs.firstCall
-	for call.tag != tag && call != nil {
-		call = call.next
-	}
-	if call != nil {
+	call, ok := rs.calls[tag]
+	if ok {
+		delete(rs.calls, tag)
 		call.response = response
 		close(call.done)
-		rs.unlinkCall(call)
-	} else {
+	}
+	rs.mu.Unlock()
+	if !ok {
 		log.WithFields(log.Fields{
 			"message": response,
 		}).Debug("Response for no request?")
 	}
-	rs.mu.Unlock()
 }
 
-// do sends a request and waits up to a second for its response.
-func (rs *RemoteVersionedStore) do(request message.Message) (response message.Message, err error) {
+// do sends a request, tagging it with a tag not in use by any other request
+// waiting for a response, and waits for its response. If the context has no
+// deadline, the request timeout applies. A request timing out has no effect on
+// any other request.
+func (rs *RemoteVersionedStore) do(ctx context.Context, request message.Message) (response message.Message, err error) {
 	rs.doing.Add(1)
 	defer rs.doing.Done()
-	tag := request.Tag()
-	r := rs.newCall(tag, request)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rs.opts.requestTimeout)
+		defer cancel()
+	}
+	call := &remoteCall{done: make(chan struct{})}
 	rs.mu.Lock()
-	rs.linkCall(r)
+	tag, err := rs.registerCall(call)
 	rs.mu.Unlock()
-	if err := rs.remote.Send(request); err != nil {
-		rs.mu.Lock()
-		rs.unlinkCall(r)
-		rs.mu.Unlock()
+	if err != nil {
+		return response, err
+	}
+	if err := rs.remote.Send(request.WithTag(tag)); err != nil {
+		rs.unregisterCall(tag)
 		return response, err
 	}
 	select {
-	case <-r.done:
-		return r.response, nil
-	case <-time.After(rs.opts.requestTimeout):
-		rs.mu.Lock()
-		rs.unlinkCall(r)
-		rs.mu.Unlock()
-		// Not ideal: The request might be taking longer not because of a
-		// networking issue.
-		rs.remote.Close()
-		return response, ErrTimeout
+	case <-call.done:
+		return call.response, call.err
+	case <-ctx.Done():
+		rs.unregisterCall(tag)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return response, ErrTimeout
+		}
+		return response, ctx.Err()
 	}
 }
 
 func (rs *RemoteVersionedStore) Put(version uint64, key []byte, value []byte) (err error) {
-	if err := rs.ensureAuthorized(); err != nil {
+	return rs.PutContext(context.Background(), version, key, value)
+}
+
+// PutContext implements ContextVersionedStore.
+func (rs *RemoteVersionedStore) PutContext(ctx context.Context, version uint64, key []byte, value []byte) (err error) {
+	if err := rs.ensureReady(ctx); err != nil {
 		return err
 	}
-	request := message.NewPutMessage(rs.tags.Next(), string(key), string(value), version)
-	response, err := rs.do(request)
+	request := message.NewPutMessage(0, string(key), string(value), version)
+	response, err := rs.do(ctx, request)
 	if err != nil {
 		return err
 	}
 	switch response.Kind() {
 	case message.KindPut:
-		if request != response {
+		rs.observe(response)
+		if request != response.WithTag(0).WithSequence(0) {
 			log.WithFields(log.Fields{
 				"request":  request,
 				"response": response,
@@ -224,72 +380,348 @@ func (rs *RemoteVersionedStore) Put(version uint64, key []byte, value []byte) (e
 		}
 		return nil
 	case message.KindError:
-		v := response.Value()
-		if v == ErrStalePut.Error() {
-			return ErrStalePut
-		}
-		if strings.Contains(v, "go away") {
-			rs.authorized = false
-		}
-		return errors.New(v)
+		return rs.responseError(response)
 	default:
 		return fmt.Errorf("unexpected response kind: %v", response.Kind())
 	}
 }
 
 func (rs *RemoteVersionedStore) Get(key []byte) (version uint64, value []byte, err error) {
-	if err := rs.ensureAuthorized(); err != nil {
+	return rs.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextVersionedStore.
+func (rs *RemoteVersionedStore) GetContext(ctx context.Context, key []byte) (version uint64, value []byte, err error) {
+	if err := rs.ensureReady(ctx); err != nil {
 		return 0, nil, err
 	}
-	version, value, err = rs.local.Get(key)
+	version, value, err = rs.cache().Get(key)
 	if err == nil {
 		return
 	}
-	response, err := rs.do(message.NewGetMessage(rs.tags.Next(), string(key)))
+	response, err := rs.do(ctx, message.NewGetMessage(0, string(key)))
 	if err != nil {
 		return 0, nil, err
 	}
 	switch response.Kind() {
 	case message.KindPut:
+		rs.observe(response)
 		return response.Version(), []byte(response.Value()), nil
 	case message.KindError:
-		v := response.Value()
-		if strings.HasSuffix(v, "not found") {
-			return 0, nil, ErrNotFound
+		return 0, nil, rs.responseError(response)
+	default:
+		fmt.Println(response.String())
+		return 0, nil, fmt.Errorf("unexpected response kind: %v", response.Kind())
+	}
+}
+
+// GetIfModified implements ConditionalGetter.
+func (rs *RemoteVersionedStore) GetIfModified(key []byte, version uint64) (newVersion uint64, value []byte, err error) {
+	return rs.GetIfModifiedContext(context.Background(), key, version)
+}
+
+// GetIfModifiedContext implements ContextConditionalGetter.
+func (rs *RemoteVersionedStore) GetIfModifiedContext(ctx context.Context, key []byte, version uint64) (newVersion uint64, value []byte, err error) {
+	if err := rs.ensureReady(ctx); err != nil {
+		return 0, nil, err
+	}
+	newVersion, value, err = rs.cache().Get(key)
+	if err == nil {
+		if newVersion == version {
+			return 0, nil, ErrNotModified
 		}
-		if strings.Contains(v, "go away") {
-			rs.authorized = false
+		return
+	}
+	legacy, err := rs.legacy()
+	if err != nil {
+		return 0, nil, err
+	}
+	if legacy {
+		newVersion, value, err = rs.GetContext(ctx, key)
+		if err == nil && newVersion == version {
+			return 0, nil, ErrNotModified
 		}
-		return 0, nil, errors.New(v)
+		return newVersion, value, err
+	}
+	response, err := rs.do(ctx, message.NewGetIfModifiedMessage(0, string(key), version))
+	if err != nil {
+		return 0, nil, err
+	}
+	switch response.Kind() {
+	case message.KindNotModified:
+		rs.observe(response)
+		return 0, nil, ErrNotModified
+	case message.KindPut:
+		rs.observe(response)
+		return response.Version(), []byte(response.Value()), nil
+	case message.KindError:
+		return 0, nil, rs.responseError(response)
 	default:
-		fmt.Println(response.String())
 		return 0, nil, fmt.Errorf("unexpected response kind: %v", response.Kind())
 	}
 }
 
-func (rs *RemoteVersionedStore) ensureAuthorized() error {
-	if rs.opts.authKey == "" || rs.authorized {
+// Keys per get many or subscribe many message, to bound the size of messages.
+const getManyBatchSize = 1000
+
+// GetMany implements MultiGetter. Values found in the local cache are not
+// requested again. If the server doesn't support get many messages, or a batch
+// of values is too large to be transferred at once, values are requested one at
+// a time.
+func (rs *RemoteVersionedStore) GetMany(keys [][]byte) (map[string]VersionedValue, error) {
+	return rs.GetManyContext(context.Background(), keys)
+}
+
+// GetManyContext implements ContextMultiGetter.
+func (rs *RemoteVersionedStore) GetManyContext(ctx context.Context, keys [][]byte) (map[string]VersionedValue, error) {
+	if err := rs.ensureReady(ctx); err != nil {
+		return nil, err
+	}
+	values := make(map[string]VersionedValue, len(keys))
+	cache := rs.cache()
+	var missing []string
+	for _, key := range keys {
+		if version, value, err := cache.Get(key); err == nil {
+			values[string(key)] = VersionedValue{Version: version, Value: value}
+		} else {
+			missing = append(missing, string(key))
+		}
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+	capable, err := rs.remote.Capable(message.CapabilityGetMany)
+	if err != nil {
+		return nil, err
+	}
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > getManyBatchSize {
+			batch = batch[:getManyBatchSize]
+		}
+		missing = missing[len(batch):]
+		if capable {
+			err = rs.getMany(ctx, batch, values)
+		}
+		if !capable || errors.Is(err, ErrTooLarge) {
+			err = rs.getOneByOne(ctx, batch, values)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (rs *RemoteVersionedStore) getMany(ctx context.Context, keys []string, values map[string]VersionedValue) error {
+	response, err := rs.do(ctx, message.NewGetManyMessage(0, keys))
+	if err != nil {
+		return err
+	}
+	switch response.Kind() {
+	case message.KindEntries:
+		rs.observe(response)
+		for _, e := range response.Entries() {
+			values[e.Key] = VersionedValue{Version: e.Version, Value: []byte(e.Value)}
+		}
+		return nil
+	case message.KindError:
+		return rs.responseError(response)
+	default:
+		return fmt.Errorf("unexpected response kind: %v", response.Kind())
+	}
+}
+
+func (rs *RemoteVersionedStore) getOneByOne(ctx context.Context, keys []string, values map[string]VersionedValue) error {
+	for _, key := range keys {
+		version, value, err := rs.GetContext(ctx, []byte(key))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		values[key] = VersionedValue{Version: version, Value: value}
+	}
+	return nil
+}
+
+// responseError returns the error described by an error message from the
+// server. If the error is about authorization, the connection will be
+// authorized again before the next request.
+func (rs *RemoteVersionedStore) responseError(response message.Message) error {
+	err := MessageError(response)
+	if errors.Is(err, ErrUnauthorized) {
+		rs.mu.Lock()
+		rs.authorizedOn = 0
+		rs.mu.Unlock()
+	}
+	return err
+}
+
+// ensureReady makes sure the connection is on the right volume, authorized and
+// configured before sending requests on it.
+func (rs *RemoteVersionedStore) ensureReady(ctx context.Context) error {
+	// Not to authorize or configure the same connection more than once.
+	rs.readying.Lock()
+	defer rs.readying.Unlock()
+	if err := rs.ensureVolume(ctx); err != nil {
+		return err
+	}
+	if err := rs.ensureAuthorized(ctx); err != nil {
+		return err
+	}
+	return rs.ensureConfigured(ctx)
+}
+
+func (rs *RemoteVersionedStore) ensureConfigured(ctx context.Context) error {
+	if !rs.opts.invalidations {
+		return nil
+	}
+	generation, err := rs.generation()
+	if err != nil {
+		return fmt.Errorf("not configured: %w", err)
+	}
+	rs.mu.Lock()
+	configured := rs.configuredOn == generation
+	rs.mu.Unlock()
+	if configured {
+		return nil
+	}
+	legacy, err := rs.legacy()
+	if err != nil {
+		return fmt.Errorf("not configured: %w", err)
+	}
+	if legacy {
+		// Such servers broadcast puts, which do just as well.
+		return nil
+	}
+	request := message.NewOptionMessage(0, message.OptionBroadcast, message.BroadcastInvalidations)
+	response, err := rs.do(ctx, request)
+	if err != nil {
+		return fmt.Errorf("not configured: %w", err)
+	}
+	switch response.Kind() {
+	case message.KindOption:
+		rs.mu.Lock()
+		rs.configuredOn = generation
+		rs.mu.Unlock()
+		return nil
+	case message.KindError:
+		return fmt.Errorf("not configured: %w", rs.responseError(response))
+	default:
+		return fmt.Errorf("not configured, got response of kind %v", response.Kind())
+	}
+}
+
+// ensureVolume chooses the volume, which must happen before authorizing, since
+// the password might be the volume's own.
+func (rs *RemoteVersionedStore) ensureVolume(ctx context.Context) error {
+	if rs.opts.volume == "" {
+		return nil
+	}
+	generation, err := rs.generation()
+	if err != nil {
+		return fmt.Errorf("no volume: %w", err)
+	}
+	rs.mu.Lock()
+	selected := rs.selectedOn == generation
+	rs.mu.Unlock()
+	if selected {
 		return nil
 	}
-	request := message.NewAuthMessage(rs.tags.Next(), rs.opts.authKey)
-	response, err := rs.do(request)
+	legacy, err := rs.legacy()
+	if err != nil {
+		return fmt.Errorf("no volume: %w", err)
+	}
+	if legacy {
+		return errors.New("no volume: the server does not support volumes")
+	}
+	request := message.NewOptionMessage(0, message.OptionVolume, rs.opts.volume)
+	response, err := rs.do(ctx, request)
+	if err != nil {
+		return fmt.Errorf("no volume: %w", err)
+	}
+	switch response.Kind() {
+	case message.KindOption:
+		rs.mu.Lock()
+		rs.selectedOn = generation
+		rs.mu.Unlock()
+		return nil
+	case message.KindError:
+		err := MessageError(response)
+		if errors.Is(err, ErrNotFound) {
+			// Not to be mistaken for a missing key.
+			return fmt.Errorf("%q: %w", rs.opts.volume, ErrNoVolume)
+		}
+		return fmt.Errorf("no volume: %w", err)
+	default:
+		return fmt.Errorf("no volume, got response of kind %v", response.Kind())
+	}
+}
+
+func (rs *RemoteVersionedStore) ensureAuthorized(ctx context.Context) error {
+	if rs.opts.authKey == "" {
+		return nil
+	}
+	generation, err := rs.generation()
+	if err != nil {
+		return fmt.Errorf("not authorized: %w", err)
+	}
+	rs.mu.Lock()
+	authorized := rs.authorizedOn == generation
+	rs.mu.Unlock()
+	if authorized {
+		return nil
+	}
+	request := message.NewAuthMessage(0, rs.opts.authKey)
+	if rs.opts.user != "" {
+		capable, err := rs.remote.Capable(message.CapabilityUsers)
+		if err != nil {
+			return fmt.Errorf("not authorized: %w", err)
+		}
+		if !capable {
+			return errors.New("not authorized: the server does not support users")
+		}
+		request = message.NewLoginMessage(0, rs.opts.user, rs.opts.authKey)
+	}
+	response, err := rs.do(ctx, request)
 	if err != nil {
 		return fmt.Errorf("not authorized: %w", err)
 	}
 	if response.Kind() == message.KindAuth {
-		rs.authorized = true
+		rs.mu.Lock()
+		rs.authorizedOn = generation
+		rs.mu.Unlock()
 		return nil
 	}
 	// Fail closed.
 	if response.Kind() == message.KindError {
-		return fmt.Errorf("not authorized: %v", response.Value())
+		err := MessageError(response)
+		if errors.Is(err, ErrNotFound) && rs.opts.volume != "" {
+			// Servers only tell authorized clients that the volume
+			// doesn't exist.
+			return fmt.Errorf("%q: %w", rs.opts.volume, ErrNoVolume)
+		}
+		return fmt.Errorf("not authorized: %w", err)
 	}
 	return fmt.Errorf("not authorized, got response of kind %v", response.Kind())
 }
 
+// generation returns the generation of the client connection, connecting if
+// necessary.
+func (rs *RemoteVersionedStore) generation() (uint64, error) {
+	if err := rs.remote.Connect(); err != nil {
+		return 0, err
+	}
+	return rs.remote.Generation(), nil
+}
+
 func (rs *RemoteVersionedStore) receiveLoop() {
 	rs.doing.Add(1)
 	defer rs.doing.Done()
+	backoff := rs.opts.responseBackoff
+	connected := false
 	for {
 		rs.mu.Lock()
 		stopped := rs.stopped
@@ -297,28 +729,78 @@ func (rs *RemoteVersionedStore) receiveLoop() {
 		if stopped {
 			break
 		}
+		if !connected {
+			if err := rs.remote.Connect(); err != nil {
+				log.WithFields(log.Fields{
+					"err":     err,
+					"backoff": backoff,
+				}).Warn("Could not connect")
+				if !rs.wait(backoff) {
+					break
+				}
+				backoff = rs.nextBackoff(backoff)
+				continue
+			}
+			connected = true
+			rs.setState(StateConnected, nil)
+			rs.doing.Add(1)
+			go func() {
+				defer rs.doing.Done()
+				rs.reestablish()
+			}()
+		}
 		var m message.Message
 		if err := rs.remote.Receive(&m); err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("Receive error")
 			rs.mu.Lock()
 			stopped := rs.stopped
 			rs.mu.Unlock()
 			if stopped {
 				break
 			}
-			time.Sleep(rs.opts.responseBackoff)
+			log.WithFields(log.Fields{
+				"err":     err,
+				"backoff": backoff,
+			}).Error("Receive error")
+			connected = false
+			rs.setState(StateDisconnected, err)
+			// The responses would have arrived on the lost connection.
+			rs.failCalls(fmt.Errorf("%w: %v", ErrDisconnected, err))
+			if !rs.wait(backoff) {
+				break
+			}
+			backoff = rs.nextBackoff(backoff)
 			continue
 		}
+		backoff = rs.opts.responseBackoff
+		switch m.Kind() {
+		case message.KindPut, message.KindChanges, message.KindInvalidate, message.KindNotModified, message.KindEntries:
+			rs.observe(m)
+		}
 		tag := m.Tag()
 		if tag != 0 {
 			log.WithField("message", m).Debug("Received response")
 			rs.pairResponse(tag, m)
 		}
+		if tag == 0 && m.Kind() == message.KindInvalidate {
+			if !rs.subscribed(m.Key()) {
+				log.WithField("message", m).Debug("Ignoring broadcast")
+				continue
+			}
+			log.WithField("message", m).Debug("Received invalidation")
+			rs.invalidate(m)
+			if rs.opts.listener != nil {
+				log.WithField("message", m).Debug("Notifying listener")
+				rs.opts.listener(m)
+			}
+		}
 		if tag == 0 && m.Kind() == message.KindPut {
+			if !rs.subscribed(m.Key()) {
+				// Sent before the server processed our unsubscribe request.
+				log.WithField("message", m).Debug("Ignoring broadcast")
+				continue
+			}
 			log.WithField("message", m).Debug("Received broadcast")
-			lres := ApplyMessage(rs.local, m)
+			lres := ApplyMessage(rs.cache(), m)
 			if lres.Kind() == message.KindError {
 				log.WithFields(log.Fields{
 					"err": lres,
@@ -330,3 +812,417 @@ func (rs *RemoteVersionedStore) receiveLoop() {
 		}
 	}
 }
+
+// reestablish prepares a new connection for use: it authorizes and configures
+// it, renews the subscriptions, and catches up on the broadcasts that might have
+// been lost with the previous connection. Requests would authorize and
+// configure the connection anyway, but it's best to learn early of problems.
+func (rs *RemoteVersionedStore) reestablish() {
+	if err := rs.ensureReady(context.Background()); err != nil {
+		log.WithField("err", err).Warn("Could not prepare new connection")
+		return
+	}
+	if rs.resubscribe() {
+		rs.catchUp()
+	}
+}
+
+// setState notifies the connection state listener, if any, of state changes.
+func (rs *RemoteVersionedStore) setState(state ConnectionState, err error) {
+	rs.mu.Lock()
+	changed := rs.state != state
+	rs.state = state
+	rs.mu.Unlock()
+	if !changed {
+		return
+	}
+	log.WithFields(log.Fields{
+		"state": state,
+		"err":   err,
+	}).Info("Connection state changed")
+	if rs.opts.stateListener != nil {
+		rs.opts.stateListener(state, err)
+	}
+}
+
+// ConnectionState returns the state of the connection to the server.
+func (rs *RemoteVersionedStore) ConnectionState() ConnectionState {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.state
+}
+
+// wait waits for about the given backoff, randomized so that clients that lost
+// their connections at the same time don't try reconnecting at the same time.
+// It returns false if the store is stopped in the meantime.
+func (rs *RemoteVersionedStore) wait(backoff time.Duration) bool {
+	d := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-rs.stopc:
+		return false
+	}
+}
+
+func (rs *RemoteVersionedStore) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > rs.opts.maxBackoff {
+		backoff = rs.opts.maxBackoff
+	}
+	return backoff
+}
+
+func (rs *RemoteVersionedStore) pingLoop() {
+	defer rs.doing.Done()
+	ticker := time.NewTicker(rs.opts.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-rs.stopc:
+			return
+		}
+		if rs.ConnectionState() != StateConnected {
+			continue
+		}
+		if capable, err := rs.remote.Capable(message.CapabilityPing); err != nil || !capable {
+			continue
+		}
+		rs.ping()
+	}
+}
+
+// ping pings the server, and drops the connection if the server doesn't
+// respond in time, so that a new one is made.
+func (rs *RemoteVersionedStore) ping() {
+	generation := rs.remote.Generation()
+	sent := time.Now()
+	response, err := rs.do(context.Background(), message.NewPingMessage(0, uint64(sent.UnixNano())))
+	if err == nil && response.Kind() == message.KindPong {
+		log.WithField("rtt", time.Since(sent)).Debug("Received pong")
+		return
+	}
+	if errors.Is(err, ErrStopped) || errors.Is(err, ErrDisconnected) {
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("unexpected response kind: %v", response.Kind())
+	}
+	if rs.remote.Generation() != generation {
+		// Already on a new connection.
+		return
+	}
+	log.WithField("err", err).Warn("Ping failed, dropping connection")
+	rs.remote.Close()
+}
+
+// cache returns the store holding the values received as broadcasts. It may be
+// replaced as a whole when resyncing.
+func (rs *RemoteVersionedStore) cache() VersionedStore {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.local
+}
+
+// observe keeps track of the highest change log sequence number seen.
+func (rs *RemoteVersionedStore) observe(m message.Message) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if s := m.Sequence(); s > rs.lastSequence {
+		rs.lastSequence = s
+	}
+}
+
+// catchUp asks the server to replay the accepted puts that might have been
+// missed while disconnected. The replayed puts arrive as broadcasts, ahead of
+// the response to the request. If the server can't replay them, the store
+// resyncs.
+func (rs *RemoteVersionedStore) catchUp() {
+	ctx := context.Background()
+	rs.mu.Lock()
+	since := rs.lastSequence
+	stopped := rs.stopped
+	rs.mu.Unlock()
+	if stopped {
+		return
+	}
+	legacy, err := rs.legacy()
+	if err != nil {
+		log.WithField("err", err).Warn("Could not catch up")
+		return
+	}
+	if legacy {
+		// Such servers can't replay changes, and their puts carry no sequence
+		// numbers, so anything cached on a previous connection may be stale.
+		if rs.remote.Generation() > 1 {
+			log.Info("Server can't replay changes, resyncing")
+			rs.resync()
+		}
+		return
+	}
+	if since == 0 {
+		// Nothing was obtained from the server yet, nothing can be stale.
+		return
+	}
+	logger := log.WithField("since", since)
+	if err := rs.ensureReady(ctx); err != nil {
+		logger.WithField("err", err).Warn("Could not catch up")
+		return
+	}
+	response, err := rs.do(ctx, message.NewChangesMessage(0, since))
+	if err != nil {
+		logger.WithField("err", err).Warn("Could not catch up")
+		return
+	}
+	switch response.Kind() {
+	case message.KindChanges:
+		logger.WithField("until", response.Sequence()).Debug("Caught up")
+	case message.KindError:
+		if err := rs.responseError(response); !errors.Is(err, ErrChangeLogTruncated) {
+			logger.WithField("err", err).Warn("Could not catch up")
+			return
+		}
+		logger.Info("Change log truncated, resyncing")
+		rs.resync()
+	default:
+		logger.WithField("kind", response.Kind()).Warn("Unexpected response to changes request")
+	}
+}
+
+// invalidate drops the cached value for the key of the invalidate message,
+// unless it's already at the same or a later version.
+func (rs *RemoteVersionedStore) invalidate(m message.Message) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	version, _, err := rs.local.Get([]byte(m.Key()))
+	if err == nil && version >= m.Version() {
+		return
+	}
+	rs.cached.Delete([]byte(m.Key()))
+}
+
+// resync drops all cached values and notifies the resync listener, if any.
+func (rs *RemoteVersionedStore) resync() {
+	rs.mu.Lock()
+	rs.cached = NewInMemoryStore()
+	rs.local = NewVersionedWrapper(rs.cached)
+	rs.lastSequence = 0
+	rs.mu.Unlock()
+	if rs.opts.resyncListener != nil {
+		rs.opts.resyncListener()
+	}
+}
+
+// Subscribe implements Subscriber. Once it's called, broadcasts are received
+// only for the keys subscribed to.
+func (rs *RemoteVersionedStore) Subscribe(key []byte) error {
+	return rs.SubscribeContext(context.Background(), key)
+}
+
+// SubscribeContext implements ContextSubscriber.
+func (rs *RemoteVersionedStore) SubscribeContext(ctx context.Context, key []byte) error {
+	rs.mu.Lock()
+	if rs.subscriptions == nil {
+		rs.subscriptions = make(map[string]struct{})
+	}
+	if _, ok := rs.subscriptions[string(key)]; ok {
+		rs.mu.Unlock()
+		return nil
+	}
+	// Add it right away, not to drop broadcasts that arrive after the server
+	// handled the request but before we get the response.
+	rs.subscriptions[string(key)] = struct{}{}
+	rs.mu.Unlock()
+	legacy, err := rs.legacy()
+	if err == nil && !legacy {
+		err = rs.doAcknowledged(ctx, message.NewSubscribeMessage(0, string(key)))
+	}
+	if err != nil {
+		rs.mu.Lock()
+		delete(rs.subscriptions, string(key))
+		rs.mu.Unlock()
+	}
+	return err
+}
+
+// SubscribeMany implements MultiSubscriber.
+func (rs *RemoteVersionedStore) SubscribeMany(keys [][]byte) error {
+	return rs.SubscribeManyContext(context.Background(), keys)
+}
+
+// SubscribeManyContext implements ContextMultiSubscriber, sending few subscribe
+// many messages rather than a subscribe message per key, if the server supports
+// them.
+func (rs *RemoteVersionedStore) SubscribeManyContext(ctx context.Context, keys [][]byte) error {
+	rs.mu.Lock()
+	if rs.subscriptions == nil {
+		rs.subscriptions = make(map[string]struct{})
+	}
+	var added []string
+	for _, key := range keys {
+		if _, ok := rs.subscriptions[string(key)]; ok {
+			continue
+		}
+		// See SubscribeContext.
+		rs.subscriptions[string(key)] = struct{}{}
+		added = append(added, string(key))
+	}
+	rs.mu.Unlock()
+	if len(added) == 0 {
+		return nil
+	}
+	legacy, err := rs.legacy()
+	if err == nil && !legacy {
+		err = rs.subscribeMany(ctx, added)
+	}
+	if err != nil {
+		rs.mu.Lock()
+		for _, key := range added {
+			delete(rs.subscriptions, key)
+		}
+		rs.mu.Unlock()
+	}
+	return err
+}
+
+// Unsubscribe implements Subscriber. The key is also dropped from the local
+// cache, since it would no longer be kept up to date.
+func (rs *RemoteVersionedStore) Unsubscribe(key []byte) error {
+	return rs.UnsubscribeContext(context.Background(), key)
+}
+
+// UnsubscribeContext implements ContextSubscriber.
+func (rs *RemoteVersionedStore) UnsubscribeContext(ctx context.Context, key []byte) error {
+	rs.mu.Lock()
+	if rs.subscriptions == nil {
+		rs.subscriptions = make(map[string]struct{})
+	}
+	delete(rs.subscriptions, string(key))
+	rs.cached.Delete(key)
+	rs.mu.Unlock()
+	legacy, err := rs.legacy()
+	if err != nil || legacy {
+		return err
+	}
+	return rs.doAcknowledged(ctx, message.NewUnsubscribeMessage(0, string(key)))
+}
+
+func (rs *RemoteVersionedStore) subscribed(key string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.subscriptions == nil {
+		return true
+	}
+	_, ok := rs.subscriptions[key]
+	return ok
+}
+
+// resubscribe renews all subscriptions, e.g., on a new connection. It returns
+// false if that was not possible.
+func (rs *RemoteVersionedStore) resubscribe() bool {
+	ctx := context.Background()
+	rs.mu.Lock()
+	var keys []string
+	if rs.subscriptions != nil {
+		keys = make([]string, 0, len(rs.subscriptions))
+		for key := range rs.subscriptions {
+			keys = append(keys, key)
+		}
+	}
+	stopped := rs.stopped
+	rs.mu.Unlock()
+	if stopped {
+		return false
+	}
+	legacy, err := rs.legacy()
+	if err != nil {
+		log.WithField("err", err).Warn("Could not resubscribe")
+		return false
+	}
+	if legacy {
+		// Such servers broadcast all puts, and the unwanted ones are
+		// ignored when received.
+		return true
+	}
+	if keys != nil && len(keys) == 0 {
+		// Subscribed to nothing, but still opted out of broadcasts for all
+		// keys.
+		if err := rs.doAcknowledged(ctx, message.NewUnsubscribeMessage(0, "")); err != nil {
+			log.WithField("err", err).Warn("Could not resubscribe")
+			return false
+		}
+	}
+	if err := rs.subscribeMany(ctx, keys); err != nil {
+		log.WithField("err", err).Warn("Could not resubscribe")
+		return false
+	}
+	if len(keys) > 0 {
+		log.WithField("count", len(keys)).Debug("Resubscribed")
+	}
+	return true
+}
+
+// subscribeMany sends subscribe requests for the keys, in batches if the server
+// supports subscribe many messages, otherwise one key at a time. It does not
+// touch the local subscriptions.
+func (rs *RemoteVersionedStore) subscribeMany(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	capable, err := rs.remote.Capable(message.CapabilitySubscribeMany)
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > getManyBatchSize {
+			batch = batch[:getManyBatchSize]
+		}
+		keys = keys[len(batch):]
+		if capable {
+			err = rs.doAcknowledged(ctx, message.NewSubscribeManyMessage(0, batch))
+		}
+		if !capable || errors.Is(err, ErrTooLarge) {
+			err = nil
+			for _, key := range batch {
+				if err = rs.doAcknowledged(ctx, message.NewSubscribeMessage(0, key)); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacy tells whether the server predates the handshake, and so only
+// understands get, put and auth messages. Broadcasts from such servers are for
+// all keys, and carry no sequence numbers.
+func (rs *RemoteVersionedStore) legacy() (bool, error) {
+	version, err := rs.remote.ProtocolVersion()
+	return version == 0, err
+}
+
+// doAcknowledged sends a request the server should respond to by echoing it.
+func (rs *RemoteVersionedStore) doAcknowledged(ctx context.Context, request message.Message) error {
+	if err := rs.ensureReady(ctx); err != nil {
+		return err
+	}
+	response, err := rs.do(ctx, request)
+	if err != nil {
+		return err
+	}
+	switch response.Kind() {
+	case request.Kind():
+		return nil
+	case message.KindError:
+		return rs.responseError(response)
+	default:
+		return fmt.Errorf("unexpected response kind: %v", response.Kind())
+	}
+}
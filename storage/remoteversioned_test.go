@@ -0,0 +1,387 @@
+package storage_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/client"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSlowServer starts a fake metadata server that never responds to gets for
+// the key "slow". It returns its address, a counter of the handshakes it
+// completed, and a function to stop it.
+func newSlowServer(t *testing.T) (string, *int32, func()) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	var handshakes int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				var encoder message.Encoder
+				var decoder message.Decoder
+				var m message.Message
+				if decoder.Decode(conn, &m) != nil || m.Kind() != message.KindHello {
+					return
+				}
+				atomic.AddInt32(&handshakes, 1)
+				if encoder.Encode(conn, message.NewHelloMessage(m.Tag(), message.ProtocolVersion, "slow", nil)) != nil {
+					return
+				}
+				for decoder.Decode(conn, &m) == nil {
+					if m.Kind() == message.KindGet && m.Key() != "slow" {
+						_ = encoder.Encode(conn, message.NewPutMessage(m.Tag(), m.Key(), "fast", 1))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &handshakes, func() {
+		_ = ln.Close()
+	}
+}
+
+func TestRemoteVersionedStoreTimeouts(t *testing.T) {
+	address, handshakes, cleanup := newSlowServer(t)
+	defer cleanup()
+	rs := storage.NewRemoteVersionedStore(
+		client.New(client.WithAddress(address), client.WithFallbackToPlainTCP()),
+		storage.WithRequestTimeout(200*time.Millisecond),
+	)
+	rs.Start()
+	defer rs.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _, err := rs.Get([]byte("slow"))
+		assert.Equal(t, storage.ErrTimeout, err)
+	}()
+	_, value, err := rs.Get([]byte("fast"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("fast"), value)
+	wg.Wait()
+
+	// The timeout affected the slow request only, and the connection is
+	// still in use.
+	_, value, err = rs.Get([]byte("fast"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("fast"), value)
+	assert.EqualValues(t, 1, atomic.LoadInt32(handshakes))
+}
+
+func TestRemoteVersionedStoreContext(t *testing.T) {
+	address, _, cleanup := newSlowServer(t)
+	defer cleanup()
+	rs := storage.NewRemoteVersionedStore(
+		client.New(client.WithAddress(address), client.WithFallbackToPlainTCP()),
+		storage.WithRequestTimeout(time.Minute),
+	)
+	rs.Start()
+	defer rs.Stop()
+
+	t.Run("cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		_, _, err := rs.GetContext(ctx, []byte("slow"))
+		assert.Equal(t, context.Canceled, err)
+	})
+	t.Run("deadline overrides request timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, _, err := rs.GetContext(ctx, []byte("slow"))
+		assert.Equal(t, storage.ErrTimeout, err)
+	})
+	t.Run("through the fallback functions", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := storage.GetManyContext(ctx, rs, [][]byte{[]byte("slow")})
+		assert.Equal(t, storage.ErrTimeout, err)
+	})
+}
+
+// newAuthServer starts a fake metadata server that answers gets only on
+// authorized connections. It returns its address, counters of the successful
+// auth requests and of the unauthorized requests, a function to drop all
+// connections, and a function to stop it.
+func newAuthServer(t *testing.T) (string, *int32, *int32, func(), func()) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	var auths, unauthorized int32
+	var mu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns[conn] = struct{}{}
+			mu.Unlock()
+			go func() {
+				defer func() {
+					mu.Lock()
+					delete(conns, conn)
+					mu.Unlock()
+					_ = conn.Close()
+				}()
+				var encoder message.Encoder
+				var decoder message.Decoder
+				var m message.Message
+				if decoder.Decode(conn, &m) != nil || m.Kind() != message.KindHello {
+					return
+				}
+				if encoder.Encode(conn, message.NewHelloMessage(m.Tag(), message.ProtocolVersion, "auth", nil)) != nil {
+					return
+				}
+				authorized := false
+				for decoder.Decode(conn, &m) == nil {
+					var response message.Message
+					switch {
+					case m.Kind() == message.KindAuth:
+						atomic.AddInt32(&auths, 1)
+						authorized = true
+						response = m
+					case !authorized:
+						atomic.AddInt32(&unauthorized, 1)
+						response = message.NewErrorMessage(m.Tag(), "go away")
+					case m.Kind() == message.KindGet:
+						response = message.NewPutMessage(m.Tag(), m.Key(), "value", 1)
+					default:
+						response = m
+					}
+					if encoder.Encode(conn, response) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	drop := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	return ln.Addr().String(), &auths, &unauthorized, drop, func() {
+		_ = ln.Close()
+	}
+}
+
+func TestRemoteVersionedStoreReconnects(t *testing.T) {
+	address, auths, unauthorized, drop, cleanup := newAuthServer(t)
+	defer cleanup()
+	states := make(chan storage.ConnectionState, 10)
+	rs := storage.NewRemoteVersionedStore(
+		client.New(client.WithAddress(address), client.WithFallbackToPlainTCP()),
+		storage.WithAuthKey("secret"),
+		storage.WithResponseBackoff(10*time.Millisecond),
+		storage.WithConnectionStateListener(func(state storage.ConnectionState, err error) {
+			states <- state
+		}),
+	)
+	rs.Start()
+	defer rs.Stop()
+
+	nextState := func() storage.ConnectionState {
+		select {
+		case state := <-states:
+			return state
+		case <-time.After(5 * time.Second):
+			t.Fatal("no state change")
+			panic("not reached")
+		}
+	}
+
+	assert.Equal(t, storage.StateConnected, nextState())
+	_, value, err := rs.Get([]byte("key"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+	assert.EqualValues(t, 1, atomic.LoadInt32(auths))
+
+	drop()
+	assert.Equal(t, storage.StateDisconnected, nextState())
+	assert.Equal(t, storage.StateConnected, nextState())
+	assert.Equal(t, storage.StateConnected, rs.ConnectionState())
+
+	// The new connection is authorized again, before any request is refused.
+	_, value, err = rs.Get([]byte("key"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+	assert.EqualValues(t, 2, atomic.LoadInt32(auths))
+	assert.EqualValues(t, 0, atomic.LoadInt32(unauthorized))
+}
+
+// newHalfOpenServer starts a fake metadata server that supports pings, but
+// stops responding to anything on the first connection right after the
+// handshake, as if the connection were half-open. It returns its address, a
+// counter of the handshakes it completed, and a function to stop it.
+func newHalfOpenServer(t *testing.T) (string, *int32, func()) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	var handshakes int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				var encoder message.Encoder
+				var decoder message.Decoder
+				var m message.Message
+				if decoder.Decode(conn, &m) != nil || m.Kind() != message.KindHello {
+					return
+				}
+				n := atomic.AddInt32(&handshakes, 1)
+				capabilities := []string{message.CapabilityPing}
+				if encoder.Encode(conn, message.NewHelloMessage(m.Tag(), message.ProtocolVersion, "half-open", capabilities)) != nil {
+					return
+				}
+				for decoder.Decode(conn, &m) == nil {
+					if n > 1 && m.Kind() == message.KindPing {
+						_ = encoder.Encode(conn, message.NewPongMessage(m.Tag(), m.Payload()))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &handshakes, func() {
+		_ = ln.Close()
+	}
+}
+
+func TestRemoteVersionedStorePings(t *testing.T) {
+	address, handshakes, cleanup := newHalfOpenServer(t)
+	defer cleanup()
+	states := make(chan storage.ConnectionState, 10)
+	rs := storage.NewRemoteVersionedStore(
+		client.New(client.WithAddress(address), client.WithFallbackToPlainTCP()),
+		storage.WithRequestTimeout(100*time.Millisecond),
+		storage.WithResponseBackoff(10*time.Millisecond),
+		storage.WithPingInterval(50*time.Millisecond),
+		storage.WithConnectionStateListener(func(state storage.ConnectionState, err error) {
+			states <- state
+		}),
+	)
+	rs.Start()
+	defer rs.Stop()
+
+	for _, want := range []storage.ConnectionState{
+		storage.StateConnected,
+		storage.StateDisconnected,
+		storage.StateConnected,
+	} {
+		select {
+		case state := <-states:
+			assert.Equal(t, want, state)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no state change, want %v", want)
+		}
+	}
+
+	// The new connection stays up.
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, storage.StateConnected, rs.ConnectionState())
+	assert.EqualValues(t, 2, atomic.LoadInt32(handshakes))
+}
+
+// newLegacyServer starts a fake metadata server predating the handshake, which
+// responds to hello messages with an error message, and only understands get,
+// put and auth messages. It returns its address, a counter of the other
+// messages it received after the first message of a connection, and a
+// function to stop it.
+func newLegacyServer(t *testing.T) (string, *int32, func()) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	store := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	var unknown int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				var encoder message.Encoder
+				var decoder message.Decoder
+				for first := true; ; first = false {
+					var m message.Message
+					if decoder.Decode(conn, &m) != nil {
+						return
+					}
+					var response message.Message
+					switch m.Kind() {
+					case message.KindGet, message.KindPut:
+						response = storage.ApplyMessage(store, m)
+					default:
+						if !first {
+							atomic.AddInt32(&unknown, 1)
+						}
+						response = message.NewErrorMessage(m.Tag(), "unknown message kind")
+					}
+					if encoder.Encode(conn, response) != nil {
+						return
+					}
+					if m.Kind() == message.KindHello {
+						// What follows would be garbled.
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &unknown, func() {
+		_ = ln.Close()
+	}
+}
+
+func TestRemoteVersionedStoreLegacyServer(t *testing.T) {
+	address, unknown, cleanup := newLegacyServer(t)
+	defer cleanup()
+	rs := storage.NewRemoteVersionedStore(
+		client.New(client.WithAddress(address), client.WithFallbackToPlainTCP()),
+		storage.WithRequestTimeout(5*time.Second),
+		storage.WithInvalidations(),
+	)
+	rs.Start()
+	defer rs.Stop()
+
+	require.Nil(t, rs.Subscribe([]byte("name")))
+	require.Nil(t, rs.Put(1, []byte("name"), []byte("tony")))
+	// Also drops the cached value, so that the server is asked below.
+	require.Nil(t, rs.Unsubscribe([]byte("name")))
+	_, _, err := rs.GetIfModified([]byte("name"), 1)
+	assert.Equal(t, storage.ErrNotModified, err)
+	values, err := storage.GetMany(rs, [][]byte{[]byte("name")})
+	require.Nil(t, err)
+	assert.Equal(t, []byte("tony"), values["name"].Value)
+	version, value, err := rs.Get([]byte("name"))
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, version)
+	assert.Equal(t, []byte("tony"), value)
+	assert.EqualValues(t, 0, atomic.LoadInt32(unknown))
+}
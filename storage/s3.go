@@ -2,15 +2,20 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -58,8 +63,13 @@ func NewS3Store(profile, region, bucket string) (*S3Store, error) {
 }
 
 func (s *S3Store) Get(key []byte) (value []byte, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextStore.
+func (s *S3Store) GetContext(ctx context.Context, key []byte) (value []byte, err error) {
 	hexKey := fmt.Sprintf("%x", key)
-	output, err := s.client.GetObject(&s3.GetObjectInput{
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(hexKey),
 	})
@@ -83,11 +93,116 @@ func (s *S3Store) Get(key []byte) (value []byte, err error) {
 }
 
 func (s *S3Store) Put(key, value []byte) (err error) {
+	return s.PutContext(context.Background(), key, value)
+}
+
+// PutContext implements ContextStore.
+func (s *S3Store) PutContext(ctx context.Context, key, value []byte) (err error) {
 	hexKey := fmt.Sprintf("%x", key)
-	_, err = s.client.PutObject(&s3.PutObjectInput{
+	_, err = s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(hexKey),
 		Body:   bytes.NewReader(value),
 	})
 	return
 }
+
+// PutStream implements StreamStore. Large values are uploaded in parts, so
+// that they needn't be held in memory whole.
+func (s *S3Store) PutStream(ctx context.Context, key []byte, r io.Reader, size int64) error {
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	_, err := s3manager.NewUploaderWithClient(s.client).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(fmt.Sprintf("%x", key)),
+		Body:   r,
+	})
+	return err
+}
+
+// GetRange implements StreamStore.
+func (s *S3Store) GetRange(ctx context.Context, key []byte, offset int64, length int64) (rc io.ReadCloser, size int64, err error) {
+	hexKey := fmt.Sprintf("%x", key)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(hexKey),
+	}
+	if offset > 0 || length >= 0 {
+		input.Range = aws.String(rangeHeader(offset, length))
+	}
+	output, err := s.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		if rfErr, ok := err.(awserr.RequestFailure); ok {
+			switch rfErr.StatusCode() {
+			case http.StatusNotFound:
+				return nil, 0, fmt.Errorf("%q: %w", key, ErrNotFound)
+			case http.StatusRequestedRangeNotSatisfiable:
+				// Past the end of the value. Get its size.
+				head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+					Bucket: aws.String(s.bucket),
+					Key:    aws.String(hexKey),
+				})
+				if err != nil {
+					return nil, 0, err
+				}
+				return ioutil.NopCloser(bytes.NewReader(nil)), aws.Int64Value(head.ContentLength), nil
+			}
+		}
+		return nil, 0, err
+	}
+	size = aws.Int64Value(output.ContentLength)
+	if cr := aws.StringValue(output.ContentRange); cr != "" {
+		if size, err = parseContentRangeSize(cr); err != nil {
+			_ = output.Body.Close()
+			return nil, 0, err
+		}
+	}
+	if length == 0 {
+		_ = output.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(nil)), size, nil
+	}
+	return output.Body, size, nil
+}
+
+// Stat implements Statter, with a HEAD request.
+func (s *S3Store) Stat(ctx context.Context, key []byte) (size int64, err error) {
+	output, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(fmt.Sprintf("%x", key)),
+	})
+	if err != nil {
+		if rfErr, ok := err.(awserr.RequestFailure); ok && rfErr.StatusCode() == http.StatusNotFound {
+			return 0, fmt.Errorf("%q: %w", key, ErrNotFound)
+		}
+		return 0, err
+	}
+	return aws.Int64Value(output.ContentLength), nil
+}
+
+// rangeHeader returns the value of the Range header requesting length bytes
+// from offset, or all bytes from offset if length is negative. A zero length
+// can't be expressed, so it requests one byte.
+func rangeHeader(offset int64, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	if length == 0 {
+		length = 1
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// parseContentRangeSize returns the size of the whole value from the value of
+// a Content-Range header, e.g., "bytes 0-99/1000" or "bytes */1000".
+func parseContentRangeSize(value string) (int64, error) {
+	i := strings.LastIndexByte(value, '/')
+	if i < 0 || !strings.HasPrefix(value, "bytes ") {
+		return 0, fmt.Errorf("%q: invalid content range", value)
+	}
+	size, err := strconv.ParseInt(value[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q: invalid content range: %w", value, err)
+	}
+	return size, nil
+}
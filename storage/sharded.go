@@ -0,0 +1,389 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/client"
+)
+
+// ErrShardsChanged is returned by CheckShards if the shards differ from those
+// the key space was first partitioned among.
+var ErrShardsChanged = errors.New("shards changed")
+
+// The key under which each shard records the names of all shards.
+var shardsKey = []byte("\x00shards")
+
+// How many points on the hash ring each shard gets. More points spread the
+// keys more evenly.
+const pointsPerShard = 128
+
+// hashRing maps keys to shards by consistent hashing: adding or removing a
+// shard only moves the keys that shard gains or loses.
+type hashRing struct {
+	points []uint64
+	owners []string
+}
+
+func newHashRing(names []string) hashRing {
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	var points []point
+	for _, name := range names {
+		for i := 0; i < pointsPerShard; i++ {
+			points = append(points, point{
+				hash:  hashOf([]byte(name + "#" + strconv.Itoa(i))),
+				owner: name,
+			})
+		}
+	}
+	// Ties are unlikely, but break them the same way everywhere.
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	var r hashRing
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.owner)
+	}
+	return r
+}
+
+// owner returns the name of the shard owning the key: the one with the first
+// point at or after the hash of the key, going around the ring.
+func (r hashRing) owner(key []byte) string {
+	h := hashOf(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// hashOf hashes with SHA-256 rather than a cheaper hash like FNV, whose high
+// bits hardly depend on the last bytes, which would cluster similar keys.
+func hashOf(b []byte) uint64 {
+	sum := sha256.Sum256(b)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ShardedVersionedStore is a VersionedStore partitioning the key space across
+// several versioned stores, the shards, by consistent hashing of the keys.
+// Each request goes to the shard owning the key, and requests for many keys are
+// split among the owning shards. Shards are identified by name, which
+// determines the keys they own, so names should stay the same as shards are
+// added or removed, e.g., a name could be the address of a metadata server.
+type ShardedVersionedStore struct {
+	shards map[string]VersionedStore
+	ring   hashRing
+}
+
+func NewShardedVersionedStore(shards map[string]VersionedStore) *ShardedVersionedStore {
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	return &ShardedVersionedStore{
+		shards: shards,
+		ring:   newHashRing(names),
+	}
+}
+
+// CheckShards makes sure the shards are the same as when the key space was
+// first partitioned, since adding, removing or renaming a shard would move
+// keys to shards that don't have them. The names of the shards are recorded
+// on each shard the first time, and compared with the recorded ones
+// afterwards. Keys aren't migrated, so on ErrShardsChanged, the shards should
+// be changed back.
+func (s *ShardedVersionedStore) CheckShards(ctx context.Context) error {
+	names := make([]string, 0, len(s.shards))
+	for name := range s.shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := strings.Join(names, "\n")
+	var unrecorded []string
+	for _, name := range names {
+		_, value, err := VersionedGetContext(ctx, s.shards[name], shardsKey)
+		if errors.Is(err, ErrNotFound) {
+			unrecorded = append(unrecorded, name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("shard %q: %w", name, err)
+		}
+		if got := string(value); got != want {
+			return fmt.Errorf("shard %q was partitioned among %q, not %q: %w",
+				name, strings.Split(got, "\n"), names, ErrShardsChanged)
+		}
+	}
+	// Either this is the first time, or the first time was interrupted: the
+	// names recorded on the others would not include shards added since.
+	for _, name := range unrecorded {
+		err := VersionedPutContext(ctx, s.shards[name], 1, shardsKey, []byte(want))
+		if errors.Is(err, ErrStalePut) {
+			// Recorded concurrently, e.g., by another file system instance.
+			var value []byte
+			_, value, err = VersionedGetContext(ctx, s.shards[name], shardsKey)
+			if err == nil && string(value) != want {
+				err = fmt.Errorf("partitioned among %q, not %q: %w",
+					strings.Split(string(value), "\n"), names, ErrShardsChanged)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("shard %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *ShardedVersionedStore) shard(key []byte) VersionedStore {
+	return s.shards[s.ring.owner(key)]
+}
+
+func (s *ShardedVersionedStore) Put(version uint64, key []byte, value []byte) error {
+	return s.PutContext(context.Background(), version, key, value)
+}
+
+// PutContext implements ContextVersionedStore.
+func (s *ShardedVersionedStore) PutContext(ctx context.Context, version uint64, key []byte, value []byte) error {
+	return VersionedPutContext(ctx, s.shard(key), version, key, value)
+}
+
+func (s *ShardedVersionedStore) Get(key []byte) (version uint64, value []byte, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextVersionedStore.
+func (s *ShardedVersionedStore) GetContext(ctx context.Context, key []byte) (version uint64, value []byte, err error) {
+	return VersionedGetContext(ctx, s.shard(key), key)
+}
+
+// GetIfModified implements ConditionalGetter.
+func (s *ShardedVersionedStore) GetIfModified(key []byte, version uint64) (newVersion uint64, value []byte, err error) {
+	return s.GetIfModifiedContext(context.Background(), key, version)
+}
+
+// GetIfModifiedContext implements ContextConditionalGetter.
+func (s *ShardedVersionedStore) GetIfModifiedContext(ctx context.Context, key []byte, version uint64) (newVersion uint64, value []byte, err error) {
+	return GetIfModifiedContext(ctx, s.shard(key), key, version)
+}
+
+// GetMany implements MultiGetter.
+func (s *ShardedVersionedStore) GetMany(keys [][]byte) (map[string]VersionedValue, error) {
+	return s.GetManyContext(context.Background(), keys)
+}
+
+// GetManyContext implements ContextMultiGetter. The shards are asked
+// concurrently.
+func (s *ShardedVersionedStore) GetManyContext(ctx context.Context, keys [][]byte) (map[string]VersionedValue, error) {
+	keysByShard := make(map[string][][]byte)
+	for _, key := range keys {
+		name := s.ring.owner(key)
+		keysByShard[name] = append(keysByShard[name], key)
+	}
+	type result struct {
+		values map[string]VersionedValue
+		err    error
+	}
+	results := make(chan result, len(keysByShard))
+	for name, keys := range keysByShard {
+		go func(shard VersionedStore, keys [][]byte) {
+			values, err := GetManyContext(ctx, shard, keys)
+			results <- result{values: values, err: err}
+		}(s.shards[name], keys)
+	}
+	values := make(map[string]VersionedValue, len(keys))
+	var err error
+	for range keysByShard {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		for k, v := range r.values {
+			values[k] = v
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Subscribe implements Subscriber. Shards that aren't subscribers need no
+// subscriptions.
+func (s *ShardedVersionedStore) Subscribe(key []byte) error {
+	return s.SubscribeContext(context.Background(), key)
+}
+
+// SubscribeContext implements ContextSubscriber.
+func (s *ShardedVersionedStore) SubscribeContext(ctx context.Context, key []byte) error {
+	switch shard := s.shard(key).(type) {
+	case ContextSubscriber:
+		return shard.SubscribeContext(ctx, key)
+	case Subscriber:
+		return shard.Subscribe(key)
+	default:
+		return nil
+	}
+}
+
+// SubscribeMany implements MultiSubscriber.
+func (s *ShardedVersionedStore) SubscribeMany(keys [][]byte) error {
+	return s.SubscribeManyContext(context.Background(), keys)
+}
+
+// SubscribeManyContext implements ContextMultiSubscriber. The shards are asked
+// concurrently.
+func (s *ShardedVersionedStore) SubscribeManyContext(ctx context.Context, keys [][]byte) error {
+	keysByShard := make(map[string][][]byte)
+	for _, key := range keys {
+		name := s.ring.owner(key)
+		keysByShard[name] = append(keysByShard[name], key)
+	}
+	errs := make(chan error, len(keysByShard))
+	for name, keys := range keysByShard {
+		go func(shard VersionedStore, keys [][]byte) {
+			errs <- SubscribeManyContext(ctx, shard, keys)
+		}(s.shards[name], keys)
+	}
+	var err error
+	for range keysByShard {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Unsubscribe implements Subscriber.
+func (s *ShardedVersionedStore) Unsubscribe(key []byte) error {
+	return s.UnsubscribeContext(context.Background(), key)
+}
+
+// UnsubscribeContext implements ContextSubscriber.
+func (s *ShardedVersionedStore) UnsubscribeContext(ctx context.Context, key []byte) error {
+	switch shard := s.shard(key).(type) {
+	case ContextSubscriber:
+		return shard.UnsubscribeContext(ctx, key)
+	case Subscriber:
+		return shard.Unsubscribe(key)
+	default:
+		return nil
+	}
+}
+
+// ShardedRemoteVersionedStore is a ShardedVersionedStore whose shards are
+// RemoteVersionedStores, e.g., one per metadata server, merging the broadcasts
+// from all of them.
+type ShardedRemoteVersionedStore struct {
+	*ShardedVersionedStore
+	remotes []*RemoteVersionedStore
+
+	mu       sync.Mutex
+	states   map[string]ConnectionState
+	state    ConnectionState
+	listener ConnectionStateListener
+}
+
+// NewShardedRemoteVersionedStore creates a RemoteVersionedStore for each of the
+// given clients, by shard name, with the given options. The change and resync
+// listeners are called for the broadcasts from any shard, one at a time. The
+// connection state listener is told the store is connected once all shards are,
+// and disconnected as soon as any shard is.
+func NewShardedRemoteVersionedStore(clients map[string]*client.Client, opts ...Option) *ShardedRemoteVersionedStore {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s := &ShardedRemoteVersionedStore{
+		states:   make(map[string]ConnectionState),
+		listener: o.stateListener,
+	}
+	var mu sync.Mutex
+	var shared []Option
+	if listener := o.listener; listener != nil {
+		shared = append(shared, WithChangeListener(func(m message.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			listener(m)
+		}))
+	}
+	if listener := o.resyncListener; listener != nil {
+		shared = append(shared, WithResyncListener(func() {
+			mu.Lock()
+			defer mu.Unlock()
+			listener()
+		}))
+	}
+	shards := make(map[string]VersionedStore)
+	for name, c := range clients {
+		name := name
+		shardOptions := append(append(append([]Option(nil), opts...), shared...),
+			WithConnectionStateListener(func(state ConnectionState, err error) {
+				s.setState(name, state, err)
+			}))
+		remote := NewRemoteVersionedStore(c, shardOptions...)
+		s.remotes = append(s.remotes, remote)
+		shards[name] = remote
+	}
+	s.ShardedVersionedStore = NewShardedVersionedStore(shards)
+	return s
+}
+
+func (s *ShardedRemoteVersionedStore) Start() {
+	for _, remote := range s.remotes {
+		remote.Start()
+	}
+}
+
+func (s *ShardedRemoteVersionedStore) Stop() {
+	for _, remote := range s.remotes {
+		remote.Stop()
+	}
+}
+
+func (s *ShardedRemoteVersionedStore) setState(name string, state ConnectionState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[name] = state
+	overall := StateConnected
+	if len(s.states) < len(s.remotes) {
+		overall = StateDisconnected
+	}
+	for _, state := range s.states {
+		if state != StateConnected {
+			overall = StateDisconnected
+		}
+	}
+	if overall == s.state {
+		return
+	}
+	s.state = overall
+	if s.listener != nil {
+		s.listener(overall, err)
+	}
+}
+
+// ConnectionState returns StateConnected if all shards are connected.
+func (s *ShardedRemoteVersionedStore) ConnectionState() ConnectionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
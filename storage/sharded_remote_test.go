@@ -0,0 +1,126 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/client"
+	"github.com/nicolagi/dino/metadata/server"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedRemoteVersionedStore(t *testing.T) {
+	backends := make(map[string]storage.VersionedStore)
+	addresses := make(map[string]string)
+	for _, name := range []string{"a", "b"} {
+		backend := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+		srv := server.New(
+			server.WithAddress("localhost:0"),
+			server.WithVersionedStore(backend),
+		)
+		address, err := srv.Listen()
+		require.Nil(t, err)
+		done := make(chan struct{})
+		go func() {
+			assert.Nil(t, srv.Serve())
+			close(done)
+		}()
+		defer func() {
+			assert.Nil(t, srv.Shutdown())
+			<-done
+		}()
+		backends[name] = backend
+		addresses[name] = address
+	}
+	newClients := func() map[string]*client.Client {
+		clients := make(map[string]*client.Client)
+		for name, address := range addresses {
+			clients[name] = client.New(client.WithAddress(address), client.WithFallbackToPlainTCP())
+		}
+		return clients
+	}
+
+	var mu sync.Mutex
+	changed := make(map[string]bool)
+	var states []storage.ConnectionState
+	watcher := storage.NewShardedRemoteVersionedStore(
+		newClients(),
+		storage.WithChangeListener(func(m message.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			changed[m.Key()] = true
+		}),
+		storage.WithConnectionStateListener(func(state storage.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, state)
+		}),
+	)
+	watcher.Start()
+	defer watcher.Stop()
+	require.Eventually(t, func() bool {
+		return watcher.ConnectionState() == storage.StateConnected
+	}, 5*time.Second, 10*time.Millisecond)
+
+	writer := storage.NewShardedRemoteVersionedStore(newClients())
+	writer.Start()
+	defer writer.Stop()
+
+	var keys [][]byte
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		keys = append(keys, key)
+		require.Nil(t, writer.Put(1, key, []byte("value")))
+	}
+
+	t.Run("each key is stored by one shard only", func(t *testing.T) {
+		for _, key := range keys {
+			owners := 0
+			for _, backend := range backends {
+				if _, _, err := backend.Get(key); err == nil {
+					owners++
+				}
+			}
+			assert.Equal(t, 1, owners, "key %q", key)
+		}
+		for name, backend := range backends {
+			values, err := storage.GetManyContext(context.Background(), backend, keys)
+			require.Nil(t, err)
+			assert.NotEmpty(t, values, "shard %q stores no keys", name)
+		}
+	})
+	t.Run("get many collects values from all shards", func(t *testing.T) {
+		values, err := watcher.GetMany(keys)
+		require.Nil(t, err)
+		assert.Len(t, values, len(keys))
+	})
+	t.Run("broadcasts from all shards are merged", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(changed) == len(keys)
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+	t.Run("connected is reported once for all shards", func(t *testing.T) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []storage.ConnectionState{storage.StateConnected}, states)
+	})
+	t.Run("other shards are refused", func(t *testing.T) {
+		require.Nil(t, writer.CheckShards(context.Background()))
+		clients := newClients()
+		delete(clients, "b")
+		fewer := storage.NewShardedRemoteVersionedStore(clients)
+		fewer.Start()
+		defer fewer.Stop()
+		err := fewer.CheckShards(context.Background())
+		assert.True(t, errors.Is(err, storage.ErrShardsChanged), "got %v", err)
+	})
+}
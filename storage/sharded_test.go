@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashRing(t *testing.T) {
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+	t.Run("keys are spread across all shards", func(t *testing.T) {
+		r := newHashRing([]string{"a", "b", "c", "d"})
+		counts := make(map[string]int)
+		for _, key := range keys {
+			counts[r.owner(key)]++
+		}
+		assert.Len(t, counts, 4)
+		for name, count := range counts {
+			assert.True(t, count > len(keys)/8, "shard %q owns only %d keys", name, count)
+		}
+	})
+	t.Run("adding a shard only moves keys to the new shard", func(t *testing.T) {
+		before := newHashRing([]string{"a", "b", "c"})
+		after := newHashRing([]string{"a", "b", "c", "d"})
+		moved := 0
+		for _, key := range keys {
+			if owner := after.owner(key); owner != before.owner(key) {
+				assert.Equal(t, "d", owner)
+				moved++
+			}
+		}
+		assert.True(t, moved > 0)
+		assert.True(t, moved < len(keys)/2)
+	})
+	t.Run("ownership does not depend on the order of the shards", func(t *testing.T) {
+		r1 := newHashRing([]string{"a", "b", "c"})
+		r2 := newHashRing([]string{"c", "a", "b"})
+		for _, key := range keys {
+			assert.Equal(t, r1.owner(key), r2.owner(key))
+		}
+	})
+}
+
+func TestShardedVersionedStoreCheckShards(t *testing.T) {
+	ctx := context.Background()
+	newShards := func(names ...string) map[string]VersionedStore {
+		shards := make(map[string]VersionedStore)
+		for _, name := range names {
+			shards[name] = NewVersionedWrapper(NewInMemoryStore())
+		}
+		return shards
+	}
+	pick := func(shards map[string]VersionedStore, names ...string) map[string]VersionedStore {
+		picked := make(map[string]VersionedStore)
+		for _, name := range names {
+			picked[name] = shards[name]
+		}
+		return picked
+	}
+	t.Run("the same shards pass", func(t *testing.T) {
+		shards := newShards("a", "b", "c")
+		require.Nil(t, NewShardedVersionedStore(shards).CheckShards(ctx))
+		for name, shard := range shards {
+			_, value, err := shard.Get(shardsKey)
+			require.Nil(t, err, name)
+			assert.Equal(t, "a\nb\nc", string(value))
+		}
+		assert.Nil(t, NewShardedVersionedStore(pick(shards, "c", "a", "b")).CheckShards(ctx))
+	})
+	t.Run("added shards are refused", func(t *testing.T) {
+		shards := newShards("a", "b", "c")
+		require.Nil(t, NewShardedVersionedStore(pick(shards, "a", "b")).CheckShards(ctx))
+		err := NewShardedVersionedStore(shards).CheckShards(ctx)
+		assert.True(t, errors.Is(err, ErrShardsChanged), "got %v", err)
+		_, _, err = shards["c"].Get(shardsKey)
+		assert.True(t, errors.Is(err, ErrNotFound), "got %v", err)
+	})
+	t.Run("removed shards are refused", func(t *testing.T) {
+		shards := newShards("a", "b", "c")
+		require.Nil(t, NewShardedVersionedStore(shards).CheckShards(ctx))
+		err := NewShardedVersionedStore(pick(shards, "a", "b")).CheckShards(ctx)
+		assert.True(t, errors.Is(err, ErrShardsChanged), "got %v", err)
+	})
+	t.Run("renamed shards are refused", func(t *testing.T) {
+		shards := newShards("a", "b")
+		require.Nil(t, NewShardedVersionedStore(shards).CheckShards(ctx))
+		renamed := map[string]VersionedStore{"a": shards["a"], "z": shards["b"]}
+		err := NewShardedVersionedStore(renamed).CheckShards(ctx)
+		assert.True(t, errors.Is(err, ErrShardsChanged), "got %v", err)
+	})
+	t.Run("interrupted recording is completed", func(t *testing.T) {
+		shards := newShards("a", "b")
+		require.Nil(t, shards["a"].Put(1, shardsKey, []byte("a\nb")))
+		require.Nil(t, NewShardedVersionedStore(shards).CheckShards(ctx))
+		_, value, err := shards["b"].Get(shardsKey)
+		require.Nil(t, err)
+		assert.Equal(t, "a\nb", string(value))
+	})
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// Statter is implemented by stores that can tell whether they have a value,
+// and its size, without transferring it. Use the Stat and Has functions to
+// fall back to reading the value for other stores.
+type Statter interface {
+	// Stat returns the size of the value for the key. It should return
+	// ErrNotFound if the key is not in the store.
+	Stat(ctx context.Context, key []byte) (size int64, err error)
+}
+
+// MissingFinder is implemented by stores that can tell which of many keys
+// they don't have more efficiently than one key at a time. Use the Missing
+// function to fall back to Stat for other stores.
+type MissingFinder interface {
+	// Missing returns the keys, among the given ones, that are not in the
+	// store, in the order they were given.
+	Missing(ctx context.Context, keys [][]byte) (missing [][]byte, err error)
+}
+
+// Stat calls the store's Stat method if it is a Statter. Otherwise, it gets
+// an empty range of the value, which only transfers the whole value for stores
+// that can't stream.
+func Stat(ctx context.Context, store Store, key []byte) (size int64, err error) {
+	if st, ok := store.(Statter); ok {
+		return st.Stat(ctx, key)
+	}
+	rc, size, err := GetRange(ctx, store, key, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	_ = rc.Close()
+	return size, nil
+}
+
+// Has tells whether the key is in the store.
+func Has(ctx context.Context, store Store, key []byte) (bool, error) {
+	_, err := Stat(ctx, store, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Missing calls the store's Missing method if it is a MissingFinder,
+// otherwise it checks the keys one at a time.
+func Missing(ctx context.Context, store Store, keys [][]byte) (missing [][]byte, err error) {
+	if mf, ok := store.(MissingFinder); ok {
+		return mf.Missing(ctx, keys)
+	}
+	for _, key := range keys {
+		has, err := Has(ctx, store, key)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,128 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts puts, to check which ones were skipped.
+type countingStore struct {
+	*storage.InMemoryStore
+	puts int32
+}
+
+func (s *countingStore) Put(key, value []byte) error {
+	atomic.AddInt32(&s.puts, 1)
+	return s.InMemoryStore.Put(key, value)
+}
+
+// statCountingStore counts stats, to check which stores were asked about
+// single keys. It finds missing keys without counting them.
+type statCountingStore struct {
+	*storage.InMemoryStore
+	stats int32
+}
+
+func (s *statCountingStore) Stat(ctx context.Context, key []byte) (int64, error) {
+	atomic.AddInt32(&s.stats, 1)
+	return s.InMemoryStore.Stat(ctx, key)
+}
+
+func (s *statCountingStore) Missing(ctx context.Context, keys [][]byte) (missing [][]byte, err error) {
+	return storage.Missing(ctx, s.InMemoryStore, keys)
+}
+
+func TestStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dino-stat-")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	for _, tc := range []struct {
+		name  string
+		store storage.Store
+	}{
+		{"disk", storage.NewDiskStore(dir)},
+		{"in-memory", storage.NewInMemoryStore()},
+		// Hides the Stat method.
+		{"fallback", struct{ storage.Store }{storage.NewInMemoryStore()}},
+		{"paired", storage.NewPaired(storage.NewInMemoryStore(), storage.NewInMemoryStore())},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testStat(t, tc.store)
+		})
+	}
+}
+
+func testStat(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	present := randomKey()[:16]
+	absent := randomKey()[:16]
+	require.Nil(t, store.Put(present, []byte("value")))
+
+	size, err := storage.Stat(ctx, store, present)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 5, size)
+	_, err = storage.Stat(ctx, store, absent)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), "got %v", err)
+
+	has, err := storage.Has(ctx, store, present)
+	assert.Nil(t, err)
+	assert.True(t, has)
+	has, err = storage.Has(ctx, store, absent)
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	missing, err := storage.Missing(ctx, store, [][]byte{absent, present, absent})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{absent, absent}, missing)
+}
+
+func TestUploadSkipping(t *testing.T) {
+	t.Run("blob store does not put values it has", func(t *testing.T) {
+		delegate := &countingStore{InMemoryStore: storage.NewInMemoryStore()}
+		store := storage.NewBlobStore(delegate)
+		value := message.RandomBytes()
+		key1, err := store.Put(value)
+		require.Nil(t, err)
+		key2, err := store.Put(value)
+		require.Nil(t, err)
+		assert.Equal(t, key1, key2)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&delegate.puts))
+	})
+	t.Run("paired store does not write back values the slow store has", func(t *testing.T) {
+		slow := &countingStore{InMemoryStore: storage.NewInMemoryStore()}
+		paired := storage.NewPaired(storage.NewInMemoryStore(), slow)
+		old, recent := randomKey()[:16], randomKey()[:16]
+		require.Nil(t, slow.InMemoryStore.Put(old, []byte("old")))
+		require.Nil(t, paired.Put(old, []byte("old")))
+		require.Nil(t, paired.Put(recent, []byte("recent")))
+		// Write-back is in order, so once the recent value is in the slow
+		// store, the old one has been handled too.
+		assert.Eventually(t, func() bool {
+			has, _ := storage.Has(context.Background(), slow, recent)
+			return has
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&slow.puts))
+	})
+	t.Run("blob store only asks paired stores about their fast store", func(t *testing.T) {
+		slow := &statCountingStore{InMemoryStore: storage.NewInMemoryStore()}
+		store := storage.NewBlobStore(storage.NewPaired(storage.NewInMemoryStore(), slow))
+		key, err := store.Put(message.RandomBytes())
+		require.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			has, _ := storage.Has(context.Background(), slow.InMemoryStore, key)
+			return has
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Zero(t, atomic.LoadInt32(&slow.stats))
+	})
+}
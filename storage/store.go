@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"sync"
@@ -29,12 +30,121 @@ type VersionedStore interface {
 	Get(key []byte) (version uint64, value []byte, err error)
 }
 
+// Subscriber is implemented by versioned stores that receive updates pushed by
+// a server, and that can be told which keys the client is interested in. Other
+// versioned stores need no subscriptions.
+type Subscriber interface {
+	// Subscribe starts receiving updates for the given key. It should be
+	// called before the key is first read, not to miss any update.
+	Subscribe(key []byte) error
+
+	// Unsubscribe stops receiving updates for the given key.
+	Unsubscribe(key []byte) error
+}
+
+// MultiSubscriber is implemented by subscribers that can subscribe to many keys
+// at once more efficiently than one at a time. Use the SubscribeMany function
+// to fall back to one key at a time for other subscribers.
+type MultiSubscriber interface {
+	// SubscribeMany is like Subscriber.Subscribe for many keys at once.
+	SubscribeMany(keys [][]byte) error
+}
+
+// SubscribeMany calls the store's SubscribeMany method if it is a
+// MultiSubscriber, otherwise it subscribes to the keys one at a time, if the
+// store is a Subscriber at all.
+func SubscribeMany(store VersionedStore, keys [][]byte) error {
+	if ms, ok := store.(MultiSubscriber); ok {
+		return ms.SubscribeMany(keys)
+	}
+	if s, ok := store.(Subscriber); ok {
+		for _, key := range keys {
+			if err := s.Subscribe(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ConditionalGetter is implemented by versioned stores that can avoid
+// transferring a value the client already has. Use the GetIfModified function
+// to fall back to a plain get for other versioned stores.
+type ConditionalGetter interface {
+	// GetIfModified is like VersionedStore.Get, but should return
+	// ErrNotModified if the current version is the given one.
+	GetIfModified(key []byte, version uint64) (newVersion uint64, value []byte, err error)
+}
+
+// GetIfModified calls the store's GetIfModified method if it is a
+// ConditionalGetter, otherwise it gets the value and compares versions.
+func GetIfModified(store VersionedStore, key []byte, version uint64) (newVersion uint64, value []byte, err error) {
+	if cg, ok := store.(ConditionalGetter); ok {
+		return cg.GetIfModified(key, version)
+	}
+	newVersion, value, err = store.Get(key)
+	if err == nil && newVersion == version {
+		return 0, nil, ErrNotModified
+	}
+	return newVersion, value, err
+}
+
+// VersionedValue is a value with its version, as returned by GetMany.
+type VersionedValue struct {
+	Version uint64
+	Value   []byte
+}
+
+// MultiGetter is implemented by versioned stores that can get many values at
+// once more efficiently than one at a time. Use the GetMany function to fall
+// back to plain gets for other versioned stores.
+type MultiGetter interface {
+	// GetMany is like VersionedStore.Get for many keys at once. The result
+	// is keyed by string(key), and keys not in the store are left out.
+	GetMany(keys [][]byte) (map[string]VersionedValue, error)
+}
+
+// GetMany calls the store's GetMany method if it is a MultiGetter, otherwise it
+// gets the values one at a time.
+func GetMany(store VersionedStore, keys [][]byte) (map[string]VersionedValue, error) {
+	if mg, ok := store.(MultiGetter); ok {
+		return mg.GetMany(keys)
+	}
+	values := make(map[string]VersionedValue, len(keys))
+	for _, key := range keys {
+		version, value, err := store.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[string(key)] = VersionedValue{Version: version, Value: value}
+	}
+	return values, nil
+}
+
 var (
 	// ErrStalePut indicates that some client has not see the latest version of the
 	// key-value pair being put. The client should get the current version, decide
 	// if it still wants to do the put, and in that case do the put with the
 	// correct version.
 	ErrStalePut = errors.New("stale put")
+
+	// ErrChangeLogTruncated indicates that a client asked for the changes since
+	// a sequence number that the change log no longer goes back to (or that the
+	// server never assigned, e.g., because it restarted). The client cannot
+	// catch up incrementally and should consider all its cached values stale.
+	ErrChangeLogTruncated = errors.New("change log truncated")
+
+	// ErrNotModified indicates that the value for a key is still at the
+	// version the client already has.
+	ErrNotModified = errors.New("not modified")
+
+	// ErrNotLeader indicates that the server is a replica that isn't, or no
+	// longer is, the leader of its group. The client should reconnect, to
+	// find the leader.
+	ErrNotLeader = errors.New("not leader")
 )
 
 // VersionedWrapper is a VersionedStore implementation wraping a given Store
@@ -53,32 +163,55 @@ func NewVersionedWrapper(delegate Store) *VersionedWrapper {
 // number is the current version number. If the put is successful, the version
 // number is incremented by one.
 func (s *VersionedWrapper) Put(version uint64, key []byte, value []byte) error {
+	return s.PutContext(context.Background(), version, key, value)
+}
+
+// PutContext implements ContextVersionedStore.
+func (s *VersionedWrapper) PutContext(ctx context.Context, version uint64, key []byte, value []byte) error {
 	s.Lock()
 	defer s.Unlock()
-	curr, err := s.delegate.Get(key)
+	curr, err := GetContext(ctx, s.delegate, key)
 	if err != nil && !errors.Is(err, ErrNotFound) {
 		return err
 	}
 	if curr != nil {
-		expectedVersion := binary.BigEndian.Uint64(curr[0:8]) + 1
-		if version < expectedVersion {
+		currVersion, _ := decodeVersioned(curr)
+		if version < currVersion+1 {
 			return ErrStalePut
 		}
 	}
-	val := make([]byte, 8+len(value))
-	binary.BigEndian.PutUint64(val, version)
-	copy(val[8:], value)
-	return s.delegate.Put(key, val)
+	return PutContext(ctx, s.delegate, key, encodeVersioned(version, value))
 }
 
 // Get retrieves the value associated with a key and its version number.
 func (s *VersionedWrapper) Get(key []byte) (version uint64, value []byte, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextVersionedStore.
+func (s *VersionedWrapper) GetContext(ctx context.Context, key []byte) (version uint64, value []byte, err error) {
 	s.Lock()
 	defer s.Unlock()
-	value, err = s.delegate.Get(key)
+	value, err = GetContext(ctx, s.delegate, key)
 	if err == nil {
-		version = binary.BigEndian.Uint64(value[:8])
-		value = value[8:]
+		version, value = decodeVersioned(value)
 	}
 	return
 }
+
+// encodeVersioned encodes a versioned value for storage in a Store: the
+// version, as 8 big-endian bytes, followed by the value. Native versioned
+// stores use the same encoding, so that they can take over data written
+// through a VersionedWrapper.
+func encodeVersioned(version uint64, value []byte) []byte {
+	encoded := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(encoded, version)
+	copy(encoded[8:], value)
+	return encoded
+}
+
+// decodeVersioned is the inverse of encodeVersioned. The returned value
+// shares memory with the argument.
+func decodeVersioned(encoded []byte) (version uint64, value []byte) {
+	return binary.BigEndian.Uint64(encoded[:8]), encoded[8:]
+}
@@ -154,6 +154,16 @@ func TestVersionedStoreImplementations(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "sharded",
+			setup: func(t *testing.T) (store storage.VersionedStore, teardown func()) {
+				return storage.NewShardedVersionedStore(map[string]storage.VersionedStore{
+					"a": storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+					"b": storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+					"c": storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+				}), func() {}
+			},
+		},
 		{
 			name: "dynamodb",
 			setup: func(t *testing.T) (store storage.VersionedStore, teardown func()) {
@@ -177,6 +187,38 @@ func TestVersionedStoreImplementations(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "dynamodb conditional",
+			setup: func(t *testing.T) (store storage.VersionedStore, teardown func()) {
+				if dynamodbparams == "" {
+					t.Skip()
+				}
+				t.Helper()
+				parts := strings.SplitN(dynamodbparams, ",", 3)
+				ddbs, err := storage.NewDynamoDBStore(parts[0], parts[1], parts[2])
+				if err != nil {
+					t.Fatalf("Could not build DynamoDBStore: %v", err)
+				}
+				return storage.NewDynamoDBConditionalStore(ddbs), func() {
+				}
+			},
+		},
+		{
+			name: "boltdb",
+			setup: func(t *testing.T) (store storage.VersionedStore, teardown func()) {
+				f, err := ioutil.TempFile("", "test-dino-storage-")
+				require.Nil(t, err)
+				require.Nil(t, f.Close())
+				db, err := bolt.Open(f.Name(), 0600, nil)
+				require.Nil(t, err)
+				store, err = storage.NewBoltVersionedStore(db)
+				require.Nil(t, err)
+				return store, func() {
+					_ = db.Close()
+					_ = os.Remove(f.Name())
+				}
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
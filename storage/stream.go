@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// StreamStore is implemented by stores that can stream values, rather than
+// hold them in memory whole, and read parts of values. Use the PutStream,
+// GetStream and GetRange functions to fall back to the plain methods for other
+// stores.
+type StreamStore interface {
+	// PutStream stores the size bytes read from r as the value for the key.
+	// A negative size means the size is not known, and all of r is read.
+	PutStream(ctx context.Context, key []byte, r io.Reader, size int64) error
+
+	// GetRange returns a reader for length bytes of the value, starting at
+	// offset, or for the bytes up to the end of the value if length is
+	// negative or too large, and the size of the whole value. The reader is
+	// empty if offset is past the end of the value. Callers must close it.
+	// GetRange should return ErrNotFound if the key is not in the store.
+	GetRange(ctx context.Context, key []byte, offset int64, length int64) (rc io.ReadCloser, size int64, err error)
+}
+
+// PutStream calls the store's PutStream method if it is a StreamStore.
+// Otherwise, it reads the value in memory, and calls PutContext.
+func PutStream(ctx context.Context, store Store, key []byte, r io.Reader, size int64) error {
+	if ss, ok := store.(StreamStore); ok {
+		return ss.PutStream(ctx, key, r, size)
+	}
+	value, err := readValue(r, size)
+	if err != nil {
+		return err
+	}
+	return PutContext(ctx, store, key, value)
+}
+
+// GetStream returns a reader for the whole value, and its size.
+func GetStream(ctx context.Context, store Store, key []byte) (rc io.ReadCloser, size int64, err error) {
+	return GetRange(ctx, store, key, 0, -1)
+}
+
+// GetRange calls the store's GetRange method if it is a StreamStore.
+// Otherwise, it gets the whole value with GetContext, and returns a reader for
+// the requested part.
+func GetRange(ctx context.Context, store Store, key []byte, offset int64, length int64) (rc io.ReadCloser, size int64, err error) {
+	if ss, ok := store.(StreamStore); ok {
+		return ss.GetRange(ctx, key, offset, length)
+	}
+	value, err := GetContext(ctx, store, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	size = int64(len(value))
+	start, end := clampRange(offset, length, size)
+	return ioutil.NopCloser(bytes.NewReader(value[start:end])), size, nil
+}
+
+// NewReaderAt returns an io.ReaderAt for the value for the key, getting the
+// requested range of the value for each call. It suits large values read in
+// large chunks.
+func NewReaderAt(ctx context.Context, store Store, key []byte) io.ReaderAt {
+	return &readerAt{ctx: ctx, store: store, key: key}
+}
+
+type readerAt struct {
+	ctx   context.Context
+	store Store
+	key   []byte
+}
+
+func (ra *readerAt) ReadAt(p []byte, off int64) (n int, err error) {
+	rc, _, err := GetRange(ra.ctx, ra.store, ra.key, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rc.Close() }()
+	n, err = io.ReadFull(rc, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// clampRange returns the start and end of the range of the value that GetRange
+// should return.
+func clampRange(offset int64, length int64, size int64) (start int64, end int64) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > size {
+		offset = size
+	}
+	end = size
+	if length >= 0 && length < size-offset {
+		end = offset + length
+	}
+	return offset, end
+}
+
+// readValue reads the size bytes of a value from r, or all of r if the size is
+// negative.
+func readValue(r io.Reader, size int64) ([]byte, error) {
+	if size < 0 {
+		return ioutil.ReadAll(r)
+	}
+	value := make([]byte, size)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, fmt.Errorf("could not read %d bytes of value: %w", size, err)
+	}
+	return value, nil
+}
+
+// readCloser closes something else than what it reads from, e.g., a file of
+// which it reads a part.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,114 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dino-stream-")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// Serves ranges like any HTTP server would.
+	blobs := storage.NewInMemoryStore()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := []byte(strings.TrimPrefix(r.URL.Path, "/"))
+		if r.Method == http.MethodPut {
+			value, _ := ioutil.ReadAll(r.Body)
+			_ = blobs.Put(key, value)
+			return
+		}
+		value, err := blobs.Get(key)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(value))
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name  string
+		store storage.Store
+	}{
+		{"disk", storage.NewDiskStore(dir)},
+		{"fallback", storage.NewInMemoryStore()},
+		{"remote", storage.NewRemoteStore(strings.TrimPrefix(server.URL, "http://"))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testStreams(t, tc.store)
+		})
+	}
+}
+
+func testStreams(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	key := randomKey()[:16]
+	value := []byte("0123456789")
+	require.Nil(t, storage.PutStream(ctx, store, key, bytes.NewReader(value), int64(len(value))))
+
+	read := func(rc io.ReadCloser, size int64, err error) (string, int64) {
+		require.Nil(t, err)
+		defer func() { _ = rc.Close() }()
+		b, err := ioutil.ReadAll(rc)
+		require.Nil(t, err)
+		return string(b), size
+	}
+	t.Run("whole value", func(t *testing.T) {
+		got, size := read(storage.GetStream(ctx, store, key))
+		assert.Equal(t, "0123456789", got)
+		assert.EqualValues(t, 10, size)
+		stored, err := store.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, value, stored)
+	})
+	t.Run("ranges", func(t *testing.T) {
+		for _, tc := range []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, 3, "012"},
+			{7, -1, "789"},
+			{7, 100, "789"},
+			{4, 0, ""},
+			{10, -1, ""},
+			{42, 3, ""},
+		} {
+			got, size := read(storage.GetRange(ctx, store, key, tc.offset, tc.length))
+			assert.Equal(t, tc.want, got, "offset %d length %d", tc.offset, tc.length)
+			assert.EqualValues(t, 10, size)
+		}
+	})
+	t.Run("reader at", func(t *testing.T) {
+		p := make([]byte, 4)
+		n, err := storage.NewReaderAt(ctx, store, key).ReadAt(p, 8)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, "89", string(p[:n]))
+	})
+	t.Run("unknown size", func(t *testing.T) {
+		other := randomKey()[:16]
+		require.Nil(t, storage.PutStream(ctx, store, other, strings.NewReader("abc"), -1))
+		got, size := read(storage.GetStream(ctx, store, other))
+		assert.Equal(t, "abc", got)
+		assert.EqualValues(t, 3, size)
+	})
+	t.Run("missing keys", func(t *testing.T) {
+		_, _, err := storage.GetStream(ctx, store, randomKey()[:16])
+		assert.True(t, errors.Is(err, storage.ErrNotFound), "got %v", err)
+	})
+}